@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	botNotifySignatureHeader = "X-Shiroine-Signature"
+	botNotifyTimeout         = 10 * time.Second
+)
+
+// BotNotification tells the bot a premium was activated, so it can greet the
+// beneficiary and pass on a gift message
+type BotNotification struct {
+	Event     string            `json:"event"`
+	Reference string            `json:"reference"`
+	PlanID    string            `json:"planId"`
+	JID       string            `json:"jid"`
+	LID       string            `json:"lid"`
+	IsGroup   bool              `json:"isGroup"`
+	Days      int               `json:"days"`
+	Expired   time.Time         `json:"expired"`
+	Gift      *GiftNotification `json:"gift,omitempty"`
+}
+
+// GiftNotification is the sender and message of a gifted premium
+type GiftNotification struct {
+	FromPhone string `json:"fromPhone"`
+	FromName  string `json:"fromName"`
+	Message   string `json:"message,omitempty"`
+}
+
+var botNotifyClient = &http.Client{Timeout: botNotifyTimeout}
+
+// premiumActivatedNotification describes the activation of payment's plan
+func premiumActivatedNotification(payment *PaymentRecord, planID, jid, lid string, isGroup bool, days int, expired time.Time) BotNotification {
+	n := BotNotification{
+		Event:     "premium.activated",
+		Reference: payment.Reference,
+		PlanID:    planID,
+		JID:       jid,
+		LID:       lid,
+		IsGroup:   isGroup,
+		Days:      days,
+		Expired:   expired,
+	}
+	if payment.IsGift() {
+		n.Gift = &GiftNotification{
+			FromPhone: payment.PhoneNumber,
+			FromName:  payment.CustomerName,
+			Message:   payment.GiftMessage,
+		}
+	}
+	return n
+}
+
+// notifyBot posts n to BOT_WEBHOOK_URL in the background, signed with an
+// HMAC-SHA256 of the body keyed by BOT_WEBHOOK_SECRET. Notifications are
+// best effort: the premium is already active when they are sent.
+func notifyBot(ctx context.Context, n BotNotification) {
+	url := os.Getenv("BOT_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+	secret := os.Getenv("BOT_WEBHOOK_SECRET")
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := postBotEvent(ctx, url, secret, n); err != nil {
+			slog.WarnContext(ctx, "failed to notify bot", "reference", n.Reference, "event", n.Event, "error", err)
+		}
+	}()
+}
+
+// postBotEvent posts event as JSON to url, signed with secret, and checks
+// the bot accepted it
+func postBotEvent(ctx context.Context, url, secret string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, botNotifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(botNotifySignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := botNotifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bot responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
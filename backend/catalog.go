@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Channel lists are fresh for defaultChannelCacheTTL, then served stale
+	// for up to defaultChannelCacheStale while a refresh runs
+	defaultChannelCacheTTL   = 10 * time.Minute
+	defaultChannelCacheStale = time.Hour
+)
+
+// ErrChannelUnavailable is returned for a payment method the operator has
+// disabled or whose amount limits the order is outside of
+var ErrChannelUnavailable = errors.New("payment method is not available for this order")
+
+// ChannelOverride is the operator's change to one payment channel. Zero
+// fields leave the gateway's value alone.
+type ChannelOverride struct {
+	Code          string `json:"code"`
+	Disabled      bool   `json:"disabled"`
+	Name          string `json:"name"`
+	IconURL       string `json:"icon_url"`
+	MinimumAmount int    `json:"minimum_amount"`
+	MaximumAmount int    `json:"maximum_amount"`
+}
+
+// ChannelCatalog caches the payment channels of a gateway and applies the
+// operator's overrides. Listed overrides come first, in their order; the
+// other channels follow in the gateway's order.
+type ChannelCatalog struct {
+	source    func(ctx context.Context) (interface{}, error)
+	ttl       time.Duration
+	stale     time.Duration
+	overrides []ChannelOverride
+	now       func() time.Time
+
+	mu         sync.Mutex
+	channels   []map[string]interface{} // as the gateway listed them
+	fetchedAt  time.Time
+	refreshing bool
+	fetching   *channelFetch // the fetch requests are waiting for, if any
+}
+
+// channelFetch is a fetch shared by every request that finds the cache
+// empty or expired while it runs
+type channelFetch struct {
+	done     chan struct{}
+	channels []map[string]interface{}
+	err      error
+}
+
+// channelCatalog serves /api/payment-channels
+var channelCatalog *ChannelCatalog
+
+// NewChannelCatalog creates a catalog of gateway's channels
+func NewChannelCatalog(gateway PaymentGateway, ttl, stale time.Duration, overrides []ChannelOverride) *ChannelCatalog {
+	return &ChannelCatalog{
+		source:    gateway.GetPaymentChannels,
+		ttl:       ttl,
+		stale:     stale,
+		overrides: overrides,
+		now:       time.Now,
+	}
+}
+
+// NewChannelCatalogFromEnv creates a catalog configured by CHANNEL_CACHE_TTL,
+// CHANNEL_CACHE_STALE and the overrides in the JSON file CHANNEL_OVERRIDES
+func NewChannelCatalogFromEnv(gateway PaymentGateway) (*ChannelCatalog, error) {
+	var overrides []ChannelOverride
+	if path := os.Getenv("CHANNEL_OVERRIDES"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CHANNEL_OVERRIDES: %v", err)
+		}
+		if overrides, err = parseChannelOverrides(data); err != nil {
+			return nil, fmt.Errorf("CHANNEL_OVERRIDES: %v", err)
+		}
+	}
+	return NewChannelCatalog(gateway,
+		envDuration("CHANNEL_CACHE_TTL", defaultChannelCacheTTL),
+		envDuration("CHANNEL_CACHE_STALE", defaultChannelCacheStale),
+		overrides), nil
+}
+
+// envDuration reads a positive duration such as 10m, or returns fallback
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// parseChannelOverrides parses a JSON list of overrides
+func parseChannelOverrides(data []byte) ([]ChannelOverride, error) {
+	var overrides []ChannelOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range overrides {
+		o := &overrides[i]
+		o.Code = strings.ToUpper(strings.TrimSpace(o.Code))
+		if o.Code == "" {
+			return nil, fmt.Errorf("override %d has no code", i+1)
+		}
+		if seen[o.Code] {
+			return nil, fmt.Errorf("%s is overridden twice", o.Code)
+		}
+		seen[o.Code] = true
+		if o.MinimumAmount < 0 || o.MaximumAmount < 0 || (o.MaximumAmount > 0 && o.MaximumAmount < o.MinimumAmount) {
+			return nil, fmt.Errorf("%s has invalid amount limits", o.Code)
+		}
+	}
+	return overrides, nil
+}
+
+// Channels returns the channels to offer. A list older than the TTL is
+// still served while it is refreshed in the background; one past the stale
+// window is fetched again first, and kept if the gateway cannot be reached.
+// Concurrent requests wait for the same fetch rather than each starting one.
+func (c *ChannelCatalog) Channels(ctx context.Context) ([]map[string]interface{}, error) {
+	c.mu.Lock()
+	cached, age := c.channels, c.now().Sub(c.fetchedAt)
+	if cached != nil && age < c.ttl+c.stale {
+		if age >= c.ttl && !c.refreshing {
+			c.refreshing = true
+			go c.refresh(context.WithoutCancel(ctx))
+		}
+		c.mu.Unlock()
+		return c.apply(cached), nil
+	}
+	call := c.fetching
+	if call == nil {
+		call = &channelFetch{done: make(chan struct{})}
+		c.fetching = call
+		go c.fetchShared(context.WithoutCancel(ctx), call)
+	}
+	c.mu.Unlock()
+
+	var fresh []map[string]interface{}
+	var err error
+	select {
+	case <-call.done:
+		fresh, err = call.channels, call.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		slog.WarnContext(ctx, "serving expired payment channels", "age", age, "error", err)
+		return c.apply(cached), nil
+	}
+	return c.apply(fresh), nil
+}
+
+// refresh fetches the channel list in the background
+func (c *ChannelCatalog) refresh(ctx context.Context) {
+	if _, err := c.fetch(ctx); err != nil {
+		slog.WarnContext(ctx, "failed to refresh payment channels", "error", err)
+	}
+	c.mu.Lock()
+	c.refreshing = false
+	c.mu.Unlock()
+}
+
+// fetchShared runs the fetch of call and hands its result to the requests
+// waiting for it
+func (c *ChannelCatalog) fetchShared(ctx context.Context, call *channelFetch) {
+	call.channels, call.err = c.fetch(ctx)
+	c.mu.Lock()
+	c.fetching = nil
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// fetch asks the gateway for its channels and caches them
+func (c *ChannelCatalog) fetch(ctx context.Context) ([]map[string]interface{}, error) {
+	raw, err := c.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	channels, ok := channelList(raw)
+	if !ok {
+		return nil, fmt.Errorf("unexpected payment channel list %T", raw)
+	}
+
+	c.mu.Lock()
+	c.channels, c.fetchedAt = channels, c.now()
+	c.mu.Unlock()
+	return channels, nil
+}
+
+// channelList returns a gateway's channel list as JSON objects
+func channelList(raw interface{}) ([]map[string]interface{}, bool) {
+	switch v := raw.(type) {
+	case []map[string]interface{}:
+		return v, true
+	case []interface{}:
+		list := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			ch, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			list = append(list, ch)
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// apply returns copies of channels with the overrides applied
+func (c *ChannelCatalog) apply(channels []map[string]interface{}) []map[string]interface{} {
+	byCode := make(map[string]map[string]interface{}, len(channels))
+	for _, ch := range channels {
+		code, _ := ch["code"].(string)
+		byCode[strings.ToUpper(code)] = ch
+	}
+
+	result := make([]map[string]interface{}, 0, len(channels))
+	placed := make(map[string]bool, len(c.overrides))
+	for _, o := range c.overrides {
+		placed[o.Code] = true
+		ch, ok := byCode[o.Code]
+		if !ok || o.Disabled {
+			continue
+		}
+		out := copyChannel(ch)
+		if o.Name != "" {
+			out["name"] = o.Name
+		}
+		if o.IconURL != "" {
+			out["icon_url"] = o.IconURL
+		}
+		if o.MinimumAmount > 0 {
+			out["minimum_amount"] = o.MinimumAmount
+		}
+		if o.MaximumAmount > 0 {
+			out["maximum_amount"] = o.MaximumAmount
+		}
+		result = append(result, out)
+	}
+	for _, ch := range channels {
+		code, _ := ch["code"].(string)
+		if !placed[strings.ToUpper(code)] {
+			result = append(result, copyChannel(ch))
+		}
+	}
+	return result
+}
+
+// Check rejects a method the operator disabled or whose configured limits
+// exclude amount. The gateway enforces its own limits.
+func (c *ChannelCatalog) Check(method string, amount int) error {
+	for _, o := range c.overrides {
+		if !strings.EqualFold(o.Code, method) {
+			continue
+		}
+		if o.Disabled || amount < o.MinimumAmount || (o.MaximumAmount > 0 && amount > o.MaximumAmount) {
+			return ErrChannelUnavailable
+		}
+	}
+	return nil
+}
+
+// acceptsAmount reports whether a channel's minimum_amount and
+// maximum_amount, where it has them, allow amount
+func acceptsAmount(channel map[string]interface{}, amount int) bool {
+	if minimum, ok := jsonInt(channel, "minimum_amount"); ok && minimum > 0 && amount < minimum {
+		return false
+	}
+	if maximum, ok := jsonInt(channel, "maximum_amount"); ok && maximum > 0 && amount > maximum {
+		return false
+	}
+	return true
+}
+
+func copyChannel(ch map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(ch)+4)
+	for k, v := range ch {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChannelSource lists channels like Tripay does and counts the calls
+type fakeChannelSource struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+	names []string
+}
+
+func (s *fakeChannelSource) list(ctx context.Context) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	var channels []interface{}
+	for _, code := range s.names {
+		channels = append(channels, map[string]interface{}{
+			"code": code, "name": code + " Virtual Account", "minimum_amount": 10000.0, "maximum_amount": 5000000.0,
+		})
+	}
+	return channels, nil
+}
+
+func (s *fakeChannelSource) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *fakeChannelSource) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func newTestCatalog(source *fakeChannelSource, overrides []ChannelOverride) (*ChannelCatalog, *time.Time) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	c := &ChannelCatalog{source: source.list, ttl: 10 * time.Minute, stale: time.Hour, overrides: overrides}
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func channelCodes(channels []map[string]interface{}) string {
+	var list []string
+	for _, ch := range channels {
+		list = append(list, ch["code"].(string))
+	}
+	return strings.Join(list, ",")
+}
+
+func TestChannelCatalogCaching(t *testing.T) {
+	source := &fakeChannelSource{names: []string{"BNI_VA", "BRI_VA"}}
+	c, now := newTestCatalog(source, nil)
+	ctx := context.Background()
+
+	if _, err := c.Channels(ctx); err != nil {
+		t.Fatalf("Channels failed: %v", err)
+	}
+	*now = now.Add(9 * time.Minute)
+	c.Channels(ctx)
+	if n := source.callCount(); n != 1 {
+		t.Fatalf("expected a fresh list to be cached, got %d calls", n)
+	}
+
+	// Past the TTL the cached list is served while it is refreshed
+	*now = now.Add(2 * time.Minute)
+	source.mu.Lock()
+	source.names = []string{"BNI_VA", "BRI_VA", "MANDIRI_VA"}
+	source.mu.Unlock()
+	if channels, _ := c.Channels(ctx); channelCodes(channels) != "BNI_VA,BRI_VA" {
+		t.Fatalf("expected the stale list, got %s", channelCodes(channels))
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		done := !c.refreshing && len(c.channels) == 3
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a background refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if channels, _ := c.Channels(ctx); channelCodes(channels) != "BNI_VA,BRI_VA,MANDIRI_VA" {
+		t.Fatalf("expected the refreshed list, got %s", channelCodes(channels))
+	}
+
+	// Past the stale window the gateway is asked first, and an outage falls
+	// back to the last list
+	*now = now.Add(2 * time.Hour)
+	source.fail(errors.New("tripay is down"))
+	channels, err := c.Channels(ctx)
+	if err != nil || len(channels) != 3 {
+		t.Fatalf("expected the expired list during an outage, got %d channels, %v", len(channels), err)
+	}
+	if n := source.callCount(); n != 3 {
+		t.Errorf("expected the expired list to be fetched synchronously, got %d calls", n)
+	}
+}
+
+func TestChannelCatalogColdOutage(t *testing.T) {
+	source := &fakeChannelSource{err: errors.New("tripay is down")}
+	c, _ := newTestCatalog(source, nil)
+	if _, err := c.Channels(context.Background()); err == nil {
+		t.Fatal("expected an error without any cached list")
+	}
+
+	c.source = func(ctx context.Context) (interface{}, error) {
+		return map[string]interface{}{"success": false, "message": "Invalid API key"}, nil
+	}
+	if _, err := c.Channels(context.Background()); err == nil {
+		t.Fatal("expected an error response not to be cached as a channel list")
+	}
+}
+
+func TestChannelCatalogSharesColdFetch(t *testing.T) {
+	source := &fakeChannelSource{names: []string{"BRIVA"}}
+	c, _ := newTestCatalog(source, nil)
+	release := make(chan struct{})
+	c.source = func(ctx context.Context) (interface{}, error) {
+		<-release
+		return source.list(ctx)
+	}
+
+	// Requests arriving after the fetch find the cache fresh, so exactly one
+	// call is made however the goroutines are scheduled
+	var started, done sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			channels, err := c.Channels(context.Background())
+			if err == nil && channelCodes(channels) != "BRIVA" {
+				err = errors.New("unexpected channels " + channelCodes(channels))
+			}
+			errs <- err
+		}()
+	}
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Channels failed: %v", err)
+		}
+	}
+	if n := source.callCount(); n != 1 {
+		t.Fatalf("expected one fetch for concurrent requests, got %d", n)
+	}
+}
+
+func TestChannelCatalogOverrides(t *testing.T) {
+	overrides, err := parseChannelOverrides([]byte(`[
+		{"code": "qris", "name": "QRIS (semua e-wallet)", "icon_url": "https://cdn.example/qris.png"},
+		{"code": "BRI_VA", "disabled": true},
+		{"code": "MANDIRI_VA", "minimum_amount": 20000},
+		{"code": "GONE_VA", "name": "Not offered by the gateway"}
+	]`))
+	if err != nil {
+		t.Fatalf("parseChannelOverrides failed: %v", err)
+	}
+	source := &fakeChannelSource{names: []string{"BNI_VA", "BRI_VA", "MANDIRI_VA", "QRIS"}}
+	c, _ := newTestCatalog(source, overrides)
+
+	channels, err := c.Channels(context.Background())
+	if err != nil {
+		t.Fatalf("Channels failed: %v", err)
+	}
+	if got := channelCodes(channels); got != "QRIS,MANDIRI_VA,BNI_VA" {
+		t.Fatalf("expected overridden channels first and disabled ones left out, got %s", got)
+	}
+	if channels[0]["name"] != "QRIS (semua e-wallet)" || channels[0]["icon_url"] != "https://cdn.example/qris.png" {
+		t.Errorf("expected QRIS to be renamed with its icon, got %+v", channels[0])
+	}
+	if cached, _ := c.Channels(context.Background()); cached[0]["name"] != "QRIS (semua e-wallet)" {
+		t.Errorf("expected overrides to be applied on every call")
+	}
+	c.mu.Lock()
+	if c.channels[3]["name"] != "QRIS Virtual Account" {
+		t.Errorf("expected the cached gateway list to be left alone")
+	}
+	c.mu.Unlock()
+
+	// A 15.000 plan fits every channel but Mandiri, which needs 20.000
+	if got := channelCodes(withChannelFees(channels, 15000).([]map[string]interface{})); got != "QRIS,BNI_VA" {
+		t.Errorf("expected channels that can't take the amount to be left out, got %s", got)
+	}
+	if got := channelCodes(withChannelFees(channels, 5000).([]map[string]interface{})); got != "" {
+		t.Errorf("expected no channel below the gateway minimum, got %s", got)
+	}
+
+	if err := c.Check("bri_va", 50000); !errors.Is(err, ErrChannelUnavailable) {
+		t.Errorf("expected a disabled channel to be refused, got %v", err)
+	}
+	if err := c.Check("MANDIRI_VA", 15000); !errors.Is(err, ErrChannelUnavailable) {
+		t.Errorf("expected an amount below the minimum to be refused, got %v", err)
+	}
+	if err := c.Check("BNI_VA", 15000); err != nil {
+		t.Errorf("expected a channel without overrides to be allowed, got %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"code": "QRIS"}`,
+		`[{"name": "no code"}]`,
+		`[{"code": "QRIS"}, {"code": "qris"}]`,
+		`[{"code": "QRIS", "minimum_amount": 20000, "maximum_amount": 10000}]`,
+	} {
+		if _, err := parseChannelOverrides([]byte(bad)); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestCreateTransactionRefusesDisabledChannel(t *testing.T) {
+	store = NewMemoryStore()
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-CAT-1")}
+	paymentGateway = g
+	channelCatalog = NewChannelCatalog(g, time.Minute, time.Minute, []ChannelOverride{{Code: "BRI_VA", Disabled: true}})
+	t.Cleanup(func() { channelCatalog = nil })
+
+	body := `{"method":"BRI_VA","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrChannelUnavailable.Error()) {
+		t.Fatalf("expected 400 for a disabled channel, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.creates.Load() != 0 {
+		t.Fatal("expected no upstream transaction")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Who pays for a payment channel. With merchant and customer we add nothing
+// to the price and the gateway takes its fee from us or from the customer.
+// Neither is sent to the gateway, whose create APIs take no fee bearer: they
+// only mirror the channel's setting in the gateway dashboard, so the channel
+// list shows the total the customer will pay. Fixed and percent add a
+// surcharge of our own.
+const (
+	feeModeMerchant = "merchant"
+	feeModeCustomer = "customer"
+	feeModeFixed    = "fixed"
+	feeModePercent  = "percent"
+)
+
+// surchargeItemName is the order item a channel surcharge is billed as
+const surchargeItemName = "Biaya Layanan"
+
+// ChannelFee is how the fee of one payment channel is passed on
+type ChannelFee struct {
+	Mode        string
+	Fixed       int // rupiah, for fixed
+	BasisPoints int // hundredths of a percent of the price, for percent
+}
+
+// Surcharge returns what the channel adds to a price of amount. Percentages
+// are rounded up to the next rupiah.
+func (f ChannelFee) Surcharge(amount int) int {
+	switch f.Mode {
+	case feeModeFixed:
+		return f.Fixed
+	case feeModePercent:
+		return (amount*f.BasisPoints + 9999) / 10000
+	}
+	return 0
+}
+
+// ChannelFees maps payment channel codes to their fee. Channels that are not
+// listed get the fallback; the zero value leaves every fee to the gateway's
+// customer fee setting, as before fees were configurable.
+type ChannelFees struct {
+	channels map[string]ChannelFee
+	fallback ChannelFee
+}
+
+// channelFees is the policy loaded from CHANNEL_FEES
+var channelFees ChannelFees
+
+// For returns the fee of the channel with the given code
+func (c ChannelFees) For(code string) ChannelFee {
+	if fee, ok := c.channels[strings.ToUpper(code)]; ok {
+		return fee
+	}
+	if c.fallback.Mode == "" {
+		return ChannelFee{Mode: feeModeCustomer}
+	}
+	return c.fallback
+}
+
+// loadChannelFees reads CHANNEL_FEES, a comma-separated list of
+// CODE=merchant, CODE=customer, CODE=fixed:4000 or CODE=percent:0.7 with *
+// as the code of every channel not listed
+func loadChannelFees() error {
+	fees, err := parseChannelFees(os.Getenv("CHANNEL_FEES"))
+	if err != nil {
+		return fmt.Errorf("CHANNEL_FEES: %v", err)
+	}
+	channelFees = fees
+	return nil
+}
+
+// parseChannelFees parses the CHANNEL_FEES syntax
+func parseChannelFees(raw string) (ChannelFees, error) {
+	fees := ChannelFees{channels: make(map[string]ChannelFee)}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, rule, ok := strings.Cut(field, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || code == "" {
+			return fees, fmt.Errorf("invalid entry %q, expected CODE=mode", field)
+		}
+		fee, err := parseChannelFee(strings.TrimSpace(rule))
+		if err != nil {
+			return fees, fmt.Errorf("%s: %v", code, err)
+		}
+		if code == "*" {
+			fees.fallback = fee
+		} else {
+			fees.channels[code] = fee
+		}
+	}
+	return fees, nil
+}
+
+// parseChannelFee parses one rule: merchant, customer, fixed:N or percent:P
+func parseChannelFee(rule string) (ChannelFee, error) {
+	mode, value, _ := strings.Cut(rule, ":")
+	fee := ChannelFee{Mode: strings.ToLower(mode)}
+	switch fee.Mode {
+	case feeModeMerchant, feeModeCustomer:
+		if value != "" {
+			return fee, fmt.Errorf("%s takes no value", fee.Mode)
+		}
+	case feeModeFixed:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fee, fmt.Errorf("fixed needs a rupiah amount, e.g. fixed:4000")
+		}
+		fee.Fixed = n
+	case feeModePercent:
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fee, fmt.Errorf("percent needs a percentage, e.g. percent:0.7")
+		}
+		fee.BasisPoints = int(math.Round(p * 100))
+	default:
+		return fee, fmt.Errorf("unknown mode %q, expected merchant, customer, fixed or percent", mode)
+	}
+	return fee, nil
+}
+
+// applyChannelFee adds the surcharge of req's channel to its amount, billed
+// as an order item after the plan so the plan stays the first item
+func applyChannelFee(req *CreateTransactionRequest) {
+	surcharge := channelFees.For(paymentMethodOf(*req)).Surcharge(req.Amount)
+	if surcharge == 0 {
+		return
+	}
+
+	raw, _ := json.Marshal(req.OrderItems)
+	var items []map[string]interface{}
+	json.Unmarshal(raw, &items)
+	req.OrderItems = append(items, map[string]interface{}{
+		"name": surchargeItemName, "price": surcharge, "quantity": 1,
+	})
+	req.Amount += surcharge
+}
+
+// withChannelFees returns the channels of a gateway with the fee mode of
+// each and, given the price, its surcharge and the total the customer pays.
+// In customer mode the total includes the customer fee the gateway
+// publishes for the channel, if any. Given the price, channels whose amount
+// limits exclude what they would charge are left out. Lists of another
+// shape are returned as they are.
+func withChannelFees(channels interface{}, amount int) interface{} {
+	list, ok := channelList(channels)
+	if !ok {
+		return channels
+	}
+
+	result := make([]map[string]interface{}, 0, len(list))
+	for _, ch := range list {
+		out := copyChannel(ch)
+		code, _ := ch["code"].(string)
+		fee := channelFees.For(code)
+		out["fee_mode"] = fee.Mode
+		if amount > 0 {
+			surcharge := fee.Surcharge(amount)
+			if !acceptsAmount(ch, amount+surcharge) {
+				continue
+			}
+			total := amount + surcharge
+			if fee.Mode == feeModeCustomer {
+				total += publishedCustomerFee(ch, amount)
+			}
+			out["surcharge"] = surcharge
+			out["total_amount"] = total
+		}
+		result = append(result, out)
+	}
+	return result
+}
+
+// publishedCustomerFee estimates the customer fee a gateway lists for a
+// channel, as Tripay does with fee_customer {flat, percent}, or 0
+func publishedCustomerFee(channel map[string]interface{}, amount int) int {
+	fee, ok := channel["fee_customer"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	flat, _ := jsonInt(fee, "flat")
+	var percent float64
+	switch v := fee["percent"].(type) {
+	case float64:
+		percent = v
+	case string:
+		percent, _ = strconv.ParseFloat(v, 64)
+	}
+	return flat + ChannelFee{Mode: feeModePercent, BasisPoints: int(math.Round(percent * 100))}.Surcharge(amount)
+}
+
+// channelAmount reads the optional ?amount= of the channel list
+func channelAmount(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("amount")
+	if raw == "" {
+		return 0, nil
+	}
+	amount, err := strconv.Atoi(raw)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("amount must be a whole number of rupiah")
+	}
+	return amount, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setChannelFees installs the CHANNEL_FEES policy raw for the rest of a test
+func setChannelFees(t *testing.T, raw string) {
+	t.Helper()
+	fees, err := parseChannelFees(raw)
+	if err != nil {
+		t.Fatalf("parseChannelFees(%q) failed: %v", raw, err)
+	}
+	previous := channelFees
+	channelFees = fees
+	t.Cleanup(func() { channelFees = previous })
+}
+
+func TestParseChannelFees(t *testing.T) {
+	fees, err := parseChannelFees("QRIS=percent:0.7, bni_va=fixed:4000,PAYPAL=customer,*=merchant")
+	if err != nil {
+		t.Fatalf("parseChannelFees failed: %v", err)
+	}
+	for code, want := range map[string]ChannelFee{
+		"QRIS":    {Mode: feeModePercent, BasisPoints: 70},
+		"BNI_VA":  {Mode: feeModeFixed, Fixed: 4000},
+		"paypal":  {Mode: feeModeCustomer},
+		"BRI_VA":  {Mode: feeModeMerchant},
+		"UNKNOWN": {Mode: feeModeMerchant},
+	} {
+		if got := fees.For(code); got != want {
+			t.Errorf("For(%q) = %+v, want %+v", code, got, want)
+		}
+	}
+
+	if got := (ChannelFees{}).For("QRIS"); got.Mode != feeModeCustomer {
+		t.Errorf("expected the gateway to decide without CHANNEL_FEES, got %+v", got)
+	}
+
+	for _, bad := range []string{"QRIS", "QRIS=free", "QRIS=fixed", "QRIS=fixed:-1", "QRIS=percent:abc", "QRIS=percent:101", "QRIS=merchant:5", "=merchant"} {
+		if _, err := parseChannelFees(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestChannelFeeSurcharge(t *testing.T) {
+	for _, tc := range []struct {
+		fee    ChannelFee
+		amount int
+		want   int
+	}{
+		{ChannelFee{Mode: feeModeMerchant}, 16000, 0},
+		{ChannelFee{Mode: feeModeCustomer}, 16000, 0},
+		{ChannelFee{Mode: feeModeFixed, Fixed: 4000}, 16000, 4000},
+		{ChannelFee{Mode: feeModePercent, BasisPoints: 70}, 16000, 112},
+		{ChannelFee{Mode: feeModePercent, BasisPoints: 70}, 15000, 105},
+		{ChannelFee{Mode: feeModePercent, BasisPoints: 70}, 7001, 50}, // 49.007 rounds up
+	} {
+		if got := tc.fee.Surcharge(tc.amount); got != tc.want {
+			t.Errorf("%+v.Surcharge(%d) = %d, want %d", tc.fee, tc.amount, got, tc.want)
+		}
+	}
+}
+
+func TestWithChannelFees(t *testing.T) {
+	setChannelFees(t, "QRIS=percent:0.7,BNI_VA=fixed:4000,*=customer")
+
+	// Tripay lists channels as decoded JSON with its own customer fee
+	tripay := []interface{}{
+		map[string]interface{}{"code": "QRIS", "name": "QRIS"},
+		map[string]interface{}{"code": "BNI_VA", "name": "BNI Virtual Account"},
+		map[string]interface{}{"code": "BRI_VA", "fee_customer": map[string]interface{}{"flat": 4250.0, "percent": "0.00"}},
+		map[string]interface{}{"code": "OVO", "fee_customer": map[string]interface{}{"flat": 0.0, "percent": 3.0}},
+	}
+	channels := withChannelFees(tripay, 16000).([]map[string]interface{})
+	for i, want := range []struct {
+		mode         string
+		surcharge    int
+		totalAmount  int
+		keepsOldName bool
+	}{
+		{feeModePercent, 112, 16112, true},
+		{feeModeFixed, 4000, 20000, true},
+		{feeModeCustomer, 0, 20250, false},
+		{feeModeCustomer, 0, 16480, false},
+	} {
+		ch := channels[i]
+		if ch["fee_mode"] != want.mode || ch["surcharge"] != want.surcharge || ch["total_amount"] != want.totalAmount {
+			t.Errorf("channel %v: got mode %v, surcharge %v, total %v", ch["code"], ch["fee_mode"], ch["surcharge"], ch["total_amount"])
+		}
+		if want.keepsOldName && ch["name"] == nil {
+			t.Errorf("channel %v lost its fields", ch["code"])
+		}
+	}
+	if _, changed := tripay[0].(map[string]interface{})["fee_mode"]; changed {
+		t.Errorf("expected the gateway's list to be left alone")
+	}
+
+	// Without a price only the mode is known
+	pakasir, _ := (&PakasirGateway{}).GetPaymentChannels(context.Background())
+	for _, ch := range withChannelFees(pakasir, 0).([]map[string]interface{}) {
+		if _, ok := ch["total_amount"]; ok || ch["fee_mode"] == nil {
+			t.Fatalf("unexpected channel without a price %+v", ch)
+		}
+	}
+
+	if got := withChannelFees(map[string]interface{}{"success": false}, 16000); got.(map[string]interface{})["success"] != false {
+		t.Errorf("expected an unknown shape to pass through, got %+v", got)
+	}
+}
+
+func TestCreateTransactionAddsSurcharge(t *testing.T) {
+	setChannelFees(t, "QRIS=percent:0.7,BNI_VA=merchant")
+	store = NewMemoryStore()
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-FEE-1")}
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":16000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":16000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.last.Amount != 16112 {
+		t.Errorf("expected the surcharge to be added, got %d", g.last.Amount)
+	}
+	items, _ := json.Marshal(g.last.OrderItems)
+	if want := `[{"name":"User Premium 30 Days","price":16000,"quantity":1},{"name":"Biaya Layanan","price":112,"quantity":1}]`; string(items) != want {
+		t.Errorf("expected the surcharge as a second order item, got %s", items)
+	}
+
+	// The record carries the surcharge, so a repeated order still matches it
+	if payment, _ := store.GetPayment(context.Background(), "T-FEE-1"); payment.Amount != 16112 || planIDFromOrderItems(payment.OrderItems) != "user-1m" {
+		t.Errorf("unexpected stored payment %+v", payment)
+	}
+
+	merchant := `{"method":"BNI_VA","amount":16000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":16000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", merchant); rec.Code != http.StatusOK || g.last.Amount != 16000 {
+		t.Errorf("expected no surcharge when the merchant pays, got %d", g.last.Amount)
+	}
+}
+
+func TestPaymentChannelsHandlerAmount(t *testing.T) {
+	setChannelFees(t, "*=fixed:1000")
+	paymentGateway = &IskapayGateway{}
+
+	rec := httptest.NewRecorder()
+	getPaymentChannelsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/payment-channels?amount=16000", nil))
+	var resp struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Data) != 1 || resp.Data[0]["total_amount"] != 17000.0 {
+		t.Fatalf("expected the total including the surcharge, got %+v", resp.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	getPaymentChannelsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/payment-channels?amount=abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad amount, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// defaultTrustedProxies is used when TRUSTED_PROXIES is unset: loopback
+// only, for a reverse proxy on the same host. Private networks are not
+// trusted by default, since any host on them could forge client addresses;
+// a proxy elsewhere must be listed in TRUSTED_PROXIES.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedProxies are the peers whose forwarding headers are believed
+var trustedProxies = mustParsePrefixes(defaultTrustedProxies)
+
+// callbackAllowedIPs restricts who may deliver webhooks. Empty allows anyone,
+// which leaves Pakasir and Iskapay callbacks unauthenticated: only Tripay
+// signs its callbacks.
+var callbackAllowedIPs []netip.Prefix
+
+// parsePrefixes parses a list of CIDRs or bare IP addresses
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", value, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func mustParsePrefixes(values []string) []netip.Prefix {
+	prefixes, err := parsePrefixes(values)
+	if err != nil {
+		panic(err)
+	}
+	return prefixes
+}
+
+// loadClientIPConfig reads TRUSTED_PROXIES and CALLBACK_ALLOWED_IPS, both
+// comma-separated lists of CIDRs or addresses. TRUSTED_PROXIES=none trusts
+// no proxy, so the TCP peer is always the client.
+func loadClientIPConfig() error {
+	if value, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		if strings.EqualFold(strings.TrimSpace(value), "none") {
+			value = ""
+		}
+		prefixes, err := parsePrefixes(strings.Split(value, ","))
+		if err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %v", err)
+		}
+		trustedProxies = prefixes
+	}
+
+	prefixes, err := parsePrefixes(strings.Split(os.Getenv("CALLBACK_ALLOWED_IPS"), ","))
+	if err != nil {
+		return fmt.Errorf("CALLBACK_ALLOWED_IPS: %v", err)
+	}
+	callbackAllowedIPs = prefixes
+	return nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostAddr parses an address with or without a port, including
+// bracketed IPv6 such as "[2001:db8::1]:443"
+func parseHostAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// forwardedFor returns the for= addresses of an RFC 7239 Forwarded header,
+// nearest client first. Obfuscated and "unknown" nodes come back as they are
+// and fail to parse later.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// splitHeaderList joins repeated header lines and splits them on commas
+func splitHeaderList(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return hops
+}
+
+// resolveChain walks a proxy chain from the nearest hop outwards and returns
+// the first address that is not a trusted proxy. Everything left of that
+// address was written by the client and cannot be believed.
+func resolveChain(hops []string, peer netip.Addr) netip.Addr {
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(hops[i])
+		if !ok {
+			// A garbled hop was not written by a proxy we trust
+			return client
+		}
+		client = addr
+		if !containsAddr(trustedProxies, addr) {
+			return client
+		}
+	}
+	return client
+}
+
+// resolveClientIP returns the address of the client behind r. Forwarding
+// headers are only honoured when the TCP peer is a trusted proxy, so clients
+// connecting directly cannot pick their own address.
+func resolveClientIP(r *http.Request) netip.Addr {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !containsAddr(trustedProxies, peer) {
+		return peer
+	}
+
+	if hops := forwardedFor(r.Header.Values("Forwarded")); len(hops) > 0 {
+		return resolveChain(hops, peer)
+	}
+	if hops := splitHeaderList(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return resolveChain(hops, peer)
+	}
+	for _, header := range []string{"X-Real-IP", "CF-Connecting-IP"} {
+		if addr, ok := parseHostAddr(r.Header.Get(header)); ok {
+			return addr
+		}
+	}
+	return peer
+}
+
+type clientIPKey struct{}
+
+// clientIPMiddleware resolves the client address once per request so rate
+// limiting, logs and allowlists all see the same value
+func clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, resolveClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientAddr returns the resolved client address of r
+func clientAddr(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return resolveClientIP(r)
+}
+
+// getIP returns the client IP address of r as a string
+func getIP(r *http.Request) string {
+	addr := clientAddr(r)
+	if !addr.IsValid() {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
+
+// callbackAllowlistMiddleware rejects webhooks from addresses outside
+// CALLBACK_ALLOWED_IPS, when it is configured
+func callbackAllowlistMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(callbackAllowedIPs) > 0 && !containsAddr(callbackAllowedIPs, clientAddr(r)) {
+			slog.WarnContext(r.Context(), "callback rejected from address outside allowlist", "client_ip", getIP(r))
+			respondJSON(w, http.StatusForbidden, APIResponse{
+				Success: false,
+				Message: "Forbidden",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
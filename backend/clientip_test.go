@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func withTrustedProxies(t *testing.T, cidrs ...string) {
+	t.Helper()
+	previous := trustedProxies
+	trustedProxies = mustParsePrefixes(cidrs)
+	t.Cleanup(func() { trustedProxies = previous })
+}
+
+func TestResolveClientIP(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8", "::1/128")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5555", nil, "203.0.113.7"},
+		{"direct client cannot spoof", "203.0.113.7:5555", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"direct IPv6 client", "[2001:db8::1]:443", nil, "2001:db8::1"},
+		{"IPv4-mapped IPv6 peer", "[::ffff:203.0.113.7]:80", nil, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:80", map[string]string{"X-Forwarded-For": "198.51.100.4"}, "198.51.100.4"},
+		{"spoofed leftmost entry", "10.0.0.2:80", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.4"}, "198.51.100.4"},
+		{"chain of trusted proxies", "10.0.0.2:80", map[string]string{"X-Forwarded-For": "198.51.100.4, 10.0.0.9"}, "198.51.100.4"},
+		{"garbage hop", "10.0.0.2:80", map[string]string{"X-Forwarded-For": "198.51.100.4, nonsense"}, "10.0.0.2"},
+		{"forwarded header", "[::1]:80", map[string]string{"Forwarded": `for=192.0.2.60;proto=https, for="[2001:db8::17]:4711"`}, "2001:db8::17"},
+		{"forwarded wins over x-forwarded-for", "10.0.0.2:80", map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "198.51.100.4"}, "192.0.2.60"},
+		{"x-real-ip", "10.0.0.2:80", map[string]string{"X-Real-IP": "198.51.100.5"}, "198.51.100.5"},
+		{"cloudflare", "10.0.0.2:80", map[string]string{"CF-Connecting-IP": "2001:db8::2"}, "2001:db8::2"},
+		{"trusted proxy without headers", "10.0.0.2:80", nil, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := resolveClientIP(req).String(); got != tt.want {
+				t.Fatalf("resolveClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	withTrustedProxies(t)
+	limiters = newLimiterStore(maxRateLimitEntries)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/verify-user", func(w http.ResponseWriter, r *http.Request) {})
+	handler := clientIPMiddleware(routeMiddleware(mux, rateLimitMiddleware(mux)))
+
+	limit := rateLimitPolicies["/api/verify-user"].Limit
+	var last int
+	for i := 0; i <= limit; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/verify-user", nil)
+		req.RemoteAddr = "203.0.113.7:5555"
+		req.Header.Set("X-Forwarded-For", netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}).String())
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		last = rec.Code
+	}
+	if last != http.StatusTooManyRequests {
+		t.Fatalf("expected rotating X-Forwarded-For to still be limited, got %d", last)
+	}
+}
+
+func TestCallbackAllowlist(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	callbackAllowedIPs = mustParsePrefixes([]string{"198.51.100.0/24", "2001:db8::1"})
+	t.Cleanup(func() { callbackAllowedIPs = nil })
+
+	handler := clientIPMiddleware(callbackAllowlistMiddleware(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for remoteAddr, want := range map[string]int{
+		"198.51.100.20:443": http.StatusOK,
+		"[2001:db8::1]:443": http.StatusOK,
+		"203.0.113.7:443":   http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/callback", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("callback from %s: expected %d, got %d", remoteAddr, want, rec.Code)
+		}
+	}
+
+	// A gateway behind a trusted proxy is judged by its forwarded address
+	req := httptest.NewRequest(http.MethodPost, "/callback", nil)
+	req.RemoteAddr = "10.0.0.2:80"
+	req.Header.Set("X-Forwarded-For", "198.51.100.20")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected forwarded gateway address to be allowed, got %d", rec.Code)
+	}
+}
+
+func TestDefaultTrustedProxiesAreLoopbackOnly(t *testing.T) {
+	withTrustedProxies(t, defaultTrustedProxies...)
+
+	for remoteAddr, want := range map[string]string{
+		"127.0.0.1:80":  "198.51.100.4",
+		"[::1]:80":      "198.51.100.4",
+		"10.0.0.2:80":   "10.0.0.2",
+		"172.17.0.5:80": "172.17.0.5",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.4")
+		if got := resolveClientIP(req).String(); got != want {
+			t.Errorf("peer %s: resolveClientIP() = %s, want %s", remoteAddr, got, want)
+		}
+	}
+}
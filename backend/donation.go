@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Products a transaction can pay for
+const (
+	productPremium  = "premium"
+	productDonation = "donation"
+)
+
+const (
+	// Donation bounds unless DONATION_MIN_AMOUNT and DONATION_MAX_AMOUNT say otherwise
+	defaultDonationMinAmount = 1000
+	defaultDonationMaxAmount = 10000000
+	maxDonorNameLength       = 50
+	maxDonationMessageLength = 280
+	// donationItemName is the single order item of every donation
+	donationItemName = "Donasi Shiroine"
+	// anonymousDonor stands in for donors who leave no name
+	anonymousDonor      = "Anonim"
+	defaultRecentDonors = 10
+	maxRecentDonors     = 50
+)
+
+// Reasons a donation cannot be made. The messages are shown to customers.
+var (
+	ErrDonationAmount          = errors.New("donation amount is out of range")
+	ErrDonorNameTooLong        = fmt.Errorf("donor name is longer than %d characters", maxDonorNameLength)
+	ErrDonationMessageTooLong  = fmt.Errorf("donation message is longer than %d characters", maxDonationMessageLength)
+	ErrDonationNotCombinable   = errors.New("donations cannot use promo codes, referral codes or gifts")
+	ErrDonationFieldsOnPremium = errors.New("a donor name or message is only valid on a donation")
+	ErrUnknownProduct          = errors.New("unknown product")
+)
+
+// donationBounds returns the smallest and largest donation accepted
+func donationBounds() (minAmount, maxAmount int) {
+	minAmount, maxAmount = defaultDonationMinAmount, defaultDonationMaxAmount
+	if n, err := strconv.Atoi(os.Getenv("DONATION_MIN_AMOUNT")); err == nil && n > 0 {
+		minAmount = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("DONATION_MAX_AMOUNT")); err == nil && n >= minAmount {
+		maxAmount = n
+	}
+	return minAmount, maxAmount
+}
+
+// applyProduct checks req against its product. A donation gets its order
+// item from the amount the donor chose; premium plans are left as they are.
+func applyProduct(req *CreateTransactionRequest) error {
+	req.DonorName = strings.TrimSpace(req.DonorName)
+	req.DonorMessage = strings.TrimSpace(req.DonorMessage)
+
+	switch req.Product {
+	case "", productPremium:
+		if req.DonorName != "" || req.DonorMessage != "" {
+			return ErrDonationFieldsOnPremium
+		}
+		req.Product = productPremium
+		return nil
+	case productDonation:
+	default:
+		return ErrUnknownProduct
+	}
+
+	if req.PromoCode != "" || req.ReferralCode != "" || isGiftRequest(*req) {
+		return ErrDonationNotCombinable
+	}
+	minAmount, maxAmount := donationBounds()
+	if req.Amount < minAmount || req.Amount > maxAmount {
+		return fmt.Errorf("%w: donations are between %s and %s", ErrDonationAmount, formatRupiah(minAmount), formatRupiah(maxAmount))
+	}
+	if utf8.RuneCountInString(req.DonorName) > maxDonorNameLength {
+		return ErrDonorNameTooLong
+	}
+	if utf8.RuneCountInString(req.DonorMessage) > maxDonationMessageLength {
+		return ErrDonationMessageTooLong
+	}
+
+	req.PlanID = ""
+	req.OrderItems = []interface{}{
+		map[string]interface{}{"name": donationItemName, "price": req.Amount, "quantity": 1},
+	}
+	if req.CustomerName == "" {
+		req.CustomerName = req.DonorName
+		if req.CustomerName == "" {
+			req.CustomerName = anonymousDonor
+		}
+	}
+	return nil
+}
+
+// donorName is how a donation is credited in public
+func donorName(p *PaymentRecord) string {
+	if p.DonorName == "" {
+		return anonymousDonor
+	}
+	return p.DonorName
+}
+
+// donationHistoryHandler returns a phone number's donations, newest first:
+// POST /api/donation-history {"identifier": "628...", "page": 1}
+func donationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Identifier string `json:"identifier"` // phone number
+		Page       int    `json:"page"`       // page number (default 1)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+	if req.Identifier == "" {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Missing identifier",
+		})
+		return
+	}
+	if req.Page < 1 {
+		req.Page = 1
+	}
+
+	perPage := 10
+	filter := PaymentFilter{PhoneNumber: req.Identifier, Product: productDonation}
+	donations, totalCount, err := store.ListPayments(r.Context(), filter, perPage, (req.Page-1)*perPage)
+	if errors.Is(err, ErrStorageUnavailable) {
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list donations", "error", err)
+		respondJSON(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	history := []map[string]interface{}{}
+	for _, donation := range donations {
+		record := map[string]interface{}{
+			"reference":    donation.Reference,
+			"method":       donation.Method,
+			"amount":       donation.Amount,
+			"status":       donation.Status,
+			"donorName":    donation.DonorName,
+			"donorMessage": donation.DonorMessage,
+			"createdAt":    donation.CreatedAt.Format(time.RFC3339),
+		}
+		if donation.PaidAt != nil {
+			record["paidAt"] = donation.PaidAt.Format(time.RFC3339)
+		}
+		if donation.InvoiceNumber != "" {
+			record["invoiceNumber"] = donation.InvoiceNumber
+		}
+		if donation.Status == "PAID" {
+			record["receiptUrl"] = receiptPath(donation.Reference)
+		}
+		history = append(history, record)
+	}
+
+	totalPages := (totalCount + perPage - 1) / perPage
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"history":     history,
+			"page":        req.Page,
+			"perPage":     perPage,
+			"totalCount":  totalCount,
+			"totalPages":  totalPages,
+			"hasNext":     req.Page < totalPages,
+			"hasPrevious": req.Page > 1,
+		},
+	})
+}
+
+// recentDonorsHandler lists the latest PAID donations for the public
+// supporters wall: GET /api/donations/recent?limit=10. Only the name the
+// donor chose to show, the amount, the message and the time are public.
+func recentDonorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultRecentDonors
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			respondJSON(w, http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "limit must be a positive number",
+			})
+			return
+		}
+		limit = min(n, maxRecentDonors)
+	}
+
+	donations, err := store.RecentDonations(r.Context(), limit)
+	if errors.Is(err, ErrStorageUnavailable) {
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list recent donations", "error", err)
+		respondJSON(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	supporters := []map[string]interface{}{}
+	for i := range donations {
+		supporters = append(supporters, map[string]interface{}{
+			"name":    donorName(&donations[i]),
+			"amount":  donations[i].Amount,
+			"message": donations[i].DonorMessage,
+			"paidAt":  paidTime(&donations[i]).Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    supporters,
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyProduct(t *testing.T) {
+	t.Setenv("DONATION_MIN_AMOUNT", "")
+	t.Setenv("DONATION_MAX_AMOUNT", "")
+
+	req := CreateTransactionRequest{Amount: 25000, Product: productDonation, DonorName: "  Budi ", DonorMessage: "Semangat!"}
+	if err := applyProduct(&req); err != nil {
+		t.Fatalf("applyProduct failed: %v", err)
+	}
+	if req.DonorName != "Budi" || req.CustomerName != "Budi" || req.PlanID != "" {
+		t.Errorf("unexpected donation request %+v", req)
+	}
+	items, _ := json.Marshal(req.OrderItems)
+	if want := `[{"name":"Donasi Shiroine","price":25000,"quantity":1}]`; string(items) != want {
+		t.Errorf("expected the donation as the only order item, got %s", items)
+	}
+
+	anonymous := CreateTransactionRequest{Amount: 1000, Product: productDonation}
+	if err := applyProduct(&anonymous); err != nil || anonymous.CustomerName != anonymousDonor {
+		t.Errorf("expected an anonymous donation, got %+v, %v", anonymous, err)
+	}
+
+	premium := CreateTransactionRequest{Amount: 16000}
+	if err := applyProduct(&premium); err != nil || premium.Product != productPremium {
+		t.Errorf("expected premium by default, got %q, %v", premium.Product, err)
+	}
+
+	for name, tc := range map[string]struct {
+		req  CreateTransactionRequest
+		want error
+	}{
+		"too small":        {CreateTransactionRequest{Amount: 999, Product: productDonation}, ErrDonationAmount},
+		"too large":        {CreateTransactionRequest{Amount: 10000001, Product: productDonation}, ErrDonationAmount},
+		"long name":        {CreateTransactionRequest{Amount: 5000, Product: productDonation, DonorName: strings.Repeat("é", 51)}, ErrDonorNameTooLong},
+		"long message":     {CreateTransactionRequest{Amount: 5000, Product: productDonation, DonorMessage: strings.Repeat("a", 281)}, ErrDonationMessageTooLong},
+		"promo code":       {CreateTransactionRequest{Amount: 5000, Product: productDonation, PromoCode: "HEMAT"}, ErrDonationNotCombinable},
+		"gift":             {CreateTransactionRequest{Amount: 5000, Product: productDonation, RecipientPhone: "6282222222222"}, ErrDonationNotCombinable},
+		"donor on premium": {CreateTransactionRequest{Amount: 16000, DonorName: "Budi"}, ErrDonationFieldsOnPremium},
+		"unknown product":  {CreateTransactionRequest{Amount: 5000, Product: "sticker"}, ErrUnknownProduct},
+	} {
+		if err := applyProduct(&tc.req); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+
+	t.Setenv("DONATION_MIN_AMOUNT", "5000")
+	if err := applyProduct(&CreateTransactionRequest{Amount: 1000, Product: productDonation}); !errors.Is(err, ErrDonationAmount) {
+		t.Errorf("expected DONATION_MIN_AMOUNT to raise the minimum, got %v", err)
+	}
+}
+
+func TestDonationDoesNotActivatePremium(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Tester")
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-DON-1")}
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":25000,"product":"donation","donorName":"Budi","donorMessage":"Semangat!","customerPhone":"6281234567890"}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.last.Product != productDonation || g.last.CustomerName != "Budi" {
+		t.Errorf("unexpected upstream request %+v", g.last)
+	}
+
+	// Donations are never handed out again like pending premium transactions
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK || g.creates.Load() != 2 {
+		t.Fatalf("expected a second donation upstream, got %d and %d creates", rec.Code, g.creates.Load())
+	}
+
+	if err := tripayCallback(t, g.TripayGateway, "T-DON-1", "PAID", 25000); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+	payment, _ := memory.GetPayment(context.Background(), "T-DON-1")
+	if payment.Status != "PAID" || !payment.IsDonation() || payment.DonorMessage != "Semangat!" {
+		t.Fatalf("unexpected donation %+v", payment)
+	}
+	if _, err := memory.GetPremium(context.Background(), "6281234567890", "lid-123"); !errors.Is(err, ErrPremiumNotFound) {
+		t.Fatalf("expected a donation not to activate premium, got %v", err)
+	}
+}
+
+func TestAnonymousDonationWithoutPhone(t *testing.T) {
+	store = NewMemoryStore()
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-DON-2")}
+	paymentGateway = g
+
+	rec := postCreateTransaction(t, "", `{"method":"QRIS","amount":5000,"product":"donation"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected an anonymous donation to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.last.CustomerName != anonymousDonor {
+		t.Errorf("expected the donor to be anonymous, got %q", g.last.CustomerName)
+	}
+
+	rec = postCreateTransaction(t, "", `{"method":"QRIS","amount":500,"product":"donation"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Rp 1.000") {
+		t.Fatalf("expected 400 naming the bounds, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDonationHandlers(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	ctx := context.Background()
+	items, _ := json.Marshal(orderItems(donationItemName, 10000))
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "PREM-1", MerchantRef: "PREM-1", PhoneNumber: "6281234567890", Method: "QRIS", Amount: 16000, Status: "UNPAID"})
+	memory.CreatePayment(ctx, &PaymentRecord{
+		Reference: "DON-1", MerchantRef: "DON-1", PhoneNumber: "6281234567890", Method: "QRIS", Amount: 10000,
+		Status: "UNPAID", OrderItems: items, Product: productDonation, DonorName: "Budi", DonorMessage: "Semangat!",
+	})
+	memory.CreatePayment(ctx, &PaymentRecord{
+		Reference: "DON-2", MerchantRef: "DON-2", Method: "QRIS", Amount: 5000, Status: "UNPAID", OrderItems: items, Product: productDonation,
+	})
+	memory.MarkPaymentPaid(ctx, "DON-1", time.Now().Add(-time.Hour))
+	memory.MarkPaymentPaid(ctx, "DON-2", time.Now())
+
+	rec := httptest.NewRecorder()
+	donationHistoryHandler(rec, httptest.NewRequest(http.MethodPost, "/api/donation-history", strings.NewReader(`{"identifier":"6281234567890"}`)))
+	var history struct {
+		Data struct {
+			History    []map[string]interface{} `json:"history"`
+			TotalCount int                      `json:"totalCount"`
+		} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&history)
+	if history.Data.TotalCount != 1 || history.Data.History[0]["reference"] != "DON-1" || history.Data.History[0]["donorMessage"] != "Semangat!" {
+		t.Fatalf("expected only the donation in the donation history, got %+v", history.Data)
+	}
+	if _, ok := history.Data.History[0]["receiptUrl"]; !ok {
+		t.Errorf("expected a receipt for a PAID donation")
+	}
+
+	rec = httptest.NewRecorder()
+	recentDonorsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/donations/recent?limit=5", nil))
+	var recent struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&recent)
+	if len(recent.Data) != 2 || recent.Data[0]["name"] != anonymousDonor || recent.Data[1]["name"] != "Budi" {
+		t.Fatalf("expected the latest donation first with anonymous donors credited as %s, got %+v", anonymousDonor, recent.Data)
+	}
+	if _, leaked := recent.Data[1]["reference"]; leaked {
+		t.Errorf("expected the public list to leave out references")
+	}
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Errorf("expected the public list to be cacheable")
+	}
+
+	rec = httptest.NewRecorder()
+	recentDonorsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/donations/recent?limit=abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad limit, got %d", rec.Code)
+	}
+}
+
+// flakyReadStore fails the first failures reads of a payment
+type flakyReadStore struct {
+	*MemoryStore
+	failures int
+}
+
+func (s *flakyReadStore) GetPayment(ctx context.Context, reference string) (*PaymentRecord, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("driver: bad connection")
+	}
+	return s.MemoryStore.GetPayment(ctx, reference)
+}
+
+func TestPaidDonationLookupFailureActivatesNothing(t *testing.T) {
+	delay := paidLookupDelay
+	paidLookupDelay = time.Millisecond
+	t.Cleanup(func() { paidLookupDelay = delay })
+	ctx := context.Background()
+
+	for name, failures := range map[string]int{"retried": 1, "unreadable": paidLookupAttempts} {
+		memory := NewMemoryStore()
+		memory.SetUser("6281234567890", "lid-123", "Tester")
+		memory.CreatePayment(ctx, &PaymentRecord{
+			Reference: "T-DON-READ", MerchantRef: "T-DON-READ", PhoneNumber: "6281234567890",
+			Method: "QRIS", Amount: 25000, Status: "UNPAID", Product: productDonation,
+		})
+
+		before := testutil.ToFloat64(premiumActivationFailures)
+		if err := completePayment(ctx, &flakyReadStore{MemoryStore: memory, failures: failures}, "T-DON-READ", time.Now()); err != nil {
+			t.Fatalf("%s: completePayment failed: %v", name, err)
+		}
+		if got := testutil.ToFloat64(premiumActivationFailures) - before; got != 0 {
+			t.Errorf("%s: expected no premium activation failure, got %v", name, got)
+		}
+		if _, err := memory.GetPremium(ctx, "6281234567890", "lid-123"); !errors.Is(err, ErrPremiumNotFound) {
+			t.Errorf("%s: expected no premium for a donation, got %v", name, err)
+		}
+	}
+}
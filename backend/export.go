@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const exportDateLayout = "2006-01-02"
+
+// Export formats
+const (
+	exportCSV  = "csv"
+	exportXLSX = "xlsx"
+)
+
+// exportColumns are the columns of an accounting export, one row per payment
+var exportColumns = []string{
+	"Invoice Number", "Reference", "Gateway", "Method", "Plan", "Status",
+	"Created At", "Paid At", "Gross Amount", "Total Paid", "Gateway Fee", "Net Amount",
+}
+
+// exportRow is one payment as it appears in an export. Times are in WIB.
+type exportRow struct {
+	InvoiceNumber string
+	Reference     string
+	Gateway       string
+	Method        string
+	Plan          string
+	Status        string
+	CreatedAt     time.Time
+	PaidAt        *time.Time
+	Gross         int
+	TotalPaid     *int // nil while the gateway has not reported its fees
+	Fee           *int
+	Net           *int
+}
+
+// newExportRow describes p for an export
+func newExportRow(p *PaymentRecord) exportRow {
+	var items []map[string]interface{}
+	json.Unmarshal(p.OrderItems, &items)
+
+	row := exportRow{
+		InvoiceNumber: p.InvoiceNumber,
+		Reference:     p.Reference,
+		Gateway:       p.Gateway,
+		Method:        p.Method,
+		Plan:          planNameFromOrderItems(items),
+		Status:        p.Status,
+		CreatedAt:     p.CreatedAt.In(wib),
+		Gross:         p.Amount,
+	}
+	if p.PaidAt != nil {
+		paidAt := p.PaidAt.In(wib)
+		row.PaidAt = &paidAt
+	}
+	if p.Fees != nil {
+		fee := p.Fees.Total()
+		row.TotalPaid, row.Fee, row.Net = &p.Fees.TotalPaid, &fee, &p.Fees.NetAmount
+	}
+	return row
+}
+
+// parseExportRange parses an inclusive range of dates (YYYY-MM-DD, WIB)
+// into the half-open interval of times it covers
+func parseExportRange(fromRaw, toRaw string) (from, to time.Time, err error) {
+	from, err = time.ParseInLocation(exportDateLayout, fromRaw, wib)
+	if err != nil {
+		return from, to, fmt.Errorf("from must be a date like 2026-10-01")
+	}
+	to, err = time.ParseInLocation(exportDateLayout, toRaw, wib)
+	if err != nil {
+		return from, to, fmt.Errorf("to must be a date like 2026-10-31")
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to must not be before from")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// exportPayments streams the payments dated in [from, to) to w as CSV or
+// XLSX and returns how many were written
+func exportPayments(ctx context.Context, store Store, w io.Writer, format string, from, to time.Time, status string) (int, error) {
+	count := 0
+	switch format {
+	case exportCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		err := store.EachPayment(ctx, from, to, status, func(p *PaymentRecord) error {
+			count++
+			return cw.Write(newExportRow(p).csvRecord())
+		})
+		cw.Flush()
+		if err != nil {
+			return count, err
+		}
+		return count, cw.Error()
+
+	case exportXLSX:
+		xw, err := NewXLSXWriter(w, "Transactions")
+		if err != nil {
+			return 0, err
+		}
+		xw.WriteHeader(exportColumns)
+		err = store.EachPayment(ctx, from, to, status, func(p *PaymentRecord) error {
+			count++
+			return xw.WriteRow(newExportRow(p).xlsxCells())
+		})
+		if err != nil {
+			return count, err
+		}
+		return count, xw.Close()
+	}
+	return 0, fmt.Errorf("unknown export format %q", format)
+}
+
+// csvRecord returns the row as CSV fields
+func (r exportRow) csvRecord() []string {
+	optional := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+	paidAt := ""
+	if r.PaidAt != nil {
+		paidAt = r.PaidAt.Format(time.DateTime)
+	}
+	return []string{
+		r.InvoiceNumber, csvSafe(r.Reference), csvSafe(r.Gateway), csvSafe(r.Method), csvSafe(r.Plan), r.Status,
+		r.CreatedAt.Format(time.DateTime), paidAt, strconv.Itoa(r.Gross), optional(r.TotalPaid), optional(r.Fee), optional(r.Net),
+	}
+}
+
+// xlsxCells returns the row as spreadsheet cells
+func (r exportRow) xlsxCells() []XLSXCell {
+	optional := func(n *int) XLSXCell {
+		if n == nil {
+			return XLSXCell{}
+		}
+		return XLSXAmount(*n)
+	}
+	paidAt := XLSXCell{}
+	if r.PaidAt != nil {
+		paidAt = XLSXTime(*r.PaidAt)
+	}
+	return []XLSXCell{
+		XLSXString(r.InvoiceNumber), XLSXString(r.Reference), XLSXString(r.Gateway), XLSXString(r.Method),
+		XLSXString(r.Plan), XLSXString(r.Status), XLSXTime(r.CreatedAt), paidAt,
+		XLSXAmount(r.Gross), optional(r.TotalPaid), optional(r.Fee), optional(r.Net),
+	}
+}
+
+// csvSafe keeps a client-supplied value from being read as a formula when
+// the CSV is opened in a spreadsheet
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// adminOnly requires the ADMIN_TOKEN bearer token. Without ADMIN_TOKEN the
+// admin API is disabled.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+				Success: false,
+				Message: "Admin API is disabled; set ADMIN_TOKEN",
+			})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			respondJSON(w, http.StatusUnauthorized, APIResponse{
+				Success: false,
+				Message: "Unauthorized",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// exportHandler streams an accounting export:
+// GET /api/admin/export?from=2026-10-01&to=2026-10-31&format=csv|xlsx[&status=PAID]
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	from, to, err := parseExportRange(query.Get("from"), query.Get("to"))
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = exportCSV
+	}
+	if format != exportCSV && format != exportXLSX {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "format must be csv or xlsx",
+		})
+		return
+	}
+	if err := store.Ping(r.Context()); err != nil {
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	if format == exportXLSX {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	filename := fmt.Sprintf("transactions-%s_%s.%s", query.Get("from"), query.Get("to"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Rows are already on their way, so a failure can only cut the file short
+	count, err := exportPayments(r.Context(), store, w, format, from, to, query.Get("status"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "export failed", "format", format, "rows", count, "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "transactions exported", "format", format, "from", query.Get("from"), "to", query.Get("to"), "rows", count)
+}
+
+// runExportCommand implements `server export`, writing an accounting export
+// from the database to a file or stdout. It returns the exit code.
+func runExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fromRaw := fs.String("from", "", "first date to export, YYYY-MM-DD (WIB)")
+	toRaw := fs.String("to", "", "last date to export, YYYY-MM-DD (WIB)")
+	format := fs.String("format", "", "csv or xlsx (default: from the output file name, else csv)")
+	status := fs.String("status", "", "only export payments with this status, e.g. PAID")
+	output := fs.String("o", "-", "output file, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	from, to, err := parseExportRange(*fromRaw, *toRaw)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 2
+	}
+	if *format == "" {
+		*format = exportCSV
+		if strings.EqualFold(filepath.Ext(*output), ".xlsx") {
+			*format = exportXLSX
+		}
+	}
+
+	conn, err := initDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	pg := NewPostgresStore(conn)
+	defer pg.Close()
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, "export:", err)
+			return 1
+		}
+	}
+
+	count, err := exportPayments(context.Background(), pg, out, *format, from, to, *status)
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d payments\n", count)
+	return 0
+}
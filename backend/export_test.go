@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportRange(t *testing.T) {
+	from, to, err := parseExportRange("2026-10-01", "2026-10-31")
+	if err != nil {
+		t.Fatalf("parseExportRange failed: %v", err)
+	}
+	if want := time.Date(2026, 9, 30, 17, 0, 0, 0, time.UTC); !from.Equal(want) {
+		t.Errorf("expected the range to start at midnight WIB, got %s", from)
+	}
+	if want := time.Date(2026, 10, 31, 17, 0, 0, 0, time.UTC); !to.Equal(want) {
+		t.Errorf("expected the range to include the last day, got %s", to)
+	}
+
+	for _, bad := range [][2]string{{"", "2026-10-31"}, {"2026-10-01", "31/10/2026"}, {"2026-10-31", "2026-10-01"}} {
+		if _, _, err := parseExportRange(bad[0], bad[1]); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// seedExportPayments stores one paid and one unpaid October payment, an
+// expired one with a formula for a reference and one from November. Only
+// the paid one has its fees reported.
+func seedExportPayments(t *testing.T) *MemoryStore {
+	t.Helper()
+	memory := NewMemoryStore()
+	ctx := context.Background()
+	october := time.Date(2026, 10, 15, 9, 30, 0, 0, wib)
+
+	items, _ := json.Marshal(orderItems("User Premium - 30 Hari", 16000))
+	for i, ref := range []string{"EXP-PAID", "EXP-UNPAID", "EXP-NOV"} {
+		createdAt := october.Add(time.Duration(i) * time.Hour)
+		if ref == "EXP-NOV" {
+			createdAt = october.AddDate(0, 1, 0)
+		}
+		memory.CreatePayment(ctx, &PaymentRecord{
+			Reference: ref, MerchantRef: ref, Gateway: "pakasir", PhoneNumber: "6281234567890",
+			Method: "QRIS", Amount: 16000, Status: "UNPAID", OrderItems: items, CreatedAt: createdAt,
+		})
+	}
+	memory.CreatePayment(ctx, &PaymentRecord{
+		Reference: "=HYPERLINK(\"x\")", MerchantRef: "EXP-FORMULA", Gateway: "tripay", Method: "QRIS",
+		Amount: 5000, Status: "EXPIRED", OrderItems: items, CreatedAt: october.Add(5 * time.Hour),
+	})
+	memory.MarkPaymentPaid(ctx, "EXP-PAID", october.Add(10*time.Minute))
+	memory.SetPaymentFees(ctx, "EXP-PAID", *newPaymentFees(16112, 0, 112))
+	return memory
+}
+
+func TestExportPaymentsCSV(t *testing.T) {
+	memory := seedExportPayments(t)
+	from, to, _ := parseExportRange("2026-10-01", "2026-10-31")
+
+	var buf bytes.Buffer
+	count, err := exportPayments(context.Background(), memory, &buf, exportCSV, from, to, "")
+	if err != nil {
+		t.Fatalf("exportPayments failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 October payments, got %d", count)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("export is not valid CSV: %v", err)
+	}
+	if strings.Join(records[0], ",") != strings.Join(exportColumns, ",") {
+		t.Fatalf("unexpected header %v", records[0])
+	}
+	paid := records[1]
+	if !strings.HasPrefix(paid[0], "SHR/2026/10/") || paid[1] != "EXP-PAID" || paid[2] != "pakasir" || paid[4] != "User Premium - 30 Hari" {
+		t.Errorf("unexpected paid row %v", paid)
+	}
+	if paid[6] != "2026-10-15 09:30:00" || paid[7] != "2026-10-15 09:40:00" || paid[8] != "16000" {
+		t.Errorf("expected WIB times and the gross amount, got %v", paid)
+	}
+	if paid[9] != "16112" || paid[10] != "112" || paid[11] != "16000" {
+		t.Errorf("expected the total paid, fee and net amount, got %v", paid)
+	}
+	if unpaid := records[2]; unpaid[9] != "" || unpaid[10] != "" || unpaid[11] != "" {
+		t.Errorf("expected unknown fees to be left blank, got %v", unpaid)
+	}
+	if records[2][1] != "EXP-UNPAID" || records[2][0] != "" || records[2][7] != "" {
+		t.Errorf("unexpected unpaid row %v", records[2])
+	}
+	if records[3][1] != `'=HYPERLINK("x")` {
+		t.Errorf("expected formulas to be neutralized, got %q", records[3][1])
+	}
+
+	buf.Reset()
+	count, _ = exportPayments(context.Background(), memory, &buf, exportCSV, from, to, "PAID")
+	if count != 1 {
+		t.Errorf("expected the status filter to keep 1 payment, got %d", count)
+	}
+}
+
+func TestExportPaymentsXLSX(t *testing.T) {
+	memory := seedExportPayments(t)
+	from, to, _ := parseExportRange("2026-10-01", "2026-10-31")
+
+	var buf bytes.Buffer
+	if _, err := exportPayments(context.Background(), memory, &buf, exportXLSX, from, to, ""); err != nil {
+		t.Fatalf("exportPayments failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("export is not a zip archive: %v", err)
+	}
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(data)
+
+		decoder := xml.NewDecoder(bytes.NewReader(data))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s is not well-formed XML: %v", f.Name, err)
+			}
+		}
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("expected the workbook to contain %s", name)
+		}
+	}
+
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Style  int    `xml:"s,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal([]byte(parts["xl/worksheets/sheet1.xml"]), &sheet); err != nil {
+		t.Fatalf("failed to parse the sheet: %v", err)
+	}
+	if len(sheet.Rows) != 4 {
+		t.Fatalf("expected a header and 3 rows, got %d rows", len(sheet.Rows))
+	}
+	if header := sheet.Rows[0].Cells; header[0].Inline != "Invoice Number" || header[0].Style != xlsxStyleHeader {
+		t.Errorf("unexpected header cell %+v", header[0])
+	}
+	paid := sheet.Rows[1].Cells
+	if paid[1].Inline != "EXP-PAID" || paid[4].Inline != "User Premium - 30 Hari" {
+		t.Errorf("unexpected paid row %+v", paid)
+	}
+	// 2026-10-15 09:40 WIB is serial 46310 plus 9h40m
+	if paid[7].Ref != "H2" || paid[7].Style != xlsxStyleTime || !strings.HasPrefix(paid[7].Value, "46310.402") {
+		t.Errorf("unexpected paid time cell %+v", paid[7])
+	}
+	if paid[8].Value != "16000" || paid[8].Style != xlsxStyleAmount {
+		t.Errorf("unexpected amount cell %+v", paid[8])
+	}
+	if len(paid) != 12 || paid[11].Value != "16000" {
+		t.Errorf("expected the fees of the paid payment, got %+v", paid)
+	}
+	if unpaid := sheet.Rows[2].Cells; len(unpaid) != 8 {
+		t.Errorf("expected the paid time and unknown fees to be left out, got %d cells", len(unpaid))
+	}
+	if !strings.Contains(parts["xl/worksheets/sheet1.xml"], "=HYPERLINK(&#34;x&#34;)") {
+		t.Errorf("expected the formula-like reference to be stored as escaped text")
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	store = seedExportPayments(t)
+
+	get := func(path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(exportHandler)(rec, req)
+		return rec
+	}
+	path := "/api/admin/export?from=2026-10-01&to=2026-10-31"
+
+	t.Setenv("ADMIN_TOKEN", "")
+	if rec := get(path, "Bearer "); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the admin API to be disabled without ADMIN_TOKEN, got %d", rec.Code)
+	}
+
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	if rec := get(path, "Bearer wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", rec.Code)
+	}
+	if rec := get("/api/admin/export?from=2026-10-31&to=2026-10-01", "Bearer s3cret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a reversed range, got %d", rec.Code)
+	}
+	if rec := get(path+"&format=pdf", "Bearer s3cret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+
+	rec := get(path, "Bearer s3cret")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected a CSV export, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="transactions-2026-10-01_2026-10-31.csv"` {
+		t.Errorf("unexpected Content-Disposition %q", got)
+	}
+	if lines := strings.Count(rec.Body.String(), "\n"); lines != 4 {
+		t.Errorf("expected a header and 3 rows, got %d lines", lines)
+	}
+
+	rec = get(path+"&format=xlsx&status=PAID", "Bearer s3cret")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Disposition"), ".xlsx") {
+		t.Fatalf("expected an XLSX export, got %d %s", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	if _, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil {
+		t.Errorf("expected a zip archive, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPakasirFees(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data map[string]interface{}
+		want *PaymentFees
+	}{
+		"customer pays the fee": {
+			data: map[string]interface{}{"fee": 112.0, "total_payment": 16112.0},
+			want: &PaymentFees{FeeCustomer: 112, TotalPaid: 16112, NetAmount: 16000},
+		},
+		"merchant pays the fee": {
+			data: map[string]interface{}{"fee": 112.0, "total_payment": 16000.0},
+			want: &PaymentFees{FeeMerchant: 112, TotalPaid: 16000, NetAmount: 15888},
+		},
+		"fee without a total": {
+			data: map[string]interface{}{"fee": "112"},
+			want: &PaymentFees{FeeMerchant: 112, TotalPaid: 16000, NetAmount: 15888},
+		},
+		"no fee reported": {
+			data: map[string]interface{}{"amount": 16000.0, "status": "completed"},
+		},
+	} {
+		got := pakasirFees(16000, tc.data)
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("%s: pakasirFees = %+v, want %+v", name, got, tc.want)
+		}
+	}
+}
+
+func TestTripayFees(t *testing.T) {
+	detail := map[string]interface{}{"amount": 16750.0, "fee_merchant": 0.0, "fee_customer": 750.0}
+	if got := tripayFees(detail); got == nil || *got != (PaymentFees{FeeCustomer: 750, TotalPaid: 16750, NetAmount: 16000}) {
+		t.Errorf("unexpected fees of a transaction detail: %+v", got)
+	}
+	callback := map[string]interface{}{"total_amount": 16000.0, "fee_merchant": 750.0, "fee_customer": 0.0}
+	if got := tripayFees(callback); got == nil || *got != (PaymentFees{FeeMerchant: 750, TotalPaid: 16000, NetAmount: 15250}) {
+		t.Errorf("unexpected fees of a callback: %+v", got)
+	}
+	if got := tripayFees(map[string]interface{}{"amount": 16000.0}); got != nil {
+		t.Errorf("expected no fees without fee fields, got %+v", got)
+	}
+}
+
+func TestPakasirCreateRecordsFees(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"payment": map[string]interface{}{
+				"order_id":       body["order_id"],
+				"amount":         body["amount"],
+				"fee":            112,
+				"total_payment":  16112,
+				"payment_number": "00020101021226",
+			},
+		})
+	}))
+	defer upstream.Close()
+
+	g := &PakasirGateway{APIKey: "test-api-key", APIURL: upstream.URL, Slug: "shiroine"}
+	g.Initialize(store)
+	data, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        16000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 16000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	response := data.(map[string]interface{})
+	if response["total_amount"] != 16112 || response["fee"] != 112 {
+		t.Errorf("expected the customer to be shown the total with fee, got %+v", response)
+	}
+	payment, err := memory.GetPayment(context.Background(), response["merchant_order_id"].(string))
+	if err != nil {
+		t.Fatalf("GetPayment failed: %v", err)
+	}
+	if payment.Amount != 16000 {
+		t.Errorf("expected the record to keep the price, got %d", payment.Amount)
+	}
+	if payment.Fees == nil || *payment.Fees != (PaymentFees{FeeCustomer: 112, TotalPaid: 16112, NetAmount: 16000}) {
+		t.Errorf("unexpected recorded fees %+v", payment.Fees)
+	}
+}
+
+func TestTripayCallbackRecordsFees(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Tester")
+	store = memory
+	paymentGateway = newTripayTestGateway(t, "T-FEES-1")
+	g := paymentGateway.(*TripayGateway)
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        16000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 16000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+	if payment, _ := memory.GetPayment(context.Background(), "T-FEES-1"); payment.Fees != nil {
+		t.Fatalf("expected no fees before Tripay reports them, got %+v", payment.Fees)
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"reference":       "T-FEES-1",
+		"merchant_ref":    "PREMIUM-test",
+		"status":          "PAID",
+		"total_amount":    16000,
+		"fee_merchant":    750,
+		"fee_customer":    0,
+		"total_fee":       750,
+		"amount_received": 15250,
+	})
+	mac := hmac.New(sha256.New, []byte(g.PrivateKey))
+	mac.Write(payload)
+	if err := g.HandleCallback(context.Background(), payload, map[string]string{
+		"x-callback-signature": hex.EncodeToString(mac.Sum(nil)),
+	}); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+
+	payment, _ := memory.GetPayment(context.Background(), "T-FEES-1")
+	if payment.Fees == nil || *payment.Fees != (PaymentFees{FeeMerchant: 750, TotalPaid: 16000, NetAmount: 15250}) {
+		t.Fatalf("unexpected recorded fees %+v", payment.Fees)
+	}
+
+	rec := httptest.NewRecorder()
+	transactionStatusHandler(rec, httptest.NewRequest(http.MethodGet, "/api/transaction-status/T-FEES-1", nil))
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Data["fee_merchant"] != 750.0 || resp.Data["total_paid"] != 16000.0 || resp.Data["net_amount"] != 15250.0 {
+		t.Errorf("expected the status response to carry the recorded fees, got %+v", resp.Data)
+	}
+}
@@ -1,28 +1,46 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 )
 
+// ErrInvalidSignature is returned by HandleCallback when a callback fails
+// signature verification
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ErrPaymentNotRecorded is returned by CreateTransaction when the gateway
+// created a transaction that could not be saved. Its callback would find no
+// payment to activate, so the customer must not be sent to pay it.
+var ErrPaymentNotRecorded = errors.New("payment could not be recorded")
+
+// ErrGatewayUnreachable is returned by HealthCheck when a configured
+// gateway's API cannot be reached, as opposed to a gateway that is not
+// configured at all
+var ErrGatewayUnreachable = errors.New("gateway unreachable")
+
 // PaymentGateway defines the interface that all payment gateways must implement
 type PaymentGateway interface {
 	// GetName returns the name of the payment gateway
 	GetName() string
 
 	// GetPaymentChannels returns available payment channels (may be empty for QRIS-only gateways)
-	GetPaymentChannels() (interface{}, error)
+	GetPaymentChannels(ctx context.Context) (interface{}, error)
 
 	// CreateTransaction creates a new payment transaction
-	CreateTransaction(req CreateTransactionRequest) (interface{}, error)
+	CreateTransaction(ctx context.Context, req CreateTransactionRequest) (interface{}, error)
 
 	// GetTransactionStatus retrieves the status of a transaction by reference
-	GetTransactionStatus(reference string) (interface{}, error)
+	GetTransactionStatus(ctx context.Context, reference string) (interface{}, error)
 
 	// HandleCallback processes payment callback/webhook
-	HandleCallback(payload []byte, headers map[string]string) error
+	HandleCallback(ctx context.Context, payload []byte, headers map[string]string) error
+
+	// Initialize sets up the gateway with its storage
+	Initialize(store Store)
 
-	// Initialize sets up the gateway with database connection
-	Initialize(db *sql.DB)
+	// HealthCheck reports whether the gateway is configured and its API reachable
+	HealthCheck(ctx context.Context) error
 }
 
 // PaymentGatewayFactory creates the appropriate payment gateway based on configuration
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxGiftMessageLength is the longest gift message, in characters
+const maxGiftMessageLength = 500
+
+// Reasons a gift cannot be sent. The messages are shown to customers.
+var (
+	ErrGiftNoPayer                 = errors.New("your phone number is required to send a gift")
+	ErrGiftAmbiguousRecipient      = errors.New("a gift goes to either a phone number or a group, not both")
+	ErrGiftWrongRecipient          = errors.New("user plans are gifted to a phone number and group plans to a group")
+	ErrGiftToSelf                  = errors.New("you cannot send a gift to yourself")
+	ErrGiftRecipientNotFound       = errors.New("the gift recipient has not used our bot yet")
+	ErrGiftMessageWithoutRecipient = errors.New("a gift message needs a recipient")
+	ErrGiftMessageTooLong          = fmt.Errorf("gift message is longer than %d characters", maxGiftMessageLength)
+)
+
+var giftRejections = []error{
+	ErrGiftNoPayer, ErrGiftAmbiguousRecipient, ErrGiftWrongRecipient, ErrGiftToSelf,
+	ErrGiftRecipientNotFound, ErrGiftMessageWithoutRecipient, ErrGiftMessageTooLong,
+	ErrPlanMismatch,
+}
+
+// isGiftRejection reports whether err is a customer-facing gift rejection
+// rather than a storage failure
+func isGiftRejection(err error) bool {
+	for _, rejection := range giftRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGiftRequest reports whether req names a recipient or carries a gift message
+func isGiftRequest(req CreateTransactionRequest) bool {
+	return req.RecipientPhone != "" || req.RecipientGroupID != "" || req.GiftMessage != ""
+}
+
+// applyGift checks the recipient of a gift against the plan and the bot's
+// users and groups. The payer is always a phone number, so the gift shows up
+// in their payment history and counts against their promo and referral use.
+func applyGift(ctx context.Context, store Store, req *CreateTransactionRequest) error {
+	req.RecipientPhone = strings.TrimSpace(req.RecipientPhone)
+	req.RecipientGroupID = strings.TrimSpace(req.RecipientGroupID)
+	req.GiftMessage = strings.TrimSpace(req.GiftMessage)
+
+	switch {
+	case req.RecipientPhone == "" && req.RecipientGroupID == "":
+		if req.GiftMessage != "" {
+			return ErrGiftMessageWithoutRecipient
+		}
+		return nil
+	case req.RecipientPhone != "" && req.RecipientGroupID != "":
+		return ErrGiftAmbiguousRecipient
+	case req.CustomerPhone == "" || req.GroupID != "":
+		return ErrGiftNoPayer
+	case req.RecipientPhone == req.CustomerPhone:
+		return ErrGiftToSelf
+	case utf8.RuneCountInString(req.GiftMessage) > maxGiftMessageLength:
+		return ErrGiftMessageTooLong
+	}
+
+	if err := checkPlanID(*req); err != nil {
+		return err
+	}
+	_, _, isGroup := parsePlanDetails(planIDOfRequest(*req))
+	recipientType, recipient := "user", req.RecipientPhone
+	if req.RecipientGroupID != "" {
+		recipientType, recipient = "group", req.RecipientGroupID
+	}
+	if isGroup != (recipientType == "group") {
+		return ErrGiftWrongRecipient
+	}
+
+	// The same lookups /api/verify-user does, so the recipient the customer
+	// confirmed is the one the plan is activated for
+	if _, err := lookupIdentity(ctx, store, recipientType, recipient); err == ErrIdentityNotFound {
+		return ErrGiftRecipientNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyGift(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281111111111", "lid-payer", "Payer")
+	memory.SetUser("6282222222222", "lid-friend", "Friend")
+	memory.SetGroup("120363000000000000@g.us", "Grup Teman")
+
+	tests := []struct {
+		name    string
+		req     CreateTransactionRequest
+		wantErr error
+	}{
+		{"user gift", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientPhone: "6282222222222", GiftMessage: " Happy birthday! "}, nil},
+		{"group gift", CreateTransactionRequest{PlanID: "group-1m", CustomerPhone: "6281111111111", RecipientGroupID: "120363000000000000@g.us"}, nil},
+		{"unknown recipient", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientPhone: "6289999999999"}, ErrGiftRecipientNotFound},
+		{"unknown group", CreateTransactionRequest{PlanID: "group-1m", CustomerPhone: "6281111111111", RecipientGroupID: "missing@g.us"}, ErrGiftRecipientNotFound},
+		{"user plan to group", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientGroupID: "120363000000000000@g.us"}, ErrGiftWrongRecipient},
+		{"group plan to user", CreateTransactionRequest{PlanID: "group-1m", CustomerPhone: "6281111111111", RecipientPhone: "6282222222222"}, ErrGiftWrongRecipient},
+		{"both recipients", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientPhone: "6282222222222", RecipientGroupID: "120363000000000000@g.us"}, ErrGiftAmbiguousRecipient},
+		{"no payer", CreateTransactionRequest{PlanID: "user-1m", RecipientPhone: "6282222222222"}, ErrGiftNoPayer},
+		{"to self", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientPhone: "6281111111111"}, ErrGiftToSelf},
+		{"message only", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", GiftMessage: "hi"}, ErrGiftMessageWithoutRecipient},
+		{"plan mismatch", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientGroupID: "120363000000000000@g.us", OrderItems: []map[string]interface{}{{"name": "Group Premium 30 Days"}}}, ErrPlanMismatch},
+		{"long message", CreateTransactionRequest{PlanID: "user-1m", CustomerPhone: "6281111111111", RecipientPhone: "6282222222222", GiftMessage: strings.Repeat("é", maxGiftMessageLength+1)}, ErrGiftMessageTooLong},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		if err := applyGift(context.Background(), memory, &req); err != tt.wantErr {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestGiftActivatesRecipientAndNotifiesBot(t *testing.T) {
+	notifications := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		notifications <- r
+		bodies <- body
+	}))
+	defer bot.Close()
+	t.Setenv("BOT_WEBHOOK_URL", bot.URL)
+	t.Setenv("BOT_WEBHOOK_SECRET", "bot-secret")
+
+	memory := NewMemoryStore()
+	memory.SetUser("6281111111111", "lid-payer", "Payer")
+	memory.SetUser("6282222222222", "lid-friend", "Friend")
+	store = memory
+	g := newTripayTestGateway(t, "T-GIFT-1")
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":15000,"customerName":"Payer","customerPhone":"6281111111111","recipientPhone":"6282222222222","giftMessage":"Selamat ulang tahun!","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := tripayCallback(t, g, "T-GIFT-1", "PAID", 15000); err != nil {
+		t.Fatalf("callback failed: %v", err)
+	}
+
+	friend, err := memory.GetPremium(context.Background(), "6282222222222", "lid-friend")
+	if err != nil {
+		t.Fatalf("expected the recipient to get premium: %v", err)
+	}
+	assertExpiresIn(t, friend.Expired, 30)
+	if _, err := memory.GetPremium(context.Background(), "6281111111111", "lid-payer"); err != ErrPremiumNotFound {
+		t.Fatalf("expected the payer to get nothing, got %v", err)
+	}
+
+	var r *http.Request
+	select {
+	case r = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a bot notification")
+	}
+	payload := <-bodies
+	mac := hmac.New(sha256.New, []byte("bot-secret"))
+	mac.Write(payload)
+	if r.Header.Get(botNotifySignatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("unexpected signature %q", r.Header.Get(botNotifySignatureHeader))
+	}
+
+	var n BotNotification
+	json.Unmarshal(payload, &n)
+	if n.Event != "premium.activated" || n.Reference != "T-GIFT-1" || n.JID != "6282222222222" || n.LID != "lid-friend" || n.PlanID != "user-1m" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	if n.Gift == nil || n.Gift.FromPhone != "6281111111111" || n.Gift.FromName != "Payer" || n.Gift.Message != "Selamat ulang tahun!" {
+		t.Fatalf("unexpected gift: %+v", n.Gift)
+	}
+}
+
+func TestGiftRejectedForUnknownRecipient(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281111111111", "lid-payer", "Payer")
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-GIFT-2")}
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281111111111","recipientPhone":"6289999999999","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrGiftRecipientNotFound.Error()) {
+		t.Fatalf("expected 400 for an unknown recipient, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.creates.Load() != 0 {
+		t.Fatal("expected no upstream transaction")
+	}
+}
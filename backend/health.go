@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health check timing
+const (
+	healthCheckTimeout    = 3 * time.Second
+	healthCacheTTL        = time.Minute
+	heartbeatStaleAfter   = 3 // missed intervals before a worker counts as stuck
+	startupHeartbeatGrace = 2 * time.Minute
+)
+
+// Component states reported by /livez and /readyz
+const (
+	componentOK          = "ok"
+	componentUnavailable = "unavailable"
+)
+
+// ComponentStatus is the health of one dependency
+type ComponentStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Pending   []string  `json:"pending,omitempty"`
+	LatencyMs int64     `json:"latencyMs,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// Advisory components are reported but never fail the probe
+	Advisory bool `json:"advisory,omitempty"`
+}
+
+// HealthReport is the body returned by /livez and /readyz
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// worker is a background loop that reports a heartbeat every interval
+type worker struct {
+	interval time.Duration
+	started  time.Time
+	lastBeat time.Time
+}
+
+// workerRegistry tracks background worker heartbeats
+type workerRegistry struct {
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+var workers = &workerRegistry{workers: make(map[string]*worker)}
+
+// Register adds a worker that promises to call Beat at least every interval
+func (r *workerRegistry) Register(name string, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workers[name] = &worker{interval: interval, started: time.Now()}
+}
+
+// Beat records that a worker is still making progress
+func (r *workerRegistry) Beat(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w, ok := r.workers[name]; ok {
+		w.lastBeat = time.Now()
+	}
+}
+
+// Status reports every registered worker. A worker is unavailable once it
+// has missed heartbeatStaleAfter intervals.
+func (r *workerRegistry) Status(now time.Time) map[string]ComponentStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make(map[string]ComponentStatus, len(r.workers))
+	for name, w := range r.workers {
+		last, allowed := w.lastBeat, heartbeatStaleAfter*w.interval
+		if last.IsZero() {
+			// Give a freshly started worker time for its first tick
+			last, allowed = w.started, allowed+startupHeartbeatGrace
+		}
+
+		status := ComponentStatus{Status: componentOK, CheckedAt: last}
+		if now.Sub(last) > allowed {
+			status.Status = componentUnavailable
+			status.Error = fmt.Sprintf("no heartbeat for %s", now.Sub(last).Round(time.Second))
+		}
+		statuses["worker:"+name] = status
+	}
+	return statuses
+}
+
+// cachedCheck runs an expensive check at most once per ttl
+type cachedCheck struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	check  func(ctx context.Context) ComponentStatus
+	result ComponentStatus
+}
+
+func (c *cachedCheck) Get(ctx context.Context) ComponentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.result.CheckedAt.IsZero() || time.Since(c.result.CheckedAt) > c.ttl {
+		c.result = c.check(ctx)
+	}
+	return c.result
+}
+
+// HealthChecker answers liveness and readiness probes
+type HealthChecker struct {
+	store      Store
+	gateway    PaymentGateway
+	spool      *CallbackSpool // nil when callbacks cannot be spooled
+	workers    *workerRegistry
+	migrations *cachedCheck
+	gatewayUp  *cachedCheck
+}
+
+// NewHealthChecker creates a checker for store, gateway, the callback spool
+// and the registered workers
+func NewHealthChecker(store Store, gateway PaymentGateway, spool *CallbackSpool, workers *workerRegistry) *HealthChecker {
+	h := &HealthChecker{store: store, gateway: gateway, spool: spool, workers: workers}
+	h.migrations = &cachedCheck{ttl: healthCacheTTL, check: h.checkMigrations}
+	h.gatewayUp = &cachedCheck{ttl: healthCacheTTL, check: h.checkGateway}
+	return h
+}
+
+// timed runs check and fills in latency and timestamp
+func timed(check func() error) ComponentStatus {
+	start := time.Now()
+	err := check()
+	status := ComponentStatus{
+		Status:    componentOK,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		status.Status = componentUnavailable
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func (h *HealthChecker) checkDatabase(ctx context.Context) ComponentStatus {
+	return timed(func() error { return h.store.Ping(ctx) })
+}
+
+func (h *HealthChecker) checkMigrations(ctx context.Context) ComponentStatus {
+	var pending []string
+	status := timed(func() error {
+		var err error
+		pending, err = h.store.PendingMigrations(ctx)
+		if err == nil && len(pending) > 0 {
+			err = errors.New("schema is missing migrations")
+		}
+		return err
+	})
+	status.Pending = pending
+	return status
+}
+
+// checkGateway reports the gateway. An outage is advisory, since no other
+// instance could reach it either; missing credentials are not.
+func (h *HealthChecker) checkGateway(ctx context.Context) ComponentStatus {
+	var err error
+	status := timed(func() error {
+		err = h.gateway.HealthCheck(ctx)
+		return err
+	})
+	status.Advisory = err == nil || errors.Is(err, ErrGatewayUnreachable)
+	return status
+}
+
+// Liveness reports whether the process is making progress. Only stuck
+// background workers fail it, since restarting is the only cure for those.
+func (h *HealthChecker) Liveness() HealthReport {
+	return newHealthReport(h.workers.Status(time.Now()))
+}
+
+// Readiness reports whether this instance can take traffic: workers are
+// alive, a reachable database is migrated and the gateway is configured. A
+// database outage only fails it when the spool cannot take callbacks, since
+// the spool exists to accept them through one. A gateway outage is reported
+// but never fails it. Migration and gateway checks are cached.
+func (h *HealthChecker) Readiness(ctx context.Context) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	components := h.workers.Status(time.Now())
+	database := h.checkDatabase(ctx)
+	if database.Status != componentOK && h.spool != nil {
+		if err := h.spool.Writable(); err != nil {
+			database.Error += "; callback spool: " + err.Error()
+		} else {
+			database.Advisory = true
+		}
+	}
+	components["database"] = database
+	if database.Status == componentOK {
+		components["migrations"] = h.migrations.Get(ctx)
+	}
+	components["gateway:"+h.gateway.GetName()] = h.gatewayUp.Get(ctx)
+	return newHealthReport(components)
+}
+
+func newHealthReport(components map[string]ComponentStatus) HealthReport {
+	report := HealthReport{Status: componentOK, Timestamp: time.Now(), Components: components}
+	for _, c := range components {
+		if c.Status != componentOK && !c.Advisory {
+			report.Status = componentUnavailable
+		}
+	}
+	return report
+}
+
+// Failing returns the names of unhealthy components that fail the probe, sorted
+func (r HealthReport) Failing() []string {
+	var names []string
+	for name, c := range r.Components {
+		if c.Status != componentOK && !c.Advisory {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func respondHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if report.Status != componentOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, status, report)
+}
+
+// livezHandler serves the liveness probe
+func livezHandler(h *HealthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondHealth(w, h.Liveness())
+	}
+}
+
+// readyzHandler serves the readiness probe
+func readyzHandler(h *HealthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.Readiness(r.Context())
+		if failing := report.Failing(); len(failing) > 0 {
+			slog.WarnContext(r.Context(), "readiness check failing", "components", failing)
+		}
+		respondHealth(w, report)
+	}
+}
+
+// probeGateway checks that a gateway's API host answers HTTP. Any response
+// below 500 counts as reachable; auth and routing errors are still answers.
+func probeGateway(ctx context.Context, gateway, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := newGatewayClient(gateway, "health").Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrGatewayUnreachable, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: gateway returned %s", ErrGatewayUnreachable, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readyz(t *testing.T, h *HealthChecker) (int, HealthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	readyzHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid readiness body: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestReadinessReportsEachComponent(t *testing.T) {
+	var probes atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	gateway := &TripayGateway{APIKey: "key", PrivateKey: "private", MerchantCode: "T0001", APIURL: upstream.URL}
+	registry := &workerRegistry{workers: make(map[string]*worker)}
+
+	h := NewHealthChecker(NewMemoryStore(), gateway, nil, registry)
+	for i := 0; i < 3; i++ {
+		if code, report := readyz(t, h); code != http.StatusOK {
+			t.Fatalf("expected ready, got %d: %+v", code, report)
+		}
+	}
+	if probes.Load() != 1 {
+		t.Fatalf("expected the gateway probe to be cached, got %d probes", probes.Load())
+	}
+
+	h = NewHealthChecker(NewPostgresStore(nil), gateway, nil, registry)
+	code, report := readyz(t, h)
+	if code != http.StatusServiceUnavailable || report.Components["database"].Status != componentUnavailable {
+		t.Fatalf("expected 503 with the database unavailable, got %d: %+v", code, report)
+	}
+
+	// With a spool, callbacks are accepted through a database outage
+	spool := NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), defaultSpoolMaxBytes)
+	h = NewHealthChecker(NewPostgresStore(nil), gateway, spool, registry)
+	code, report = readyz(t, h)
+	if database := report.Components["database"]; code != http.StatusOK || database.Status != componentUnavailable || !database.Advisory {
+		t.Fatalf("expected ready with the database outage reported, got %d: %+v", code, report)
+	}
+
+	// A full spool cannot take callbacks, so the outage fails readiness again
+	full := filepath.Join(t.TempDir(), "spool.jsonl")
+	if err := os.WriteFile(full, make([]byte, 1024), 0o600); err != nil {
+		t.Fatalf("failed to fill spool: %v", err)
+	}
+	h = NewHealthChecker(NewPostgresStore(nil), gateway, NewCallbackSpool(full, 1024), registry)
+	code, report = readyz(t, h)
+	if database := report.Components["database"]; code != http.StatusServiceUnavailable || database.Advisory {
+		t.Fatalf("expected 503 with a full spool, got %d: %+v", code, report)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	h = NewHealthChecker(NewMemoryStore(), &TripayGateway{APIKey: "key", PrivateKey: "private", MerchantCode: "T0001", APIURL: down.URL}, nil, registry)
+	code, report = readyz(t, h)
+	if gw := report.Components["gateway:tripay"]; code != http.StatusOK || gw.Error == "" || !gw.Advisory {
+		t.Fatalf("expected ready with the gateway outage reported, got %d: %+v", code, report)
+	}
+	if failing := report.Failing(); len(failing) != 0 {
+		t.Errorf("expected advisory components not to count as failing, got %v", failing)
+	}
+}
+
+func TestReadinessFailsWithoutGatewayCredentials(t *testing.T) {
+	registry := &workerRegistry{workers: make(map[string]*worker)}
+	for _, gateway := range []PaymentGateway{&TripayGateway{}, &PakasirGateway{}, &IskapayGateway{}} {
+		h := NewHealthChecker(NewMemoryStore(), gateway, nil, registry)
+		code, report := readyz(t, h)
+		if gw := report.Components["gateway:"+gateway.GetName()]; code != http.StatusServiceUnavailable || gw.Advisory {
+			t.Errorf("%s: expected 503 without credentials, got %d: %+v", gateway.GetName(), code, report)
+		}
+	}
+}
+
+func TestWorkerHeartbeatGoesStale(t *testing.T) {
+	registry := &workerRegistry{workers: make(map[string]*worker)}
+	registry.Register("replay", time.Second)
+
+	now := time.Now()
+	if s := registry.Status(now)["worker:replay"]; s.Status != componentOK {
+		t.Fatalf("expected a new worker to get a startup grace period, got %+v", s)
+	}
+	if s := registry.Status(now.Add(startupHeartbeatGrace + 4*time.Second))["worker:replay"]; s.Status != componentUnavailable {
+		t.Fatalf("expected a worker that never beat to go stale, got %+v", s)
+	}
+
+	registry.Beat("replay")
+	if s := registry.Status(time.Now().Add(2 * time.Second))["worker:replay"]; s.Status != componentOK {
+		t.Fatalf("expected a recent heartbeat to be healthy, got %+v", s)
+	}
+	if s := registry.Status(time.Now().Add(4 * time.Second))["worker:replay"]; s.Status != componentUnavailable {
+		t.Fatalf("expected a missed heartbeat to go stale, got %+v", s)
+	}
+
+	h := NewHealthChecker(NewMemoryStore(), &TripayGateway{}, nil, registry)
+	rec := httptest.NewRecorder()
+	livezHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected live with a fresh heartbeat, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+
+	// idempotencyKeyTTL is how long a finished request is replayed to retries
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyLockTimeout frees a key whose request never finished, for
+	// example because the process died while the gateway was being called
+	idempotencyLockTimeout = time.Minute
+)
+
+// validIdempotencyKey accepts 1 to 255 printable ASCII characters
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// hashCreateRequest fingerprints a decoded request, so retries differing
+// only in JSON whitespace or key order still match
+func hashCreateRequest(req CreateTransactionRequest) string {
+	canonical, _ := json.Marshal(req)
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// reserveIdempotencyKey claims key for req. It returns false when it has
+// already answered the request: by replaying the original response, or by
+// rejecting a conflicting or concurrent request.
+func reserveIdempotencyKey(w http.ResponseWriter, r *http.Request, key string, req CreateTransactionRequest) bool {
+	now := time.Now()
+	existing, err := store.ReserveIdempotencyKey(r.Context(), IdempotencyRecord{
+		Key:         key,
+		RequestHash: hashCreateRequest(req),
+		CreatedAt:   now,
+	}, now.Add(-idempotencyKeyTTL), now.Add(-idempotencyLockTimeout))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to reserve idempotency key", "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Payment service is temporarily unavailable, please try again later",
+		})
+		return false
+	}
+	if existing == nil {
+		return true
+	}
+
+	switch {
+	case existing.RequestHash != hashCreateRequest(req):
+		respondJSON(w, http.StatusUnprocessableEntity, APIResponse{
+			Success: false,
+			Message: "Idempotency-Key has already been used for a different request",
+		})
+	case existing.StatusCode == 0:
+		w.Header().Set("Retry-After", "1")
+		respondJSON(w, http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "A request with this Idempotency-Key is still being processed",
+		})
+	default:
+		slog.InfoContext(r.Context(), "replaying idempotent response", "created_at", existing.CreatedAt)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(idempotencyReplayedHeader, "true")
+		w.WriteHeader(existing.StatusCode)
+		w.Write(existing.Response)
+	}
+	return false
+}
+
+// finishIdempotencyKey stores a successful response under key. Failures
+// release the key instead, so the customer can retry with the same key once
+// whatever went wrong is fixed.
+func finishIdempotencyKey(ctx context.Context, key string, status int, response APIResponse) {
+	if status != http.StatusOK {
+		if err := store.ReleaseIdempotencyKey(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "failed to release idempotency key", "error", err)
+		}
+		return
+	}
+
+	body, err := json.Marshal(response)
+	if err == nil {
+		err = store.CompleteIdempotencyKey(ctx, key, status, body)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to store idempotent response", "error", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingGateway counts the transactions created upstream and keeps the
+// last request
+type countingGateway struct {
+	*TripayGateway
+	creates atomic.Int32
+	last    CreateTransactionRequest
+}
+
+func (g *countingGateway) CreateTransaction(ctx context.Context, req CreateTransactionRequest) (interface{}, error) {
+	g.creates.Add(1)
+	g.last = req
+	return g.TripayGateway.CreateTransaction(ctx, req)
+}
+
+func postCreateTransaction(t *testing.T, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/create-transaction", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	createTransactionHandler(rec, req)
+	return rec
+}
+
+func TestCreateTransactionIdempotencyKey(t *testing.T) {
+	store = NewMemoryStore()
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-IDEM-1")}
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	first := postCreateTransaction(t, "checkout-1", body)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+
+	// Same body with different formatting is still the same request
+	retryBody := strings.Replace(body, `"method":"QRIS",`, `"method": "QRIS", `, 1)
+	retry := postCreateTransaction(t, "checkout-1", retryBody)
+	if retry.Code != http.StatusOK || retry.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Fatalf("expected a replayed 200, got %d %v", retry.Code, retry.Header())
+	}
+	if strings.TrimSpace(retry.Body.String()) != strings.TrimSpace(first.Body.String()) {
+		t.Fatalf("expected the original response, got %s", retry.Body.String())
+	}
+	if n := g.creates.Load(); n != 1 {
+		t.Fatalf("expected one upstream transaction, got %d", n)
+	}
+
+	conflict := postCreateTransaction(t, "checkout-1", strings.Replace(body, "15000,", "30000,", 1))
+	if conflict.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a reused key, got %d", conflict.Code)
+	}
+
+	postCreateTransaction(t, "", body)
+	postCreateTransaction(t, "checkout-2", body)
+	if n := g.creates.Load(); n != 3 {
+		t.Fatalf("expected requests without the key or with a new key to create, got %d creates", n)
+	}
+
+	if rec := postCreateTransaction(t, strings.Repeat("k", 256), body); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an oversized key, got %d", rec.Code)
+	}
+}
+
+func TestCreateTransactionIdempotencyKeyInFlight(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	paymentGateway = newTripayTestGateway(t, "T-IDEM-2")
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890"}`
+	req := CreateTransactionRequest{Method: "QRIS", Amount: 15000, CustomerPhone: "6281234567890"}
+	memory.ReserveIdempotencyKey(context.Background(), IdempotencyRecord{
+		Key:         "checkout-3",
+		RequestHash: hashCreateRequest(req),
+		CreatedAt:   time.Now(),
+	}, time.Now().Add(-idempotencyKeyTTL), time.Now().Add(-idempotencyLockTimeout))
+
+	rec := postCreateTransaction(t, "checkout-3", body)
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 409 with Retry-After while the first request runs, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,692 @@
+//go:build integration
+
+// Integration tests for the payment and premium flows.
+//
+// They run against a throwaway PostgreSQL instance: set TEST_DATABASE_URL to
+// point at an empty database you own, or leave it unset and an embedded
+// PostgreSQL is downloaded and started for the duration of the run.
+//
+//	go test -tags integration ./...
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/lib/pq"
+)
+
+var testDB *sql.DB
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+func runIntegration(m *testing.M) int {
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		port, err := freePort()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to find free port: %v\n", err)
+			return 1
+		}
+
+		runtimeDir, err := os.MkdirTemp("", "shiroine-pg-")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create runtime dir: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(runtimeDir)
+
+		pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(uint32(port)).
+			Database("shiroine_test").
+			RuntimePath(runtimeDir).
+			Logger(io.Discard))
+		if err := pg.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start embedded postgres: %v\n", err)
+			return 1
+		}
+		defer pg.Stop()
+
+		connStr = fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=shiroine_test sslmode=disable", port)
+	}
+
+	var err error
+	testDB, err = sql.Open("postgres", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open database: %v\n", err)
+		return 1
+	}
+	defer testDB.Close()
+
+	if err := applySchema(testDB); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to apply schema: %v\n", err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// applySchema loads schema.sql followed by every migration, in file name order
+func applySchema(db *sql.DB) error {
+	files := []string{"schema.sql"}
+	migrations, err := filepath.Glob(filepath.Join("migrations", "*.sql"))
+	if err != nil {
+		return err
+	}
+	files = append(files, migrations...)
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(string(content)); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// resetDB empties every table and points the package-level store at the test database
+func resetDB(t *testing.T) {
+	t.Helper()
+	_, err := testDB.Exec(`TRUNCATE payment_history, premium, users, names, groups, idempotency_keys, promo_codes, promo_redemptions, referral_codes, referrals, renewal_reminders, invoice_counters, email_outbox RESTART IDENTITY`)
+	if err != nil {
+		t.Fatalf("failed to truncate tables: %v", err)
+	}
+	store = NewPostgresStore(testDB)
+}
+
+func TestPostgresStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Store {
+		resetDB(t)
+		return store
+	}, func(t *testing.T, phone, lid, pushName string) {
+		seedUser(t, phone, lid)
+		if _, err := testDB.Exec(`INSERT INTO names (lid, push_name) VALUES ($1, $2)`, lid, pushName); err != nil {
+			t.Fatalf("failed to seed name: %v", err)
+		}
+	}, seedPromo)
+}
+
+func TestPostgresPendingMigrations(t *testing.T) {
+	resetDB(t)
+	ctx := context.Background()
+
+	if pending, err := store.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+		t.Fatalf("expected a fully migrated schema, got %v, %v", pending, err)
+	}
+
+	if _, err := testDB.Exec(`ALTER TABLE payment_history DROP COLUMN expired_at`); err != nil {
+		t.Fatalf("failed to drop column: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := applySchema(testDB); err != nil {
+			t.Fatalf("failed to re-apply migrations: %v", err)
+		}
+	})
+
+	pending, err := store.PendingMigrations(ctx)
+	if err != nil || len(pending) != 1 || pending[0] != "add_payment_number_and_expired_at.sql" {
+		t.Fatalf("expected the dropped column's migration to be pending, got %v, %v", pending, err)
+	}
+}
+
+func seedPromo(t *testing.T, p PromoCode) {
+	t.Helper()
+	_, err := testDB.Exec(`
+		INSERT INTO promo_codes (code, discount_type, discount_value, max_discount, plan_ids, max_redemptions,
+			max_per_identity, valid_from, valid_until, first_purchase_only, active)
+		VALUES ($1, $2, $3, NULLIF($4, 0), COALESCE($5::text[], '{}'), NULLIF($6, 0), NULLIF($7, 0), $8, $9, $10, $11)
+	`, strings.ToUpper(p.Code), p.DiscountType, p.DiscountValue, p.MaxDiscount, pq.Array(p.PlanIDs), p.MaxRedemptions,
+		p.MaxPerIdentity, nullTime(p.ValidFrom), nullTime(p.ValidUntil), p.FirstPurchaseOnly, p.Active)
+	if err != nil {
+		t.Fatalf("failed to seed promo code: %v", err)
+	}
+}
+
+func seedUser(t *testing.T, phone, lid string) {
+	t.Helper()
+	if _, err := testDB.Exec(`INSERT INTO users (phone_number, lid) VALUES ($1, $2)`, phone, lid); err != nil {
+		t.Fatalf("failed to seed user: %v", err)
+	}
+}
+
+func seedPremium(t *testing.T, jid, lid string, expired time.Time) {
+	t.Helper()
+	_, err := testDB.Exec(`
+		INSERT INTO premium (jid, lid, special_limit, max_special_limit, expired, last_special_reset)
+		VALUES ($1, $2, 3, 5, $3, $4)
+	`, jid, lid, expired.Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("failed to seed premium: %v", err)
+	}
+}
+
+type paymentRow struct {
+	Reference     string
+	PhoneNumber   sql.NullString
+	GroupID       sql.NullString
+	Method        string
+	Amount        int
+	Status        string
+	PaymentNumber sql.NullString
+	PaidAt        sql.NullTime
+}
+
+func loadPayment(t *testing.T, reference string) paymentRow {
+	t.Helper()
+	var row paymentRow
+	err := testDB.QueryRow(`
+		SELECT reference, phone_number, group_id, method, amount, status, payment_number, paid_at
+		FROM payment_history WHERE reference = $1
+	`, reference).Scan(&row.Reference, &row.PhoneNumber, &row.GroupID, &row.Method, &row.Amount,
+		&row.Status, &row.PaymentNumber, &row.PaidAt)
+	if err != nil {
+		t.Fatalf("failed to load payment %s: %v", reference, err)
+	}
+	return row
+}
+
+type premiumRow struct {
+	SpecialLimit    int
+	MaxSpecialLimit int
+	Expired         time.Time
+}
+
+func loadPremium(t *testing.T, jid, lid string) premiumRow {
+	t.Helper()
+	var row premiumRow
+	var expired string
+	err := testDB.QueryRow(`
+		SELECT special_limit, max_special_limit, expired FROM premium WHERE jid = $1 AND lid = $2
+	`, jid, lid).Scan(&row.SpecialLimit, &row.MaxSpecialLimit, &expired)
+	if err != nil {
+		t.Fatalf("failed to load premium for jid=%s lid=%s: %v", jid, lid, err)
+	}
+	row.Expired, err = time.Parse(time.RFC3339, expired)
+	if err != nil {
+		t.Fatalf("premium expired %q is not RFC3339: %v", expired, err)
+	}
+	return row
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := testDB.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("count query failed: %v", err)
+	}
+	return n
+}
+
+func TestTripayCreateCallbackActivatesPremium(t *testing.T) {
+	resetDB(t)
+	seedUser(t, "6281234567890", "lid-123")
+	g := newTripayTestGateway(t, "T-REF-1")
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        15000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 15000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	payment := loadPayment(t, "T-REF-1")
+	if payment.Status != "UNPAID" || payment.Amount != 15000 || payment.PhoneNumber.String != "6281234567890" {
+		t.Fatalf("unexpected payment after create: %+v", payment)
+	}
+
+	if err := tripayCallback(t, g, "T-REF-1", "PAID", 15000); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+
+	payment = loadPayment(t, "T-REF-1")
+	if payment.Status != "PAID" || !payment.PaidAt.Valid {
+		t.Fatalf("expected PAID with paid_at, got %+v", payment)
+	}
+
+	premium := loadPremium(t, "6281234567890", "lid-123")
+	if premium.MaxSpecialLimit != 15 || premium.SpecialLimit != 0 {
+		t.Fatalf("unexpected limits: %+v", premium)
+	}
+	assertExpiresIn(t, premium.Expired, 30)
+}
+
+func TestTripayDuplicateCallbackDoesNotStack(t *testing.T) {
+	resetDB(t)
+	seedUser(t, "6281234567890", "lid-123")
+	g := newTripayTestGateway(t, "T-REF-DUP")
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        5000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 5 Days", 5000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := tripayCallback(t, g, "T-REF-DUP", "PAID", 5000); err != nil {
+			t.Fatalf("HandleCallback #%d failed: %v", i+1, err)
+		}
+	}
+
+	// user-5d grants 7 days, regardless of how many times the callback arrives
+	assertExpiresIn(t, loadPremium(t, "6281234567890", "lid-123").Expired, 7)
+
+	// A late EXPIRED notification must not downgrade a paid transaction
+	if err := tripayCallback(t, g, "T-REF-DUP", "EXPIRED", 5000); err != nil {
+		t.Fatalf("HandleCallback EXPIRED failed: %v", err)
+	}
+	if status := loadPayment(t, "T-REF-DUP").Status; status != "PAID" {
+		t.Fatalf("expected status to stay PAID, got %s", status)
+	}
+}
+
+func TestTripayCallbackRejectsBadSignature(t *testing.T) {
+	resetDB(t)
+	g := newTripayTestGateway(t, "T-REF-SIG")
+
+	payload := []byte(`{"reference":"T-REF-SIG","status":"PAID"}`)
+	if err := g.HandleCallback(context.Background(), payload, map[string]string{"x-callback-signature": "bogus"}); err == nil {
+		t.Fatal("expected invalid signature error")
+	}
+}
+
+func TestTripayExpiredCallbackDoesNotActivate(t *testing.T) {
+	resetDB(t)
+	seedUser(t, "6281234567890", "lid-123")
+	g := newTripayTestGateway(t, "T-REF-EXP")
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "BRIVA",
+		Amount:        15000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 15000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	if err := tripayCallback(t, g, "T-REF-EXP", "EXPIRED", 15000); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+
+	if status := loadPayment(t, "T-REF-EXP").Status; status != "EXPIRED" {
+		t.Fatalf("expected EXPIRED, got %s", status)
+	}
+	if n := countRows(t, `SELECT COUNT(*) FROM premium`); n != 0 {
+		t.Fatalf("expected no premium rows, got %d", n)
+	}
+}
+
+func TestActivatePremiumStacking(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *time.Time
+		plan     string
+		wantDays int
+	}{
+		{name: "new premium", plan: "User Premium 15 Days", wantDays: 15},
+		{name: "active premium stacks", existing: timePtr(time.Now().AddDate(0, 0, 10)), plan: "User Premium 15 Days", wantDays: 25},
+		{name: "expired premium restarts from now", existing: timePtr(time.Now().AddDate(0, 0, -3)), plan: "User Premium 15 Days", wantDays: 15},
+		{name: "indonesian plan name", plan: "User Premium 1 Bulan", wantDays: 30},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetDB(t)
+			seedUser(t, "6281111111111", "lid-stack")
+			if tt.existing != nil {
+				seedPremium(t, "6281111111111", "lid-stack", *tt.existing)
+			}
+
+			reference := fmt.Sprintf("STACK-%d", i)
+			items, _ := json.Marshal(orderItems(tt.plan, 10000))
+			_, err := testDB.Exec(`
+				INSERT INTO payment_history (reference, merchant_ref, phone_number, method, amount, status, order_items)
+				VALUES ($1, $1, $2, 'QRIS', 10000, 'PAID', $3)
+			`, reference, "6281111111111", items)
+			if err != nil {
+				t.Fatalf("failed to seed payment: %v", err)
+			}
+
+			if err := activatePremium(context.Background(), store, reference); err != nil {
+				t.Fatalf("activatePremium failed: %v", err)
+			}
+
+			premium := loadPremium(t, "6281111111111", "lid-stack")
+			assertExpiresIn(t, premium.Expired, tt.wantDays)
+			if premium.SpecialLimit != 0 {
+				t.Fatalf("expected special_limit reset to 0, got %d", premium.SpecialLimit)
+			}
+			if n := countRows(t, `SELECT COUNT(*) FROM premium`); n != 1 {
+				t.Fatalf("expected upsert to keep a single premium row, got %d", n)
+			}
+		})
+	}
+}
+
+func TestActivatePremiumFallsBackToPhoneWithoutLID(t *testing.T) {
+	resetDB(t)
+	items, _ := json.Marshal(orderItems("User Premium 15 Days", 10000))
+	_, err := testDB.Exec(`
+		INSERT INTO payment_history (reference, merchant_ref, phone_number, method, amount, status, order_items)
+		VALUES ('NOLID-1', 'NOLID-1', '6282222222222', 'QRIS', 10000, 'PAID', $1)
+	`, items)
+	if err != nil {
+		t.Fatalf("failed to seed payment: %v", err)
+	}
+
+	if err := activatePremium(context.Background(), store, "NOLID-1"); err != nil {
+		t.Fatalf("activatePremium failed: %v", err)
+	}
+	assertExpiresIn(t, loadPremium(t, "6282222222222", "6282222222222").Expired, 15)
+}
+
+func TestActivatePremiumUnknownPlan(t *testing.T) {
+	resetDB(t)
+	items, _ := json.Marshal(orderItems("Donation", 10000))
+	_, err := testDB.Exec(`
+		INSERT INTO payment_history (reference, merchant_ref, phone_number, method, amount, status, order_items)
+		VALUES ('UNKNOWN-1', 'UNKNOWN-1', '6283333333333', 'QRIS', 10000, 'PAID', $1)
+	`, items)
+	if err != nil {
+		t.Fatalf("failed to seed payment: %v", err)
+	}
+
+	if err := activatePremium(context.Background(), store, "UNKNOWN-1"); err == nil {
+		t.Fatal("expected an error for an unknown plan")
+	}
+	if n := countRows(t, `SELECT COUNT(*) FROM premium`); n != 0 {
+		t.Fatalf("expected no premium rows, got %d", n)
+	}
+}
+
+// newPakasirTestGateway wires a Pakasir gateway to a fake upstream. The
+// transaction detail endpoint reports whatever status is stored in *status.
+func newPakasirTestGateway(t *testing.T, status *string) *PakasirGateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api/transactioncreate/"):
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"payment": map[string]interface{}{
+					"order_id":       body["order_id"],
+					"amount":         body["amount"],
+					"fee":            1003,
+					"payment_number": "00020101021226610016ID.CO.SHOPEE.WWW",
+					"expired_at":     time.Now().Add(time.Hour).Format(time.RFC3339),
+				},
+			})
+		case r.URL.Path == "/api/transactiondetail":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"transaction": map[string]interface{}{
+					"order_id": r.URL.Query().Get("order_id"),
+					"status":   *status,
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	g := &PakasirGateway{APIKey: "test-api-key", APIURL: upstream.URL, Slug: "shiroine", Mode: "sandbox"}
+	g.Initialize(store)
+	return g
+}
+
+func TestPakasirGroupCreateCallbackActivatesPremium(t *testing.T) {
+	resetDB(t)
+	status := "pending"
+	g := newPakasirTestGateway(t, &status)
+
+	data, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:     "QRIS",
+		Amount:     25000,
+		GroupID:    "120363000000000000@g.us",
+		OrderItems: orderItems("Group Premium 15 Days", 25000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+	orderID := data.(map[string]interface{})["merchant_order_id"].(string)
+
+	payment := loadPayment(t, orderID)
+	if payment.Method != "QRIS" || !payment.PaymentNumber.Valid || payment.GroupID.String != "120363000000000000@g.us" {
+		t.Fatalf("unexpected payment after create: %+v", payment)
+	}
+
+	callback, _ := json.Marshal(map[string]interface{}{
+		"order_id":       orderID,
+		"amount":         25000,
+		"status":         "completed",
+		"payment_method": "qris",
+		"completed_at":   time.Now().Format(time.RFC3339),
+	})
+	for i := 0; i < 2; i++ {
+		if err := g.HandleCallback(context.Background(), callback, nil); err != nil {
+			t.Fatalf("HandleCallback #%d failed: %v", i+1, err)
+		}
+	}
+
+	premium := loadPremium(t, "120363000000000000@g.us", "120363000000000000@g.us")
+	if premium.MaxSpecialLimit != 30 {
+		t.Fatalf("expected group-15d special limit 30, got %d", premium.MaxSpecialLimit)
+	}
+	assertExpiresIn(t, premium.Expired, 15)
+
+	// Polling after the callback must not activate a second time
+	status = "completed"
+	if _, err := g.GetTransactionStatus(context.Background(), orderID); err != nil {
+		t.Fatalf("GetTransactionStatus failed: %v", err)
+	}
+	assertExpiresIn(t, loadPremium(t, "120363000000000000@g.us", "120363000000000000@g.us").Expired, 15)
+}
+
+func TestPakasirStatusPollActivatesOnce(t *testing.T) {
+	resetDB(t)
+	seedUser(t, "6284444444444", "lid-poll")
+	status := "pending"
+	g := newPakasirTestGateway(t, &status)
+
+	data, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        10000,
+		CustomerPhone: "6284444444444",
+		OrderItems:    orderItems("User Premium 15 Days", 10000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+	orderID := data.(map[string]interface{})["merchant_order_id"].(string)
+
+	if _, err := g.GetTransactionStatus(context.Background(), orderID); err != nil {
+		t.Fatalf("GetTransactionStatus failed: %v", err)
+	}
+	if status := loadPayment(t, orderID).Status; status != "UNPAID" {
+		t.Fatalf("expected UNPAID while pending, got %s", status)
+	}
+
+	status = "completed"
+	for i := 0; i < 2; i++ {
+		if _, err := g.GetTransactionStatus(context.Background(), orderID); err != nil {
+			t.Fatalf("GetTransactionStatus #%d failed: %v", i+1, err)
+		}
+	}
+
+	if payment := loadPayment(t, orderID); payment.Status != "PAID" || !payment.PaidAt.Valid {
+		t.Fatalf("expected PAID with paid_at, got %+v", payment)
+	}
+	assertExpiresIn(t, loadPremium(t, "6284444444444", "lid-poll").Expired, 15)
+}
+
+// newIskapayTestGateway wires an Iskapay gateway to a fake upstream that
+// issues the given order ID and reports *status on lookups
+func newIskapayTestGateway(t *testing.T, orderID string, status *string) *IskapayGateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/payments":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data": map[string]interface{}{
+					"merchant_order_id": orderID,
+					"payment_url":       "https://wallet.iskapay.test/pay/" + orderID,
+				},
+			})
+		case r.Method == http.MethodGet && r.URL.Path == "/payments/"+orderID:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data": map[string]interface{}{
+					"merchant_order_id": orderID,
+					"status":            *status,
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	g := &IskapayGateway{APIKey: "test-api-key", APIURL: upstream.URL}
+	g.Initialize(store)
+	return g
+}
+
+func TestIskapayStatusThenCallbackActivatesOnce(t *testing.T) {
+	resetDB(t)
+	seedUser(t, "6285555555555", "lid-iska")
+	status := "pending"
+	g := newIskapayTestGateway(t, "INV-1-20260110-ABCD", &status)
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Amount:        15000,
+		CustomerPhone: "6285555555555",
+		OrderItems:    orderItems("User Premium 30 Hari", 15000),
+		ReturnURL:     "https://shiroine.test/pay",
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	status = "paid"
+	if _, err := g.GetTransactionStatus(context.Background(), "INV-1-20260110-ABCD"); err != nil {
+		t.Fatalf("GetTransactionStatus failed: %v", err)
+	}
+
+	callback, _ := json.Marshal(map[string]interface{}{
+		"event": "payment.completed",
+		"payment": map[string]interface{}{
+			"merchant_order_id": "INV-1-20260110-ABCD",
+			"amount":            15000,
+			"status":            "completed",
+			"paid_at":           time.Now().Format(time.RFC3339),
+		},
+	})
+	if err := g.HandleCallback(context.Background(), callback, nil); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+
+	if payment := loadPayment(t, "INV-1-20260110-ABCD"); payment.Status != "PAID" || payment.Method != "QRIS" {
+		t.Fatalf("unexpected payment: %+v", payment)
+	}
+	assertExpiresIn(t, loadPremium(t, "6285555555555", "lid-iska").Expired, 30)
+}
+
+func TestPaymentHistoryPagination(t *testing.T) {
+	resetDB(t)
+	base := time.Now().Add(-48 * time.Hour)
+	for i := 0; i < 23; i++ {
+		_, err := testDB.Exec(`
+			INSERT INTO payment_history (reference, merchant_ref, phone_number, customer_name, method, amount, status, order_items, created_at, updated_at)
+			VALUES ($1, $1, '6286666666666', 'Tester', 'QRIS', $2, 'UNPAID', '[]', $3, $3)
+		`, fmt.Sprintf("HIST-%02d", i), 1000+i, base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("failed to seed history: %v", err)
+		}
+	}
+	// Noise from another identity and from a group must not leak in
+	testDB.Exec(`INSERT INTO payment_history (reference, merchant_ref, phone_number, method, amount, status) VALUES ('OTHER-1', 'OTHER-1', '6287777777777', 'QRIS', 1, 'PAID')`)
+	testDB.Exec(`INSERT INTO payment_history (reference, merchant_ref, group_id, method, amount, status) VALUES ('GROUP-1', 'GROUP-1', '6286666666666', 'QRIS', 1, 'PAID')`)
+
+	type historyPage struct {
+		Success bool `json:"success"`
+		Data    struct {
+			History     []map[string]interface{} `json:"history"`
+			Page        int                      `json:"page"`
+			TotalCount  int                      `json:"totalCount"`
+			TotalPages  int                      `json:"totalPages"`
+			HasNext     bool                     `json:"hasNext"`
+			HasPrevious bool                     `json:"hasPrevious"`
+		} `json:"data"`
+	}
+
+	fetch := func(page int) historyPage {
+		body, _ := json.Marshal(map[string]interface{}{"identifier": "6286666666666", "type": "user", "page": page})
+		rec := httptest.NewRecorder()
+		paymentHistoryHandler(rec, httptest.NewRequest(http.MethodPost, "/api/payment-history", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("page %d: unexpected status %d: %s", page, rec.Code, rec.Body.String())
+		}
+		var resp historyPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("page %d: invalid JSON: %v", page, err)
+		}
+		return resp
+	}
+
+	first := fetch(1)
+	if first.Data.TotalCount != 23 || first.Data.TotalPages != 3 || !first.Data.HasNext || first.Data.HasPrevious {
+		t.Fatalf("unexpected first page metadata: %+v", first.Data)
+	}
+	if len(first.Data.History) != 10 || first.Data.History[0]["reference"] != "HIST-22" {
+		t.Fatalf("expected newest first, got %v", first.Data.History[0]["reference"])
+	}
+
+	last := fetch(3)
+	if len(last.Data.History) != 3 || last.Data.HasNext || !last.Data.HasPrevious {
+		t.Fatalf("unexpected last page: %d rows, %+v", len(last.Data.History), last.Data)
+	}
+	if last.Data.History[2]["reference"] != "HIST-00" {
+		t.Fatalf("expected oldest row last, got %v", last.Data.History[2]["reference"])
+	}
+
+	// Page numbers below 1 are clamped to the first page
+	if clamped := fetch(0); clamped.Data.Page != 1 {
+		t.Fatalf("expected page 0 to clamp to 1, got %d", clamped.Data.Page)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// invoicePrefix starts every invoice number
+const invoicePrefix = "SHR"
+
+// invoicePeriod returns the numbering period of a payment paid at paidAt.
+// Numbers restart every month, in WIB.
+func invoicePeriod(paidAt time.Time) string {
+	return paidAt.In(wib).Format("2006/01")
+}
+
+// formatInvoiceNumber returns the n-th invoice number of period, e.g.
+// SHR/2026/10/000123
+func formatInvoiceNumber(period string, n int) string {
+	return fmt.Sprintf("%s/%s/%06d", invoicePrefix, period, n)
+}
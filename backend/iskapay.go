@@ -1,11 +1,12 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -16,7 +17,7 @@ import (
 type IskapayGateway struct {
 	APIKey string
 	APIURL string
-	db     *sql.DB
+	store  Store
 }
 
 // NewIskapayGateway creates a new Iskapay gateway instance
@@ -34,14 +35,22 @@ func (g *IskapayGateway) GetName() string {
 	return "iskapay"
 }
 
-// Initialize sets up the gateway with database connection
-func (g *IskapayGateway) Initialize(db *sql.DB) {
-	g.db = db
+// Initialize sets up the gateway with its storage
+func (g *IskapayGateway) Initialize(store Store) {
+	g.store = store
+}
+
+// HealthCheck reports a missing API key or an unreachable Iskapay API
+func (g *IskapayGateway) HealthCheck(ctx context.Context) error {
+	if g.APIKey == "" {
+		return fmt.Errorf("iskapay API key is not configured")
+	}
+	return probeGateway(ctx, g.GetName(), g.APIURL)
 }
 
 // GetPaymentChannels returns empty for Iskapay as it only supports QRIS
 // No need to list payment methods since it's QRIS-only
-func (g *IskapayGateway) GetPaymentChannels() (interface{}, error) {
+func (g *IskapayGateway) GetPaymentChannels(ctx context.Context) (interface{}, error) {
 	// Iskapay only supports QRIS, so we return a fixed structure
 	return []map[string]interface{}{
 		{
@@ -55,14 +64,14 @@ func (g *IskapayGateway) GetPaymentChannels() (interface{}, error) {
 }
 
 // CreateTransaction creates a new QRIS payment transaction with Iskapay
-func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interface{}, error) {
+func (g *IskapayGateway) CreateTransaction(ctx context.Context, req CreateTransactionRequest) (interface{}, error) {
 	// Validate required fields
 	if req.Amount == 0 || req.OrderItems == nil {
 		return nil, fmt.Errorf("missing required fields")
 	}
 
-	// Require either phone or group ID
-	if req.CustomerPhone == "" && req.GroupID == "" {
+	// Require either phone or group ID; donors may stay anonymous
+	if req.CustomerPhone == "" && req.GroupID == "" && req.Product != productDonation {
 		return nil, fmt.Errorf("either phone number or group ID is required")
 	}
 
@@ -82,6 +91,14 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 		customerPhone = req.GroupID
 	}
 
+	// Without an address from the customer, generate one from the phone
+	customerEmail := req.CustomerEmail
+	if customerEmail == "" && customerPhone == "" {
+		customerEmail = "donatur@shiroine.web.id"
+	} else if customerEmail == "" {
+		customerEmail = fmt.Sprintf("%s@shiroine.web.id", customerPhone)
+	}
+
 	// Generate description from order items
 	description := "Premium subscription"
 	if req.OrderItems != nil {
@@ -107,7 +124,7 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 	transactionData := map[string]interface{}{
 		"amount":         req.Amount,
 		"customer_name":  customerName,
-		"customer_email": fmt.Sprintf("%s@shiroine.web.id", customerPhone), // Generate email from phone
+		"customer_email": customerEmail,
 		"customer_phone": customerPhone,
 		"description":    description,
 		"callback_url":   callbackURL,
@@ -119,8 +136,8 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 	}
 
 	// Create transaction with Iskapay
-	client := &http.Client{Timeout: 30 * time.Second}
-	httpReq, err := http.NewRequest("POST", g.APIURL+"/payments", strings.NewReader(string(jsonData)))
+	client := newGatewayClient("iskapay", "create_transaction")
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", g.APIURL+"/payments", strings.NewReader(string(jsonData)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -151,7 +168,7 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 		if msg, ok := result["message"].(string); ok {
 			message = msg
 		}
-		return nil, fmt.Errorf(message)
+		return nil, errors.New(message)
 	}
 
 	if data, ok := result["data"].(map[string]interface{}); ok {
@@ -161,35 +178,15 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 			merchantOrderID = id
 		}
 
-		// Save to payment_history table
-		if g.db != nil && merchantOrderID != "" {
-			orderItemsJSON, _ := json.Marshal(req.OrderItems)
-			var phoneNumber, groupID sql.NullString
-			if req.CustomerPhone != "" {
-				phoneNumber = sql.NullString{String: req.CustomerPhone, Valid: true}
-			}
-			if req.GroupID != "" {
-				groupID = sql.NullString{String: req.GroupID, Valid: true}
-			}
+		tagPaymentReference(ctx, merchantOrderID)
 
-			_, err := g.db.Exec(`
-				INSERT INTO payment_history 
-				(reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status, order_items, created_at)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-			`,
-				merchantOrderID,
-				merchantOrderID,
-				phoneNumber,
-				groupID,
-				customerName,
-				"QRIS",
-				req.Amount,
-				"UNPAID",
-				orderItemsJSON,
-				time.Now(),
-			)
-			if err != nil {
-				log.Printf("Failed to save transaction to database: %v", err)
+		// Save to payment_history table
+		if g.store != nil && merchantOrderID != "" {
+			record := newPaymentRecord(req, g.GetName(), merchantOrderID, merchantOrderID, "QRIS", req.Amount)
+			if err := g.store.CreatePayment(ctx, record); err != nil {
+				// Iskapay has no cancel API; left unpaid the payment page expires
+				slog.ErrorContext(ctx, "failed to save transaction, abandoning it", "gateway", "iskapay", "merchant_order_id", merchantOrderID, "error", err)
+				return nil, fmt.Errorf("%w: %v", ErrPaymentNotRecorded, err)
 			}
 		}
 
@@ -218,19 +215,19 @@ func (g *IskapayGateway) CreateTransaction(req CreateTransactionRequest) (interf
 	if msg, ok := result["message"].(string); ok {
 		message = msg
 	}
-	return nil, fmt.Errorf(message)
+	return nil, errors.New(message)
 }
 
 // GetTransactionStatus retrieves the status of a transaction
 // Based on the problem statement: GET /payments/{merchant_order_id}
-func (g *IskapayGateway) GetTransactionStatus(orderId string) (interface{}, error) {
+func (g *IskapayGateway) GetTransactionStatus(ctx context.Context, orderId string) (interface{}, error) {
 	if g.APIKey == "" {
 		return nil, fmt.Errorf("payment gateway not configured")
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newGatewayClient("iskapay", "transaction_status")
 	url := fmt.Sprintf("%s/payments/%s", g.APIURL, orderId)
-	httpReq, err := http.NewRequest("GET", url, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -259,8 +256,12 @@ func (g *IskapayGateway) GetTransactionStatus(orderId string) (interface{}, erro
 	}
 
 	if data, ok := result["data"].(map[string]interface{}); ok {
+		if g.store != nil {
+			recordPaymentFees(ctx, g.store, orderId, iskapayFees(data))
+		}
+
 		// Update transaction status in database
-		if g.db != nil && data["status"] != nil {
+		if g.store != nil && data["status"] != nil {
 			status := data["status"].(string)
 			
 			// Map Iskapay status to our internal status
@@ -279,47 +280,28 @@ func (g *IskapayGateway) GetTransactionStatus(orderId string) (interface{}, erro
 			}
 
 			// Check current status in database before updating
-			var currentStatus string
-			err := g.db.QueryRow(`
-				SELECT status FROM payment_history 
-				WHERE reference = $1 OR merchant_ref = $1
-			`, orderId).Scan(&currentStatus)
+			payment, err := g.store.GetPayment(ctx, orderId)
 
 			// Handle missing record or status change
-			if err == sql.ErrNoRows {
+			if err == ErrPaymentNotFound {
 				// Payment record doesn't exist in DB yet - this shouldn't happen
 				// but we'll log it and skip the update
-				log.Printf("Warning: Payment record not found in database for merchant_order_id=%s", orderId)
+				slog.WarnContext(ctx, "payment record not found", "gateway", "iskapay", "merchant_order_id", orderId)
 			} else if err != nil {
 				// Database error - log it
-				log.Printf("Failed to check current payment status: %v", err)
-			} else if currentStatus != dbStatus {
-				// Status has changed - update and trigger activation if needed
-				now := time.Now()
-				var paidAt interface{}
-				if dbStatus == "PAID" {
-					paidAt = now
-				} else {
-					paidAt = nil
+				slog.ErrorContext(ctx, "failed to check current payment status", "gateway", "iskapay", "merchant_order_id", orderId, "error", err)
+			} else if payment.Status != dbStatus && dbStatus == "PAID" {
+				// Trigger premium activation for PAID status (since Iskapay has no callback)
+				slog.InfoContext(ctx, "payment completed (detected via status check)", "gateway", "iskapay", "merchant_order_id", orderId)
+				if err := completePayment(ctx, g.store, orderId, time.Now()); err != nil {
+					slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "iskapay", "merchant_order_id", orderId, "error", err)
 				}
-
-				_, err := g.db.Exec(`
-					UPDATE payment_history 
-					SET status = $1, paid_at = $2, updated_at = $3
-					WHERE reference = $4 OR merchant_ref = $4
-				`, dbStatus, paidAt, now, orderId)
-				if err != nil {
-					log.Printf("Failed to update transaction status: %v", err)
+			} else if payment.Status != dbStatus {
+				// Status has changed - update without touching paid_at
+				if err := setPaymentStatus(ctx, g.store, orderId, dbStatus); err != nil {
+					slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "iskapay", "merchant_order_id", orderId, "error", err)
 				} else {
-					log.Printf("Iskapay status updated: merchant_order_id=%s, status=%s (was %s)", orderId, dbStatus, currentStatus)
-				}
-
-				// Trigger premium activation for PAID status (since Iskapay has no callback)
-				if dbStatus == "PAID" {
-					log.Printf("Payment completed for merchant_order_id: %s (detected via status check)", orderId)
-					if err := activatePremium(g.db, orderId); err != nil {
-						log.Printf("Failed to activate premium: %v", err)
-					}
+					slog.InfoContext(ctx, "payment status updated", "gateway", "iskapay", "merchant_order_id", orderId, "status", dbStatus, "previous_status", payment.Status)
 				}
 			}
 		}
@@ -330,6 +312,17 @@ func (g *IskapayGateway) GetTransactionStatus(orderId string) (interface{}, erro
 	return nil, fmt.Errorf("transaction not found")
 }
 
+// iskapayFees reads the fee of a payment, when Iskapay reports one. The
+// customer pays the amount and the fee is deducted from the settlement.
+func iskapayFees(data map[string]interface{}) *PaymentFees {
+	amount, okAmount := jsonInt(data, "amount")
+	fee, okFee := jsonInt(data, "fee")
+	if !okAmount || !okFee {
+		return nil
+	}
+	return newPaymentFees(amount, fee, 0)
+}
+
 // HandleCallback processes payment callback from Iskapay
 // Callback format:
 // {
@@ -346,7 +339,7 @@ func (g *IskapayGateway) GetTransactionStatus(orderId string) (interface{}, erro
 //   "timestamp": "2025-01-12T09:30:05Z",
 //   "signature": "abc123def456..."
 // }
-func (g *IskapayGateway) HandleCallback(payload []byte, headers map[string]string) error {
+func (g *IskapayGateway) HandleCallback(ctx context.Context, payload []byte, headers map[string]string) error {
 	var callbackPayload map[string]interface{}
 	if err := json.Unmarshal(payload, &callbackPayload); err != nil {
 		return fmt.Errorf("invalid JSON payload: %v", err)
@@ -365,16 +358,20 @@ func (g *IskapayGateway) HandleCallback(payload []byte, headers map[string]strin
 	amount, _ := paymentData["amount"].(float64)
 	paidAtStr, _ := paymentData["paid_at"].(string)
 
-	log.Printf("Iskapay Callback: event=%s, merchant_order_id=%s, status=%s, amount=%.0f, timestamp=%s",
-		event, merchantOrderID, paymentStatus, amount, time.Now().Format(time.RFC3339))
+	slog.InfoContext(ctx, "callback received", "gateway", "iskapay",
+		"event", event, "merchant_order_id", merchantOrderID, "status", paymentStatus, "amount", amount)
 
 	if merchantOrderID == "" {
 		return fmt.Errorf("merchant_order_id not found in callback")
 	}
+	tagPaymentReference(ctx, merchantOrderID)
+
+	// The callback signature is not verified, so fees are only recorded
+	// from the transaction status API in GetTransactionStatus
 
 	// Process based on event type or status
 	if event == "payment.completed" || paymentStatus == "paid" || paymentStatus == "completed" {
-		log.Printf("Payment completed for merchant_order_id: %s", merchantOrderID)
+		slog.InfoContext(ctx, "payment completed", "gateway", "iskapay", "merchant_order_id", merchantOrderID)
 
 		// Parse paid_at timestamp if available
 		var paidAt time.Time
@@ -389,67 +386,42 @@ func (g *IskapayGateway) HandleCallback(payload []byte, headers map[string]strin
 			paidAt = time.Now()
 		}
 
-		// Update payment_history table
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, paid_at = $2, updated_at = $3
-				WHERE reference = $4 OR merchant_ref = $4
-			`, "PAID", paidAt, time.Now(), merchantOrderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
-			}
-
-			// Activate premium
-			if err := activatePremium(g.db, merchantOrderID); err != nil {
-				log.Printf("Failed to activate premium: %v", err)
+		// Update payment_history table and activate premium
+		if g.store != nil {
+			if err := completePayment(ctx, g.store, merchantOrderID, paidAt); err != nil {
+				return err
 			}
 		}
 
 	} else if event == "payment.failed" || paymentStatus == "failed" {
-		log.Printf("Payment failed for merchant_order_id: %s", merchantOrderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "FAILED", time.Now(), merchantOrderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment failed", "gateway", "iskapay", "merchant_order_id", merchantOrderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, merchantOrderID, "FAILED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "iskapay", "merchant_order_id", merchantOrderID, "error", err)
 			}
 		}
 
 	} else if event == "payment.expired" || paymentStatus == "expired" {
-		log.Printf("Payment expired for merchant_order_id: %s", merchantOrderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "EXPIRED", time.Now(), merchantOrderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment expired", "gateway", "iskapay", "merchant_order_id", merchantOrderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, merchantOrderID, "EXPIRED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "iskapay", "merchant_order_id", merchantOrderID, "error", err)
 			}
 		}
 
 	} else if event == "payment.cancelled" || paymentStatus == "cancelled" {
-		log.Printf("Payment cancelled for merchant_order_id: %s", merchantOrderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "CANCELLED", time.Now(), merchantOrderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment cancelled", "gateway", "iskapay", "merchant_order_id", merchantOrderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, merchantOrderID, "CANCELLED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "iskapay", "merchant_order_id", merchantOrderID, "error", err)
 			}
 		}
 
 	} else {
-		log.Printf("Unknown event type or status: event=%s, status=%s for merchant_order_id: %s", event, paymentStatus, merchantOrderID)
+		slog.WarnContext(ctx, "unknown callback event or status", "gateway", "iskapay", "event", event, "status", paymentStatus, "merchant_order_id", merchantOrderID)
 	}
 
 	return nil
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the correlation ID on requests, responses and
+// upstream gateway calls
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID returns a context carrying a request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random 16-byte hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware reuses a well-formed incoming X-Request-ID or assigns
+// a new one, echoes it on the response and stores it in the request context
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// accessLogMiddleware logs one line per request. It must run inside
+// routeMiddleware and requestIDMiddleware.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if isInfrastructureRoute(routeFromRequest(r)) {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request completed",
+			"method", r.Method,
+			"route", routeFromRequest(r),
+			"status", rec.status,
+			"client_ip", getIP(r),
+			"duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+// setupLogging installs the default slog logger. LOG_LEVEL is one of debug,
+// info (default), warn or error; LOG_FORMAT is json (default) or text.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(&redactingHandler{next: handler}))
+}
+
+// Attribute keys whose values are always masked
+var (
+	secretKeys = map[string]bool{"api_key": true, "private_key": true, "signature": true, "token": true}
+	piiKeys    = map[string]bool{"phone": true, "phone_number": true, "customer_phone": true, "group_id": true, "jid": true, "lid": true, "name": true, "customer_name": true, "identifier": true}
+)
+
+var (
+	secretParamPattern = regexp.MustCompile(`(?i)\b(api_key|apikey|private_key|signature|token)=([^&\s"']+)`)
+	phonePattern       = regexp.MustCompile(`\+?\b(?:62|0)8\d{7,12}\b`)
+)
+
+// redactingHandler masks phone numbers, names and credentials before records
+// reach the underlying handler, and tags every record with the request ID
+// and trace found in its context
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, redactString(record.Message), record.PC)
+	if id := requestIDFrom(ctx); id != "" {
+		redacted.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		redacted.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr masks an attribute by key, or scrubs its string value
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case secretKeys[key]:
+		return slog.String(a.Key, "[REDACTED]")
+	case piiKeys[key]:
+		return slog.String(a.Key, maskValue(a.Value.String()))
+	case a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case a.Value.Kind() == slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactString(err.Error()))
+		}
+	}
+	return a
+}
+
+// redactString strips credentials from URLs and masks phone-number-like digit runs
+func redactString(s string) string {
+	s = secretParamPattern.ReplaceAllString(s, "$1=[REDACTED]")
+	return phonePattern.ReplaceAllStringFunc(s, maskValue)
+}
+
+// maskValue keeps just enough of a value to correlate log lines:
+// 628123456789 becomes 6281*****789 and Budi becomes B***
+func maskValue(s string) string {
+	if s == "" {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= 7 {
+		return string(runes[0]) + "***"
+	}
+	return string(runes[:4]) + strings.Repeat("*", len(runes)-7) + string(runes[len(runes)-3:])
+}
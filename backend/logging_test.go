@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandlerMasksPIIAndSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&redactingHandler{next: slog.NewJSONHandler(&buf, nil)})
+
+	ctx := withRequestID(context.Background(), "req-123")
+	logger.InfoContext(ctx, "payment for 6281234567890 received",
+		"phone", "6281234567890",
+		"name", "Budi Santoso",
+		"identifier", "120363012345678901@g.us",
+		"reference", "PREMIUM-1760000000000-abc1234",
+		"error", errors.New(`Get "https://app.pakasir.com/api/transactiondetail?project=shiroine&api_key=sk_live_123": timeout`))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON log line: %v", err)
+	}
+
+	out := buf.String()
+	for _, leaked := range []string{"6281234567890", "Budi Santoso", "120363012345678901", "sk_live_123"} {
+		if strings.Contains(out, leaked) {
+			t.Fatalf("log line leaked %q: %s", leaked, out)
+		}
+	}
+	if entry["request_id"] != "req-123" {
+		t.Fatalf("expected request_id from context, got %v", entry["request_id"])
+	}
+	if entry["reference"] != "PREMIUM-1760000000000-abc1234" {
+		t.Fatalf("expected reference to be left alone, got %v", entry["reference"])
+	}
+	if entry["phone"] != "6281******890" {
+		t.Fatalf("expected masked phone, got %v", entry["phone"])
+	}
+}
+
+func TestRequestIDPropagatesToGatewayAndSpool(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestIDHeader)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": []interface{}{}})
+	}))
+	defer upstream.Close()
+
+	previous := paymentGateway
+	paymentGateway = &TripayGateway{APIKey: "key", APIURL: upstream.URL}
+	t.Cleanup(func() { paymentGateway = previous })
+	handler := requestIDMiddleware(http.HandlerFunc(getPaymentChannelsHandler))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/payment-channels", nil)
+	req.Header.Set(requestIDHeader, "trace-abc")
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get(requestIDHeader) != "trace-abc" || upstreamID != "trace-abc" {
+		t.Fatalf("expected request ID to reach response and upstream, got %q and %q", rec.Header().Get(requestIDHeader), upstreamID)
+	}
+
+	spool := NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), defaultSpoolMaxBytes)
+	spool.Append(withRequestID(context.Background(), "trace-abc"), "tripay", []byte(`{}`), nil)
+	spool.Replay("tripay", func(ctx context.Context, payload []byte, headers map[string]string) error {
+		if id := requestIDFrom(ctx); id != "trace-abc" {
+			t.Fatalf("expected replay to carry the original request ID, got %q", id)
+		}
+		return nil
+	}, NewMemoryStore().Ping)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPPort = "587"
+	smtpTimeout     = 30 * time.Second
+	maxEmailLength  = 254
+)
+
+// ErrEmailInvalid rejects a customer email that is not a plain address. The
+// message is shown to customers.
+var ErrEmailInvalid = errors.New("email address is not valid")
+
+// normalizeCustomerEmail checks an optional customer email and returns it
+// trimmed with a lowercase domain, or "" when none was given
+func normalizeCustomerEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw || len(raw) > maxEmailLength {
+		return "", ErrEmailInvalid
+	}
+	at := strings.LastIndex(raw, "@")
+	domain := strings.ToLower(raw[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrEmailInvalid
+	}
+	return raw[:at+1] + domain, nil
+}
+
+// EmailMessage is a rendered email with plain text and HTML alternatives
+type EmailMessage struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []EmailAttachment
+}
+
+// EmailAttachment is a file attached to an email
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// SMTPMailer sends email through an SMTP relay. STARTTLS is used whenever
+// the server offers it; port 465 speaks TLS from the start.
+type SMTPMailer struct {
+	host string
+	port string
+	from mail.Address
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer for the relay at host:port. Credentials
+// are optional; net/smtp refuses to send them unencrypted except to localhost.
+func NewSMTPMailer(host, port, username, password string, from mail.Address) *SMTPMailer {
+	m := &SMTPMailer{host: host, port: port, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// NewSMTPMailerFromEnv creates a mailer configured by SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM. It returns nil when SMTP_HOST
+// is not set.
+func NewSMTPMailerFromEnv() (*SMTPMailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = defaultSMTPPort
+	}
+
+	rawFrom := os.Getenv("SMTP_FROM")
+	if rawFrom == "" {
+		domain := os.Getenv("DOMAIN")
+		if domain == "" {
+			domain = "shiroine.my.id"
+		}
+		rawFrom = fmt.Sprintf("Shiroine <noreply@%s>", domain)
+	}
+	from, err := mail.ParseAddress(rawFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM %q: %v", rawFrom, err)
+	}
+
+	return NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), *from), nil
+}
+
+// Send delivers msg, giving up when ctx is done or after smtpTimeout
+func (m *SMTPMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	body, err := m.build(msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(m.host, m.port)
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if m.port == "465" {
+		conn = tls.Client(conn, &tls.Config{ServerName: m.host})
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return fmt.Errorf("smtp handshake failed: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && m.port != "465" {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return fmt.Errorf("smtp starttls failed: %v", err)
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return fmt.Errorf("smtp auth failed: %v", err)
+		}
+	}
+	if err := c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// isPermanentSMTPError reports whether the relay rejected a message for
+// good (a 5xx reply), so retrying cannot help
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+// build encodes msg as a MIME message: the text and HTML bodies as
+// alternatives, followed by any attachments
+func (m *SMTPMailer) build(msg *EmailMessage, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	header("From", m.from.String())
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain))
+	header("MIME-Version", "1.0")
+
+	alternative, err := encodeAlternative(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Attachments) == 0 {
+		header("Content-Type", alternative.contentType)
+		buf.WriteString("\r\n")
+		buf.Write(alternative.body)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {alternative.contentType}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(alternative.body)
+
+	for _, a := range msg.Attachments {
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64Lines(part, a.Data)
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mimePart is an encoded body part and its Content-Type
+type mimePart struct {
+	contentType string
+	body        []byte
+}
+
+// encodeAlternative encodes the text and HTML bodies of msg as a
+// multipart/alternative part, plain text first as RFC 2046 asks
+func encodeAlternative(msg *EmailMessage) (mimePart, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, body := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		if body.content == "" {
+			continue
+		}
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return mimePart{}, err
+		}
+		qp := quotedprintable.NewWriter(part)
+		qp.Write([]byte(body.content))
+		qp.Close()
+	}
+	if err := w.Close(); err != nil {
+		return mimePart{}, err
+	}
+	return mimePart{contentType: "multipart/alternative; boundary=" + w.Boundary(), body: buf.Bytes()}, nil
+}
+
+// writeBase64Lines writes data base64 encoded in 76 character lines
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
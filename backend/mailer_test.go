@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is a local SMTP server keeping every message it accepts. While
+// reject is set, MAIL FROM is answered with that reply instead.
+type smtpSink struct {
+	addr     string
+	mu       sync.Mutex
+	messages []sinkMessage
+	reject   string
+}
+
+type sinkMessage struct {
+	from, to string
+	data     []byte
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &smtpSink{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 sink ready")
+
+	var msg sinkMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO", "RSET", "NOOP":
+			c.PrintfLine("250 sink")
+		case "MAIL":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject != "" {
+				c.PrintfLine("%s", reject)
+				continue
+			}
+			msg = sinkMessage{from: line}
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = data
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) setReject(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reply
+}
+
+func (s *smtpSink) received() []sinkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sinkMessage(nil), s.messages...)
+}
+
+func (s *smtpSink) mailer() *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.addr)
+	return NewSMTPMailer(host, port, "", "", mail.Address{Name: "Shiroine", Address: "noreply@shiroine.my.id"})
+}
+
+// parsedEmail is a received message split into its parts
+type parsedEmail struct {
+	subject     string
+	text, html  string
+	attachments map[string][]byte
+}
+
+func parseEmail(t *testing.T, data []byte) parsedEmail {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse message: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	parsed := parsedEmail{subject: subject, attachments: make(map[string][]byte)}
+
+	var walk func(contentType string, body io.Reader)
+	walk = func(contentType string, body io.Reader) {
+		mediaType, params, _ := mime.ParseMediaType(contentType)
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return
+		}
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextPart()
+			if err != nil {
+				return
+			}
+			content, _ := io.ReadAll(part)
+			partType := part.Header.Get("Content-Type")
+			switch {
+			case strings.HasPrefix(partType, "multipart/"):
+				walk(partType, bytes.NewReader(content))
+			case part.FileName() != "":
+				decoded, _ := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(content), "\r\n", ""))
+				parsed.attachments[part.FileName()] = decoded
+			case strings.HasPrefix(partType, "text/plain"):
+				parsed.text = string(content)
+			case strings.HasPrefix(partType, "text/html"):
+				parsed.html = string(content)
+			}
+		}
+	}
+	walk(msg.Header.Get("Content-Type"), msg.Body)
+	return parsed
+}
+
+func TestNormalizeCustomerEmail(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":                     "",
+		"  ":                   "",
+		"budi@example.com":     "budi@example.com",
+		" Budi@Example.COM ":   "Budi@example.com",
+		"budi+premium@mail.id": "budi+premium@mail.id",
+	} {
+		got, err := normalizeCustomerEmail(raw)
+		if err != nil || got != want {
+			t.Errorf("normalizeCustomerEmail(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"budi", "budi@localhost", "Budi <budi@example.com>", "budi@example.com\r\nBcc: x@y.z", "a@b.", strings.Repeat("a", 250) + "@example.com"} {
+		if _, err := normalizeCustomerEmail(raw); err != ErrEmailInvalid {
+			t.Errorf("expected %q to be rejected, got %v", raw, err)
+		}
+	}
+}
+
+func TestCreateTransactionStoresCustomerEmail(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	paymentGateway = newTripayTestGateway(t, "T-EMAIL-1")
+
+	invalid := postCreateTransaction(t, "", `{"method":"QRIS","amount":20000,"customerPhone":"6281234567890","customerEmail":"not-an-email","orderItems":[{"name":"User Premium 30 Days","price":20000,"quantity":1}]}`)
+	if invalid.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid email, got %d: %s", invalid.Code, invalid.Body.String())
+	}
+
+	rec := postCreateTransaction(t, "", `{"method":"QRIS","amount":20000,"customerPhone":"6281234567890","customerEmail":" Budi@Example.COM ","orderItems":[{"name":"User Premium 30 Days","price":20000,"quantity":1}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if p, err := memory.GetPayment(context.Background(), "T-EMAIL-1"); err != nil || p.CustomerEmail != "Budi@example.com" {
+		t.Fatalf("expected the normalized email to be stored, got %+v, %v", p, err)
+	}
+}
+
+func TestSMTPMailerSendsMultipartMessage(t *testing.T) {
+	sink := newSMTPSink(t)
+	err := sink.mailer().Send(context.Background(), &EmailMessage{
+		To:          "budi@example.com",
+		Subject:     "Kuitansi Šhiroine",
+		Text:        "Halo Budi, terima kasih.",
+		HTML:        "<p>Halo <strong>Budi</strong>, terima kasih.</p>",
+		Attachments: []EmailAttachment{{Filename: "receipt.pdf", ContentType: "application/pdf", Data: bytes.Repeat([]byte("%PDF-"), 40)}},
+	})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	received := sink.received()
+	if len(received) != 1 || received[0].to != "budi@example.com" {
+		t.Fatalf("expected one message to budi@example.com, got %+v", received)
+	}
+	email := parseEmail(t, received[0].data)
+	if email.subject != "Kuitansi Šhiroine" || email.text != "Halo Budi, terima kasih." || !strings.Contains(email.html, "<strong>Budi</strong>") {
+		t.Fatalf("unexpected message: %+v", email)
+	}
+	if !bytes.Equal(email.attachments["receipt.pdf"], bytes.Repeat([]byte("%PDF-"), 40)) {
+		t.Fatalf("expected the attachment to survive encoding, got %q", email.attachments["receipt.pdf"])
+	}
+}
+
+func TestReceiptEmailedWhenPaid(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Budi")
+	receiptCache = &ReceiptCache{dir: t.TempDir()}
+	sink := newSMTPSink(t)
+	queue := NewMailQueue(memory, sink.mailer())
+	mailQueue = queue
+	t.Cleanup(func() { mailQueue = nil })
+	ctx := context.Background()
+
+	items, _ := json.Marshal(orderItems("User Premium 30 Days", 16000))
+	for _, p := range []*PaymentRecord{
+		{Reference: "T-MAIL-1", CustomerEmail: "budi@example.com", PromoCode: "HEMAT20", DiscountAmount: 4000},
+		{Reference: "T-MAIL-2"},
+	} {
+		p.MerchantRef, p.PhoneNumber, p.CustomerName, p.Method, p.Amount, p.Status, p.OrderItems =
+			p.Reference, "6281234567890", "Budi", "QRIS", 16000, "UNPAID", items
+		memory.CreatePayment(ctx, p)
+	}
+
+	now := time.Now()
+	for _, ref := range []string{"T-MAIL-1", "T-MAIL-2", "T-MAIL-1"} {
+		if err := completePayment(ctx, memory, ref, now); err != nil {
+			t.Fatalf("completePayment failed: %v", err)
+		}
+	}
+	now = time.Now()
+	if sent, err := queue.RunOnce(ctx, now); err != nil || sent != 1 {
+		t.Fatalf("RunOnce = %d, %v; want the one receipt with an email", sent, err)
+	}
+	if sent, _ := queue.RunOnce(ctx, now.Add(time.Hour)); sent != 0 {
+		t.Fatalf("expected the receipt to be sent once, got %d more", sent)
+	}
+
+	received := sink.received()
+	if len(received) != 1 || received[0].to != "budi@example.com" {
+		t.Fatalf("expected one receipt for budi@example.com, got %+v", received)
+	}
+	email := parseEmail(t, received[0].data)
+	paid, _ := memory.GetPayment(ctx, "T-MAIL-1")
+	if !strings.Contains(email.subject, paid.InvoiceNumber) || paid.InvoiceNumber == "" {
+		t.Fatalf("expected the invoice number %q in the subject, got %q", paid.InvoiceNumber, email.subject)
+	}
+	for _, want := range []string{"Rp 20.000", "HEMAT20", "-Rp 4.000", "Rp 16.000", "User Premium 30 Days"} {
+		if !strings.Contains(email.text, want) || !strings.Contains(email.html, want) {
+			t.Errorf("expected %q in both text and HTML bodies", want)
+		}
+	}
+	if pdf := email.attachments["receipt-T-MAIL-1.pdf"]; !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Fatalf("expected the PDF receipt attached, got %d bytes", len(pdf))
+	}
+
+	// Once fees are recorded the email shows them like the PDF does
+	paid.Fees = newPaymentFees(16112, 0, 112)
+	if data := newReceiptEmail(paid); data.Fee != "Rp 112" || data.Total != "Rp 16.112" {
+		t.Errorf("expected the customer fee and total paid, got %q and %q", data.Fee, data.Total)
+	}
+}
+
+func TestMailQueueRetriesWithBackoff(t *testing.T) {
+	memory := NewMemoryStore()
+	receiptCache = &ReceiptCache{dir: t.TempDir()}
+	sink := newSMTPSink(t)
+	queue := NewMailQueue(memory, sink.mailer())
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	for _, ref := range []string{"T-RETRY-1", "T-RETRY-2"} {
+		memory.CreatePayment(ctx, &PaymentRecord{Reference: ref, MerchantRef: ref, PhoneNumber: "6281234567890", CustomerEmail: "budi@example.com", Status: "UNPAID"})
+		memory.MarkPaymentPaid(ctx, ref, now)
+		p, _ := memory.GetPayment(ctx, ref)
+		queue.EnqueueReceipt(ctx, p)
+	}
+	now = time.Now()
+
+	sink.setReject("451 4.3.0 try again later")
+	if sent, err := queue.RunOnce(ctx, now); err != nil || sent != 0 {
+		t.Fatalf("RunOnce = %d, %v; want nothing sent", sent, err)
+	}
+	job, _ := memory.GetEmail(ctx, "receipt:T-RETRY-1")
+	if job.Status != EmailPending || job.Attempts != 1 || !job.NextAttempt.Equal(now.Add(time.Minute)) || !strings.Contains(job.LastError, "451") {
+		t.Fatalf("expected a retry in a minute, got %+v", job)
+	}
+
+	sink.setReject("")
+	if sent, _ := queue.RunOnce(ctx, now.Add(30*time.Second)); sent != 0 {
+		t.Fatalf("expected nothing due before the backoff, got %d", sent)
+	}
+	if sent, _ := queue.RunOnce(ctx, now.Add(time.Minute)); sent != 2 {
+		t.Fatalf("expected both emails once due, got %d", sent)
+	}
+	if job, _ := memory.GetEmail(ctx, "receipt:T-RETRY-1"); job.Status != EmailSent || job.SentAt == nil || job.LastError != "" {
+		t.Fatalf("expected the email sent, got %+v", job)
+	}
+
+	// A permanent rejection is not retried
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "T-RETRY-3", MerchantRef: "T-RETRY-3", PhoneNumber: "6281234567890", CustomerEmail: "gone@example.com", Status: "UNPAID"})
+	memory.MarkPaymentPaid(ctx, "T-RETRY-3", now)
+	p, _ := memory.GetPayment(ctx, "T-RETRY-3")
+	queue.EnqueueReceipt(ctx, p)
+	sink.setReject("550 5.1.1 mailbox unavailable")
+	queue.RunOnce(ctx, now.Add(time.Hour))
+	if job, _ := memory.GetEmail(ctx, "receipt:T-RETRY-3"); job.Status != EmailFailed {
+		t.Fatalf("expected the email given up on, got %+v", job)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		7:  time.Hour,
+		20: time.Hour,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestExpiryWarningEmailed(t *testing.T) {
+	memory := NewMemoryStore()
+	sink := newSMTPSink(t)
+	queue := NewMailQueue(memory, sink.mailer())
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	premium := func(jid string, expires time.Duration) {
+		memory.UpsertPremium(ctx, PremiumRecord{JID: jid, LID: "lid-" + jid, MaxSpecialLimit: 15, Expired: now.Add(expires), LastSpecialReset: now})
+	}
+	paid := func(ref, phone, recipient, email string) {
+		items, _ := json.Marshal(orderItems("User Premium 30 Days", 20000))
+		memory.CreatePayment(ctx, &PaymentRecord{Reference: ref, MerchantRef: ref, PhoneNumber: phone, RecipientPhone: recipient, CustomerName: "Budi",
+			CustomerEmail: email, Status: "UNPAID", OrderItems: items})
+		memory.MarkPaymentPaid(ctx, ref, now.Add(-29*24*time.Hour))
+	}
+	premium("6281111111111", 12*time.Hour)
+	paid("E-1", "6281111111111", "", "budi@example.com")
+	premium("6282222222222", 12*time.Hour)
+	paid("E-2", "6282222222222", "", "")
+	// The recipient of a gift did not give the payer's email
+	premium("6283333333333", 12*time.Hour)
+	paid("E-3", "6281111111111", "6283333333333", "budi@example.com")
+
+	bot := &recordingNotifier{}
+	s := NewRenewalScheduler(memory, renewalNotifiers{queue, bot}, []int{3, 1}, "https://shiroine.my.id")
+	if sent, err := s.RunOnce(ctx, now); err != nil || sent != 3 {
+		t.Fatalf("RunOnce = %d, %v; want 3 reminders", sent, err)
+	}
+	if sent, err := queue.RunOnce(ctx, time.Now()); err != nil || sent != 1 {
+		t.Fatalf("queue RunOnce = %d, %v; want one email", sent, err)
+	}
+
+	received := sink.received()
+	if len(received) != 1 || received[0].to != "budi@example.com" {
+		t.Fatalf("expected one warning for budi@example.com, got %+v", received)
+	}
+	email := parseEmail(t, received[0].data)
+	wantURL := "https://shiroine.my.id/checkout?phone=6281111111111&plan=user-1m"
+	if !strings.Contains(email.subject, "1 hari") || !strings.Contains(email.text, wantURL) || !strings.Contains(email.html, "plan=user-1m") {
+		t.Fatalf("unexpected warning: %+v", email)
+	}
+	if len(bot.notices) != 3 {
+		t.Fatalf("expected the bot to be reminded too, got %d", len(bot.notices))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	defaultMailInterval    = time.Minute
+	defaultMailMaxAttempts = 8
+	mailBatchSize          = 20
+	mailLease              = 5 * time.Minute
+	mailMaxRetryDelay      = time.Hour
+	mailWorkerName         = "email_outbox"
+)
+
+// mailQueue sends customer emails; nil while SMTP is not configured
+var mailQueue *MailQueue
+
+// MailQueue sends the emails in the store's outbox, retrying failures with
+// exponential backoff. Emails are queued in the same step that triggers
+// them, so one survives a restart or an SMTP outage.
+type MailQueue struct {
+	store       Store
+	mailer      *SMTPMailer
+	maxAttempts int
+}
+
+// NewMailQueue creates a queue sending through mailer
+func NewMailQueue(store Store, mailer *SMTPMailer) *MailQueue {
+	return &MailQueue{store: store, mailer: mailer, maxAttempts: defaultMailMaxAttempts}
+}
+
+// NewMailQueueFromEnv creates a queue for the SMTP relay configured in the
+// environment, or returns nil when there is none
+func NewMailQueueFromEnv(store Store) (*MailQueue, error) {
+	mailer, err := NewSMTPMailerFromEnv()
+	if err != nil || mailer == nil {
+		return nil, err
+	}
+	return NewMailQueue(store, mailer), nil
+}
+
+// mailInterval returns how often the queue looks for due emails
+func mailInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("EMAIL_QUEUE_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultMailInterval
+}
+
+// retryDelay is the wait after the given number of failed attempts: one
+// minute, doubling up to an hour
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < mailMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > mailMaxRetryDelay {
+		delay = mailMaxRetryDelay
+	}
+	return delay
+}
+
+// enqueue adds an email to the outbox; a key already queued is left alone
+func (q *MailQueue) enqueue(ctx context.Context, key, kind, to string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode email payload: %v", err)
+	}
+	queued, err := q.store.EnqueueEmail(ctx, EmailJob{Key: key, Kind: kind, To: to, Payload: data, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to queue email: %v", err)
+	}
+	if queued {
+		slog.InfoContext(ctx, "email queued", "key", key, "kind", kind)
+	}
+	return nil
+}
+
+// receiptPayload identifies the payment a receipt email is about
+type receiptPayload struct {
+	Reference string `json:"reference"`
+}
+
+// EnqueueReceipt queues the receipt of a PAID payment to its customer email
+func (q *MailQueue) EnqueueReceipt(ctx context.Context, payment *PaymentRecord) error {
+	if payment.CustomerEmail == "" {
+		return nil
+	}
+	return q.enqueue(ctx, "receipt:"+payment.Reference, emailKindReceipt, payment.CustomerEmail,
+		receiptPayload{Reference: payment.Reference})
+}
+
+// NotifyRenewal queues the expiry warning of n to whoever last bought the
+// plan, when they left an email. Gift recipients never gave one, so they
+// are reminded by the bot only.
+func (q *MailQueue) NotifyRenewal(ctx context.Context, n RenewalNotice) error {
+	payment, err := q.store.LatestPaidPayment(ctx, n.JID)
+	if err == ErrPaymentNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if payment.CustomerEmail == "" || payment.IsGift() {
+		return nil
+	}
+	key := fmt.Sprintf("expiry:%s:%s:%d:%d", n.JID, n.LID, n.Expired.Unix(), n.DaysLeft)
+	return q.enqueue(ctx, key, emailKindExpiry, payment.CustomerEmail, n)
+}
+
+// compose renders a queued job into a message
+func (q *MailQueue) compose(ctx context.Context, job EmailJob) (*EmailMessage, error) {
+	tmpl, ok := emailTemplates[job.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown email kind %q", job.Kind)
+	}
+
+	switch job.Kind {
+	case emailKindReceipt:
+		var payload receiptPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return nil, fmt.Errorf("invalid receipt payload: %v", err)
+		}
+		payment, err := q.store.GetPayment(ctx, payload.Reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load payment: %w", err)
+		}
+		msg, err := tmpl.render(job.To, newReceiptEmail(payment))
+		if err != nil {
+			return nil, err
+		}
+		pdf, err := cachedReceipt(ctx, payment)
+		if err != nil {
+			return nil, err
+		}
+		msg.Attachments = []EmailAttachment{{
+			Filename:    "receipt-" + payment.Reference + ".pdf",
+			ContentType: "application/pdf",
+			Data:        pdf,
+		}}
+		return msg, nil
+
+	case emailKindExpiry:
+		var notice RenewalNotice
+		if err := json.Unmarshal(job.Payload, &notice); err != nil {
+			return nil, fmt.Errorf("invalid expiry payload: %v", err)
+		}
+		data := expiryEmail{
+			CustomerName: "Pelanggan",
+			Plan:         "Premium",
+			DaysLeft:     notice.DaysLeft,
+			Expired:      notice.Expired.In(wib).Format("02 Jan 2006 15:04 MST"),
+			RenewalURL:   notice.RenewalURL,
+		}
+		if payment, err := q.store.LatestPaidPayment(ctx, notice.JID); err == nil {
+			data.CustomerName = payment.CustomerName
+			var items []map[string]interface{}
+			json.Unmarshal(payment.OrderItems, &items)
+			if plan := planNameFromOrderItems(items); plan != "" {
+				data.Plan = plan
+			}
+		}
+		return tmpl.render(job.To, data)
+	}
+	return nil, fmt.Errorf("unknown email kind %q", job.Kind)
+}
+
+// newReceiptEmail fills the receipt email of a PAID payment
+func newReceiptEmail(p *PaymentRecord) receiptEmail {
+	var items []map[string]interface{}
+	json.Unmarshal(p.OrderItems, &items)
+	plan := planNameFromOrderItems(items)
+	if plan == "" {
+		plan = "Premium"
+	}
+	paidAt := p.UpdatedAt
+	if p.PaidAt != nil {
+		paidAt = *p.PaidAt
+	}
+
+	data := receiptEmail{
+		CustomerName:  p.CustomerName,
+		InvoiceNumber: invoiceNumberOf(p),
+		Reference:     p.Reference,
+		Plan:          plan,
+		PaidAt:        paidAt.In(wib).Format("02 Jan 2006 15:04 MST"),
+		Method:        p.Method,
+		Price:         formatRupiah(p.Amount + p.DiscountAmount),
+	}
+	var total int
+	data.Fee, total = receiptTotals(p)
+	data.Total = formatRupiah(total)
+	if p.DiscountAmount > 0 {
+		data.Discount = formatRupiah(-p.DiscountAmount)
+		data.PromoCode = p.PromoCode
+	}
+	if p.IsGift() {
+		phone, groupID := p.Beneficiary()
+		data.GiftFor = phone + groupID
+	}
+	return data
+}
+
+// RunOnce sends the emails due at now and returns how many were sent
+func (q *MailQueue) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	jobs, err := q.store.ClaimEmails(ctx, now, now.Add(mailLease), mailBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim emails: %v", err)
+	}
+
+	sent := 0
+	for _, job := range jobs {
+		msg, err := q.compose(ctx, job)
+		if err == nil {
+			err = q.mailer.Send(ctx, msg)
+		}
+		if err == nil {
+			if err := q.store.CompleteEmail(ctx, job.Key, now); err != nil {
+				slog.ErrorContext(ctx, "failed to mark email sent", "key", job.Key, "error", err)
+			}
+			emailsTotal.WithLabelValues(job.Kind, "sent").Inc()
+			slog.InfoContext(ctx, "email sent", "key", job.Key, "kind", job.Kind, "attempt", job.Attempts)
+			sent++
+			continue
+		}
+
+		var retryAt *time.Time
+		outcome := "failed"
+		if job.Attempts < q.maxAttempts && !isPermanentSMTPError(err) && !errors.Is(err, ErrPaymentNotFound) {
+			next := now.Add(retryDelay(job.Attempts))
+			retryAt = &next
+			outcome = "retry"
+		}
+		emailsTotal.WithLabelValues(job.Kind, outcome).Inc()
+		slog.WarnContext(ctx, "failed to send email", "key", job.Key, "kind", job.Kind, "attempt", job.Attempts, "retry_at", retryAt, "error", err)
+		if err := q.store.FailEmail(ctx, job.Key, err.Error(), retryAt); err != nil {
+			slog.ErrorContext(ctx, "failed to record email failure", "key", job.Key, "error", err)
+		}
+	}
+	return sent, nil
+}
+
+// Run sends due emails on every interval tick while the store is
+// reachable. It never returns.
+func (q *MailQueue) Run(interval time.Duration) {
+	workers.Register(mailWorkerName, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		workers.Beat(mailWorkerName)
+
+		ctx := context.Background()
+		if err := q.store.Ping(ctx); err == nil {
+			if _, err := q.RunOnce(ctx, time.Now()); err != nil {
+				slog.Error("email queue run failed", "error", err)
+			}
+		}
+		<-ticker.C
+	}
+}
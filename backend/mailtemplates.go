@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Kinds of email the outbox sends
+const (
+	emailKindReceipt = "receipt"
+	emailKindExpiry  = "expiry"
+)
+
+// emailTemplate renders the subject, plain text and HTML of one kind of email
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// mustEmailTemplate parses the three parts of an email template
+func mustEmailTemplate(name, subject, text, html string) emailTemplate {
+	return emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name + ".subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + ".txt").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + ".html").Parse(emailLayout + html)),
+	}
+}
+
+// render fills the template with data
+func (t emailTemplate) render(to string, data interface{}) (*EmailMessage, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return nil, err
+	}
+	return &EmailMessage{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// receiptEmail is the data of the receipt email
+type receiptEmail struct {
+	CustomerName  string
+	InvoiceNumber string
+	Reference     string
+	Plan          string
+	PaidAt        string
+	Method        string
+	Price         string
+	Discount      string // empty without a promo code
+	PromoCode     string
+	Fee           string // "-" until the gateway reports its fees
+	Total         string
+	GiftFor       string // empty unless the plan was a gift
+}
+
+// expiryEmail is the data of the premium expiry warning
+type expiryEmail struct {
+	CustomerName string
+	Plan         string
+	DaysLeft     int
+	Expired      string
+	RenewalURL   string
+}
+
+// emailLayout wraps every HTML email; each template defines "content"
+const emailLayout = `<!DOCTYPE html>
+<html lang="id">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"></head>
+<body style="margin:0;padding:24px;background:#f4f4f5;font-family:Helvetica,Arial,sans-serif;color:#18181b">
+<table role="presentation" width="100%" style="max-width:560px;margin:0 auto;background:#ffffff;border-radius:8px;padding:24px">
+<tr><td>
+<h1 style="margin:0 0 16px;font-size:22px">Shiroine</h1>
+{{template "content" .}}
+<p style="margin-top:24px;font-size:12px;color:#71717a">Email ini dikirim otomatis, mohon tidak membalas. / This email was sent automatically, please do not reply.</p>
+</td></tr>
+</table>
+</body>
+</html>
+`
+
+var emailTemplates = map[string]emailTemplate{
+	emailKindReceipt: mustEmailTemplate(emailKindReceipt,
+		`Kuitansi {{.InvoiceNumber}} - {{.Plan}}`,
+		`Halo {{.CustomerName}},
+
+Terima kasih! Pembayaran Anda telah kami terima.
+Thank you! We have received your payment.
+
+No. Invoice : {{.InvoiceNumber}}
+Referensi   : {{.Reference}}
+Paket       : {{.Plan}}
+Dibayar     : {{.PaidAt}}
+Metode      : {{.Method}}
+{{- if .GiftFor}}
+Hadiah untuk: {{.GiftFor}}
+{{- end}}
+
+Harga       : {{.Price}}
+{{- if .Discount}}
+Diskon ({{.PromoCode}}): {{.Discount}}
+{{- end}}
+Biaya       : {{.Fee}}
+Total       : {{.Total}}
+
+Kuitansi PDF terlampir. / The PDF receipt is attached.
+`,
+		`{{define "content"}}
+<p>Halo {{.CustomerName}},</p>
+<p>Terima kasih! Pembayaran Anda telah kami terima.<br><span style="color:#71717a">Thank you! We have received your payment.</span></p>
+<table role="presentation" width="100%" style="border-collapse:collapse;font-size:14px">
+<tr><td style="padding:4px 0;color:#71717a">No. Invoice</td><td style="padding:4px 0;text-align:right"><strong>{{.InvoiceNumber}}</strong></td></tr>
+<tr><td style="padding:4px 0;color:#71717a">Referensi</td><td style="padding:4px 0;text-align:right">{{.Reference}}</td></tr>
+<tr><td style="padding:4px 0;color:#71717a">Paket</td><td style="padding:4px 0;text-align:right">{{.Plan}}</td></tr>
+<tr><td style="padding:4px 0;color:#71717a">Dibayar</td><td style="padding:4px 0;text-align:right">{{.PaidAt}}</td></tr>
+<tr><td style="padding:4px 0;color:#71717a">Metode</td><td style="padding:4px 0;text-align:right">{{.Method}}</td></tr>
+{{- if .GiftFor}}
+<tr><td style="padding:4px 0;color:#71717a">Hadiah untuk</td><td style="padding:4px 0;text-align:right">{{.GiftFor}}</td></tr>
+{{- end}}
+<tr><td style="padding:12px 0 4px;color:#71717a;border-top:1px solid #e4e4e7">Harga</td><td style="padding:12px 0 4px;text-align:right;border-top:1px solid #e4e4e7">{{.Price}}</td></tr>
+{{- if .Discount}}
+<tr><td style="padding:4px 0;color:#71717a">Diskon ({{.PromoCode}})</td><td style="padding:4px 0;text-align:right">{{.Discount}}</td></tr>
+{{- end}}
+<tr><td style="padding:4px 0;color:#71717a">Biaya</td><td style="padding:4px 0;text-align:right">{{.Fee}}</td></tr>
+<tr><td style="padding:4px 0"><strong>Total</strong></td><td style="padding:4px 0;text-align:right"><strong>{{.Total}}</strong></td></tr>
+</table>
+<p>Kuitansi PDF terlampir.<br><span style="color:#71717a">The PDF receipt is attached.</span></p>
+{{end}}`),
+
+	emailKindExpiry: mustEmailTemplate(emailKindExpiry,
+		`Premium Anda berakhir dalam {{.DaysLeft}} hari - Shiroine`,
+		`Halo {{.CustomerName}},
+
+Premium {{.Plan}} Anda akan berakhir dalam {{.DaysLeft}} hari, pada {{.Expired}}.
+Your {{.Plan}} premium expires in {{.DaysLeft}} day(s), on {{.Expired}}.
+
+Perpanjang sekarang / Renew now:
+{{.RenewalURL}}
+`,
+		`{{define "content"}}
+<p>Halo {{.CustomerName}},</p>
+<p>Premium <strong>{{.Plan}}</strong> Anda akan berakhir dalam <strong>{{.DaysLeft}} hari</strong>, pada {{.Expired}}.<br>
+<span style="color:#71717a">Your {{.Plan}} premium expires in {{.DaysLeft}} day(s), on {{.Expired}}.</span></p>
+<p style="margin:24px 0"><a href="{{.RenewalURL}}" style="background:#18181b;color:#ffffff;padding:12px 20px;border-radius:6px;text-decoration:none">Perpanjang / Renew</a></p>
+<p style="font-size:12px;color:#71717a">{{.RenewalURL}}</p>
+{{end}}`),
+}
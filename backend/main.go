@@ -1,26 +1,33 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
-	"golang.org/x/time/rate"
 )
 
 // Global variables
-var db *sql.DB
+var store Store
 var paymentGateway PaymentGateway
+var callbackSpool *CallbackSpool
+
+// Database reconnect backoff bounds
+const (
+	dbRetryInitialBackoff = time.Second
+	dbRetryMaxBackoff     = time.Minute
+)
 
 // Transaction record structure
 type TransactionRecord struct {
@@ -43,6 +50,27 @@ type CreateTransactionRequest struct {
 	GroupID       string      `json:"groupId"`
 	OrderItems    interface{} `json:"orderItems"`
 	ReturnURL     string      `json:"returnUrl"`
+	// ForceNew skips reusing a pending transaction for the same order
+	ForceNew bool `json:"forceNew"`
+	// PlanID names the plan when a promo code prices the order
+	PlanID    string `json:"planId"`
+	PromoCode string `json:"promoCode"`
+	// DiscountAmount is set by applyPromo, never by the client
+	DiscountAmount int `json:"-"`
+	// ReferralCode credits whoever referred the customer on their first purchase
+	ReferralCode string `json:"referralCode"`
+	// Recipient of a gift. CustomerPhone is then the payer; without a
+	// recipient the plan goes to CustomerPhone or GroupID.
+	RecipientPhone   string `json:"recipientPhone"`
+	RecipientGroupID string `json:"recipientGroupId"`
+	GiftMessage      string `json:"giftMessage"`
+	// CustomerEmail is optional; PAID receipts and expiry warnings go there
+	CustomerEmail string `json:"customerEmail"`
+	// Product is "premium" (the default) or "donation". A donation is any
+	// amount within bounds, optionally credited to a public name and message.
+	Product      string `json:"product"`
+	DonorName    string `json:"donorName"`
+	DonorMessage string `json:"donorMessage"`
 }
 
 // Response structures
@@ -53,51 +81,13 @@ type APIResponse struct {
 	Error   string      `json:"error,omitempty"`
 }
 
-// Rate limiter map with mutex for thread-safety
-var (
-	limiters   = make(map[string]*rate.Limiter)
-	limitersMu sync.RWMutex
-)
-
-// Rate limiter middleware
-func rateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getIP(r)
-
-		limitersMu.RLock()
-		limiter, exists := limiters[ip]
-		limitersMu.RUnlock()
-
-		if !exists {
-			limitersMu.Lock()
-			// Double-check after acquiring write lock
-			if limiter, exists = limiters[ip]; !exists {
-				// 100 requests per 15 minutes = ~0.111 requests per second
-				limiter = rate.NewLimiter(rate.Every(9*time.Second), 100)
-				limiters[ip] = limiter
-			}
-			limitersMu.Unlock()
-		}
-
-		if !limiter.Allow() {
-			respondJSON(w, http.StatusTooManyRequests, APIResponse{
-				Success: false,
-				Message: "Too many requests from this IP, please try again later.",
-			})
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// Get client IP address
-func getIP(r *http.Request) string {
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return strings.Split(forwarded, ",")[0]
+// isInfrastructureRoute reports whether route serves orchestrator probes or metrics
+func isInfrastructureRoute(route string) bool {
+	switch route {
+	case "/livez", "/readyz", "/metrics":
+		return true
 	}
-	return strings.Split(r.RemoteAddr, ":")[0]
+	return false
 }
 
 // Helper function to respond with JSON
@@ -131,7 +121,22 @@ func getPaymentChannelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	channels, err := paymentGateway.GetPaymentChannels()
+	// With ?amount= every channel carries the total the customer would pay
+	amount, err := channelAmount(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var channels interface{}
+	if channelCatalog != nil {
+		channels, err = channelCatalog.Channels(r.Context())
+	} else {
+		channels, err = paymentGateway.GetPaymentChannels(r.Context())
+	}
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -143,7 +148,7 @@ func getPaymentChannelsHandler(w http.ResponseWriter, r *http.Request) {
 
 	respondJSON(w, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    channels,
+		Data:    withChannelFees(channels, amount),
 	})
 }
 
@@ -158,6 +163,14 @@ func createTransactionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && !validIdempotencyKey(key) {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Idempotency-Key must be 1 to 255 printable ASCII characters",
+		})
+		return
+	}
+
 	if paymentGateway == nil {
 		respondJSON(w, http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -166,26 +179,177 @@ func createTransactionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paymentData, err := paymentGateway.CreateTransaction(req)
-	if err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
+	// Without storage the callback could never activate premium, so refuse
+	// before an upstream transaction exists that a customer could pay
+	if err := store.Ping(r.Context()); err != nil {
+		slog.WarnContext(r.Context(), "refusing to create transaction", "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
 			Success: false,
-			Message: err.Error(),
+			Message: "Payment service is temporarily unavailable, please try again later",
 		})
 		return
 	}
 
-	respondJSON(w, http.StatusOK, APIResponse{
+	// Retries of a request that carries an Idempotency-Key get the original
+	// transaction back instead of a second one
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if idempotencyKey != "" && !reserveIdempotencyKey(w, r, idempotencyKey, req) {
+		return
+	}
+
+	status, response := createTransaction(r.Context(), req)
+	if idempotencyKey != "" {
+		finishIdempotencyKey(r.Context(), idempotencyKey, status, response)
+	}
+	respondJSON(w, status, response)
+}
+
+// createTransaction creates req upstream and returns the response to send
+func createTransaction(ctx context.Context, req CreateTransactionRequest) (int, APIResponse) {
+	email, err := normalizeCustomerEmail(req.CustomerEmail)
+	if err != nil {
+		return http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+	req.CustomerEmail = email
+
+	if err := applyProduct(&req); err != nil {
+		return http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+
+	if isGiftRequest(req) {
+		if err := applyGift(ctx, store, &req); err != nil {
+			if isGiftRejection(err) {
+				return http.StatusBadRequest, APIResponse{
+					Success: false,
+					Message: err.Error(),
+				}
+			}
+			slog.ErrorContext(ctx, "failed to verify gift recipient", "error", err)
+			return http.StatusServiceUnavailable, APIResponse{
+				Success: false,
+				Message: "Payment service is temporarily unavailable, please try again later",
+			}
+		}
+	}
+
+	if req.PromoCode != "" {
+		if err := applyPromo(ctx, store, &req); err != nil {
+			if isPromoRejection(err) {
+				return http.StatusBadRequest, APIResponse{
+					Success: false,
+					Message: err.Error(),
+				}
+			}
+			slog.ErrorContext(ctx, "failed to apply promo code", "error", err)
+			return http.StatusServiceUnavailable, APIResponse{
+				Success: false,
+				Message: "Payment service is temporarily unavailable, please try again later",
+			}
+		}
+	}
+
+	if req.ReferralCode != "" {
+		if err := applyReferral(ctx, store, &req); err != nil {
+			if isReferralRejection(err) {
+				return http.StatusBadRequest, APIResponse{
+					Success: false,
+					Message: err.Error(),
+				}
+			}
+			slog.ErrorContext(ctx, "failed to check referral code", "error", err)
+			return http.StatusServiceUnavailable, APIResponse{
+				Success: false,
+				Message: "Payment service is temporarily unavailable, please try again later",
+			}
+		}
+	}
+
+	// Add the surcharge of the chosen channel, if it has one, after every
+	// discount so it is charged on what the customer actually pays
+	applyChannelFee(&req)
+	if channelCatalog != nil {
+		if err := channelCatalog.Check(paymentMethodOf(req), req.Amount); err != nil {
+			return http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	// Hand out the QR code or VA number the customer already has instead of
+	// a new one, unless they explicitly ask for a fresh transaction. Every
+	// donation is a new one.
+	if !req.ForceNew && req.Product == productPremium {
+		existing, err := findReusablePayment(ctx, store, paymentGateway.GetName(), req)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to look up pending transactions", "error", err)
+		} else if existing != nil {
+			tagPaymentReference(ctx, existing.Reference)
+			slog.InfoContext(ctx, "reusing pending transaction", "reference", existing.Reference)
+			data := reusedPaymentData(existing)
+			addQRISImageURL(data, existing.Reference)
+			return http.StatusOK, APIResponse{
+				Success: true,
+				Data:    data,
+				Message: "Pending transaction reused",
+			}
+		}
+	}
+
+	paymentData, err := paymentGateway.CreateTransaction(ctx, req)
+	if errors.Is(err, ErrPaymentNotRecorded) {
+		return http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Payment service is temporarily unavailable, please try again later",
+		}
+	}
+	if err != nil {
+		return http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "QRIS"
+	}
+	orderItems, _ := json.Marshal(req.OrderItems)
+	observePaymentEvent("created", orderItems, method)
+	if data, ok := paymentData.(map[string]interface{}); ok {
+		reference, _ := data["merchant_order_id"].(string)
+		// Never show a QR code that can't be paid or charges the wrong amount
+		if err := checkQRISPayment(ctx, data, reference); err != nil {
+			slog.ErrorContext(ctx, "gateway returned an invalid QRIS code", "reference", reference, "error", err)
+			if err := setPaymentStatus(ctx, store, reference, "FAILED"); err != nil {
+				slog.ErrorContext(ctx, "failed to mark payment failed", "reference", reference, "error", err)
+			}
+			return http.StatusBadGateway, APIResponse{
+				Success: false,
+				Message: "Payment gateway returned an invalid QRIS code, please try again",
+			}
+		}
+		addQRISImageURL(data, reference)
+	}
+
+	return http.StatusOK, APIResponse{
 		Success: true,
 		Data:    paymentData,
 		Message: "Transaction created successfully",
-	})
+	}
 }
 
 // Transaction status handler
 func transactionStatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract reference from URL path
 	reference := strings.TrimPrefix(r.URL.Path, "/api/transaction-status/")
+	tagPaymentReference(r.Context(), reference)
 
 	if paymentGateway == nil {
 		respondJSON(w, http.StatusInternalServerError, APIResponse{
@@ -195,7 +359,7 @@ func transactionStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := paymentGateway.GetTransactionStatus(reference)
+	data, err := paymentGateway.GetTransactionStatus(r.Context(), reference)
 	if err != nil {
 		respondJSON(w, http.StatusNotFound, APIResponse{
 			Success: false,
@@ -203,6 +367,9 @@ func transactionStatusHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	addPaymentFees(r.Context(), reference, data)
+	addQRISImageURL(data, reference)
+	addQRISMerchant(r.Context(), data)
 
 	respondJSON(w, http.StatusOK, APIResponse{
 		Success: true,
@@ -238,9 +405,22 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// While storage is down, keep the callback for replay instead of losing it
+	if err := store.Ping(r.Context()); err != nil {
+		spoolCallback(w, r, body, headers, err)
+		return
+	}
+
 	// Handle callback using the configured gateway
-	if err := paymentGateway.HandleCallback(body, headers); err != nil {
-		log.Printf("Callback error: %v", err)
+	if err := paymentGateway.HandleCallback(r.Context(), body, headers); err != nil {
+		if errors.Is(err, ErrStorageUnavailable) {
+			spoolCallback(w, r, body, headers, err)
+			return
+		}
+		if errors.Is(err, ErrInvalidSignature) {
+			callbackVerificationFailures.WithLabelValues(paymentGateway.GetName()).Inc()
+		}
+		slog.ErrorContext(r.Context(), "callback error", "gateway", paymentGateway.GetName(), "error", err)
 		respondJSON(w, http.StatusBadRequest, APIResponse{
 			Success: false,
 			Message: err.Error(),
@@ -252,6 +432,22 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, APIResponse{Success: true})
 }
 
+// spoolCallback durably queues a callback that could not reach storage.
+// The gateway only gets a 200 once the callback is on disk.
+func spoolCallback(w http.ResponseWriter, r *http.Request, body []byte, headers map[string]string, cause error) {
+	if err := callbackSpool.Append(r.Context(), paymentGateway.GetName(), body, headers); err != nil {
+		slog.ErrorContext(r.Context(), "failed to spool callback", "cause", cause, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Service temporarily unavailable",
+		})
+		return
+	}
+
+	slog.WarnContext(r.Context(), "storage unavailable, callback spooled for replay", "cause", cause)
+	respondJSON(w, http.StatusOK, APIResponse{Success: true, Message: "Callback queued"})
+}
+
 // Payment history handler - queries database by phone/group ID
 func paymentHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -288,85 +484,61 @@ func paymentHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	perPage := 10
 	offset := (req.Page - 1) * perPage
 
-	if db == nil {
-		respondJSON(w, http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: "Database not available",
-		})
-		return
-	}
-
 	// Query database
-	var rows *sql.Rows
-	var err error
-	var totalCount int
-
+	filter := PaymentFilter{PhoneNumber: req.Identifier, Product: productPremium}
 	if req.Type == "group" {
-		rows, err = db.Query(`
-			SELECT reference, merchant_ref, customer_name, method, amount, status, 
-			       order_items, created_at, updated_at, paid_at
-			FROM payment_history
-			WHERE group_id = $1
-			ORDER BY created_at DESC
-			LIMIT $2 OFFSET $3
-		`, req.Identifier, perPage, offset)
-
-		db.QueryRow("SELECT COUNT(*) FROM payment_history WHERE group_id = $1", req.Identifier).Scan(&totalCount)
-	} else {
-		rows, err = db.Query(`
-			SELECT reference, merchant_ref, customer_name, method, amount, status, 
-			       order_items, created_at, updated_at, paid_at
-			FROM payment_history
-			WHERE phone_number = $1
-			ORDER BY created_at DESC
-			LIMIT $2 OFFSET $3
-		`, req.Identifier, perPage, offset)
-
-		db.QueryRow("SELECT COUNT(*) FROM payment_history WHERE phone_number = $1", req.Identifier).Scan(&totalCount)
+		filter = PaymentFilter{GroupID: req.Identifier, Product: productPremium}
 	}
 
-	if err != nil {
-		log.Printf("Database error: %v", err)
+	payments, totalCount, err := store.ListPayments(r.Context(), filter, perPage, offset)
+	if errors.Is(err, ErrStorageUnavailable) {
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list payments", "error", err)
 		respondJSON(w, http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Message: "Database error",
 		})
 		return
 	}
-	defer rows.Close()
 
 	var history []map[string]interface{}
-	for rows.Next() {
-		var reference, merchantRef, customerName, method, status string
-		var amount int
-		var orderItemsJSON []byte
-		var createdAt, updatedAt time.Time
-		var paidAt sql.NullTime
-
-		err := rows.Scan(&reference, &merchantRef, &customerName, &method, &amount,
-			&status, &orderItemsJSON, &createdAt, &updatedAt, &paidAt)
-		if err != nil {
-			log.Printf("Row scan error: %v", err)
-			continue
-		}
-
+	for _, payment := range payments {
 		var orderItems interface{}
-		json.Unmarshal(orderItemsJSON, &orderItems)
+		json.Unmarshal(payment.OrderItems, &orderItems)
 
 		record := map[string]interface{}{
-			"reference":    reference,
-			"merchantRef":  merchantRef,
-			"customerName": customerName,
-			"method":       method,
-			"amount":       amount,
-			"status":       status,
+			"reference":    payment.Reference,
+			"merchantRef":  payment.MerchantRef,
+			"customerName": payment.CustomerName,
+			"method":       payment.Method,
+			"amount":       payment.Amount,
+			"status":       payment.Status,
 			"orderItems":   orderItems,
-			"createdAt":    createdAt.Format(time.RFC3339),
-			"updatedAt":    updatedAt.Format(time.RFC3339),
+			"createdAt":    payment.CreatedAt.Format(time.RFC3339),
+			"updatedAt":    payment.UpdatedAt.Format(time.RFC3339),
+		}
+
+		if payment.PaidAt != nil {
+			record["paidAt"] = payment.PaidAt.Format(time.RFC3339)
+		}
+
+		if payment.InvoiceNumber != "" {
+			record["invoiceNumber"] = payment.InvoiceNumber
 		}
 
-		if paidAt.Valid {
-			record["paidAt"] = paidAt.Time.Format(time.RFC3339)
+		if payment.Status == "PAID" {
+			record["receiptUrl"] = receiptPath(payment.Reference)
+		}
+
+		if payment.IsGift() {
+			record["recipientPhone"] = payment.RecipientPhone
+			record["recipientGroupId"] = payment.RecipientGroupID
+			record["giftMessage"] = payment.GiftMessage
 		}
 
 		history = append(history, record)
@@ -397,8 +569,7 @@ func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Initialize database connection
-func initDB() error {
-	var err error
+func initDB() (*sql.DB, error) {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	dbUser := os.Getenv("DB_USER")
@@ -413,23 +584,47 @@ func initDB() error {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		dbHost, dbPort, dbUser, dbPassword, dbName, dbSSLMode)
 
-	db, err = sql.Open("postgres", connStr)
+	conn, err := sql.Open("postgres", connStr)
 	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
 	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	conn.SetMaxOpenConns(25)
+	conn.SetMaxIdleConns(5)
+	conn.SetConnMaxLifetime(5 * time.Minute)
 
 	// Test connection
-	if err = db.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %v", err)
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	log.Println("✅ Database connection established successfully")
-	return nil
+	slog.Info("database connection established")
+	return conn, nil
+}
+
+// connectDB retries initDB with exponential backoff until the database
+// answers, then installs the connection into pg and calls onConnect.
+// Once connected, database/sql reconnects dropped connections by itself.
+func connectDB(pg *PostgresStore, onConnect func()) {
+	backoff := dbRetryInitialBackoff
+	for {
+		conn, err := initDB()
+		if err == nil {
+			pg.SetDB(conn)
+			onConnect()
+			return
+		}
+
+		slog.Warn("database connection failed, retrying", "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > dbRetryMaxBackoff {
+			backoff = dbRetryMaxBackoff
+		}
+	}
 }
 
 // Verify user handler
@@ -460,48 +655,27 @@ func verifyUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Type == "group" {
-		// Query groups table
-		var groupName string
-		err := db.QueryRow("SELECT group_name FROM groups WHERE id = $1", req.Identifier).Scan(&groupName)
-		if err == sql.ErrNoRows {
-			respondJSON(w, http.StatusNotFound, APIResponse{
-				Success: false,
-				Message: "Tidak menemukan grup di database, pastikan kamu sudah menggunakan bot dari kami",
-			})
-			return
-		} else if err != nil {
-			log.Printf("Database error: %v", err)
-			respondJSON(w, http.StatusInternalServerError, APIResponse{
-				Success: false,
-				Message: "Database error",
-			})
-			return
-		}
-
-		respondJSON(w, http.StatusOK, APIResponse{
-			Success: true,
-			Message: fmt.Sprintf("Apakah grup kamu bernama \"%s\"?", groupName),
-			Data: map[string]interface{}{
-				"type": "group",
-				"id":   req.Identifier,
-				"name": groupName,
-			},
+	if err := store.Ping(r.Context()); err != nil {
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
 		})
 		return
 	}
 
-	// For user verification
-	var lid sql.NullString
-	err := db.QueryRow("SELECT lid FROM users WHERE phone_number = $1", req.Identifier).Scan(&lid)
-	if err == sql.ErrNoRows || !lid.Valid || lid.String == "" {
+	data, err := lookupIdentity(r.Context(), store, req.Type, req.Identifier)
+	if err == ErrIdentityNotFound {
+		message := "Tidak menemukan user di database, pastikan kamu sudah menggunakan bot dari kami"
+		if req.Type == "group" {
+			message = "Tidak menemukan grup di database, pastikan kamu sudah menggunakan bot dari kami"
+		}
 		respondJSON(w, http.StatusNotFound, APIResponse{
 			Success: false,
-			Message: "Tidak menemukan user di database, pastikan kamu sudah menggunakan bot dari kami",
+			Message: message,
 		})
 		return
 	} else if err != nil {
-		log.Printf("Database error: %v", err)
+		slog.ErrorContext(r.Context(), "failed to look up identity", "type", req.Type, "identifier", req.Identifier, "error", err)
 		respondJSON(w, http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Message: "Database error",
@@ -509,45 +683,86 @@ func verifyUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := fmt.Sprintf("Apakah kamu bernama \"%s\"?", data["name"])
+	if req.Type == "group" {
+		message = fmt.Sprintf("Apakah grup kamu bernama \"%s\"?", data["name"])
+	}
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// lookupIdentity finds a group ("group") or phone number (any other type)
+// known to the bot and returns the details shown to customers, or
+// ErrIdentityNotFound
+func lookupIdentity(ctx context.Context, store Store, identityType, identifier string) (map[string]interface{}, error) {
+	if identityType == "group" {
+		// Query groups table
+		groupName, err := store.GroupName(ctx, identifier)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"type": "group",
+			"id":   identifier,
+			"name": groupName,
+		}, nil
+	}
+
+	// For user verification
+	lid, err := store.UserLID(ctx, identifier)
+	if err != nil {
+		return nil, err
+	}
+
 	// Query names table for push_name
-	var pushName string
-	err = db.QueryRow("SELECT push_name FROM names WHERE lid = $1", lid.String).Scan(&pushName)
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("Database error querying names: %v", err)
+	pushName, err := store.PushName(ctx, lid)
+	if err != nil && err != ErrIdentityNotFound {
+		slog.ErrorContext(ctx, "failed to look up push name", "lid", lid, "error", err)
 	}
 
 	if pushName == "" {
 		pushName = "User"
 	}
 
-	respondJSON(w, http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("Apakah kamu bernama \"%s\"?", pushName),
-		Data: map[string]interface{}{
-			"type":        "user",
-			"phoneNumber": req.Identifier,
-			"lid":         lid.String,
-			"name":        pushName,
-		},
-	})
+	return map[string]interface{}{
+		"type":        "user",
+		"phoneNumber": identifier,
+		"lid":         lid,
+		"name":        pushName,
+	}, nil
 }
 
 func main() {
 	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
+	envErr := godotenv.Load()
+	setupLogging()
+	if envErr != nil {
+		slog.Info("no .env file found, using environment variables")
 	}
 
-	// Initialize database
-	if err := initDB(); err != nil {
-		log.Printf("⚠️  WARNING: Database connection failed: %v", err)
-		log.Println("Server will continue without database features")
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExportCommand(os.Args[2:]))
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := loadClientIPConfig(); err != nil {
+		slog.Error("invalid client IP configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if err := loadChannelFees(); err != nil {
+		slog.Error("invalid channel fee configuration", "error", err)
+		os.Exit(1)
 	}
-	defer func() {
-		if db != nil {
-			db.Close()
-		}
-	}()
 
 	// Initialize payment gateway based on configuration
 	gatewayType := os.Getenv("PAYMENT_GATEWAY")
@@ -556,9 +771,64 @@ func main() {
 	}
 
 	paymentGateway = PaymentGatewayFactory(gatewayType)
-	paymentGateway.Initialize(db)
 
-	log.Printf("✅ Payment gateway initialized: %s", paymentGateway.GetName())
+	// Initialize storage. Callbacks that arrive while the database is
+	// unreachable are spooled to disk and replayed once it answers.
+	callbackSpool = NewCallbackSpoolFromEnv()
+	if os.Getenv("STORAGE_BACKEND") == "memory" {
+		store = NewMemoryStore()
+		slog.Warn("using in-memory storage, data will not survive a restart")
+	} else {
+		pg := NewPostgresStore(nil)
+		defer pg.Close()
+		store = pg
+
+		if conn, err := initDB(); err == nil {
+			pg.SetDB(conn)
+		} else {
+			slog.Warn("database connection failed, running in degraded mode: new transactions are refused and callbacks are spooled until the database is reachable", "error", err)
+			go connectDB(pg, callbackSpool.Trigger)
+		}
+	}
+
+	paymentGateway.Initialize(store)
+
+	// Cache the gateway's payment channels and apply the operator's overrides
+	channelCatalog, err = NewChannelCatalogFromEnv(paymentGateway)
+	if err != nil {
+		slog.Error("invalid payment channel configuration", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("payment gateway initialized", "gateway", paymentGateway.GetName())
+
+	// Replay callbacks left over from a previous outage
+	go callbackSpool.Run(spoolReplayInterval, store, paymentGateway)
+	callbackSpool.Trigger()
+
+	// Mail receipts and expiry warnings to customers who left an email
+	mailQueue, err = NewMailQueueFromEnv(store)
+	if err != nil {
+		slog.Error("invalid SMTP configuration", "error", err)
+		os.Exit(1)
+	}
+	if mailQueue != nil {
+		go mailQueue.Run(mailInterval())
+	} else {
+		slog.Info("customer emails disabled, SMTP_HOST is not set")
+	}
+
+	// Remind premium owners before their premium runs out
+	renewalScheduler, err := NewRenewalSchedulerFromEnv(store, mailQueue)
+	if err != nil {
+		slog.Error("invalid renewal reminder configuration", "error", err)
+		os.Exit(1)
+	}
+	if renewalScheduler != nil {
+		go renewalScheduler.Run(reminderInterval())
+	} else {
+		slog.Info("renewal reminders disabled")
+	}
 
 	// Get port
 	port := os.Getenv("PORT")
@@ -581,14 +851,26 @@ func main() {
 		}
 	})
 	mux.HandleFunc("/api/transaction-status/", transactionStatusHandler)
-	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/callback", callbackAllowlistMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			callbackHandler(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	}))
 	mux.HandleFunc("/api/payment-history", paymentHistoryHandler)
+	mux.HandleFunc("/api/promo/validate", promoValidateHandler)
+	mux.HandleFunc("/api/referral/code", referralCodeHandler)
+	mux.HandleFunc("/api/referral/stats", referralStatsHandler)
+	mux.HandleFunc("/api/receipt/", receiptHandler)
+	mux.HandleFunc("/api/qris/", qrisImageHandler)
+	mux.HandleFunc("/api/admin/export", adminOnly(exportHandler))
+	mux.HandleFunc("/api/donation-history", donationHistoryHandler)
+	mux.HandleFunc("/api/donations/recent", recentDonorsHandler)
+	mux.Handle("/metrics", metricsHandler())
+	healthChecker := NewHealthChecker(store, paymentGateway, callbackSpool, workers)
+	mux.HandleFunc("/livez", livezHandler(healthChecker))
+	mux.HandleFunc("/readyz", readyzHandler(healthChecker))
 	mux.HandleFunc("/", notFoundHandler)
 
 	// Setup CORS
@@ -607,6 +889,12 @@ func main() {
 	// Apply middlewares
 	handler := c.Handler(mux)
 	handler = rateLimitMiddleware(handler)
+	handler = accessLogMiddleware(handler)
+	handler = metricsMiddleware(handler)
+	handler = tracingMiddleware(handler)
+	handler = routeMiddleware(mux, handler)
+	handler = requestIDMiddleware(handler)
+	handler = clientIPMiddleware(handler)
 
 	// Security headers middleware
 	securityHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -629,8 +917,9 @@ func main() {
 	`)
 
 	// Start server
-	log.Printf("Server listening on port %s\n", port)
+	slog.Info("server listening", "port", port)
 	if err := http.ListenAndServe(":"+port, securityHandler); err != nil {
-		log.Fatal("Server failed to start:", err)
+		slog.Error("server failed to start", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics exposed at /metrics
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "shiroine",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	gatewayRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "gateway_requests_total",
+		Help:      "Upstream payment gateway calls, by gateway, operation and outcome (ok, http_4xx, http_5xx, error).",
+	}, []string{"gateway", "operation", "outcome"})
+
+	gatewayRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "shiroine",
+		Name:      "gateway_request_duration_seconds",
+		Help:      "Upstream payment gateway call latency, by gateway and operation.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"gateway", "operation"})
+
+	paymentTransactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "payment_transactions_total",
+		Help:      "Payment transaction lifecycle events (created, paid, expired, failed, cancelled), by plan and method.",
+	}, []string{"event", "plan", "method"})
+
+	callbackVerificationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "callback_verification_failures_total",
+		Help:      "Gateway callbacks rejected because their signature did not verify.",
+	}, []string{"gateway"})
+
+	premiumActivationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "premium_activation_failures_total",
+		Help:      "Paid transactions whose premium activation failed.",
+	})
+
+	rateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiter, by route.",
+	}, []string{"route"})
+
+	renewalRemindersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "renewal_reminders_total",
+		Help:      "Premium renewal reminders, by outcome (sent, failed).",
+	}, []string{"outcome"})
+
+	emailsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "shiroine",
+		Name:      "emails_total",
+		Help:      "Customer email delivery attempts, by kind (receipt, expiry) and outcome (sent, retry, failed).",
+	}, []string{"kind", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		gatewayRequestsTotal,
+		gatewayRequestDuration,
+		paymentTransactionsTotal,
+		callbackVerificationFailures,
+		premiumActivationFailures,
+		rateLimitRejections,
+		renewalRemindersTotal,
+		emailsTotal,
+	)
+}
+
+// metricsHandler serves Prometheus metrics. When METRICS_TOKEN is set the
+// scraper must send it as a bearer token.
+func metricsHandler() http.Handler {
+	handler := promhttp.Handler()
+	token := os.Getenv("METRICS_TOKEN")
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+type routeKey struct{}
+
+// routeMiddleware resolves the mux pattern a request will be served by and
+// stores it in the request context, so metrics and rate limiting can label
+// by route without the unbounded cardinality of raw paths
+func routeMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, pattern)))
+	})
+}
+
+// routeFromRequest returns the route resolved by routeMiddleware
+func routeFromRequest(r *http.Request) string {
+	if route, ok := r.Context().Value(routeKey{}).(string); ok {
+		return route
+	}
+	return "unmatched"
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware records request count and latency per route. It must run
+// inside routeMiddleware.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeFromRequest(r)
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// instrumentedTransport records latency and outcome of upstream gateway calls
+// in a client span and metrics, and forwards the trace context and request ID
+type instrumentedTransport struct {
+	gateway   string
+	operation string
+	next      http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The URL is left out of the span: Pakasir puts api_key in the query
+	ctx, span := tracer.Start(req.Context(), t.gateway+" "+t.operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("payment.gateway", t.gateway),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.path", req.URL.Path),
+		))
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	gatewayRequestDuration.WithLabelValues(t.gateway, t.operation).Observe(time.Since(start).Seconds())
+
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+
+	outcome := "ok"
+	switch {
+	case err != nil:
+		outcome = "error"
+	case resp.StatusCode >= 500:
+		outcome = "http_5xx"
+	case resp.StatusCode >= 400:
+		outcome = "http_4xx"
+	}
+	gatewayRequestsTotal.WithLabelValues(t.gateway, t.operation, outcome).Inc()
+	return resp, err
+}
+
+// newGatewayClient returns the HTTP client gateways use for upstream calls
+func newGatewayClient(gateway, operation string) *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &instrumentedTransport{
+			gateway:   gateway,
+			operation: operation,
+			next:      http.DefaultTransport,
+		},
+	}
+}
+
+// observePaymentEvent counts a transaction lifecycle event by plan and method
+func observePaymentEvent(event string, orderItems json.RawMessage, method string) {
+	plan := planIDFromOrderItems(orderItems)
+	if plan == "" {
+		plan = "unknown"
+		var items []map[string]interface{}
+		if json.Unmarshal(orderItems, &items) == nil && planNameFromOrderItems(items) == donationItemName {
+			plan = productDonation
+		}
+	}
+	if method == "" {
+		method = "unknown"
+	}
+	paymentTransactionsTotal.WithLabelValues(event, plan, method).Inc()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddlewareLabelsByRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/transaction-status/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := routeMiddleware(mux, metricsMiddleware(mux))
+
+	counter := httpRequestsTotal.WithLabelValues("/api/transaction-status/", http.MethodGet, "404")
+	before := testutil.ToFloat64(counter)
+
+	for _, ref := range []string{"T1", "T2", "T3"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/transaction-status/"+ref, nil))
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Fatalf("expected 3 requests recorded under the route pattern, got %v", got)
+	}
+}
+
+func TestPaymentEventsRecordedOnce(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetUser("628123", "lid-1", "Budi")
+	store.CreatePayment(context.Background(), &PaymentRecord{
+		Reference:   "T-METRICS",
+		MerchantRef: "T-METRICS",
+		PhoneNumber: "628123",
+		Method:      "QRIS",
+		Amount:      15000,
+		Status:      "UNPAID",
+		OrderItems:  json.RawMessage(`[{"name":"User Premium 30 Days","price":15000,"quantity":1}]`),
+	})
+
+	paid := paymentTransactionsTotal.WithLabelValues("paid", "user-1m", "QRIS")
+	before := testutil.ToFloat64(paid)
+
+	for i := 0; i < 2; i++ {
+		if err := completePayment(context.Background(), store, "T-METRICS", time.Now()); err != nil {
+			t.Fatalf("completePayment failed: %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(paid) - before; got != 1 {
+		t.Fatalf("expected one paid event, got %v", got)
+	}
+}
+
+func TestMetricsHandlerRequiresToken(t *testing.T) {
+	t.Setenv("METRICS_TOKEN", "secret")
+	handler := metricsHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "shiroine_payment_transactions_total") {
+		t.Fatalf("expected metrics output, got %d", rec.Code)
+	}
+}
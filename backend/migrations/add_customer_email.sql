@@ -0,0 +1,33 @@
+-- Migration: Add customer email and email outbox
+-- Date: 2026-10-18
+-- Description: Stores the optional customer email of a transaction and queues the receipt and expiry emails sent to it
+
+-- Add customer_email column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='customer_email') THEN
+    ALTER TABLE payment_history ADD COLUMN customer_email TEXT;
+  END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS email_outbox (
+    dedup_key TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(next_attempt_at) WHERE status = 'pending';
+
+-- Verify the column and table were added
+SELECT table_name, column_name, data_type
+FROM information_schema.columns
+WHERE (table_name = 'payment_history' AND column_name = 'customer_email')
+   OR table_name = 'email_outbox';
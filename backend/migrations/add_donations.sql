@@ -0,0 +1,31 @@
+-- Migration: Add donations
+-- Date: 2026-10-18
+-- Description: Tells donations apart from premium purchases and keeps the donor's name and message
+
+-- Add donation columns if they don't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='product') THEN
+    ALTER TABLE payment_history ADD COLUMN product TEXT NOT NULL DEFAULT 'premium';
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='donor_name') THEN
+    ALTER TABLE payment_history ADD COLUMN donor_name TEXT;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='donor_message') THEN
+    ALTER TABLE payment_history ADD COLUMN donor_message TEXT;
+  END IF;
+END $$;
+
+-- Index for the recent supporters list
+CREATE INDEX IF NOT EXISTS idx_payment_history_donations ON payment_history(paid_at DESC) WHERE product = 'donation' AND status = 'PAID';
+
+-- Verify the columns were added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+  AND column_name IN ('product', 'donor_name', 'donor_message');
@@ -0,0 +1,27 @@
+-- Migration: Add gift purchases
+-- Date: 2026-10-18
+-- Description: Records the recipient and message of a premium bought for another phone number or group
+
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='recipient_phone') THEN
+    ALTER TABLE payment_history ADD COLUMN recipient_phone TEXT;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='recipient_group_id') THEN
+    ALTER TABLE payment_history ADD COLUMN recipient_group_id TEXT;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='gift_message') THEN
+    ALTER TABLE payment_history ADD COLUMN gift_message TEXT;
+  END IF;
+END $$;
+
+-- Verify the columns were added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+AND column_name IN ('recipient_phone', 'recipient_group_id', 'gift_message');
@@ -0,0 +1,18 @@
+-- Migration: Add idempotency_keys table
+-- Date: 2026-10-18
+-- Description: Stores Idempotency-Key headers of /api/create-transaction so retried requests return the original transaction
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER,
+    response TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
+
+-- Verify the table was created
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'idempotency_keys';
@@ -0,0 +1,23 @@
+-- Migration: Add invoice numbers
+-- Date: 2026-10-18
+-- Description: Adds gap-free invoice numbers (SHR/YYYY/MM/NNNNNN) assigned when a payment becomes PAID
+
+CREATE TABLE IF NOT EXISTS invoice_counters (
+    period TEXT PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+-- Add invoice_number column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='invoice_number') THEN
+    ALTER TABLE payment_history ADD COLUMN invoice_number TEXT UNIQUE;
+  END IF;
+END $$;
+
+-- Verify the column was added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+AND column_name = 'invoice_number';
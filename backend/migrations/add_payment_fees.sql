@@ -0,0 +1,33 @@
+-- Migration: Add payment fees
+-- Date: 2026-10-18
+-- Description: Records the fees each gateway charged and what it settles, for accounting
+
+-- Add fee columns if they don't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='fee_merchant') THEN
+    ALTER TABLE payment_history ADD COLUMN fee_merchant INTEGER;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='fee_customer') THEN
+    ALTER TABLE payment_history ADD COLUMN fee_customer INTEGER;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='total_paid') THEN
+    ALTER TABLE payment_history ADD COLUMN total_paid INTEGER;
+  END IF;
+
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='net_amount') THEN
+    ALTER TABLE payment_history ADD COLUMN net_amount INTEGER;
+  END IF;
+END $$;
+
+-- Verify the columns were added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+  AND column_name IN ('fee_merchant', 'fee_customer', 'total_paid', 'net_amount');
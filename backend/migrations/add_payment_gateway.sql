@@ -0,0 +1,20 @@
+-- Migration: Add payment gateway
+-- Date: 2026-10-18
+-- Description: Records which payment gateway handled a transaction, for accounting exports
+
+-- Add gateway column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='gateway') THEN
+    ALTER TABLE payment_history ADD COLUMN gateway TEXT;
+  END IF;
+END $$;
+
+-- Exports select payments by the date they were paid, or created if unpaid
+CREATE INDEX IF NOT EXISTS idx_payment_history_booked ON payment_history((COALESCE(paid_at, created_at)));
+
+-- Verify the column was added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history' AND column_name = 'gateway';
@@ -0,0 +1,53 @@
+-- Migration: Add promo codes
+-- Date: 2026-10-18
+-- Description: Adds promo_codes and promo_redemptions tables and records the applied code and discount on payment_history
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    code TEXT PRIMARY KEY CHECK (code = UPPER(code)),
+    discount_type TEXT NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),
+    max_discount INTEGER,
+    plan_ids TEXT[] NOT NULL DEFAULT '{}',
+    max_redemptions INTEGER,
+    max_per_identity INTEGER,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    first_purchase_only BOOLEAN NOT NULL DEFAULT FALSE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    id SERIAL PRIMARY KEY,
+    code TEXT NOT NULL REFERENCES promo_codes(code),
+    reference TEXT NOT NULL UNIQUE,
+    identity TEXT NOT NULL,
+    discount INTEGER NOT NULL,
+    redeemed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code ON promo_redemptions(code, identity);
+
+-- Add promo_code column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='promo_code') THEN
+    ALTER TABLE payment_history ADD COLUMN promo_code TEXT;
+  END IF;
+END $$;
+
+-- Add discount_amount column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='discount_amount') THEN
+    ALTER TABLE payment_history ADD COLUMN discount_amount INTEGER DEFAULT 0;
+  END IF;
+END $$;
+
+-- Verify the columns were added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+AND column_name IN ('promo_code', 'discount_amount');
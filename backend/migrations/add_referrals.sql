@@ -0,0 +1,35 @@
+-- Migration: Add referral program
+-- Date: 2026-10-18
+-- Description: Adds referral_codes and referrals tables and records the referral code used on payment_history
+
+CREATE TABLE IF NOT EXISTS referral_codes (
+    code TEXT PRIMARY KEY CHECK (code = UPPER(code)),
+    phone_number TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS referrals (
+    referred_phone TEXT PRIMARY KEY,
+    referrer_phone TEXT NOT NULL,
+    code TEXT NOT NULL REFERENCES referral_codes(code),
+    reference TEXT NOT NULL,
+    bonus_days INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_phone);
+
+-- Add referral_code column if it doesn't exist
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_name='payment_history' AND column_name='referral_code') THEN
+    ALTER TABLE payment_history ADD COLUMN referral_code TEXT;
+  END IF;
+END $$;
+
+-- Verify the column was added
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'payment_history'
+AND column_name = 'referral_code';
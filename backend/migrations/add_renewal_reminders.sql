@@ -0,0 +1,17 @@
+-- Migration: Add renewal reminders
+-- Date: 2026-10-18
+-- Description: Records the renewal reminders sent for each premium expiry so none is sent twice
+
+CREATE TABLE IF NOT EXISTS renewal_reminders (
+    jid TEXT NOT NULL,
+    lid TEXT NOT NULL,
+    expired TIMESTAMPTZ NOT NULL,
+    days_before INTEGER NOT NULL,
+    sent_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (jid, lid, expired, days_before)
+);
+
+-- Verify the table was created
+SELECT column_name, data_type
+FROM information_schema.columns
+WHERE table_name = 'renewal_reminders';
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -18,7 +19,7 @@ type PakasirGateway struct {
 	APIURL  string
 	Slug    string
 	Mode    string // sandbox or production
-	db      *sql.DB
+	store   Store
 }
 
 // NewPakasirGateway creates a new Pakasir gateway instance
@@ -43,14 +44,22 @@ func (g *PakasirGateway) GetName() string {
 	return "pakasir"
 }
 
-// Initialize sets up the gateway with database connection
-func (g *PakasirGateway) Initialize(db *sql.DB) {
-	g.db = db
+// Initialize sets up the gateway with its storage
+func (g *PakasirGateway) Initialize(store Store) {
+	g.store = store
+}
+
+// HealthCheck reports missing credentials or an unreachable Pakasir API
+func (g *PakasirGateway) HealthCheck(ctx context.Context) error {
+	if g.APIKey == "" || g.Slug == "" {
+		return fmt.Errorf("pakasir API key or slug is not configured")
+	}
+	return probeGateway(ctx, g.GetName(), g.APIURL)
 }
 
 // GetPaymentChannels returns available payment channels for Pakasir
 // Pakasir supports QRIS, Virtual Account, and PayPal
-func (g *PakasirGateway) GetPaymentChannels() (interface{}, error) {
+func (g *PakasirGateway) GetPaymentChannels(ctx context.Context) (interface{}, error) {
 	// Pakasir supports multiple payment methods
 	channels := []map[string]interface{}{
 		{
@@ -147,14 +156,14 @@ func (g *PakasirGateway) GetPaymentChannels() (interface{}, error) {
 }
 
 // CreateTransaction creates a new payment transaction with Pakasir
-func (g *PakasirGateway) CreateTransaction(req CreateTransactionRequest) (interface{}, error) {
+func (g *PakasirGateway) CreateTransaction(ctx context.Context, req CreateTransactionRequest) (interface{}, error) {
 	// Validate required fields
 	if req.Amount == 0 || req.OrderItems == nil {
 		return nil, fmt.Errorf("missing required fields")
 	}
 
-	// Require either phone or group ID
-	if req.CustomerPhone == "" && req.GroupID == "" {
+	// Require either phone or group ID; donors may stay anonymous
+	if req.CustomerPhone == "" && req.GroupID == "" && req.Product != productDonation {
 		return nil, fmt.Errorf("either phone number or group ID is required")
 	}
 
@@ -189,6 +198,7 @@ func (g *PakasirGateway) CreateTransaction(req CreateTransactionRequest) (interf
 
 	// Generate order ID
 	orderID := fmt.Sprintf("INV-%s-%d", time.Now().Format("20060102"), time.Now().UnixNano()%1000000)
+	tagPaymentReference(ctx, orderID)
 
 	// Map payment method code to Pakasir method
 	pakasirMethod := strings.ToLower(req.Method)
@@ -215,15 +225,15 @@ func (g *PakasirGateway) CreateTransaction(req CreateTransactionRequest) (interf
 
 	// For QRIS, VA, and PayPal methods, use API integration
 	if pakasirMethod == "qris" || strings.Contains(pakasirMethod, "_va") || pakasirMethod == "paypal" {
-		return g.createAPITransaction(req, orderID, pakasirMethod, description)
+		return g.createAPITransaction(ctx, req, orderID, pakasirMethod, description)
 	}
 
 	// For other methods, use URL-based integration
-	return g.createURLTransaction(req, orderID, pakasirMethod, description)
+	return g.createURLTransaction(ctx, req, orderID, pakasirMethod, description)
 }
 
 // createAPITransaction creates transaction using Pakasir API
-func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orderID, method, description string) (interface{}, error) {
+func (g *PakasirGateway) createAPITransaction(ctx context.Context, req CreateTransactionRequest, orderID, method, description string) (interface{}, error) {
 	// Prepare transaction data for Pakasir API
 	transactionData := map[string]interface{}{
 		"project":  g.Slug,
@@ -238,9 +248,9 @@ func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orde
 	}
 
 	// Create transaction with Pakasir API
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newGatewayClient("pakasir", "create_transaction")
 	url := fmt.Sprintf("%s/api/transactioncreate/%s", g.APIURL, method)
-	httpReq, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonData)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -270,7 +280,7 @@ func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orde
 		if msg, ok := result["message"].(string); ok {
 			message = msg
 		}
-		return nil, fmt.Errorf(message)
+		return nil, errors.New(message)
 	}
 
 	// Extract payment details
@@ -284,10 +294,13 @@ func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orde
 		paymentNumber = num
 	}
 
+	// The record keeps the price: transaction detail lookups must send the
+	// amount the transaction was created with, not the total with fees
 	totalPayment := req.Amount
-//	if total, ok := paymentData["total_payment"].(float64); ok {
-//		totalPayment = int(total)
-//	}
+	fees := pakasirFees(req.Amount, paymentData)
+	if fees != nil {
+		totalPayment = fees.TotalPaid
+	}
 
 	expiredAt := ""
 	var expiredAtTime *time.Time
@@ -300,41 +313,17 @@ func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orde
 	}
 
 	// Save to payment_history table
-	if g.db != nil {
-		orderItemsJSON, _ := json.Marshal(req.OrderItems)
-		var phoneNumber, groupID sql.NullString
-		if req.CustomerPhone != "" {
-			phoneNumber = sql.NullString{String: req.CustomerPhone, Valid: true}
-		}
-		if req.GroupID != "" {
-			groupID = sql.NullString{String: req.GroupID, Valid: true}
-		}
-
-		customerName := req.CustomerName
-		if customerName == "" {
-			customerName = fmt.Sprintf("Customer-%s", req.CustomerPhone)
-		}
-
-		_, err := g.db.Exec(`
-			INSERT INTO payment_history 
-			(reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status, order_items, payment_number, expired_at, created_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-		`,
-			merchantOrderID,
-			merchantOrderID,
-			phoneNumber,
-			groupID,
-			customerName,
-			strings.ToUpper(req.Method),
-			totalPayment,
-			"UNPAID",
-			orderItemsJSON,
-			paymentNumber,
-			expiredAtTime,
-			time.Now(),
-		)
-		if err != nil {
-			log.Printf("Failed to save transaction to database: %v", err)
+	if g.store != nil {
+		record := newPaymentRecord(req, g.GetName(), merchantOrderID, merchantOrderID, strings.ToUpper(req.Method), req.Amount)
+		record.PaymentNumber = paymentNumber
+		record.ExpiredAt = expiredAtTime
+		record.Fees = fees
+		if err := g.store.CreatePayment(ctx, record); err != nil {
+			slog.ErrorContext(ctx, "failed to save transaction, cancelling it", "gateway", "pakasir", "order_id", merchantOrderID, "error", err)
+			if cancelErr := g.cancelTransaction(ctx, merchantOrderID, req.Amount); cancelErr != nil {
+				slog.ErrorContext(ctx, "failed to cancel unsaved transaction", "gateway", "pakasir", "order_id", merchantOrderID, "error", cancelErr)
+			}
+			return nil, fmt.Errorf("%w: %v", ErrPaymentNotRecorded, err)
 		}
 	}
 
@@ -351,15 +340,45 @@ func (g *PakasirGateway) createAPITransaction(req CreateTransactionRequest, orde
 	}
 
 	// Add fee if available
-	if fee, ok := paymentData["fee"].(float64); ok {
-		responseData["fee"] = int(fee)
+	if fees != nil {
+		responseData["fee"] = fees.Total()
 	}
 
 	return responseData, nil
 }
 
+// cancelTransaction cancels an unpaid API transaction
+func (g *PakasirGateway) cancelTransaction(ctx context.Context, orderID string, amount int) error {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"project":  g.Slug,
+		"order_id": orderID,
+		"amount":   amount,
+		"api_key":  g.APIKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create cancel data: %v", err)
+	}
+
+	client := newGatewayClient("pakasir", "cancel_transaction")
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", g.APIURL+"/api/transactioncancel", strings.NewReader(string(jsonData)))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to cancel transaction: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to cancel transaction: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // createURLTransaction creates transaction using Pakasir URL-based integration
-func (g *PakasirGateway) createURLTransaction(req CreateTransactionRequest, orderID, method, description string) (interface{}, error) {
+func (g *PakasirGateway) createURLTransaction(ctx context.Context, req CreateTransactionRequest, orderID, method, description string) (interface{}, error) {
 	// For URL-based integration, we create a checkout URL
 	// Format: https://app.pakasir.com/pay/{slug}/{amount}?order_id={order_id}
 	// Or for PayPal: https://app.pakasir.com/paypal/{slug}/{amount}?order_id={order_id}
@@ -380,39 +399,12 @@ func (g *PakasirGateway) createURLTransaction(req CreateTransactionRequest, orde
 		baseURL, pathPrefix, g.Slug, req.Amount, orderID, domain, orderID)
 
 	// Save to payment_history table
-	if g.db != nil {
-		orderItemsJSON, _ := json.Marshal(req.OrderItems)
-		var phoneNumber, groupID sql.NullString
-		if req.CustomerPhone != "" {
-			phoneNumber = sql.NullString{String: req.CustomerPhone, Valid: true}
-		}
-		if req.GroupID != "" {
-			groupID = sql.NullString{String: req.GroupID, Valid: true}
-		}
-
-		customerName := req.CustomerName
-		if customerName == "" {
-			customerName = fmt.Sprintf("Customer-%s", req.CustomerPhone)
-		}
-
-		_, err := g.db.Exec(`
-			INSERT INTO payment_history 
-			(reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status, order_items, created_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		`,
-			orderID,
-			orderID,
-			phoneNumber,
-			groupID,
-			customerName,
-			strings.ToUpper(req.Method),
-			req.Amount,
-			"UNPAID",
-			orderItemsJSON,
-			time.Now(),
-		)
-		if err != nil {
-			log.Printf("Failed to save transaction to database: %v", err)
+	if g.store != nil {
+		record := newPaymentRecord(req, g.GetName(), orderID, orderID, strings.ToUpper(req.Method), req.Amount)
+		// Nothing exists upstream until the customer opens the checkout URL
+		if err := g.store.CreatePayment(ctx, record); err != nil {
+			slog.ErrorContext(ctx, "failed to save transaction", "gateway", "pakasir", "order_id", orderID, "error", err)
+			return nil, fmt.Errorf("%w: %v", ErrPaymentNotRecorded, err)
 		}
 	}
 
@@ -432,28 +424,22 @@ func (g *PakasirGateway) createURLTransaction(req CreateTransactionRequest, orde
 // GetTransactionStatus retrieves the status of a transaction
 // For QRIS: Uses Pakasir API to check transaction status
 // For PayPal and VA: Relies solely on callback, returns database status
-func (g *PakasirGateway) GetTransactionStatus(orderId string) (interface{}, error) {
+func (g *PakasirGateway) GetTransactionStatus(ctx context.Context, orderId string) (interface{}, error) {
 	if g.APIKey == "" || g.Slug == "" {
 		return nil, fmt.Errorf("payment gateway not configured")
 	}
 
 	// First, check database for transaction details
-	var amount int
-	var method string
-	var status string
-	var paymentNumber sql.NullString
-	var expiredAt sql.NullTime
-	var paidAt sql.NullTime
-	
-	err := g.db.QueryRow(`
-		SELECT amount, method, status, payment_number, expired_at, paid_at 
-		FROM payment_history 
-		WHERE reference = $1 OR merchant_ref = $1
-	`, orderId).Scan(&amount, &method, &status, &paymentNumber, &expiredAt, &paidAt)
+	if g.store == nil {
+		return nil, fmt.Errorf("transaction not found in database")
+	}
 
+	payment, err := g.store.GetPayment(ctx, orderId)
 	if err != nil {
 		return nil, fmt.Errorf("transaction not found in database")
 	}
+	amount := payment.Amount
+	method := payment.Method
 
 	// For PayPal and Virtual Account, rely solely on callback (database status)
 	// Only use API check for QRIS
@@ -464,30 +450,30 @@ func (g *PakasirGateway) GetTransactionStatus(orderId string) (interface{}, erro
 			"merchant_order_id": orderId,
 			"payment_method":    method,
 			"amount":            amount,
-			"status":            strings.ToLower(status),
+			"status":            strings.ToLower(payment.Status),
 		}
 		
-		if paymentNumber.Valid {
-			responseData["payment_number"] = paymentNumber.String
+		if payment.PaymentNumber != "" {
+			responseData["payment_number"] = payment.PaymentNumber
 		}
 		
-		if expiredAt.Valid {
-			responseData["expired_at"] = expiredAt.Time.Format(time.RFC3339)
+		if payment.ExpiredAt != nil {
+			responseData["expired_at"] = payment.ExpiredAt.Format(time.RFC3339)
 		}
 		
-		if paidAt.Valid {
-			responseData["paid_at"] = paidAt.Time.Format(time.RFC3339)
+		if payment.PaidAt != nil {
+			responseData["paid_at"] = payment.PaidAt.Format(time.RFC3339)
 		}
 		
 		return responseData, nil
 	}
 
 	// For QRIS, use Pakasir API to get transaction detail
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newGatewayClient("pakasir", "transaction_status")
 	url := fmt.Sprintf("%s/api/transactiondetail?project=%s&amount=%d&order_id=%s&api_key=%s",
 		g.APIURL, g.Slug, amount, orderId, g.APIKey)
 	
-	httpReq, err := http.NewRequest("GET", url, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -514,8 +500,10 @@ func (g *PakasirGateway) GetTransactionStatus(orderId string) (interface{}, erro
 		return nil, fmt.Errorf("transaction not found")
 	}
 
+	recordPaymentFees(ctx, g.store, orderId, pakasirFees(amount, transactionData))
+
 	// Update transaction status in database
-	if g.db != nil && transactionData["status"] != nil {
+	if transactionData["status"] != nil {
 		status := transactionData["status"].(string)
 
 		// Map Pakasir status to our internal status
@@ -533,58 +521,48 @@ func (g *PakasirGateway) GetTransactionStatus(orderId string) (interface{}, erro
 			dbStatus = "CANCELLED"
 		}
 
-		// Check current status in database before updating
-		var currentStatus string
-		err := g.db.QueryRow(`
-			SELECT status FROM payment_history 
-			WHERE reference = $1 OR merchant_ref = $1
-		`, orderId).Scan(&currentStatus)
-
-		// Handle missing record or status change
-		if err == sql.ErrNoRows {
-			log.Printf("Warning: Payment record not found in database for order_id=%s", orderId)
-		} else if err != nil {
-			log.Printf("Failed to check current payment status: %v", err)
-		} else if currentStatus != dbStatus {
-			// Status has changed - update and trigger activation if needed
-			now := time.Now()
-			var paidAt interface{}
-			if dbStatus == "PAID" {
-				paidAt = now
-			} else {
-				paidAt = nil
+		// Status has changed - update and trigger activation if needed
+		if payment.Status != dbStatus && dbStatus == "PAID" {
+			// Trigger premium activation for PAID status
+			slog.InfoContext(ctx, "payment completed (detected via status check)", "gateway", "pakasir", "order_id", orderId)
+			if err := completePayment(ctx, g.store, orderId, time.Now()); err != nil {
+				slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "pakasir", "order_id", orderId, "error", err)
 			}
-
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, paid_at = $2, updated_at = $3
-				WHERE reference = $4 OR merchant_ref = $4
-			`, dbStatus, paidAt, now, orderId)
-			if err != nil {
-				log.Printf("Failed to update transaction status: %v", err)
+		} else if payment.Status != dbStatus {
+			// Status has changed - update without touching paid_at
+			if err := setPaymentStatus(ctx, g.store, orderId, dbStatus); err != nil {
+				slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "pakasir", "order_id", orderId, "error", err)
 			} else {
-				log.Printf("Pakasir status updated: order_id=%s, status=%s (was %s)", orderId, dbStatus, currentStatus)
-			}
-
-			// Trigger premium activation for PAID status
-			if dbStatus == "PAID" {
-				log.Printf("Payment completed for order_id: %s (detected via status check)", orderId)
-				if err := activatePremium(g.db, orderId); err != nil {
-					log.Printf("Failed to activate premium: %v", err)
-				}
+				slog.InfoContext(ctx, "payment status updated", "gateway", "pakasir", "order_id", orderId, "status", dbStatus, "previous_status", payment.Status)
 			}
 		}
 	}
 
 	// Add payment_number from database to response for QRIS
 	// This is the QR string that frontend needs to generate QR code
-	if paymentNumber.Valid && paymentNumber.String != "" {
-		transactionData["payment_number"] = paymentNumber.String
+	if payment.PaymentNumber != "" {
+		transactionData["payment_number"] = payment.PaymentNumber
 	}
 
 	return transactionData, nil
 }
 
+// pakasirFees reads the fee Pakasir reports for a transaction of amount.
+// Whatever total_payment adds on top of amount is the customer's share of
+// the fee; the rest comes out of the settlement.
+func pakasirFees(amount int, data map[string]interface{}) *PaymentFees {
+	fee, ok := jsonInt(data, "fee")
+	if !ok {
+		return nil
+	}
+	totalPaid, ok := jsonInt(data, "total_payment")
+	if !ok {
+		totalPaid = amount
+	}
+	feeCustomer := min(max(totalPaid-amount, 0), fee)
+	return newPaymentFees(totalPaid, fee-feeCustomer, feeCustomer)
+}
+
 // HandleCallback processes payment callback from Pakasir
 // Callback format (from Pakasir documentation):
 // {
@@ -595,7 +573,7 @@ func (g *PakasirGateway) GetTransactionStatus(orderId string) (interface{}, erro
 //   "payment_method": "qris",
 //   "completed_at": "2024-09-10T08:07:02.819+07:00"
 // }
-func (g *PakasirGateway) HandleCallback(payload []byte, headers map[string]string) error {
+func (g *PakasirGateway) HandleCallback(ctx context.Context, payload []byte, headers map[string]string) error {
 	var callbackPayload map[string]interface{}
 	if err := json.Unmarshal(payload, &callbackPayload); err != nil {
 		return fmt.Errorf("invalid JSON payload: %v", err)
@@ -608,16 +586,20 @@ func (g *PakasirGateway) HandleCallback(payload []byte, headers map[string]strin
 	completedAtStr, _ := callbackPayload["completed_at"].(string)
 	paymentMethod, _ := callbackPayload["payment_method"].(string)
 
-	log.Printf("Pakasir Callback: order_id=%s, status=%s, amount=%.0f, payment_method=%s, timestamp=%s",
-		orderID, status, amount, paymentMethod, time.Now().Format(time.RFC3339))
+	slog.InfoContext(ctx, "callback received", "gateway", "pakasir",
+		"order_id", orderID, "status", status, "amount", amount, "payment_method", paymentMethod)
 
 	if orderID == "" {
 		return fmt.Errorf("order_id not found in callback")
 	}
+	tagPaymentReference(ctx, orderID)
+
+	// Pakasir does not sign its callbacks, so fees are only recorded from
+	// the transaction detail API in GetTransactionStatus
 
 	// Process based on status
 	if status == "completed" || status == "paid" || status == "success" {
-		log.Printf("Payment completed for order_id: %s", orderID)
+		slog.InfoContext(ctx, "payment completed", "gateway", "pakasir", "order_id", orderID)
 
 		// Parse completed_at timestamp if available
 		var completedAt time.Time
@@ -632,67 +614,42 @@ func (g *PakasirGateway) HandleCallback(payload []byte, headers map[string]strin
 			completedAt = time.Now()
 		}
 
-		// Update payment_history table
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, paid_at = $2, updated_at = $3
-				WHERE reference = $4 OR merchant_ref = $4
-			`, "PAID", completedAt, time.Now(), orderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
-			}
-
-			// Activate premium
-			if err := activatePremium(g.db, orderID); err != nil {
-				log.Printf("Failed to activate premium: %v", err)
+		// Update payment_history table and activate premium
+		if g.store != nil {
+			if err := completePayment(ctx, g.store, orderID, completedAt); err != nil {
+				return err
 			}
 		}
 
 	} else if status == "failed" {
-		log.Printf("Payment failed for order_id: %s", orderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "FAILED", time.Now(), orderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment failed", "gateway", "pakasir", "order_id", orderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, orderID, "FAILED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "pakasir", "order_id", orderID, "error", err)
 			}
 		}
 
 	} else if status == "expired" {
-		log.Printf("Payment expired for order_id: %s", orderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "EXPIRED", time.Now(), orderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment expired", "gateway", "pakasir", "order_id", orderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, orderID, "EXPIRED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "pakasir", "order_id", orderID, "error", err)
 			}
 		}
 
 	} else if status == "cancelled" {
-		log.Printf("Payment cancelled for order_id: %s", orderID)
-
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3 OR merchant_ref = $3
-			`, "CANCELLED", time.Now(), orderID)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		slog.InfoContext(ctx, "payment cancelled", "gateway", "pakasir", "order_id", orderID)
+
+		if g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, orderID, "CANCELLED"); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "pakasir", "order_id", orderID, "error", err)
 			}
 		}
 
 	} else {
-		log.Printf("Unknown status: %s for order_id: %s", status, orderID)
+		slog.WarnContext(ctx, "unknown callback status", "gateway", "pakasir", "status", status, "order_id", orderID)
 	}
 
 	return nil
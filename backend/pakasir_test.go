@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPakasirCancelsTransactionItCannotRecord(t *testing.T) {
+	var cancelled map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api/transactioncreate/"):
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"payment": map[string]interface{}{"order_id": body["order_id"], "amount": body["amount"], "payment_number": "8800123456"},
+			})
+		case r.URL.Path == "/api/transactioncancel":
+			json.NewDecoder(r.Body).Decode(&cancelled)
+			w.Write([]byte(`{"success": true}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	g := &PakasirGateway{APIKey: "test-api-key", APIURL: upstream.URL, Slug: "shiroine"}
+	g.Initialize(unrecordingStore{NewMemoryStore()})
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method: "BRI_VA", Amount: 15000, CustomerPhone: "6281234567890", OrderItems: orderItems("User Premium 30 Days", 15000),
+	})
+	if !errors.Is(err, ErrPaymentNotRecorded) {
+		t.Fatalf("expected ErrPaymentNotRecorded, got %v", err)
+	}
+	if cancelled == nil || cancelled["project"] != "shiroine" || cancelled["amount"] != 15000.0 || !strings.HasPrefix(cancelled["order_id"].(string), "INV-") {
+		t.Errorf("expected the upstream transaction to be cancelled, got %v", cancelled)
+	}
+}
+
+func TestCallbacksDoNotRecordFees(t *testing.T) {
+	memory := NewMemoryStore()
+	items, _ := json.Marshal(orderItems("User Premium 30 Days", 15000))
+	for _, ref := range []string{"INV-PAKASIR-FEES", "INV-ISKAPAY-FEES"} {
+		memory.CreatePayment(context.Background(), &PaymentRecord{
+			Reference: ref, MerchantRef: ref, PhoneNumber: "6281234567890", Method: "QRIS",
+			Amount: 15000, Status: "UNPAID", OrderItems: items,
+		})
+	}
+
+	// Neither gateway signs its callbacks, so anyone could post these
+	pakasir := &PakasirGateway{}
+	pakasir.Initialize(memory)
+	err := pakasir.HandleCallback(context.Background(),
+		[]byte(`{"order_id":"INV-PAKASIR-FEES","amount":15000,"status":"pending","fee":14000,"total_payment":15000}`), nil)
+	if err != nil {
+		t.Fatalf("Pakasir HandleCallback failed: %v", err)
+	}
+
+	iskapay := &IskapayGateway{}
+	iskapay.Initialize(memory)
+	err = iskapay.HandleCallback(context.Background(),
+		[]byte(`{"event":"payment.pending","payment":{"merchant_order_id":"INV-ISKAPAY-FEES","amount":15000,"fee":14000,"status":"pending"}}`), nil)
+	if err != nil {
+		t.Fatalf("Iskapay HandleCallback failed: %v", err)
+	}
+
+	for _, ref := range []string{"INV-PAKASIR-FEES", "INV-ISKAPAY-FEES"} {
+		if payment, _ := memory.GetPayment(context.Background(), ref); payment.Fees != nil {
+			t.Errorf("%s: expected no fees from an unauthenticated callback, got %+v", ref, payment.Fees)
+		}
+	}
+}
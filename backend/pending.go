@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// pendingReuseMargin is how long a pending payment must still be payable to
+// be handed out again, so nobody scans a QR code that expires meanwhile
+const pendingReuseMargin = 5 * time.Minute
+
+// createdStatus is the status each gateway's create response carries, so a
+// reused payment answers in the same shape as a new one
+var createdStatus = map[string]string{
+	"tripay":  "UNPAID",
+	"pakasir": "pending",
+	"iskapay": "pending",
+}
+
+// paymentMethodOf returns the method a request will be stored under.
+// Gateways store QRIS when no method is given.
+func paymentMethodOf(req CreateTransactionRequest) string {
+	if req.Method == "" {
+		return "QRIS"
+	}
+	return req.Method
+}
+
+// findReusablePayment returns the newest UNPAID, unexpired payment made
+// through gateway for the same customer or group, plan, amount and method as
+// req, or nil. Payments without a QR string or pay code are redirect channels
+// whose checkout URL is not stored, so they are never reused; nor are those
+// of another gateway, whose callbacks no longer arrive.
+func findReusablePayment(ctx context.Context, store Store, gateway string, req CreateTransactionRequest) (*PaymentRecord, error) {
+	filter := PaymentFilter{PhoneNumber: req.CustomerPhone, GroupID: req.GroupID, Product: productPremium}
+	if filter.PhoneNumber == "" && filter.GroupID == "" {
+		return nil, nil
+	}
+
+	pending, err := store.PendingPayments(ctx, filter, time.Now().Add(pendingReuseMargin))
+	if err != nil {
+		return nil, err
+	}
+
+	planID := planIDOfRequest(req)
+	for i := range pending {
+		p := &pending[i]
+		if p.PaymentNumber != "" &&
+			p.Gateway == gateway &&
+			p.Amount == req.Amount &&
+			p.PromoCode == req.PromoCode &&
+			p.ReferralCode == req.ReferralCode &&
+			p.RecipientPhone == req.RecipientPhone &&
+			p.RecipientGroupID == req.RecipientGroupID &&
+			p.GiftMessage == req.GiftMessage &&
+			strings.EqualFold(p.Method, paymentMethodOf(req)) &&
+			planIDFromOrderItems(p.OrderItems) == planID {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// reusedPaymentData builds the create-transaction response for a payment
+// that already exists, in the shape the gateways return for new ones
+func reusedPaymentData(p *PaymentRecord) map[string]interface{} {
+	data := map[string]interface{}{
+		"reference":         p.Reference,
+		"merchant_order_id": p.Reference,
+		"payment_method":    p.Method,
+		"amount":            p.Amount,
+		"total_amount":      p.Amount,
+		"status":            strings.ToLower(p.Status),
+		"reused":            true,
+	}
+	if status, ok := createdStatus[p.Gateway]; ok {
+		data["status"] = status
+	}
+	if p.PaymentNumber != "" {
+		data["payment_number"] = p.PaymentNumber
+		if strings.Contains(strings.ToUpper(p.Method), "QRIS") {
+			data["qr_code"] = p.PaymentNumber
+			data["qr_string"] = p.PaymentNumber
+		} else {
+			data["pay_code"] = p.PaymentNumber
+		}
+	}
+	if p.ExpiredAt != nil {
+		data["expired_at"] = p.ExpiredAt.Format(time.RFC3339)
+	}
+	if p.Fees != nil {
+		data["total_amount"] = p.Fees.TotalPaid
+		data["fee"] = p.Fees.Total()
+	}
+	return data
+}
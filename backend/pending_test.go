@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateTransactionReusesPendingPayment(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-NEW-1")}
+	paymentGateway = g
+
+	seed := func(reference, plan, status string, expiresIn time.Duration) {
+		t.Helper()
+		seedPayment(t, memory, reference, plan, status, "00020101021226"+reference, expiresIn)
+	}
+	seed("T-PENDING-1", "User Premium 30 Days", "UNPAID", time.Hour)
+	seed("T-ALMOST-EXPIRED", "User Premium 30 Days", "UNPAID", time.Minute)
+	seed("T-PAID", "User Premium 30 Days", "PAID", time.Hour)
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data["reference"] != "T-PENDING-1" || resp.Data["reused"] != true {
+		t.Fatalf("expected the pending transaction back, got %v", resp.Data)
+	}
+	if resp.Data["status"] != "UNPAID" || resp.Data["qr_code"] != "00020101021226T-PENDING-1" || resp.Data["expired_at"] == nil {
+		t.Fatalf("expected the stored QR string and expiry, got %v", resp.Data)
+	}
+	if n := g.creates.Load(); n != 0 {
+		t.Fatalf("expected no upstream call, got %d", n)
+	}
+
+	for name, body := range map[string]string{
+		"forceNew":       `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","forceNew":true,"orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`,
+		"other method":   `{"method":"BRIVA","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`,
+		"other plan":     `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"Group Premium 30 Days","price":15000,"quantity":1}]}`,
+		"other customer": `{"method":"QRIS","amount":15000,"customerPhone":"6289999999999","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`,
+	} {
+		before := g.creates.Load()
+		if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", name, rec.Code, rec.Body.String())
+		}
+		if g.creates.Load() != before+1 {
+			t.Fatalf("%s: expected a new upstream transaction", name)
+		}
+	}
+}
+
+// seedPayment stores a 15000 payment by 6281234567890 for plan
+func seedPayment(t *testing.T, memory *MemoryStore, reference, plan, status, paymentNumber string, expiresIn time.Duration) {
+	t.Helper()
+	items, _ := json.Marshal(orderItems(plan, 15000))
+	err := memory.CreatePayment(context.Background(), &PaymentRecord{
+		Reference:     reference,
+		MerchantRef:   reference,
+		Gateway:       "tripay",
+		PhoneNumber:   "6281234567890",
+		Method:        "QRIS",
+		Amount:        15000,
+		Status:        status,
+		OrderItems:    items,
+		PaymentNumber: paymentNumber,
+		ExpiredAt:     timePtr(time.Now().Add(expiresIn)),
+	})
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+}
+
+func TestCreateTransactionSkipsRedirectPayments(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-NEW-2")}
+	paymentGateway = g
+
+	// A redirect channel leaves only a checkout URL, which is not stored
+	seedPayment(t, memory, "T-REDIRECT", "User Premium 30 Days", "UNPAID", "", time.Hour)
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := g.creates.Load(); n != 1 {
+		t.Fatalf("expected a new upstream transaction, got %d", n)
+	}
+}
+
+func TestCreateTransactionSkipsOtherGatewayPayments(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-NEW-3")}
+	paymentGateway = g
+
+	// Made before PAYMENT_GATEWAY was switched; its callback goes nowhere
+	seedPayment(t, memory, "INV-PAKASIR-1", "User Premium 30 Days", "UNPAID", "00020101021226INV-PAKASIR-1", time.Hour)
+	memory.payments["INV-PAKASIR-1"].Gateway = "pakasir"
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := g.creates.Load(); n != 1 {
+		t.Fatalf("expected a new upstream transaction, got %d", n)
+	}
+}
+
+func TestReusedPaymentStatusMatchesGateway(t *testing.T) {
+	for gateway, want := range map[string]string{"tripay": "UNPAID", "pakasir": "pending", "iskapay": "pending", "": "unpaid"} {
+		data := reusedPaymentData(&PaymentRecord{Reference: "INV-1", Gateway: gateway, Status: "UNPAID"})
+		if data["status"] != want {
+			t.Errorf("%q: expected status %q, got %v", gateway, want, data["status"])
+		}
+	}
+}
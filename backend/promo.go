@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// planPrices are the list prices in rupiah, as shown on the pricing page.
+// Discounts are always taken off these, never off a client-supplied amount.
+var planPrices = map[string]int{
+	"user-5d":   7000,
+	"user-15d":  15000,
+	"user-1m":   20000,
+	"group-15d": 30000,
+	"group-1m":  50000,
+}
+
+// planItemNames name each plan's order item when the client's name does not
+// resolve to it; planIDFromName maps every one back to its plan
+var planItemNames = map[string]string{
+	"user-5d":   "User Premium 5 Days",
+	"user-15d":  "User Premium 15 Days",
+	"user-1m":   "User Premium 30 Days",
+	"group-15d": "Group Premium 15 Days",
+	"group-1m":  "Group Premium 30 Days",
+}
+
+// minimumPaymentAmount is the smallest amount a discount may leave, since
+// the gateways refuse anything lower
+const minimumPaymentAmount = 1000
+
+// Reasons a promo code cannot be applied. The messages are shown to customers.
+var (
+	ErrPromoInvalid       = errors.New("promo code is not valid")
+	ErrPromoNotStarted    = errors.New("promo code is not active yet")
+	ErrPromoExpired       = errors.New("promo code has expired")
+	ErrPromoNotApplicable = errors.New("promo code does not apply to this plan")
+	ErrPromoExhausted     = errors.New("promo code has been fully redeemed")
+	ErrPromoAlreadyUsed   = errors.New("promo code has already been used by this account")
+	ErrPromoFirstPurchase = errors.New("promo code is only valid on a first purchase")
+	ErrPromoNoOwner       = errors.New("a phone number or group ID is required to use a promo code")
+)
+
+// ErrPlanMismatch rejects an order item naming another plan than planId.
+// It is both a promo and a gift rejection.
+var ErrPlanMismatch = errors.New("the order item does not match the selected plan")
+
+var promoRejections = []error{
+	ErrPromoInvalid, ErrPromoNotStarted, ErrPromoExpired, ErrPromoNotApplicable,
+	ErrPromoExhausted, ErrPromoAlreadyUsed, ErrPromoFirstPurchase, ErrPromoNoOwner,
+	ErrPlanMismatch,
+}
+
+// isPromoRejection reports whether err is a customer-facing promo rejection
+// rather than a storage failure
+func isPromoRejection(err error) bool {
+	for _, rejection := range promoRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// PromoQuote is the price of a plan after a promo code
+type PromoQuote struct {
+	Code           string `json:"code"`
+	PlanID         string `json:"planId"`
+	OriginalAmount int    `json:"originalAmount"`
+	Discount       int    `json:"discount"`
+	FinalAmount    int    `json:"finalAmount"`
+}
+
+// promoIdentity is the phone number or group a redemption counts against
+func promoIdentity(filter PaymentFilter) string {
+	if filter.GroupID != "" {
+		return filter.GroupID
+	}
+	return filter.PhoneNumber
+}
+
+// discountFor returns the discount p gives on price, leaving at least
+// minimumPaymentAmount to pay
+func (p *PromoCode) discountFor(price int) int {
+	discount := p.DiscountValue
+	if p.DiscountType == DiscountPercent {
+		discount = price * p.DiscountValue / 100
+		if p.MaxDiscount > 0 && discount > p.MaxDiscount {
+			discount = p.MaxDiscount
+		}
+	}
+	if limit := price - minimumPaymentAmount; discount > limit {
+		discount = limit
+	}
+	if discount < 0 {
+		discount = 0
+	}
+	return discount
+}
+
+// appliesTo reports whether p may be used on planID
+func (p *PromoCode) appliesTo(planID string) bool {
+	if len(p.PlanIDs) == 0 {
+		return true
+	}
+	for _, id := range p.PlanIDs {
+		if id == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// quotePromo checks every rule of code for planID and the paying owner and
+// returns the discounted price
+func quotePromo(ctx context.Context, store Store, code, planID string, filter PaymentFilter, now time.Time) (*PromoQuote, error) {
+	identity := promoIdentity(filter)
+	if identity == "" {
+		return nil, ErrPromoNoOwner
+	}
+
+	promo, err := store.GetPromoCode(ctx, strings.TrimSpace(code))
+	if err == ErrPromoNotFound {
+		return nil, ErrPromoInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !promo.Active:
+		return nil, ErrPromoInvalid
+	case promo.ValidFrom != nil && now.Before(*promo.ValidFrom):
+		return nil, ErrPromoNotStarted
+	case promo.ValidUntil != nil && now.After(*promo.ValidUntil):
+		return nil, ErrPromoExpired
+	}
+
+	price, ok := planPrices[planID]
+	if !ok || !promo.appliesTo(planID) {
+		return nil, ErrPromoNotApplicable
+	}
+
+	if promo.MaxRedemptions > 0 || promo.MaxPerIdentity > 0 {
+		total, byIdentity, err := store.CountPromoRedemptions(ctx, promo.Code, identity)
+		if err != nil {
+			return nil, err
+		}
+		if promo.MaxRedemptions > 0 && total >= promo.MaxRedemptions {
+			return nil, ErrPromoExhausted
+		}
+		if promo.MaxPerIdentity > 0 && byIdentity >= promo.MaxPerIdentity {
+			return nil, ErrPromoAlreadyUsed
+		}
+	}
+
+	if promo.FirstPurchaseOnly {
+		plans := filter
+		plans.Product = productPremium
+		paid, err := store.CountPaidPayments(ctx, plans)
+		if err != nil {
+			return nil, err
+		}
+		if paid > 0 {
+			return nil, ErrPromoFirstPurchase
+		}
+	}
+
+	discount := promo.discountFor(price)
+	return &PromoQuote{
+		Code:           promo.Code,
+		PlanID:         planID,
+		OriginalAmount: price,
+		Discount:       discount,
+		FinalAmount:    price - discount,
+	}, nil
+}
+
+// planIDOfRequest returns the plan being bought, preferring the explicit
+// plan ID over parsing the order item name
+func planIDOfRequest(req CreateTransactionRequest) string {
+	if req.PlanID != "" {
+		return req.PlanID
+	}
+	orderItems, _ := json.Marshal(req.OrderItems)
+	return planIDFromOrderItems(orderItems)
+}
+
+// checkPlanID rejects a request whose plan ID and order item name name
+// different plans. The plan ID sets the price but the item name decides what
+// activatePremium grants, so they must agree.
+func checkPlanID(req CreateTransactionRequest) error {
+	if req.PlanID == "" {
+		return nil
+	}
+	orderItems, _ := json.Marshal(req.OrderItems)
+	if itemPlan := planIDFromOrderItems(orderItems); itemPlan != "" && itemPlan != req.PlanID {
+		return ErrPlanMismatch
+	}
+	return nil
+}
+
+// applyPromo prices req from the plan list price minus its promo code. The
+// single order item is rewritten too, since gateways check that the items
+// add up to the amount, and renamed after the plan unless its name already
+// resolves to it, so activatePremium grants what was priced.
+func applyPromo(ctx context.Context, store Store, req *CreateTransactionRequest) error {
+	if err := checkPlanID(*req); err != nil {
+		return err
+	}
+	planID := planIDOfRequest(*req)
+	quote, err := quotePromo(ctx, store, req.PromoCode, planID, PaymentFilter{PhoneNumber: req.CustomerPhone, GroupID: req.GroupID}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var items []map[string]interface{}
+	raw, _ := json.Marshal(req.OrderItems)
+	json.Unmarshal(raw, &items)
+	name := planNameFromOrderItems(items)
+	if planIDFromName(name) != planID {
+		name = planItemNames[planID]
+	}
+
+	req.Amount = quote.FinalAmount
+	req.OrderItems = []map[string]interface{}{
+		{"name": name, "price": quote.FinalAmount, "quantity": 1},
+	}
+	req.PromoCode = quote.Code
+	req.DiscountAmount = quote.Discount
+	return nil
+}
+
+// redeemPromo counts the promo code of a payment that just became PAID
+func redeemPromo(ctx context.Context, store Store, payment *PaymentRecord) {
+	redeemed, err := store.RedeemPromoCode(ctx, PromoRedemption{
+		Code:       payment.PromoCode,
+		Reference:  payment.Reference,
+		Identity:   promoIdentity(PaymentFilter{PhoneNumber: payment.PhoneNumber, GroupID: payment.GroupID}),
+		Discount:   payment.DiscountAmount,
+		RedeemedAt: time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record promo redemption", "reference", payment.Reference, "promo_code", payment.PromoCode, "error", err)
+		return
+	}
+	if redeemed {
+		slog.InfoContext(ctx, "promo code redeemed", "reference", payment.Reference, "promo_code", payment.PromoCode, "discount", payment.DiscountAmount)
+	}
+}
+
+// PromoValidateRequest is the body of POST /api/promo/validate
+type PromoValidateRequest struct {
+	Code          string `json:"code"`
+	PlanID        string `json:"planId"`
+	CustomerPhone string `json:"customerPhone"`
+	GroupID       string `json:"groupId"`
+}
+
+// promoValidateHandler quotes a promo code for a plan without reserving it
+func promoValidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PromoValidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.PlanID == "" {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "code and planId are required",
+		})
+		return
+	}
+
+	quote, err := quotePromo(r.Context(), store, req.Code, req.PlanID, PaymentFilter{PhoneNumber: req.CustomerPhone, GroupID: req.GroupID}, time.Now())
+	if err != nil {
+		if isPromoRejection(err) {
+			respondJSON(w, http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to validate promo code", "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Payment service is temporarily unavailable, please try again later",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    quote,
+		Message: "Promo code applied",
+	})
+}
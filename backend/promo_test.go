@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotePromo(t *testing.T) {
+	memory := NewMemoryStore()
+	now := time.Now()
+	memory.SetPromoCode(PromoCode{Code: "hemat20", DiscountType: DiscountPercent, DiscountValue: 20, MaxDiscount: 5000, Active: true})
+	memory.SetPromoCode(PromoCode{Code: "POTONG", DiscountType: DiscountFixed, DiscountValue: 100000, PlanIDs: []string{"user-1m"}, Active: true})
+	memory.SetPromoCode(PromoCode{Code: "LATE", DiscountType: DiscountFixed, DiscountValue: 1000, ValidUntil: timePtr(now.Add(-time.Hour)), Active: true})
+	memory.SetPromoCode(PromoCode{Code: "EARLY", DiscountType: DiscountFixed, DiscountValue: 1000, ValidFrom: timePtr(now.Add(time.Hour)), Active: true})
+	memory.SetPromoCode(PromoCode{Code: "OFF", DiscountType: DiscountFixed, DiscountValue: 1000})
+	memory.SetPromoCode(PromoCode{Code: "NEWBIE", DiscountType: DiscountFixed, DiscountValue: 1000, FirstPurchaseOnly: true, Active: true})
+	memory.SetPromoCode(PromoCode{Code: "ONCE", DiscountType: DiscountFixed, DiscountValue: 1000, MaxPerIdentity: 1, Active: true})
+	memory.SetPromoCode(PromoCode{Code: "LIMITED", DiscountType: DiscountFixed, DiscountValue: 1000, MaxRedemptions: 1, Active: true})
+
+	memory.CreatePayment(context.Background(), &PaymentRecord{Reference: "OLD-1", MerchantRef: "OLD-1", PhoneNumber: "6281111111111", Status: "PAID"})
+	memory.RedeemPromoCode(context.Background(), PromoRedemption{Code: "ONCE", Reference: "OLD-1", Identity: "6281111111111"})
+	memory.RedeemPromoCode(context.Background(), PromoRedemption{Code: "LIMITED", Reference: "OLD-2", Identity: "6282222222222"})
+
+	returning := PaymentFilter{PhoneNumber: "6281111111111"}
+	fresh := PaymentFilter{PhoneNumber: "6283333333333"}
+
+	tests := []struct {
+		code, plan   string
+		filter       PaymentFilter
+		wantErr      error
+		wantDiscount int
+	}{
+		{"HEMAT20", "user-15d", fresh, nil, 3000},
+		{"hemat20", "group-1m", fresh, nil, 5000}, // capped at MaxDiscount
+		{"POTONG", "user-1m", fresh, nil, 19000},  // leaves the minimum payable
+		{"POTONG", "user-15d", fresh, ErrPromoNotApplicable, 0},
+		{"HEMAT20", "unknown-plan", fresh, ErrPromoNotApplicable, 0},
+		{"LATE", "user-1m", fresh, ErrPromoExpired, 0},
+		{"EARLY", "user-1m", fresh, ErrPromoNotStarted, 0},
+		{"OFF", "user-1m", fresh, ErrPromoInvalid, 0},
+		{"NOPE", "user-1m", fresh, ErrPromoInvalid, 0},
+		{"NEWBIE", "user-1m", fresh, nil, 1000},
+		{"NEWBIE", "user-1m", returning, ErrPromoFirstPurchase, 0},
+		{"ONCE", "user-1m", fresh, nil, 1000},
+		{"ONCE", "user-1m", returning, ErrPromoAlreadyUsed, 0},
+		{"LIMITED", "user-1m", fresh, ErrPromoExhausted, 0},
+		{"HEMAT20", "user-1m", PaymentFilter{}, ErrPromoNoOwner, 0},
+	}
+	for _, tt := range tests {
+		quote, err := quotePromo(context.Background(), memory, tt.code, tt.plan, tt.filter, now)
+		if err != tt.wantErr {
+			t.Errorf("%s on %s: expected error %v, got %v", tt.code, tt.plan, tt.wantErr, err)
+			continue
+		}
+		if err == nil && (quote.Discount != tt.wantDiscount || quote.FinalAmount != quote.OriginalAmount-tt.wantDiscount) {
+			t.Errorf("%s on %s: unexpected quote %+v", tt.code, tt.plan, quote)
+		}
+	}
+}
+
+func TestPromoRedeemedOnlyWhenPaid(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Tester")
+	memory.SetPromoCode(PromoCode{Code: "HEMAT20", DiscountType: DiscountPercent, DiscountValue: 20, MaxPerIdentity: 1, Active: true})
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-PROMO-1")}
+	paymentGateway = g
+
+	// The client-supplied amount is ignored in favour of the list price
+	body := `{"method":"QRIS","amount":1,"customerPhone":"6281234567890","planId":"user-1m","promoCode":"hemat20","orderItems":[{"name":"User Premium - 1 Bulan","price":1,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if g.last.Amount != 16000 {
+		t.Fatalf("expected the gateway to charge 16000, got %d", g.last.Amount)
+	}
+	items, _ := json.Marshal(g.last.OrderItems)
+	if !strings.Contains(string(items), `"price":16000`) {
+		t.Fatalf("expected order items to add up to the charged amount, got %s", items)
+	}
+
+	payment, err := memory.GetPayment(context.Background(), "T-PROMO-1")
+	if err != nil {
+		t.Fatalf("GetPayment failed: %v", err)
+	}
+	if payment.PromoCode != "HEMAT20" || payment.DiscountAmount != 4000 || payment.Amount != 16000 {
+		t.Fatalf("expected promo recorded on the payment, got %+v", payment)
+	}
+
+	if total, _, _ := memory.CountPromoRedemptions(context.Background(), "HEMAT20", "6281234567890"); total != 0 {
+		t.Fatalf("expected no redemption before payment, got %d", total)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tripayCallback(t, g.TripayGateway, "T-PROMO-1", "PAID", 16000); err != nil {
+			t.Fatalf("callback failed: %v", err)
+		}
+	}
+	if total, byIdentity, _ := memory.CountPromoRedemptions(context.Background(), "HEMAT20", "6281234567890"); total != 1 || byIdentity != 1 {
+		t.Fatalf("expected exactly one redemption after payment, got %d/%d", total, byIdentity)
+	}
+
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the per-identity cap to reject a second use, got %d", rec.Code)
+	}
+}
+
+func TestPromoRejectsPlanMismatch(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetPromoCode(PromoCode{Code: "HEMAT20", DiscountType: DiscountPercent, DiscountValue: 20, Active: true})
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-PROMO-2")}
+	paymentGateway = g
+
+	// Priced as a 5 day user plan, but the item would activate a group month
+	body := `{"method":"QRIS","amount":1,"customerPhone":"6281234567890","planId":"user-5d","promoCode":"HEMAT20","orderItems":[{"name":"Group Premium 30 Days","price":1,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrPlanMismatch.Error()) {
+		t.Fatalf("expected the mismatch to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := g.creates.Load(); n != 0 {
+		t.Fatalf("expected no upstream call, got %d", n)
+	}
+}
+
+func TestPromoValidateHandler(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetPromoCode(PromoCode{Code: "HEMAT20", DiscountType: DiscountPercent, DiscountValue: 20, Active: true})
+	store = memory
+
+	validate := func(body string) (*httptest.ResponseRecorder, APIResponse) {
+		rec := httptest.NewRecorder()
+		promoValidateHandler(rec, httptest.NewRequest(http.MethodPost, "/api/promo/validate", strings.NewReader(body)))
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, resp := validate(`{"code":"hemat20","planId":"user-15d","customerPhone":"6281234567890"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	quote := resp.Data.(map[string]interface{})
+	if quote["code"] != "HEMAT20" || quote["finalAmount"] != float64(12000) || quote["discount"] != float64(3000) {
+		t.Fatalf("unexpected quote: %v", quote)
+	}
+
+	rec, resp = validate(`{"code":"NOPE","planId":"user-15d","customerPhone":"6281234567890"}`)
+	if rec.Code != http.StatusBadRequest || resp.Message != ErrPromoInvalid.Error() {
+		t.Fatalf("expected 400 with the rejection reason, got %d %q", rec.Code, resp.Message)
+	}
+
+	if rec, _ := validate(`{"code":"HEMAT20"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a plan, got %d", rec.Code)
+	}
+}
+
+func TestPromoRenamesUnknownPlanItem(t *testing.T) {
+	for planID, name := range planItemNames {
+		if got := planIDFromName(name); got != planID {
+			t.Errorf("%s: item name %q resolves to %q", planID, name, got)
+		}
+	}
+
+	memory := NewMemoryStore()
+	memory.SetPromoCode(PromoCode{Code: "HEMAT20", DiscountType: DiscountPercent, DiscountValue: 20, Active: true})
+	store = memory
+	g := &countingGateway{TripayGateway: newTripayTestGateway(t, "T-PROMO-3")}
+	paymentGateway = g
+
+	// A name that resolves to no plan would leave the paid plan unactivated
+	body := `{"method":"QRIS","amount":1,"customerPhone":"6281234567890","planId":"user-1m","promoCode":"HEMAT20","orderItems":[{"name":"Premium - Subscription","price":1,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	items, _ := json.Marshal(g.last.OrderItems)
+	if planIDFromOrderItems(items) != "user-1m" {
+		t.Fatalf("expected the item to be renamed after the plan, got %s", items)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// QR image sizes in pixels, without the caption
+const (
+	defaultQRISImageSize = 512
+	minQRISImageSize     = 128
+	maxQRISImageSize     = 2048
+)
+
+// qrisPayloadPrefix starts every EMVCo QR payload (payload format indicator 01)
+const qrisPayloadPrefix = "000201"
+
+var (
+	qrisLogoOnce sync.Once
+	qrisLogo     image.Image
+)
+
+// qrisLogoImage returns the logo from QRIS_LOGO_PATH, or nil without one
+func qrisLogoImage() image.Image {
+	qrisLogoOnce.Do(func() {
+		path := os.Getenv("QRIS_LOGO_PATH")
+		if path == "" {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			slog.Warn("failed to open QRIS logo", "path", path, "error", err)
+			return
+		}
+		defer f.Close()
+		if qrisLogo, _, err = image.Decode(f); err != nil {
+			slog.Warn("failed to decode QRIS logo", "path", path, "error", err)
+		}
+	})
+	return qrisLogo
+}
+
+// qrisToken authorizes rendering the QR code of reference
+func qrisToken(reference string) string {
+	mac := hmac.New(sha256.New, receiptKey())
+	mac.Write([]byte("qris:" + reference))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// qrisImagePath returns the signed link to the QR code of reference as a
+// PNG or SVG image
+func qrisImagePath(reference, format string) string {
+	return "/api/qris/" + url.PathEscape(reference) + "." + format + "?token=" + qrisToken(reference)
+}
+
+// addQRISImageURL links a transaction response that carries a QRIS payload
+// to its rendered QR code, so the bot can send it as an image
+func addQRISImageURL(data interface{}, reference string) {
+	response, ok := data.(map[string]interface{})
+	if !ok || reference == "" {
+		return
+	}
+	if qrisPayloadOf(response) != "" {
+		response["qris_image_url"] = qrisImagePath(reference, "png")
+	}
+}
+
+// qrisImageOptions describe how a QR code is drawn
+type qrisImageOptions struct {
+	Size    int         // width of the QR code in pixels
+	Logo    image.Image // drawn in the middle, or nil
+	Caption string      // printed below the code, or ""
+}
+
+// newQRCode encodes payload, with more error correction when a logo will
+// cover part of it
+func newQRCode(payload string, opts qrisImageOptions) (*qrcode.QRCode, error) {
+	level := qrcode.Medium
+	if opts.Logo != nil {
+		level = qrcode.High
+	}
+	return qrcode.New(payload, level)
+}
+
+// captionHeight is the height of the caption strip below a QR code
+func captionHeight(size int) int {
+	return size / 8
+}
+
+// renderQRISPNG writes payload as a PNG QR code
+func renderQRISPNG(w io.Writer, payload string, opts qrisImageOptions) error {
+	q, err := newQRCode(payload, opts)
+	if err != nil {
+		return err
+	}
+
+	height := opts.Size
+	if opts.Caption != "" {
+		height += captionHeight(opts.Size)
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Size, height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, image.Rect(0, 0, opts.Size, opts.Size), q.Image(opts.Size), image.Point{}, draw.Src)
+
+	if opts.Logo != nil {
+		box := logoBox(opts.Size)
+		draw.Draw(canvas, box.Inset(-opts.Size/100), image.White, image.Point{}, draw.Src)
+		xdraw.ApproxBiLinear.Scale(canvas, box, opts.Logo, opts.Logo.Bounds(), draw.Over, nil)
+	}
+	if opts.Caption != "" {
+		drawCaption(canvas, image.Rect(0, opts.Size, opts.Size, height), opts.Caption)
+	}
+	return png.Encode(w, canvas)
+}
+
+// logoBox is where the logo goes on a QR code of size pixels: a centered
+// square a fifth as wide, well within what high error correction recovers
+func logoBox(size int) image.Rectangle {
+	side := size / 5
+	at := (size - side) / 2
+	return image.Rect(at, at, at+side, at+side)
+}
+
+// drawCaption prints text centered in area with the built-in bitmap font,
+// scaled up to fill the area's height
+func drawCaption(dst draw.Image, area image.Rectangle, text string) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	if width == 0 {
+		return
+	}
+	small := image.NewRGBA(image.Rect(0, 0, width, face.Height))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	d := font.Drawer{Dst: small, Src: image.NewUniform(color.Black), Face: face, Dot: fixed.P(0, face.Ascent)}
+	d.DrawString(text)
+
+	scale := max(1, min(area.Dy()*3/4/face.Height, area.Dx()*9/10/width))
+	w, h := width*scale, face.Height*scale
+	x, y := area.Min.X+(area.Dx()-w)/2, area.Min.Y+(area.Dy()-h)/2
+	xdraw.NearestNeighbor.Scale(dst, image.Rect(x, y, x+w, y+h), small, small.Bounds(), draw.Over, nil)
+}
+
+// renderQRISSVG writes payload as an SVG QR code, one unit per module
+func renderQRISSVG(w io.Writer, payload string, opts qrisImageOptions) error {
+	q, err := newQRCode(payload, opts)
+	if err != nil {
+		return err
+	}
+	bitmap := q.Bitmap()
+	n := len(bitmap)
+
+	// Caption and logo are laid out in module units, in proportion to the
+	// PNG rendering
+	viewHeight := float64(n)
+	height := opts.Size
+	if opts.Caption != "" {
+		viewHeight += float64(n) / 8
+		height += captionHeight(opts.Size)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %s" shape-rendering="crispEdges">`,
+		opts.Size, height, n, strconv.FormatFloat(viewHeight, 'f', -1, 64))
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			run := 1
+			for x+run < n && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x, y, run, run)
+			x += run - 1
+		}
+	}
+	b.WriteString(`"/>`)
+
+	if opts.Logo != nil {
+		var logo bytes.Buffer
+		if err := png.Encode(&logo, opts.Logo); err != nil {
+			return err
+		}
+		side := float64(n) / 5
+		at := (float64(n) - side) / 2
+		pad := float64(n) / 100
+		fmt.Fprintf(&b, `<rect x="%s" y="%s" width="%s" height="%s" fill="#fff"/>`,
+			svgNumber(at-pad), svgNumber(at-pad), svgNumber(side+2*pad), svgNumber(side+2*pad))
+		fmt.Fprintf(&b, `<image x="%s" y="%s" width="%s" height="%s" href="data:image/png;base64,%s"/>`,
+			svgNumber(at), svgNumber(at), svgNumber(side), svgNumber(side), base64.StdEncoding.EncodeToString(logo.Bytes()))
+	}
+	if opts.Caption != "" {
+		fmt.Fprintf(&b, `<text x="%s" y="%s" font-family="sans-serif" font-weight="bold" font-size="%s" text-anchor="middle" dominant-baseline="middle">`,
+			svgNumber(float64(n)/2), svgNumber(float64(n)+float64(n)/16), svgNumber(float64(n)/14))
+		xml.EscapeText(&b, []byte(opts.Caption))
+		b.WriteString(`</text>`)
+	}
+	b.WriteString(`</svg>`)
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+func svgNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// qrisImageHandler renders the QRIS code of an UNPAID payment:
+// GET /api/qris/{reference}.png|svg?token=...&size=512&logo=true&caption=true
+// The caption shows the amount to pay; the logo comes from QRIS_LOGO_PATH.
+func qrisImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/qris/")
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 || (name[dot+1:] != "png" && name[dot+1:] != "svg") {
+		respondJSON(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "QR images are served as .png or .svg",
+		})
+		return
+	}
+	reference, format := name[:dot], name[dot+1:]
+	tagPaymentReference(r.Context(), reference)
+
+	if !hmac.Equal([]byte(r.URL.Query().Get("token")), []byte(qrisToken(reference))) {
+		respondJSON(w, http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "Invalid QR code link",
+		})
+		return
+	}
+
+	opts, showAmount, err := parseQRISImageOptions(r)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	payment, err := store.GetPayment(r.Context(), reference)
+	if errors.Is(err, ErrPaymentNotFound) {
+		respondJSON(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Payment not found",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up payment for QR code", "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+	if !strings.Contains(strings.ToUpper(payment.Method), "QRIS") || !strings.HasPrefix(payment.PaymentNumber, qrisPayloadPrefix) {
+		respondJSON(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Payment has no QRIS code",
+		})
+		return
+	}
+	if payment.Status != "UNPAID" || (payment.ExpiredAt != nil && payment.ExpiredAt.Before(time.Now())) {
+		respondJSON(w, http.StatusGone, APIResponse{
+			Success: false,
+			Message: "QRIS code can no longer be paid",
+		})
+		return
+	}
+
+	if showAmount {
+		amount := payment.Amount
+		if payment.Fees != nil {
+			amount = payment.Fees.TotalPaid
+		}
+		opts.Caption = formatRupiah(amount)
+	}
+
+	var buf bytes.Buffer
+	contentType := "image/png"
+	if format == "svg" {
+		contentType = "image/svg+xml"
+		err = renderQRISSVG(&buf, payment.PaymentNumber, opts)
+	} else {
+		err = renderQRISPNG(&buf, payment.PaymentNumber, opts)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to render QR code", "format", format, "error", err)
+		respondJSON(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to render QR code",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// parseQRISImageOptions reads size and logo from the query, and whether
+// caption asks for the amount below the code
+func parseQRISImageOptions(r *http.Request) (opts qrisImageOptions, showAmount bool, err error) {
+	query := r.URL.Query()
+	opts.Size = defaultQRISImageSize
+	if raw := query.Get("size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < minQRISImageSize || size > maxQRISImageSize {
+			return opts, false, fmt.Errorf("size must be between %d and %d pixels", minQRISImageSize, maxQRISImageSize)
+		}
+		opts.Size = size
+	}
+	if raw := query.Get("logo"); raw != "" {
+		logo, err := strconv.ParseBool(raw)
+		if err != nil {
+			return opts, false, fmt.Errorf("logo must be true or false")
+		}
+		if logo {
+			opts.Logo = qrisLogoImage()
+		}
+	}
+	if raw := query.Get("caption"); raw != "" {
+		if showAmount, err = strconv.ParseBool(raw); err != nil {
+			return opts, false, fmt.Errorf("caption must be true or false")
+		}
+	}
+	return opts, showAmount, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// testQRISPayload is a static QRIS code as printed on the donation page
+const testQRISPayload = "00020101021126570011ID.DANA.WWW011893600915377709982202097770998220303UMI51440014ID.CO.QRIS.WWW0215ID10254099274110303UMI5204481453033605802ID5913Shiroine Cell6015Kota Jakarta Ti61051347063044DC7"
+
+func TestRenderQRISPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := renderQRISPNG(&buf, testQRISPayload, qrisImageOptions{Size: 400}); err != nil {
+		t.Fatalf("renderQRISPNG failed: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("not a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 400 {
+		t.Fatalf("expected 400x400, got %v", b)
+	}
+
+	// Every module is drawn where the encoder put it
+	q, _ := qrcode.New(testQRISPayload, qrcode.Medium)
+	bitmap := q.Bitmap()
+	module := 400 / len(bitmap)
+	offset := (400 - module*len(bitmap)) / 2
+	for y, row := range bitmap {
+		for x, dark := range row {
+			r, _, _, _ := img.At(offset+x*module+module/2, offset+y*module+module/2).RGBA()
+			if (r == 0) != dark {
+				t.Fatalf("module (%d, %d) should be dark=%v", x, y, dark)
+			}
+		}
+	}
+
+	buf.Reset()
+	logo := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	if err := renderQRISPNG(&buf, testQRISPayload, qrisImageOptions{Size: 400, Logo: logo, Caption: "Rp 16.112"}); err != nil {
+		t.Fatalf("renderQRISPNG with logo and caption failed: %v", err)
+	}
+	img, _ = png.Decode(&buf)
+	if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 450 {
+		t.Fatalf("expected room for the caption, got %v", b)
+	}
+	dark := 0
+	for y := 400; y < 450; y++ {
+		for x := 0; x < 400; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r == 0 {
+				dark++
+			}
+		}
+	}
+	if dark == 0 {
+		t.Errorf("expected the caption to be drawn")
+	}
+}
+
+func TestRenderQRISSVG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := renderQRISSVG(&buf, testQRISPayload, qrisImageOptions{Size: 300, Caption: "Rp 16.112 <test>"}); err != nil {
+		t.Fatalf("renderQRISSVG failed: %v", err)
+	}
+	var svg struct {
+		Width  int `xml:"width,attr"`
+		Height int `xml:"height,attr"`
+		Path   struct {
+			D string `xml:"d,attr"`
+		} `xml:"path"`
+		Text string `xml:"text"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &svg); err != nil {
+		t.Fatalf("not well-formed SVG: %v", err)
+	}
+	if svg.Width != 300 || svg.Height != 337 || svg.Text != "Rp 16.112 <test>" {
+		t.Errorf("unexpected SVG %dx%d with caption %q", svg.Width, svg.Height, svg.Text)
+	}
+	if !strings.HasPrefix(svg.Path.D, "M") {
+		t.Errorf("expected the modules as a path")
+	}
+}
+
+func TestQRISImageHandler(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	ctx := context.Background()
+	memory.CreatePayment(ctx, &PaymentRecord{
+		Reference: "T-QR-1", MerchantRef: "T-QR-1", Method: "QRIS", Amount: 16000, Status: "UNPAID",
+		PaymentNumber: testQRISPayload, ExpiredAt: timePtr(time.Now().Add(time.Hour)),
+	})
+	memory.SetPaymentFees(ctx, "T-QR-1", *newPaymentFees(16112, 0, 112))
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "T-VA-1", MerchantRef: "T-VA-1", Method: "BRI_VA", Amount: 16000, Status: "UNPAID", PaymentNumber: "8800123456"})
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "T-QR-PAID", MerchantRef: "T-QR-PAID", Method: "QRIS", Amount: 16000, Status: "UNPAID", PaymentNumber: testQRISPayload})
+	memory.MarkPaymentPaid(ctx, "T-QR-PAID", time.Now())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		qrisImageHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get(qrisImagePath("T-QR-1", "png") + "&size=256&caption=true")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected a PNG, got %d %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	config, err := png.DecodeConfig(rec.Body)
+	if err != nil || config.Width != 256 || config.Height != 288 {
+		t.Fatalf("expected a 256px code with a caption, got %+v, %v", config, err)
+	}
+
+	rec = get(qrisImagePath("T-QR-1", "svg") + "&caption=1")
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/svg+xml" || !strings.Contains(string(body), "Rp 16.112") {
+		t.Fatalf("expected an SVG captioned with the total, got %d: %s", rec.Code, body)
+	}
+
+	for path, want := range map[string]int{
+		"/api/qris/T-QR-1.png?token=wrong":                                 http.StatusForbidden,
+		qrisImagePath("T-QR-1", "png") + "&size=64":                        http.StatusBadRequest,
+		qrisImagePath("T-QR-1", "png") + "&logo=maybe":                     http.StatusBadRequest,
+		strings.Replace(qrisImagePath("T-QR-1", "png"), ".png", ".gif", 1): http.StatusNotFound,
+		qrisImagePath("T-MISSING", "png"):                                  http.StatusNotFound,
+		qrisImagePath("T-VA-1", "png"):                                     http.StatusNotFound,
+		qrisImagePath("T-QR-PAID", "png"):                                  http.StatusGone,
+	} {
+		if rec := get(path); rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
+
+func TestAddQRISImageURL(t *testing.T) {
+	data := map[string]interface{}{"merchant_order_id": "T-QR-1", "qr_string": testQRISPayload}
+	addQRISImageURL(data, "T-QR-1")
+	if data["qris_image_url"] != qrisImagePath("T-QR-1", "png") {
+		t.Errorf("expected a QR image link, got %v", data["qris_image_url"])
+	}
+
+	va := map[string]interface{}{"merchant_order_id": "T-VA-1", "payment_number": "8800123456"}
+	addQRISImageURL(va, "T-VA-1")
+	if _, ok := va["qris_image_url"]; ok {
+		t.Errorf("expected no QR image for a virtual account")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Errors returned for QRIS payloads
+var (
+	ErrQRISMalformed      = errors.New("QRIS payload is malformed")
+	ErrQRISChecksum       = errors.New("QRIS payload checksum does not match")
+	ErrQRISAmountMismatch = errors.New("QRIS amount does not match the payment")
+)
+
+// QRISPayload is what a QRIS code tells the customer's wallet
+type QRISPayload struct {
+	Dynamic bool // point of initiation 12: the code is for a single payment
+	// MerchantID is the national merchant ID (NMID) from tag 51, or the
+	// merchant ID of the first merchant account when there is no NMID
+	MerchantID   string
+	MerchantName string
+	MerchantCity string
+	Amount       int // in rupiah, 0 when the customer enters the amount
+}
+
+// emvField is one tag-length-value field of an EMVCo QR payload
+type emvField struct {
+	Tag   string
+	Value string
+}
+
+// parseEMVFields splits s into its fields: a two digit tag, a two digit
+// length and the value
+func parseEMVFields(s string) ([]emvField, error) {
+	var fields []emvField
+	for len(s) > 0 {
+		if len(s) < 4 {
+			return nil, fmt.Errorf("%w: truncated field", ErrQRISMalformed)
+		}
+		tag := s[:2]
+		length, err := strconv.Atoi(s[2:4])
+		if err != nil || length < 0 || !isDigits(tag) {
+			return nil, fmt.Errorf("%w: bad field header %q", ErrQRISMalformed, s[:4])
+		}
+		if len(s) < 4+length {
+			return nil, fmt.Errorf("%w: field %s is truncated", ErrQRISMalformed, tag)
+		}
+		fields = append(fields, emvField{Tag: tag, Value: s[4 : 4+length]})
+		s = s[4+length:]
+	}
+	return fields, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// ParseQRIS parses a QRIS payload and verifies its CRC
+func ParseQRIS(payload string) (*QRISPayload, error) {
+	fields, err := parseEMVFields(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || fields[0].Tag != "00" || fields[0].Value != "01" {
+		return nil, fmt.Errorf("%w: missing payload format indicator", ErrQRISMalformed)
+	}
+	last := fields[len(fields)-1]
+	if last.Tag != "63" || len(last.Value) != 4 {
+		return nil, fmt.Errorf("%w: missing CRC", ErrQRISMalformed)
+	}
+	// The CRC covers everything up to and including its own tag and length
+	if want := fmt.Sprintf("%04X", crc16CCITT(payload[:len(payload)-4])); !strings.EqualFold(last.Value, want) {
+		return nil, ErrQRISChecksum
+	}
+
+	qr := &QRISPayload{}
+	var accountID string
+	for _, f := range fields[1 : len(fields)-1] {
+		tag, _ := strconv.Atoi(f.Tag)
+		switch {
+		case f.Tag == "01":
+			qr.Dynamic = f.Value == "12"
+		case tag >= 26 && tag <= 51:
+			// Merchant account templates carry the merchant ID in sub-tag 02
+			sub, err := parseEMVFields(f.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: merchant account %s", ErrQRISMalformed, f.Tag)
+			}
+			for _, s := range sub {
+				if s.Tag != "02" {
+					continue
+				}
+				if tag == 51 {
+					qr.MerchantID = s.Value
+				} else if accountID == "" {
+					accountID = s.Value
+				}
+			}
+		case f.Tag == "54":
+			if qr.Amount, err = parseQRISAmount(f.Value); err != nil {
+				return nil, err
+			}
+		case f.Tag == "59":
+			qr.MerchantName = strings.TrimSpace(f.Value)
+		case f.Tag == "60":
+			qr.MerchantCity = strings.TrimSpace(f.Value)
+		}
+	}
+	if qr.MerchantID == "" {
+		qr.MerchantID = accountID
+	}
+	if qr.MerchantName == "" {
+		return nil, fmt.Errorf("%w: missing merchant name", ErrQRISMalformed)
+	}
+	return qr, nil
+}
+
+// parseQRISAmount parses a transaction amount such as 16112 or 16112.00.
+// Rupiah have no minor unit, so any cents are refused.
+func parseQRISAmount(s string) (int, error) {
+	whole, cents, _ := strings.Cut(s, ".")
+	if !isDigits(whole) || strings.Trim(cents, "0") != "" {
+		return 0, fmt.Errorf("%w: bad amount %q", ErrQRISMalformed, s)
+	}
+	amount, err := strconv.Atoi(whole)
+	if err != nil || amount <= 0 {
+		return 0, fmt.Errorf("%w: bad amount %q", ErrQRISMalformed, s)
+	}
+	return amount, nil
+}
+
+// crc16CCITT is the CRC-16/CCITT-FALSE checksum QRIS payloads end with
+func crc16CCITT(data string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// qrisPayloadOf returns the QRIS payload a gateway response carries, if any
+func qrisPayloadOf(response map[string]interface{}) string {
+	for _, key := range []string{"qr_string", "qr_code", "payment_number"} {
+		if s, _ := response[key].(string); strings.HasPrefix(s, qrisPayloadPrefix) {
+			return s
+		}
+	}
+	return ""
+}
+
+// checkQRISPayment verifies the QRIS code of a newly created payment, and
+// that a code with an amount charges what the payment was stored with,
+// customer fee included
+func checkQRISPayment(ctx context.Context, response map[string]interface{}, reference string) error {
+	payload := qrisPayloadOf(response)
+	if payload == "" {
+		return nil
+	}
+	qr, err := ParseQRIS(payload)
+	if err != nil {
+		return err
+	}
+	if qr.Amount == 0 {
+		return nil
+	}
+
+	payment, err := store.GetPayment(ctx, reference)
+	if err != nil {
+		slog.WarnContext(ctx, "cannot check QRIS amount without the payment", "reference", reference, "error", err)
+		return nil
+	}
+	expected := payment.Amount
+	if payment.Fees != nil && payment.Fees.TotalPaid > 0 {
+		expected = payment.Fees.TotalPaid
+	}
+	if qr.Amount != expected {
+		return fmt.Errorf("%w: the code charges %s, the payment is %s", ErrQRISAmountMismatch, formatRupiah(qr.Amount), formatRupiah(expected))
+	}
+	return nil
+}
+
+// addQRISMerchant adds the merchant a transaction's QRIS code pays to, so
+// customers can check the name their wallet shows
+func addQRISMerchant(ctx context.Context, data interface{}) {
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	payload := qrisPayloadOf(response)
+	if payload == "" {
+		return
+	}
+	qr, err := ParseQRIS(payload)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to parse QRIS payload", "error", err)
+		return
+	}
+	response["qris_merchant_name"] = qr.MerchantName
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dynamicQRIS builds a single-payment QRIS code for amount with a valid CRC
+func dynamicQRIS(amount string) string {
+	body := "000201010212" +
+		"26570011ID.DANA.WWW011893600915377709982202097770998220303UMI" +
+		"5204481453033605802ID" +
+		fmt.Sprintf("54%02d%s", len(amount), amount) +
+		"5913Shiroine Cell6015Kota Jakarta Ti610513470" + "6304"
+	return body + fmt.Sprintf("%04X", crc16CCITT(body))
+}
+
+func TestParseQRIS(t *testing.T) {
+	qr, err := ParseQRIS(testQRISPayload)
+	if err != nil {
+		t.Fatalf("ParseQRIS failed: %v", err)
+	}
+	want := QRISPayload{MerchantID: "ID1025409927411", MerchantName: "Shiroine Cell", MerchantCity: "Kota Jakarta Ti"}
+	if *qr != want {
+		t.Errorf("got %+v, want %+v", *qr, want)
+	}
+
+	// Without an NMID the merchant ID comes from the merchant account
+	qr, err = ParseQRIS(dynamicQRIS("16112.00"))
+	if err != nil {
+		t.Fatalf("ParseQRIS failed: %v", err)
+	}
+	if !qr.Dynamic || qr.Amount != 16112 || qr.MerchantID != "777099822" {
+		t.Errorf("unexpected dynamic code %+v", *qr)
+	}
+
+	lower := testQRISPayload[:len(testQRISPayload)-4] + "4dc7"
+	if _, err := ParseQRIS(lower); err != nil {
+		t.Errorf("expected a lower case CRC to be accepted, got %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		payload string
+		want    error
+	}{
+		"tampered name": {strings.Replace(testQRISPayload, "Shiroine", "Shiroima", 1), ErrQRISChecksum},
+		"wrong CRC":     {testQRISPayload[:len(testQRISPayload)-4] + "0000", ErrQRISChecksum},
+		"no CRC":        {testQRISPayload[:len(testQRISPayload)-8], ErrQRISMalformed},
+		"truncated":     {testQRISPayload[:len(testQRISPayload)-10], ErrQRISMalformed},
+		"not EMVCo":     {"8800123456", ErrQRISMalformed},
+		"cents":         {dynamicQRIS("16112.50"), ErrQRISMalformed},
+		"bad amount":    {dynamicQRIS("16.112"), ErrQRISMalformed},
+	} {
+		if _, err := ParseQRIS(tc.payload); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestCRC16CCITT(t *testing.T) {
+	// The standard check value of CRC-16/CCITT-FALSE
+	if got := crc16CCITT("123456789"); got != 0x29B1 {
+		t.Errorf("crc16CCITT = %04X, want 29B1", got)
+	}
+}
+
+// newQRISTestGateway is a Tripay gateway whose QRIS codes charge
+// qrAmount(amount) for a transaction of amount
+func newQRISTestGateway(t *testing.T, reference string, qrAmount func(int) int) *TripayGateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		amount := int(body["amount"].(float64))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data": map[string]interface{}{
+				"reference":    reference,
+				"merchant_ref": body["merchant_ref"],
+				"amount":       amount + 112,
+				"fee_merchant": 0,
+				"fee_customer": 112,
+				"qr_string":    dynamicQRIS(fmt.Sprint(qrAmount(amount))),
+				"status":       "UNPAID",
+			},
+		})
+	}))
+	t.Cleanup(upstream.Close)
+
+	g := &TripayGateway{APIKey: "test-api-key", PrivateKey: "test-private-key", MerchantCode: "T0001", APIURL: upstream.URL}
+	g.Initialize(store)
+	return g
+}
+
+func TestCreateTransactionChecksQRIS(t *testing.T) {
+	body := `{"method":"QRIS","amount":16000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":16000,"quantity":1}]}`
+
+	// The customer fee is part of what the code charges
+	store = NewMemoryStore()
+	paymentGateway = newQRISTestGateway(t, "T-QRIS-OK", func(amount int) int { return amount + 112 })
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "qris_image_url") {
+		t.Fatalf("expected the code to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	store = NewMemoryStore()
+	paymentGateway = newQRISTestGateway(t, "T-QRIS-BAD", func(amount int) int { return amount - 1000 })
+	rec = postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 for a code with the wrong amount, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if payment, _ := store.GetPayment(context.Background(), "T-QRIS-BAD"); payment.Status != "FAILED" {
+		t.Errorf("expected the payment to be marked failed, got %s", payment.Status)
+	}
+
+	// The rejected payment is not handed out again
+	paymentGateway = newQRISTestGateway(t, "T-QRIS-RETRY", func(amount int) int { return amount + 112 })
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "T-QRIS-RETRY") {
+		t.Fatalf("expected a new transaction, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddQRISMerchant(t *testing.T) {
+	data := map[string]interface{}{"qr_string": testQRISPayload}
+	addQRISMerchant(context.Background(), data)
+	if data["qris_merchant_name"] != "Shiroine Cell" {
+		t.Errorf("expected the merchant name, got %v", data["qris_merchant_name"])
+	}
+
+	broken := map[string]interface{}{"payment_number": testQRISPayload[:len(testQRISPayload)-4] + "0000"}
+	addQRISMerchant(context.Background(), broken)
+	if _, ok := broken["qris_merchant_name"]; ok {
+		t.Errorf("expected no merchant name from a code that fails its CRC")
+	}
+}
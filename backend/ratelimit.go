@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitPolicy allows Limit requests per Window from one client, as a
+// token bucket that refills continuously
+type rateLimitPolicy struct {
+	Limit  int
+	Window time.Duration
+	Exempt bool
+	// ExemptWhenAllowlisted lifts the limit while CALLBACK_ALLOWED_IPS
+	// restricts who can reach the route
+	ExemptWhenAllowlisted bool
+}
+
+// defaultRateLimitPolicy applies to every route without its own policy.
+// Those routes share one bucket per client.
+var defaultRateLimitPolicy = rateLimitPolicy{Limit: 100, Window: 15 * time.Minute}
+
+// rateLimitPolicies are the per-route overrides, keyed by mux pattern
+var rateLimitPolicies = map[string]rateLimitPolicy{
+	// Each call creates an upstream transaction
+	"/api/create-transaction": {Limit: 10, Window: 10 * time.Minute},
+	// Stops enumerating phone numbers and group IDs
+	"/api/verify-user": {Limit: 20, Window: 10 * time.Minute},
+	// Stops guessing promo codes
+	"/api/promo/validate": {Limit: 20, Window: 10 * time.Minute},
+	// Throttling the gateway delays payments, but only Tripay signs its
+	// callbacks, so they are only unlimited once the allowlist keeps everyone
+	// else out. The limit is well above what a gateway sends from one address.
+	"/callback": {Limit: 120, Window: time.Minute, ExemptWhenAllowlisted: true},
+	// Probes and scrapes poll from one address far more often than any limit
+	"/livez":   {Exempt: true},
+	"/readyz":  {Exempt: true},
+	"/metrics": {Exempt: true},
+}
+
+// maxRateLimitEntries bounds the number of client buckets kept in memory
+const maxRateLimitEntries = 10000
+
+// policyForRoute returns the policy for route and the bucket it counts against
+func policyForRoute(route string) (rateLimitPolicy, string) {
+	if policy, ok := rateLimitPolicies[route]; ok {
+		return policy, route
+	}
+	return defaultRateLimitPolicy, "default"
+}
+
+type limiterEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	idleTTL  time.Duration
+}
+
+// limiterStore keeps token buckets in LRU order. A bucket idle for its
+// policy window has refilled completely, so dropping it loses nothing; the
+// size cap only matters when more clients than that are active at once.
+type limiterStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+}
+
+func newLimiterStore(maxEntries int) *limiterStore {
+	return &limiterStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// get returns the bucket for key, creating it from policy if needed
+func (s *limiterStore) get(key string, policy rateLimitPolicy, now time.Time) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*limiterEntry)
+		entry.lastSeen = now
+		s.order.MoveToFront(elem)
+		return entry.limiter
+	}
+
+	s.evict(now)
+
+	every := policy.Window / time.Duration(policy.Limit)
+	entry := &limiterEntry{
+		key:      key,
+		limiter:  rate.NewLimiter(rate.Every(every), policy.Limit),
+		lastSeen: now,
+		idleTTL:  policy.Window,
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	return entry.limiter
+}
+
+// evict drops idle buckets from the back, then the least recently used
+// until there is room for one more. Callers must hold s.mu.
+func (s *limiterStore) evict(now time.Time) {
+	for elem := s.order.Back(); elem != nil; elem = s.order.Back() {
+		entry := elem.Value.(*limiterEntry)
+		if s.order.Len() < s.maxEntries && now.Sub(entry.lastSeen) < entry.idleTTL {
+			return
+		}
+		s.order.Remove(elem)
+		delete(s.entries, entry.key)
+	}
+}
+
+// Len returns the number of buckets held
+func (s *limiterStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+var limiters = newLimiterStore(maxRateLimitEntries)
+
+// setRateLimitHeaders writes the IETF RateLimit-* headers for a bucket
+func setRateLimitHeaders(w http.ResponseWriter, policy rateLimitPolicy, limiter *rate.Limiter, now time.Time) {
+	tokens := limiter.TokensAt(now)
+	remaining := int(math.Max(0, math.Floor(tokens)))
+	resetSeconds := int(math.Ceil((float64(policy.Limit) - tokens) / float64(limiter.Limit())))
+
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int(policy.Window.Seconds())))
+	h.Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(resetSeconds))
+}
+
+// rateLimitMiddleware applies the policy of the matched route per client IP.
+// It must run inside routeMiddleware.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeFromRequest(r)
+		policy, bucket := policyForRoute(route)
+		if policy.Exempt || (policy.ExemptWhenAllowlisted && len(callbackAllowedIPs) > 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		limiter := limiters.get(bucket+"|"+getIP(r), policy, now)
+		allowed := limiter.AllowN(now, 1)
+		setRateLimitHeaders(w, policy, limiter, now)
+
+		if !allowed {
+			retryAfter := math.Ceil((1 - limiter.TokensAt(now)) / float64(limiter.Limit()))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+
+			rateLimitRejections.WithLabelValues(route).Inc()
+			respondJSON(w, http.StatusTooManyRequests, APIResponse{
+				Success: false,
+				Message: "Too many requests from this IP, please try again later.",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func rateLimitedMux() http.Handler {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux.HandleFunc("/api/create-transaction", ok)
+	mux.HandleFunc("/callback", ok)
+	mux.HandleFunc("/health", ok)
+	return routeMiddleware(mux, rateLimitMiddleware(mux))
+}
+
+func TestRateLimitPerRoutePolicies(t *testing.T) {
+	limiters = newLimiterStore(maxRateLimitEntries)
+	handler := rateLimitedMux()
+	policy := rateLimitPolicies["/api/create-transaction"]
+	rejections := rateLimitRejections.WithLabelValues("/api/create-transaction")
+	before := testutil.ToFloat64(rejections)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "203.0.113.7:5555"
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < policy.Limit; i++ {
+		rec := send("/api/create-transaction")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d rejected early", i+1)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(policy.Limit-i-1) {
+			t.Fatalf("request %d: RateLimit-Remaining = %s", i+1, got)
+		}
+	}
+
+	rec := send("/api/create-transaction")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the limit, got %d", rec.Code)
+	}
+	if retry, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retry <= 0 {
+		t.Fatalf("expected a positive Retry-After, got %q", rec.Header().Get("Retry-After"))
+	}
+	if testutil.ToFloat64(rejections)-before != 1 {
+		t.Fatal("expected the rejection to be counted")
+	}
+
+	// Other routes draw from their own bucket
+	if rec := send("/health"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "100" {
+		t.Fatalf("expected /health on the default policy, got %d %q", rec.Code, rec.Header().Get("RateLimit-Limit"))
+	}
+
+	// Anyone may send callbacks without an allowlist, so they are limited
+	callbacks := rateLimitPolicies["/callback"]
+	for i := 0; i < callbacks.Limit; i++ {
+		if rec := send("/callback"); rec.Code != http.StatusOK {
+			t.Fatalf("callback %d rejected early", i+1)
+		}
+	}
+	if rec := send("/callback"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected callbacks past the limit to be rejected, got %d", rec.Code)
+	}
+
+	callbackAllowedIPs = mustParsePrefixes([]string{"203.0.113.0/24"})
+	t.Cleanup(func() { callbackAllowedIPs = nil })
+	for i := 0; i < 200; i++ {
+		if rec := send("/callback"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("expected allowlisted callbacks to be exempt, got %d", rec.Code)
+		}
+	}
+}
+
+func TestLimiterStoreEvictsIdleAndLeastRecentlyUsed(t *testing.T) {
+	store := newLimiterStore(2)
+	policy := rateLimitPolicy{Limit: 1, Window: time.Minute}
+	now := time.Now()
+
+	a := store.get("a", policy, now)
+	a.AllowN(now, 1)
+	store.get("b", policy, now)
+	store.get("a", policy, now) // a is now the most recently used
+	store.get("c", policy, now)
+
+	if store.Len() != 2 {
+		t.Fatalf("expected the store to stay at capacity, got %d", store.Len())
+	}
+	if store.get("a", policy, now) != a {
+		t.Fatal("expected the recently used bucket to survive eviction")
+	}
+
+	later := now.Add(2 * time.Minute)
+	store.get("d", policy, later)
+	if store.Len() != 1 {
+		t.Fatalf("expected idle buckets to be dropped, got %d", store.Len())
+	}
+}
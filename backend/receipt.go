@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const defaultReceiptCacheDir = "data/receipts"
+
+// wib is Western Indonesia Time, which has no daylight saving
+var wib = time.FixedZone("WIB", 7*60*60)
+
+var (
+	receiptSecretOnce sync.Once
+	receiptSecret     []byte
+)
+
+// receiptKey returns the key signing receipt links. Without RECEIPT_SECRET
+// a random key is used, so links stop working after a restart.
+func receiptKey() []byte {
+	receiptSecretOnce.Do(func() {
+		if secret := os.Getenv("RECEIPT_SECRET"); secret != "" {
+			receiptSecret = []byte(secret)
+			return
+		}
+		slog.Warn("RECEIPT_SECRET not set, receipt links will not survive a restart")
+		receiptSecret = make([]byte, 32)
+		rand.Read(receiptSecret)
+	})
+	return receiptSecret
+}
+
+// receiptToken authorizes downloading the receipt of reference. It is only
+// handed to the payment's owner, through their payment history.
+func receiptToken(reference string) string {
+	mac := hmac.New(sha256.New, receiptKey())
+	mac.Write([]byte("receipt:" + reference))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// receiptPath returns the signed receipt link of reference
+func receiptPath(reference string) string {
+	return "/api/receipt/" + url.PathEscape(reference) + "?token=" + receiptToken(reference)
+}
+
+// formatRupiah formats an amount the Indonesian way, e.g. "Rp 15.000"
+func formatRupiah(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := strconv.Itoa(amount)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte('.')
+		}
+		b.WriteRune(d)
+	}
+	return sign + "Rp " + b.String()
+}
+
+// invoiceNumberOf returns the number printed on the receipt of p. Payments
+// paid before invoice numbering fall back to their reference.
+func invoiceNumberOf(p *PaymentRecord) string {
+	if p.InvoiceNumber != "" {
+		return p.InvoiceNumber
+	}
+	return p.Reference
+}
+
+// ReceiptCache keeps rendered receipts on disk. A PAID payment only changes
+// when its fees are recorded, so receipts are cached by receiptCacheKey.
+type ReceiptCache struct {
+	dir string
+}
+
+// NewReceiptCacheFromEnv creates a cache in RECEIPT_CACHE_DIR
+func NewReceiptCacheFromEnv() *ReceiptCache {
+	dir := os.Getenv("RECEIPT_CACHE_DIR")
+	if dir == "" {
+		dir = defaultReceiptCacheDir
+	}
+	return &ReceiptCache{dir: dir}
+}
+
+// path names the cache file of key; references come from gateways, so keys
+// are hashed rather than trusted as file names
+func (c *ReceiptCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".pdf")
+}
+
+// Get returns the receipt cached under key, if any
+func (c *ReceiptCache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores a receipt under key, replacing the file atomically
+func (c *ReceiptCache) Put(key string, pdf []byte) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, "receipt-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pdf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+var receiptCache = NewReceiptCacheFromEnv()
+
+// receiptCacheKey is the reference of p plus the fees printed on its
+// receipt, so recording the fees renders it again
+func receiptCacheKey(p *PaymentRecord) string {
+	if p.Fees == nil {
+		return p.Reference
+	}
+	return fmt.Sprintf("%s|fee=%d|total=%d", p.Reference, p.Fees.FeeCustomer, p.Fees.TotalPaid)
+}
+
+// receiptTotals returns the fee and total a receipt of p shows. Only the
+// customer fee is on top of the price; the merchant fee comes out of our
+// settlement. Before the gateway reports fees the fee is "-".
+func receiptTotals(p *PaymentRecord) (fee string, total int) {
+	if p.Fees == nil {
+		return "-", p.Amount
+	}
+	return formatRupiah(p.Fees.FeeCustomer), p.Fees.TotalPaid
+}
+
+// renderReceipt renders the PDF receipt of a PAID payment
+func renderReceipt(p *PaymentRecord) ([]byte, error) {
+	var items []map[string]interface{}
+	json.Unmarshal(p.OrderItems, &items)
+	plan := planNameFromOrderItems(items)
+	if plan == "" {
+		plan = "Premium"
+	}
+
+	paidAt := p.UpdatedAt
+	if p.PaidAt != nil {
+		paidAt = *p.PaidAt
+	}
+
+	payer := p.CustomerName
+	if owner := p.PhoneNumber + p.GroupID; owner != "" && owner != payer {
+		payer = fmt.Sprintf("%s (%s)", payer, owner)
+	}
+	beneficiaryPhone, beneficiaryGroup := p.Beneficiary()
+	beneficiary := beneficiaryPhone + beneficiaryGroup
+
+	pdf := fpdf.New("P", "mm", "A5", "")
+	pdf.SetTitle("Receipt "+invoiceNumberOf(p), true)
+	pdf.SetAuthor("Shiroine", true)
+	pdf.SetMargins(12, 12, 12)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	width, _ := pdf.GetPageSize()
+	contentWidth := width - 24
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(contentWidth/2, 10, "Shiroine", "", 0, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(contentWidth/2, 10, "KUITANSI / RECEIPT", "", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	pdf.CellFormat(contentWidth, 5, "Premium WhatsApp Bot", "", 1, "L", false, 0, "")
+	pdf.Ln(3)
+	pdf.Line(12, pdf.GetY(), width-12, pdf.GetY())
+	pdf.Ln(4)
+
+	row := func(label, value string) {
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(38, 6, label, "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.MultiCell(contentWidth-38, 6, tr(value), "", "L", false)
+	}
+	row("Invoice No.", invoiceNumberOf(p))
+	row("Reference", p.Reference)
+	row("Paid at", paidAt.In(wib).Format("02 Jan 2006 15:04 MST"))
+	row("Payment method", p.Method)
+	row("Status", p.Status)
+	row("Billed to", payer)
+	if p.IsGift() {
+		row("Gift for", beneficiary)
+	}
+
+	pdf.Ln(4)
+	pdf.SetFillColor(240, 240, 240)
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.CellFormat(contentWidth-40, 7, "Item", "B", 0, "L", true, 0, "")
+	pdf.CellFormat(40, 7, "Amount", "B", 1, "R", true, 0, "")
+
+	line := func(label, value string, bold bool) {
+		style := ""
+		if bold {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 9)
+		pdf.CellFormat(contentWidth-40, 7, tr(label), "", 0, "L", false, 0, "")
+		pdf.CellFormat(40, 7, value, "", 1, "R", false, 0, "")
+	}
+	line(plan, formatRupiah(p.Amount+p.DiscountAmount), false)
+	if p.DiscountAmount > 0 {
+		line("Discount ("+p.PromoCode+")", formatRupiah(-p.DiscountAmount), false)
+	}
+	fee, total := receiptTotals(p)
+	line("Fee", fee, false)
+	pdf.Line(12, pdf.GetY(), width-12, pdf.GetY())
+	line("Total paid", formatRupiah(total), true)
+
+	pdf.Ln(8)
+	pdf.SetFont("Helvetica", "I", 8)
+	pdf.MultiCell(contentWidth, 4, "This receipt was generated electronically and is valid without a signature.", "", "L", false)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to render receipt: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// cachedReceipt returns the receipt of a PAID payment from the cache,
+// rendering and caching it on first use
+func cachedReceipt(ctx context.Context, payment *PaymentRecord) ([]byte, error) {
+	key := receiptCacheKey(payment)
+	if pdf, ok := receiptCache.Get(key); ok {
+		return pdf, nil
+	}
+	pdf, err := renderReceipt(payment)
+	if err != nil {
+		return nil, err
+	}
+	if err := receiptCache.Put(key, pdf); err != nil {
+		slog.WarnContext(ctx, "failed to cache receipt", "reference", payment.Reference, "error", err)
+	}
+	return pdf, nil
+}
+
+// receiptHandler serves the PDF receipt of a PAID payment at
+// /api/receipt/{reference}?token=... The token comes from the owner's
+// payment history.
+func receiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reference := strings.TrimPrefix(r.URL.Path, "/api/receipt/")
+	tagPaymentReference(r.Context(), reference)
+	token := r.URL.Query().Get("token")
+	if reference == "" || !hmac.Equal([]byte(token), []byte(receiptToken(reference))) {
+		respondJSON(w, http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "Invalid receipt link",
+		})
+		return
+	}
+
+	payment, err := store.GetPayment(r.Context(), reference)
+	if err == ErrPaymentNotFound {
+		respondJSON(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Payment not found",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to load payment for receipt", "reference", reference, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+	if payment.Status != "PAID" {
+		respondJSON(w, http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "A receipt is available once the payment is PAID",
+		})
+		return
+	}
+
+	pdf, err := cachedReceipt(r.Context(), payment)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to render receipt", "reference", reference, "error", err)
+		respondJSON(w, http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to render receipt",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", "receipt-"+payment.Reference+".pdf"))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(pdf)
+}
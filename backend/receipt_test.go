@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRupiah(t *testing.T) {
+	for amount, want := range map[int]string{
+		0:       "Rp 0",
+		999:     "Rp 999",
+		15000:   "Rp 15.000",
+		1250000: "Rp 1.250.000",
+		-4000:   "-Rp 4.000",
+	} {
+		if got := formatRupiah(amount); got != want {
+			t.Errorf("formatRupiah(%d) = %q, want %q", amount, got, want)
+		}
+	}
+}
+
+func TestReceiptHandler(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	receiptCache = &ReceiptCache{dir: t.TempDir()}
+	ctx := context.Background()
+
+	items, _ := json.Marshal(orderItems("User Premium 30 Days", 16000))
+	for _, ref := range []string{"T-RCPT-PAID", "T-RCPT-UNPAID"} {
+		memory.CreatePayment(ctx, &PaymentRecord{
+			Reference: ref, MerchantRef: ref, PhoneNumber: "6281234567890", CustomerName: "Budi Šantoso",
+			Method: "QRIS", Amount: 16000, Status: "UNPAID", OrderItems: items, PromoCode: "HEMAT20", DiscountAmount: 4000,
+		})
+	}
+	memory.MarkPaymentPaid(ctx, "T-RCPT-PAID", time.Now())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		receiptHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/api/receipt/T-RCPT-PAID?token=forged"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a forged token, got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(receiptPath("T-RCPT-UNPAID"), "UNPAID", "PAID", 1)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a token to be tied to its reference, got %d", rec.Code)
+	}
+	if rec := get(receiptPath("T-RCPT-UNPAID")); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an unpaid payment, got %d", rec.Code)
+	}
+	if rec := get(receiptPath("T-MISSING")); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown payment, got %d", rec.Code)
+	}
+
+	rec := get(receiptPath("T-RCPT-PAID"))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("expected a PDF, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF-")) {
+		t.Fatalf("expected a PDF body, got %q", rec.Body.Bytes()[:16])
+	}
+
+	// Later requests are served from the cache
+	if err := os.WriteFile(receiptCache.path("T-RCPT-PAID"), []byte("%PDF-cached"), 0o644); err != nil {
+		t.Fatalf("failed to overwrite cached receipt: %v", err)
+	}
+	if rec := get(receiptPath("T-RCPT-PAID")); rec.Body.String() != "%PDF-cached" {
+		t.Fatalf("expected the cached receipt, got %d bytes", rec.Body.Len())
+	}
+
+	// Recording the fees changes the receipt, so it is rendered again
+	memory.SetPaymentFees(ctx, "T-RCPT-PAID", *newPaymentFees(16112, 0, 112))
+	if rec := get(receiptPath("T-RCPT-PAID")); rec.Code != http.StatusOK || rec.Body.String() == "%PDF-cached" {
+		t.Fatalf("expected a fresh receipt after the fees changed, got %d %q", rec.Code, rec.Body.Bytes()[:16])
+	}
+}
+
+func TestPaymentHistoryLinksReceipts(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	ctx := context.Background()
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "H-PAID", MerchantRef: "H-PAID", PhoneNumber: "6281234567890", Status: "UNPAID"})
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "H-UNPAID", MerchantRef: "H-UNPAID", PhoneNumber: "6281234567890", Status: "UNPAID"})
+	memory.MarkPaymentPaid(ctx, "H-PAID", time.Now())
+
+	rec := httptest.NewRecorder()
+	paymentHistoryHandler(rec, httptest.NewRequest(http.MethodPost, "/api/payment-history", strings.NewReader(`{"identifier":"6281234567890","type":"user"}`)))
+	var resp struct {
+		Data struct {
+			History []map[string]interface{} `json:"history"`
+		} `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	for _, record := range resp.Data.History {
+		if _, ok := record["invoiceNumber"]; ok != (record["status"] == "PAID") {
+			t.Fatalf("expected invoice numbers on PAID payments only, got %v", record)
+		}
+		url, ok := record["receiptUrl"]
+		if paid := record["status"] == "PAID"; paid != ok {
+			t.Fatalf("expected receipt links on PAID payments only, got %v", record)
+		}
+		if ok && url != receiptPath("H-PAID") {
+			t.Fatalf("unexpected receipt link %v", url)
+		}
+	}
+	if len(resp.Data.History) != 2 {
+		t.Fatalf("expected two payments, got %d", len(resp.Data.History))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultReferralBonusDays is granted to both parties unless
+	// REFERRAL_BONUS_DAYS says otherwise
+	defaultReferralBonusDays = 3
+	// referralBonusSpecialLimit is the special limit of a premium created by a
+	// bonus alone, matching the smallest user plan
+	referralBonusSpecialLimit = 5
+	referralCodeLength        = 8
+	// maxReferralChain bounds the walk up the referrer chain when looking for loops
+	maxReferralChain = 32
+)
+
+// Reasons a referral code cannot be used. The messages are shown to customers.
+var (
+	ErrReferralInvalid          = errors.New("referral code is not valid")
+	ErrReferralSelf             = errors.New("you cannot use your own referral code")
+	ErrReferralAlreadyReferred  = errors.New("this number has already been referred")
+	ErrReferralNotFirstPurchase = errors.New("referral codes are only valid on a first purchase")
+	ErrReferralLoop             = errors.New("this referral code belongs to someone you referred")
+	ErrReferralGroup            = errors.New("referral codes apply to personal purchases only")
+)
+
+var referralRejections = []error{
+	ErrReferralInvalid, ErrReferralSelf, ErrReferralAlreadyReferred,
+	ErrReferralNotFirstPurchase, ErrReferralLoop, ErrReferralGroup,
+}
+
+// isReferralRejection reports whether err is a customer-facing referral
+// rejection rather than a storage failure
+func isReferralRejection(err error) bool {
+	for _, rejection := range referralRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// referralBonusDays returns the premium days each party earns
+func referralBonusDays() int {
+	if days, err := strconv.Atoi(os.Getenv("REFERRAL_BONUS_DAYS")); err == nil && days >= 0 {
+		return days
+	}
+	return defaultReferralBonusDays
+}
+
+// checkReferral returns the phone owning code if phone may use it. phone
+// must not have been referred before and must have no more than paidSoFar
+// PAID payments. Referring yourself, directly or through a chain of people
+// you referred, is refused.
+func checkReferral(ctx context.Context, store Store, code, phone string, paidSoFar int) (string, error) {
+	referrer, err := store.ReferralCodeOwner(ctx, strings.TrimSpace(code))
+	if err == ErrReferralNotFound {
+		return "", ErrReferralInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if referrer == phone {
+		return "", ErrReferralSelf
+	}
+
+	if _, err := store.Referrer(ctx, phone); err == nil {
+		return "", ErrReferralAlreadyReferred
+	} else if err != ErrReferralNotFound {
+		return "", err
+	}
+
+	paid, err := store.CountPaidPayments(ctx, PaymentFilter{PhoneNumber: phone, Product: productPremium})
+	if err != nil {
+		return "", err
+	}
+	if paid > paidSoFar {
+		return "", ErrReferralNotFirstPurchase
+	}
+
+	current := referrer
+	for i := 0; i < maxReferralChain; i++ {
+		up, err := store.Referrer(ctx, current)
+		if err == ErrReferralNotFound {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if up == phone {
+			return "", ErrReferralLoop
+		}
+		current = up
+	}
+	return referrer, nil
+}
+
+// applyReferral checks the referral code of a new transaction and stores it
+// in canonical form
+func applyReferral(ctx context.Context, store Store, req *CreateTransactionRequest) error {
+	if req.CustomerPhone == "" {
+		return ErrReferralGroup
+	}
+	if _, err := checkReferral(ctx, store, req.ReferralCode, req.CustomerPhone, 0); err != nil {
+		return err
+	}
+	req.ReferralCode = strings.ToUpper(strings.TrimSpace(req.ReferralCode))
+	return nil
+}
+
+// rewardReferral grants both parties their bonus days once the referred
+// customer's first payment is PAID. The rules are checked again, since
+// another payment may have completed since the transaction was created.
+func rewardReferral(ctx context.Context, store Store, payment *PaymentRecord) {
+	referrer, err := checkReferral(ctx, store, payment.ReferralCode, payment.PhoneNumber, 1)
+	if err != nil {
+		if isReferralRejection(err) {
+			slog.InfoContext(ctx, "referral not rewarded", "reference", payment.Reference, "referral_code", payment.ReferralCode, "reason", err)
+		} else {
+			slog.ErrorContext(ctx, "failed to check referral", "reference", payment.Reference, "error", err)
+		}
+		return
+	}
+
+	days := referralBonusDays()
+	created, err := store.CreateReferral(ctx, Referral{
+		ReferredPhone: payment.PhoneNumber,
+		ReferrerPhone: referrer,
+		Code:          payment.ReferralCode,
+		Reference:     payment.Reference,
+		BonusDays:     days,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record referral", "reference", payment.Reference, "error", err)
+		return
+	}
+	if !created || days == 0 {
+		return
+	}
+
+	for _, phone := range []string{payment.PhoneNumber, referrer} {
+		jid, lid := userPremiumKey(ctx, store, phone)
+		expired, err := stackPremium(ctx, store, jid, lid, days, referralBonusSpecialLimit, false)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to grant referral bonus", "reference", payment.Reference, "phone", phone, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "referral bonus granted", "reference", payment.Reference, "phone", phone, "days", days, "expired", expired)
+	}
+}
+
+// referralCodeHandler returns the caller's referral code, creating one on
+// first use. Only numbers registered with the bot get a code.
+func referralCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PhoneNumber string `json:"phoneNumber"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PhoneNumber == "" {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "phoneNumber is required",
+		})
+		return
+	}
+
+	if _, err := store.UserLID(r.Context(), req.PhoneNumber); err == ErrIdentityNotFound {
+		respondJSON(w, http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Tidak menemukan user di database, pastikan kamu sudah menggunakan bot dari kami",
+		})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up user", "phone", req.PhoneNumber, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+
+	var code string
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err = store.CreateReferralCode(r.Context(), req.PhoneNumber, strings.ToUpper(randomString(referralCodeLength)))
+		if err != ErrReferralCodeTaken {
+			break
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create referral code", "phone", req.PhoneNumber, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"phoneNumber": req.PhoneNumber,
+			"code":        code,
+			"bonusDays":   referralBonusDays(),
+		},
+	})
+}
+
+// referralStatsHandler reports a phone number's referral code and rewards
+func referralStatsHandler(w http.ResponseWriter, r *http.Request) {
+	phone := r.URL.Query().Get("phone")
+	if phone == "" {
+		respondJSON(w, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "phone is required",
+		})
+		return
+	}
+
+	code, err := store.ReferralCodeFor(r.Context(), phone)
+	if err != nil && err != ErrReferralNotFound {
+		slog.ErrorContext(r.Context(), "failed to look up referral code", "phone", phone, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+
+	stats, err := store.ReferralStats(r.Context(), phone)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to load referral stats", "phone", phone, "error", err)
+		respondJSON(w, http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: "Database not available",
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"code":      code,
+			"referrals": stats.Referrals,
+			"bonusDays": stats.BonusDays,
+		},
+	})
+}
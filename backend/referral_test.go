@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReferral(t *testing.T) {
+	memory := NewMemoryStore()
+	ctx := context.Background()
+	memory.CreateReferralCode(ctx, "6281111111111", "ALICE001")
+	memory.CreateReferralCode(ctx, "6282222222222", "BOBBY002")
+	// Alice referred Bob, so Bob's code must not be usable by Alice
+	memory.CreateReferral(ctx, Referral{ReferredPhone: "6282222222222", ReferrerPhone: "6281111111111", Code: "ALICE001", Reference: "OLD-1", CreatedAt: time.Now()})
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "OLD-2", MerchantRef: "OLD-2", PhoneNumber: "6284444444444", Status: "PAID"})
+
+	tests := []struct {
+		name, code, phone string
+		wantErr           error
+		wantReferrer      string
+	}{
+		{"new customer", "alice001", "6283333333333", nil, "6281111111111"},
+		{"unknown code", "NOPE", "6283333333333", ErrReferralInvalid, ""},
+		{"own code", "ALICE001", "6281111111111", ErrReferralSelf, ""},
+		{"already referred", "ALICE001", "6282222222222", ErrReferralAlreadyReferred, ""},
+		{"returning customer", "ALICE001", "6284444444444", ErrReferralNotFirstPurchase, ""},
+		{"loop", "BOBBY002", "6281111111111", ErrReferralLoop, ""},
+	}
+	for _, tt := range tests {
+		referrer, err := checkReferral(ctx, memory, tt.code, tt.phone, 0)
+		if err != tt.wantErr || referrer != tt.wantReferrer {
+			t.Errorf("%s: checkReferral = %q, %v; want %q, %v", tt.name, referrer, err, tt.wantReferrer, tt.wantErr)
+		}
+	}
+}
+
+func TestReferralRewardedOnFirstPaidPurchase(t *testing.T) {
+	t.Setenv("REFERRAL_BONUS_DAYS", "3")
+	memory := NewMemoryStore()
+	ctx := context.Background()
+	memory.SetUser("6281111111111", "lid-alice", "Alice")
+	memory.SetUser("6283333333333", "lid-carol", "Carol")
+	memory.CreateReferralCode(ctx, "6281111111111", "ALICE001")
+	memory.UpsertPremium(ctx, PremiumRecord{JID: "6281111111111", LID: "lid-alice", SpecialLimit: 2, MaxSpecialLimit: 15, Expired: time.Now().AddDate(0, 0, 10), LastSpecialReset: time.Now()})
+	store = memory
+	g := newTripayTestGateway(t, "T-REF-1")
+	paymentGateway = g
+
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"6283333333333","referralCode":" alice001 ","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	if rec := postCreateTransaction(t, "", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	payment, err := memory.GetPayment(ctx, "T-REF-1")
+	if err != nil || payment.ReferralCode != "ALICE001" {
+		t.Fatalf("expected the canonical code on the payment, got %+v, %v", payment, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tripayCallback(t, g, "T-REF-1", "PAID", 15000); err != nil {
+			t.Fatalf("callback failed: %v", err)
+		}
+	}
+
+	carol, err := memory.GetPremium(ctx, "6283333333333", "lid-carol")
+	if err != nil {
+		t.Fatalf("GetPremium failed: %v", err)
+	}
+	assertExpiresIn(t, carol.Expired, 33)
+
+	alice, err := memory.GetPremium(ctx, "6281111111111", "lid-alice")
+	if err != nil {
+		t.Fatalf("GetPremium failed: %v", err)
+	}
+	assertExpiresIn(t, alice.Expired, 13)
+	if alice.SpecialLimit != 2 || alice.MaxSpecialLimit != 15 {
+		t.Fatalf("expected the referrer's limits to be kept, got %+v", alice)
+	}
+
+	if stats, _ := memory.ReferralStats(ctx, "6281111111111"); stats.Referrals != 1 || stats.BonusDays != 3 {
+		t.Fatalf("expected one rewarded referral, got %+v", stats)
+	}
+
+	rec := postCreateTransaction(t, "", strings.Replace(body, `"amount":15000`, `"amount":15000,"forceNew":true`, 1))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a second referral to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestReferralHandlers(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281111111111", "lid-alice", "Alice")
+	store = memory
+
+	createCode := func(body string) (*httptest.ResponseRecorder, APIResponse) {
+		rec := httptest.NewRecorder()
+		referralCodeHandler(rec, httptest.NewRequest(http.MethodPost, "/api/referral/code", strings.NewReader(body)))
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, resp := createCode(`{"phoneNumber":"6281111111111"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	code := resp.Data.(map[string]interface{})["code"].(string)
+	if len(code) != referralCodeLength || code != strings.ToUpper(code) {
+		t.Fatalf("unexpected referral code %q", code)
+	}
+	if _, again := createCode(`{"phoneNumber":"6281111111111"}`); again.Data.(map[string]interface{})["code"] != code {
+		t.Fatalf("expected the same code on every request, got %v", again.Data)
+	}
+	if rec, _ := createCode(`{"phoneNumber":"6289999999999"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a number unknown to the bot, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	referralStatsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/referral/stats?phone=6281111111111", nil))
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	stats := resp.Data.(map[string]interface{})
+	if rec.Code != http.StatusOK || stats["code"] != code || stats["referrals"] != float64(0) {
+		t.Fatalf("unexpected stats: %d %v", rec.Code, stats)
+	}
+}
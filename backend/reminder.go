@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReminderDays     = "3,1"
+	defaultReminderInterval = time.Hour
+	reminderWorkerName      = "renewal_reminders"
+)
+
+// RenewalNotice asks the bot to remind a beneficiary that their premium is
+// about to expire, with a checkout link pre-filled for the same plan
+type RenewalNotice struct {
+	Event      string    `json:"event"`
+	JID        string    `json:"jid"`
+	LID        string    `json:"lid"`
+	IsGroup    bool      `json:"isGroup"`
+	PlanID     string    `json:"planId,omitempty"`
+	Expired    time.Time `json:"expired"`
+	DaysLeft   int       `json:"daysLeft"`
+	RenewalURL string    `json:"renewalUrl"`
+}
+
+// RenewalNotifier delivers renewal reminders
+type RenewalNotifier interface {
+	NotifyRenewal(ctx context.Context, n RenewalNotice) error
+}
+
+// botWebhookNotifier delivers renewal reminders to the bot webhook
+type botWebhookNotifier struct {
+	url    string
+	secret string
+}
+
+// NotifyRenewal posts n to the bot webhook
+func (b botWebhookNotifier) NotifyRenewal(ctx context.Context, n RenewalNotice) error {
+	return postBotEvent(ctx, b.url, b.secret, n)
+}
+
+// renewalNotifiers delivers a reminder through each notifier in turn,
+// stopping at the first failure so the reminder is retried
+type renewalNotifiers []RenewalNotifier
+
+// NotifyRenewal hands n to every notifier
+func (ns renewalNotifiers) NotifyRenewal(ctx context.Context, n RenewalNotice) error {
+	for _, notifier := range ns {
+		if err := notifier.NotifyRenewal(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenewalScheduler reminds premium users and groups before their premium
+// expires. Each expiry gets each reminder at most once.
+type RenewalScheduler struct {
+	store    Store
+	notifier RenewalNotifier
+	days     []int // days before expiry to remind, largest first
+	baseURL  string
+}
+
+// NewRenewalScheduler creates a scheduler sending a reminder the given days
+// before expiry, linking to the checkout at baseURL
+func NewRenewalScheduler(store Store, notifier RenewalNotifier, days []int, baseURL string) *RenewalScheduler {
+	days = append([]int(nil), days...)
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return &RenewalScheduler{
+		store:    store,
+		notifier: notifier,
+		days:     days,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+	}
+}
+
+// NewRenewalSchedulerFromEnv creates a scheduler configured by
+// RENEWAL_REMINDER_DAYS and FRONTEND_URL that emails customers through mail,
+// if not nil, and notifies BOT_WEBHOOK_URL. It returns nil when reminders
+// are disabled or there is nobody to notify.
+func NewRenewalSchedulerFromEnv(store Store, mail *MailQueue) (*RenewalScheduler, error) {
+	// Emails go first: they are only queued, and queueing twice is harmless
+	// should the bot fail and the reminder be retried
+	var notifiers renewalNotifiers
+	if mail != nil {
+		notifiers = append(notifiers, mail)
+	}
+	if webhook := os.Getenv("BOT_WEBHOOK_URL"); webhook != "" {
+		notifiers = append(notifiers, botWebhookNotifier{url: webhook, secret: os.Getenv("BOT_WEBHOOK_SECRET")})
+	}
+
+	raw, ok := os.LookupEnv("RENEWAL_REMINDER_DAYS")
+	if !ok {
+		raw = defaultReminderDays
+	}
+	if len(notifiers) == 0 || raw == "" || raw == "none" {
+		return nil, nil
+	}
+
+	days, err := parseReminderDays(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := os.Getenv("FRONTEND_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:3000"
+	}
+	return NewRenewalScheduler(store, notifiers, days, baseURL), nil
+}
+
+// parseReminderDays parses a comma-separated list of positive day counts
+func parseReminderDays(raw string) ([]int, error) {
+	var days []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(raw, ",") {
+		d, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid RENEWAL_REMINDER_DAYS entry %q", field)
+		}
+		if !seen[d] {
+			seen[d] = true
+			days = append(days, d)
+		}
+	}
+	return days, nil
+}
+
+// reminderInterval returns how often the scheduler looks for expiring premium
+func reminderInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RENEWAL_REMINDER_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultReminderInterval
+}
+
+// stageFor returns the tightest reminder due for an expiry, so a premium
+// first seen with one day left gets the one-day reminder only
+func (s *RenewalScheduler) stageFor(expired, now time.Time) int {
+	stage := s.days[0]
+	for _, d := range s.days {
+		if !expired.After(now.AddDate(0, 0, d)) {
+			stage = d
+		}
+	}
+	return stage
+}
+
+// renewalPlan returns the plan p was last bought with, from the newest PAID
+// payment for its owner or else from its special limit, or "" if unknown
+func (s *RenewalScheduler) renewalPlan(ctx context.Context, p PremiumRecord) string {
+	payment, err := s.store.LatestPaidPayment(ctx, p.JID)
+	if err == nil {
+		if planID := planIDFromOrderItems(payment.OrderItems); planID != "" {
+			return planID
+		}
+	} else if err != ErrPaymentNotFound {
+		slog.WarnContext(ctx, "failed to look up last payment", "jid", p.JID, "error", err)
+	}
+
+	isGroup := strings.HasSuffix(p.JID, "@g.us")
+	for planID := range planPrices {
+		_, specialLimit, groupPlan := parsePlanDetails(planID)
+		if specialLimit == p.MaxSpecialLimit && groupPlan == isGroup {
+			return planID
+		}
+	}
+	return ""
+}
+
+// renewalURL links to the checkout for planID with the owner filled in, or
+// to the pricing page when the plan is unknown
+func (s *RenewalScheduler) renewalURL(planID, jid string, isGroup bool) string {
+	if planID == "" {
+		return s.baseURL + "/pricing"
+	}
+	query := url.Values{"plan": {planID}}
+	if isGroup {
+		query.Set("group", jid)
+	} else {
+		query.Set("phone", jid)
+	}
+	return s.baseURL + "/checkout?" + query.Encode()
+}
+
+// RunOnce sends the reminders due at now and returns how many were sent
+func (s *RenewalScheduler) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	expiring, err := s.store.ExpiringPremium(ctx, now, now.AddDate(0, 0, s.days[0]))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expiring premium: %v", err)
+	}
+
+	sent := 0
+	for _, p := range expiring {
+		reminder := RenewalReminder{
+			JID:        p.JID,
+			LID:        p.LID,
+			Expired:    p.Expired,
+			DaysBefore: s.stageFor(p.Expired, now),
+			SentAt:     now,
+		}
+		claimed, err := s.store.ClaimRenewalReminder(ctx, reminder)
+		if err != nil {
+			return sent, fmt.Errorf("failed to record renewal reminder: %v", err)
+		}
+		if !claimed {
+			continue
+		}
+
+		planID := s.renewalPlan(ctx, p)
+		isGroup := strings.HasPrefix(planID, "group-") || (planID == "" && strings.HasSuffix(p.JID, "@g.us"))
+		notice := RenewalNotice{
+			Event:      "premium.expiring",
+			JID:        p.JID,
+			LID:        p.LID,
+			IsGroup:    isGroup,
+			PlanID:     planID,
+			Expired:    p.Expired,
+			DaysLeft:   reminder.DaysBefore,
+			RenewalURL: s.renewalURL(planID, p.JID, isGroup),
+		}
+		if err := s.notifier.NotifyRenewal(ctx, notice); err != nil {
+			renewalRemindersTotal.WithLabelValues("failed").Inc()
+			slog.WarnContext(ctx, "failed to send renewal reminder", "jid", p.JID, "days_left", reminder.DaysBefore, "error", err)
+			// Try again on the next tick
+			if err := s.store.ReleaseRenewalReminder(ctx, reminder); err != nil {
+				slog.ErrorContext(ctx, "failed to release renewal reminder", "jid", p.JID, "error", err)
+			}
+			continue
+		}
+		renewalRemindersTotal.WithLabelValues("sent").Inc()
+		slog.InfoContext(ctx, "renewal reminder sent", "jid", p.JID, "plan_id", planID, "days_left", reminder.DaysBefore, "expired", p.Expired)
+		sent++
+	}
+	return sent, nil
+}
+
+// Run sends due reminders on every interval tick while the store is
+// reachable. It never returns.
+func (s *RenewalScheduler) Run(interval time.Duration) {
+	workers.Register(reminderWorkerName, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		workers.Beat(reminderWorkerName)
+
+		ctx := context.Background()
+		if err := s.store.Ping(ctx); err == nil {
+			if _, err := s.RunOnce(ctx, time.Now()); err != nil {
+				slog.Error("renewal reminder run failed", "error", err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingNotifier keeps the notices it is asked to deliver, failing while
+// fail is set
+type recordingNotifier struct {
+	notices []RenewalNotice
+	fail    bool
+}
+
+func (n *recordingNotifier) NotifyRenewal(ctx context.Context, notice RenewalNotice) error {
+	if n.fail {
+		return errors.New("bot unreachable")
+	}
+	n.notices = append(n.notices, notice)
+	return nil
+}
+
+func TestRenewalSchedulerSendsEachReminderOnce(t *testing.T) {
+	memory := NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	premium := func(jid, lid string, maxSpecialLimit int, expires time.Duration) {
+		memory.UpsertPremium(ctx, PremiumRecord{JID: jid, LID: lid, MaxSpecialLimit: maxSpecialLimit, Expired: now.Add(expires), LastSpecialReset: now})
+	}
+	premium("6281111111111", "lid-a", 10, 60*time.Hour)
+	premium("120363000000000000@g.us", "120363000000000000@g.us", 50, 12*time.Hour)
+	premium("6283333333333", "lid-c", 15, 10*24*time.Hour)
+	premium("6284444444444", "lid-d", 15, -time.Hour)
+
+	// The last plan bought wins over the one implied by the special limit
+	items, _ := json.Marshal(orderItems("User Premium 30 Days", 20000))
+	memory.CreatePayment(ctx, &PaymentRecord{Reference: "R-1", MerchantRef: "R-1", PhoneNumber: "6281111111111", Status: "UNPAID", OrderItems: items})
+	memory.MarkPaymentPaid(ctx, "R-1", now.Add(-20*24*time.Hour))
+
+	notifier := &recordingNotifier{}
+	s := NewRenewalScheduler(memory, notifier, []int{1, 3}, "https://shiroine.my.id/")
+
+	sent, err := s.RunOnce(ctx, now)
+	if err != nil || sent != 2 {
+		t.Fatalf("RunOnce = %d, %v; want 2 reminders", sent, err)
+	}
+	group, user := notifier.notices[0], notifier.notices[1]
+	if group.JID != "120363000000000000@g.us" || group.DaysLeft != 1 || !group.IsGroup || group.PlanID != "group-1m" ||
+		group.RenewalURL != "https://shiroine.my.id/checkout?group=120363000000000000%40g.us&plan=group-1m" {
+		t.Fatalf("unexpected group reminder: %+v", group)
+	}
+	if user.JID != "6281111111111" || user.LID != "lid-a" || user.DaysLeft != 3 || user.IsGroup || user.PlanID != "user-1m" ||
+		user.RenewalURL != "https://shiroine.my.id/checkout?phone=6281111111111&plan=user-1m" || user.Event != "premium.expiring" {
+		t.Fatalf("unexpected user reminder: %+v", user)
+	}
+
+	if sent, _ := s.RunOnce(ctx, now.Add(time.Hour)); sent != 0 {
+		t.Fatalf("expected no repeated reminders, got %d", sent)
+	}
+
+	// Two days on, the user is inside the one-day window
+	if sent, _ := s.RunOnce(ctx, now.Add(40*time.Hour)); sent != 1 || notifier.notices[2].DaysLeft != 1 {
+		t.Fatalf("expected the one-day reminder, got %d: %+v", sent, notifier.notices)
+	}
+
+	// Renewing moves the expiry, which earns a fresh set of reminders
+	premium("6281111111111", "lid-a", 10, 62*time.Hour)
+	if sent, _ := s.RunOnce(ctx, now); sent != 1 {
+		t.Fatalf("expected a reminder for the new expiry, got %d", sent)
+	}
+}
+
+func TestRenewalSchedulerRetriesFailedReminders(t *testing.T) {
+	memory := NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	memory.UpsertPremium(ctx, PremiumRecord{JID: "6281111111111", LID: "lid-a", MaxSpecialLimit: 5, Expired: now.Add(12 * time.Hour), LastSpecialReset: now})
+
+	notifier := &recordingNotifier{fail: true}
+	s := NewRenewalScheduler(memory, notifier, []int{3, 1}, "https://shiroine.my.id")
+	if sent, err := s.RunOnce(ctx, now); err != nil || sent != 0 {
+		t.Fatalf("RunOnce = %d, %v; want nothing sent", sent, err)
+	}
+
+	notifier.fail = false
+	if sent, _ := s.RunOnce(ctx, now); sent != 1 {
+		t.Fatalf("expected the failed reminder to be retried, got %d", sent)
+	}
+	if notifier.notices[0].PlanID != "user-5d" {
+		t.Fatalf("expected the plan from the special limit, got %+v", notifier.notices[0])
+	}
+}
+
+func TestParseReminderDays(t *testing.T) {
+	days, err := parseReminderDays("3, 1,3")
+	if err != nil || len(days) != 2 || days[0] != 3 || days[1] != 1 {
+		t.Fatalf("parseReminderDays = %v, %v", days, err)
+	}
+	for _, raw := range []string{"0", "three", "3,,1"} {
+		if _, err := parseReminderDays(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
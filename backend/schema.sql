@@ -55,7 +55,105 @@ CREATE TABLE IF NOT EXISTS payment_history (
     expired_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    paid_at TIMESTAMP
+    paid_at TIMESTAMP,
+    promo_code TEXT,
+    discount_amount INTEGER DEFAULT 0,
+    referral_code TEXT,
+    recipient_phone TEXT,
+    recipient_group_id TEXT,
+    gift_message TEXT,
+    invoice_number TEXT UNIQUE,
+    customer_email TEXT,
+    gateway TEXT,
+    fee_merchant INTEGER,
+    fee_customer INTEGER,
+    total_paid INTEGER,
+    net_amount INTEGER,
+    product TEXT NOT NULL DEFAULT 'premium',
+    donor_name TEXT,
+    donor_message TEXT
+);
+
+-- Promo codes. NULL limits and windows mean unlimited; empty plan_ids applies to every plan
+CREATE TABLE IF NOT EXISTS promo_codes (
+    code TEXT PRIMARY KEY CHECK (code = UPPER(code)),
+    discount_type TEXT NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),
+    max_discount INTEGER,
+    plan_ids TEXT[] NOT NULL DEFAULT '{}',
+    max_redemptions INTEGER,
+    max_per_identity INTEGER,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    first_purchase_only BOOLEAN NOT NULL DEFAULT FALSE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Referral codes, one per phone number
+CREATE TABLE IF NOT EXISTS referral_codes (
+    code TEXT PRIMARY KEY CHECK (code = UPPER(code)),
+    phone_number TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Rewarded referrals; a phone number can be referred only once
+CREATE TABLE IF NOT EXISTS referrals (
+    referred_phone TEXT PRIMARY KEY,
+    referrer_phone TEXT NOT NULL,
+    code TEXT NOT NULL REFERENCES referral_codes(code),
+    reference TEXT NOT NULL,
+    bonus_days INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Promo codes used by PAID payments, one row per payment
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    id SERIAL PRIMARY KEY,
+    code TEXT NOT NULL REFERENCES promo_codes(code),
+    reference TEXT NOT NULL UNIQUE,
+    identity TEXT NOT NULL,
+    discount INTEGER NOT NULL,
+    redeemed_at TIMESTAMP NOT NULL
+);
+
+-- Idempotency keys of create-transaction requests and their responses
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER,
+    response TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Renewal reminders sent, one per premium expiry and reminder day
+CREATE TABLE IF NOT EXISTS renewal_reminders (
+    jid TEXT NOT NULL,
+    lid TEXT NOT NULL,
+    expired TIMESTAMPTZ NOT NULL,
+    days_before INTEGER NOT NULL,
+    sent_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (jid, lid, expired, days_before)
+);
+
+-- Last invoice number handed out per month (YYYY/MM, in WIB)
+CREATE TABLE IF NOT EXISTS invoice_counters (
+    period TEXT PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+-- Customer emails waiting to be sent, retried with backoff
+CREATE TABLE IF NOT EXISTS email_outbox (
+    dedup_key TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMPTZ
 );
 
 -- Create indexes for better query performance
@@ -63,5 +161,11 @@ CREATE INDEX IF NOT EXISTS idx_payment_history_phone ON payment_history(phone_nu
 CREATE INDEX IF NOT EXISTS idx_payment_history_group ON payment_history(group_id);
 CREATE INDEX IF NOT EXISTS idx_payment_history_status ON payment_history(status);
 CREATE INDEX IF NOT EXISTS idx_payment_history_created ON payment_history(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_payment_history_booked ON payment_history((COALESCE(paid_at, created_at)));
+CREATE INDEX IF NOT EXISTS idx_payment_history_donations ON payment_history(paid_at DESC) WHERE product = 'donation' AND status = 'PAID';
 CREATE INDEX IF NOT EXISTS idx_premium_jid ON premium(jid);
 CREATE INDEX IF NOT EXISTS idx_premium_lid ON premium(lid);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code ON promo_redemptions(code, identity);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_phone);
+CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(next_attempt_at) WHERE status = 'pending';
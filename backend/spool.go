@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default limits for the callback spool
+const (
+	defaultSpoolPath     = "data/callback-spool.jsonl"
+	defaultSpoolMaxBytes = 10 << 20 // 10 MiB
+	spoolReplayInterval  = 30 * time.Second
+	spoolWorkerName      = "callback_spool"
+	spoolHeadroom        = 64 << 10 // room Writable wants for another callback
+)
+
+// ErrSpoolFull is returned when the spool has reached its size limit
+var ErrSpoolFull = errors.New("callback spool is full")
+
+// SpooledCallback is a gateway callback received while storage was unavailable.
+// The raw payload and headers are kept so signatures can be verified on replay,
+// and the request ID so the replay can be correlated with the original request.
+type SpooledCallback struct {
+	ReceivedAt time.Time         `json:"receivedAt"`
+	RequestID  string            `json:"requestId,omitempty"`
+	Gateway    string            `json:"gateway"`
+	Payload    []byte            `json:"payload"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// CallbackSpool is an append-only JSON lines file of callbacks waiting for
+// the database. Every append is fsynced before the gateway gets its 200, so
+// an acknowledged callback survives a crash.
+type CallbackSpool struct {
+	path      string
+	maxBytes  int64
+	mu        sync.Mutex // guards the file
+	replaying sync.Mutex // serializes Replay, which releases mu while handling
+	kick      chan struct{}
+}
+
+// NewCallbackSpool creates a spool backed by the file at path
+func NewCallbackSpool(path string, maxBytes int64) *CallbackSpool {
+	return &CallbackSpool{
+		path:     path,
+		maxBytes: maxBytes,
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// NewCallbackSpoolFromEnv creates a spool configured by CALLBACK_SPOOL_PATH
+func NewCallbackSpoolFromEnv() *CallbackSpool {
+	path := os.Getenv("CALLBACK_SPOOL_PATH")
+	if path == "" {
+		path = defaultSpoolPath
+	}
+	return NewCallbackSpool(path, defaultSpoolMaxBytes)
+}
+
+// Append durably records a callback for later replay
+func (s *CallbackSpool) Append(ctx context.Context, gateway string, payload []byte, headers map[string]string) error {
+	line, err := json.Marshal(SpooledCallback{
+		ReceivedAt: time.Now(),
+		RequestID:  requestIDFrom(ctx),
+		Gateway:    gateway,
+		Payload:    payload,
+		Headers:    headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode callback: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil && info.Size()+int64(len(line)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write spool: %v", err)
+	}
+	return f.Sync()
+}
+
+// Writable reports whether Append can take another callback: the spool has
+// room for one and its file can be written
+func (s *CallbackSpool) Writable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		tmp, err := os.CreateTemp(filepath.Dir(s.path), "spool-*.tmp")
+		if err != nil {
+			return fmt.Errorf("spool directory is not writable: %v", err)
+		}
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	} else if err != nil {
+		return err
+	}
+
+	if info.Size()+spoolHeadroom > s.maxBytes {
+		return ErrSpoolFull
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("spool is not writable: %v", err)
+	}
+	return f.Close()
+}
+
+// Pending returns the number of spooled callbacks
+func (s *CallbackSpool) Pending() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.read()
+	return len(entries), err
+}
+
+// read loads every entry. Callers must hold s.mu.
+func (s *CallbackSpool) read() ([]SpooledCallback, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []SpooledCallback
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxBytes))
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry SpooledCallback
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line from a crash mid-write was never acknowledged
+			slog.Warn("skipping unreadable spool entry", "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// rewrite atomically replaces the spool with entries. Callers must hold s.mu.
+func (s *CallbackSpool) rewrite(entries []SpooledCallback) error {
+	if len(entries) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Replay hands every spooled callback for gateway to handle, in arrival order,
+// with a context carrying the callback's original request ID.
+// Entries are removed once handled, or once they fail for a reason other than
+// storage being unavailable (a bad signature will not get better with time).
+// A failure while ping fails counts as storage being unavailable, since a
+// database that drops after connecting fails with driver errors instead.
+// Replay stops at the first such failure and keeps the rest. The spool stays
+// open to Append while callbacks are handled.
+func (s *CallbackSpool) Replay(gateway string, handle func(ctx context.Context, payload []byte, headers map[string]string) error, ping func(ctx context.Context) error) (int, error) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	s.mu.Lock()
+	entries, err := s.read()
+	s.mu.Unlock()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var remaining []SpooledCallback
+	replayed := 0
+	for i, entry := range entries {
+		if entry.Gateway != gateway {
+			slog.Warn("keeping spooled callback for inactive gateway", "gateway", entry.Gateway)
+			remaining = append(remaining, entry)
+			continue
+		}
+
+		requestID := entry.RequestID
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		ctx := withRequestID(context.Background(), requestID)
+
+		err := handle(ctx, entry.Payload, entry.Headers)
+		if err != nil && !errors.Is(err, ErrStorageUnavailable) {
+			if pingErr := ping(ctx); pingErr != nil {
+				err = fmt.Errorf("%w: %v", ErrStorageUnavailable, err)
+			}
+		}
+		if errors.Is(err, ErrStorageUnavailable) {
+			slog.WarnContext(ctx, "keeping spooled callbacks while storage is unavailable", "gateway", gateway, "error", err)
+			remaining = append(remaining, entries[i:]...)
+			break
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "dropping spooled callback", "gateway", gateway, "received_at", entry.ReceivedAt, "error", err)
+		}
+		replayed++
+	}
+
+	// Callbacks appended while the others were handled follow the ones kept
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.read()
+	if err != nil {
+		return replayed, err
+	}
+	if len(current) > len(entries) {
+		remaining = append(remaining, current[len(entries):]...)
+	}
+	return replayed, s.rewrite(remaining)
+}
+
+// Trigger asks a running replay loop to try again now
+func (s *CallbackSpool) Trigger() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run replays the spool into gateway whenever store is reachable, on every
+// interval tick and whenever Trigger is called. It never returns.
+func (s *CallbackSpool) Run(interval time.Duration, store Store, gateway PaymentGateway) {
+	workers.Register(spoolWorkerName, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		workers.Beat(spoolWorkerName)
+
+		if pending, err := s.Pending(); err != nil || pending == 0 {
+			if err != nil {
+				slog.Error("failed to read callback spool", "error", err)
+			}
+			continue
+		}
+
+		if err := store.Ping(context.Background()); err != nil {
+			continue
+		}
+
+		replayed, err := s.Replay(gateway.GetName(), gateway.HandleCallback, store.Ping)
+		if err != nil {
+			slog.Error("failed to replay callback spool", "error", err)
+		}
+		if replayed > 0 {
+			slog.Info("replayed spooled callbacks", "gateway", gateway.GetName(), "count", replayed)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCallbackSpoolReplayStopsWhileStorageUnavailable(t *testing.T) {
+	spool := NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), defaultSpoolMaxBytes)
+	for i := 0; i < 3; i++ {
+		payload := []byte(fmt.Sprintf(`{"n":%d}`, i))
+		if err := spool.Append(context.Background(), "tripay", payload, map[string]string{"x-callback-signature": "sig"}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	var seen []string
+	replayed, err := spool.Replay("tripay", func(ctx context.Context, payload []byte, headers map[string]string) error {
+		seen = append(seen, string(payload))
+		if headers["x-callback-signature"] != "sig" {
+			t.Fatalf("headers not preserved: %v", headers)
+		}
+		if len(seen) == 2 {
+			return fmt.Errorf("failed to update payment history: %w", ErrStorageUnavailable)
+		}
+		return nil
+	}, NewMemoryStore().Ping)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if replayed != 1 {
+		t.Fatalf("expected 1 replayed callback, got %d", replayed)
+	}
+	if pending, _ := spool.Pending(); pending != 2 {
+		t.Fatalf("expected 2 callbacks left in the spool, got %d", pending)
+	}
+
+	// Once storage is back, the rest replays in order; permanent failures are dropped
+	seen = nil
+	replayed, _ = spool.Replay("tripay", func(ctx context.Context, payload []byte, headers map[string]string) error {
+		seen = append(seen, string(payload))
+		if len(seen) == 2 {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}, NewMemoryStore().Ping)
+	if replayed != 2 || seen[0] != `{"n":1}` || seen[1] != `{"n":2}` {
+		t.Fatalf("unexpected replay: %d, %v", replayed, seen)
+	}
+	if pending, _ := spool.Pending(); pending != 0 {
+		t.Fatalf("expected empty spool, got %d", pending)
+	}
+}
+
+func TestCallbackSpoolKeepsCallbacksWhenDatabaseDrops(t *testing.T) {
+	spool := NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), defaultSpoolMaxBytes)
+	for i := 0; i < 2; i++ {
+		spool.Append(context.Background(), "tripay", []byte(fmt.Sprintf(`{"n":%d}`, i)), nil)
+	}
+
+	// A connection lost mid-query surfaces as a driver error, not ErrStorageUnavailable
+	down := NewPostgresStore(nil)
+	replayed, err := spool.Replay("tripay", func(ctx context.Context, payload []byte, headers map[string]string) error {
+		// Live callbacks are still spooled while this one is handled
+		if err := spool.Append(ctx, "tripay", []byte(`{"n":"live"}`), nil); err != nil {
+			t.Fatalf("Append during replay failed: %v", err)
+		}
+		return errors.New("driver: bad connection")
+	}, down.Ping)
+	if err != nil || replayed != 0 {
+		t.Fatalf("expected nothing replayed, got %d, %v", replayed, err)
+	}
+	if pending, _ := spool.Pending(); pending != 3 {
+		t.Fatalf("expected both callbacks kept and the live one added, got %d", pending)
+	}
+}
+
+func TestCallbackSpoolRejectsWhenFull(t *testing.T) {
+	spool := NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), 200)
+	payload := bytes.Repeat([]byte("x"), 64)
+
+	if err := spool.Append(context.Background(), "tripay", payload, nil); err != nil {
+		t.Fatalf("first Append failed: %v", err)
+	}
+	if err := spool.Append(context.Background(), "tripay", payload, nil); err != ErrSpoolFull {
+		t.Fatalf("expected ErrSpoolFull, got %v", err)
+	}
+}
+
+func TestDegradedModeSpoolsCallbacksAndRefusesTransactions(t *testing.T) {
+	store = NewPostgresStore(nil)
+	paymentGateway = &TripayGateway{APIKey: "key", PrivateKey: "private", MerchantCode: "T0001"}
+	paymentGateway.Initialize(store)
+	callbackSpool = NewCallbackSpool(filepath.Join(t.TempDir(), "spool.jsonl"), defaultSpoolMaxBytes)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/callback", bytes.NewBufferString(`{"reference":"T1","status":"PAID"}`))
+	req.Header.Set("X-Callback-Signature", "sig")
+	callbackHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a spooled callback, got %d", rec.Code)
+	}
+	if pending, _ := callbackSpool.Pending(); pending != 1 {
+		t.Fatalf("expected the callback to be spooled, got %d entries", pending)
+	}
+
+	rec = httptest.NewRecorder()
+	body := `{"method":"QRIS","amount":15000,"customerPhone":"628123","orderItems":[{"name":"User Premium 30 Days"}]}`
+	createTransactionHandler(rec, httptest.NewRequest(http.MethodPost, "/api/create-transaction", bytes.NewBufferString(body)))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while storage is unavailable, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Errors returned by store implementations
+var (
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	ErrPaymentNotFound    = errors.New("payment not found")
+	ErrPremiumNotFound    = errors.New("premium not found")
+	ErrIdentityNotFound   = errors.New("identity not found")
+	ErrPromoNotFound      = errors.New("promo code not found")
+	ErrReferralNotFound   = errors.New("referral not found")
+	ErrReferralCodeTaken  = errors.New("referral code already taken")
+	ErrEmailNotFound      = errors.New("email not found")
+)
+
+// PaymentRecord is a single row of payment_history
+type PaymentRecord struct {
+	Reference      string
+	MerchantRef    string
+	PhoneNumber    string // empty for group purchases
+	GroupID        string // empty for user purchases
+	CustomerName   string
+	Method         string
+	Amount         int
+	Status         string
+	OrderItems     json.RawMessage
+	PaymentNumber  string
+	ExpiredAt      *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	PaidAt         *time.Time
+	PromoCode      string // empty when no promo code was applied
+	DiscountAmount int
+	ReferralCode   string // referral code the customer signed up with
+	// The recipient of a gift, empty when the payer buys for themselves
+	RecipientPhone   string
+	RecipientGroupID string
+	GiftMessage      string
+	// InvoiceNumber is assigned when the payment becomes PAID
+	InvoiceNumber string
+	CustomerEmail string // optional, receipts are mailed here
+	Gateway       string // empty for payments created before it was recorded
+	// Fees is nil until the gateway reports what it charged
+	Fees *PaymentFees
+	// Product is productPremium or productDonation. Donations carry the
+	// donor's public name and message, both optional.
+	Product      string
+	DonorName    string
+	DonorMessage string
+}
+
+// IsDonation reports whether the payment is a donation rather than a plan
+func (p *PaymentRecord) IsDonation() bool {
+	return p.Product == productDonation
+}
+
+// paidTime is when p was paid, or created if the payment time is unknown
+func paidTime(p *PaymentRecord) time.Time {
+	if p.PaidAt != nil {
+		return *p.PaidAt
+	}
+	return p.CreatedAt
+}
+
+// PaymentFees is what a gateway charged for a payment, in rupiah
+type PaymentFees struct {
+	FeeMerchant int // deducted from the settlement
+	FeeCustomer int // added on top of the price
+	TotalPaid   int // what the customer paid, customer fee included
+	NetAmount   int // what the gateway settles to us
+}
+
+// newPaymentFees derives the net settlement of a payment from what the
+// customer paid and the fees charged to either side
+func newPaymentFees(totalPaid, feeMerchant, feeCustomer int) *PaymentFees {
+	return &PaymentFees{
+		FeeMerchant: feeMerchant,
+		FeeCustomer: feeCustomer,
+		TotalPaid:   totalPaid,
+		NetAmount:   totalPaid - feeMerchant - feeCustomer,
+	}
+}
+
+// Total returns the fees charged to both sides
+func (f *PaymentFees) Total() int {
+	return f.FeeMerchant + f.FeeCustomer
+}
+
+// Beneficiary returns who the plan is activated for: the gift recipient if
+// there is one, otherwise the payer
+func (p *PaymentRecord) Beneficiary() (phone, groupID string) {
+	if p.RecipientPhone != "" || p.RecipientGroupID != "" {
+		return p.RecipientPhone, p.RecipientGroupID
+	}
+	return p.PhoneNumber, p.GroupID
+}
+
+// IsGift reports whether the plan goes to someone other than the payer
+func (p *PaymentRecord) IsGift() bool {
+	return p.RecipientPhone != "" || p.RecipientGroupID != ""
+}
+
+// PaymentFilter selects payment_history rows by owner
+type PaymentFilter struct {
+	PhoneNumber string
+	GroupID     string
+	Product     string // empty matches every product
+}
+
+// matches reports whether p belongs to the owner and product of the filter
+func (f PaymentFilter) matches(p *PaymentRecord) bool {
+	if f.Product != "" && p.Product != f.Product {
+		return false
+	}
+	if f.GroupID != "" {
+		return p.GroupID == f.GroupID
+	}
+	return p.PhoneNumber == f.PhoneNumber
+}
+
+// PremiumRecord is a single row of the premium table
+type PremiumRecord struct {
+	JID              string
+	LID              string
+	SpecialLimit     int
+	MaxSpecialLimit  int
+	Expired          time.Time
+	LastSpecialReset time.Time
+}
+
+// Promo code discount types
+const (
+	DiscountPercent = "percent"
+	DiscountFixed   = "fixed"
+)
+
+// PromoCode is a single row of promo_codes. Zero limits mean unlimited.
+type PromoCode struct {
+	Code              string
+	DiscountType      string // DiscountPercent or DiscountFixed
+	DiscountValue     int    // percentage, or rupiah for fixed discounts
+	MaxDiscount       int    // caps percentage discounts
+	PlanIDs           []string
+	MaxRedemptions    int // across everyone
+	MaxPerIdentity    int // per phone number or group
+	ValidFrom         *time.Time
+	ValidUntil        *time.Time
+	FirstPurchaseOnly bool
+	Active            bool
+}
+
+// PromoRedemption records a promo code used by a PAID payment
+type PromoRedemption struct {
+	Code       string
+	Reference  string
+	Identity   string // phone number or group ID
+	Discount   int
+	RedeemedAt time.Time
+}
+
+// Referral is a rewarded referral: the referred phone's first PAID payment
+type Referral struct {
+	ReferredPhone string
+	ReferrerPhone string
+	Code          string
+	Reference     string // the payment that earned the reward
+	BonusDays     int    // granted to each party
+	CreatedAt     time.Time
+}
+
+// ReferralStats summarises the referrals rewarded to one referrer
+type ReferralStats struct {
+	Referrals int
+	BonusDays int
+}
+
+// RenewalReminder records one reminder sent for one premium expiry, so a
+// renewal (which moves the expiry) gets a fresh set of reminders
+type RenewalReminder struct {
+	JID        string
+	LID        string
+	Expired    time.Time
+	DaysBefore int
+	SentAt     time.Time
+}
+
+// Email outbox statuses
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed" // gave up
+)
+
+// EmailJob is one email in the outbox. The message is rendered from Kind
+// and Payload when it is sent, so a job is small and survives restarts.
+type EmailJob struct {
+	Key         string // deduplicates, e.g. receipt:<reference>
+	Kind        string
+	To          string
+	Payload     json.RawMessage
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+	SentAt      *time.Time
+}
+
+// IdempotencyRecord is a stored Idempotency-Key together with the hash of
+// the request that claimed it and, once that request finished, its response
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int // zero while the first request is still in flight
+	Response    json.RawMessage
+	CreatedAt   time.Time
+}
+
+// PaymentStore persists payment transactions
+type PaymentStore interface {
+	// CreatePayment inserts a new payment record
+	CreatePayment(ctx context.Context, p *PaymentRecord) error
+
+	// GetPayment looks a payment up by reference or merchant reference
+	GetPayment(ctx context.Context, reference string) (*PaymentRecord, error)
+
+	// UpdatePaymentStatus sets a non-PAID status and reports whether the status
+	// changed. A PAID payment is never downgraded.
+	UpdatePaymentStatus(ctx context.Context, reference, status string) (bool, error)
+
+	// SetPaymentFees records the fees a gateway reported for a payment,
+	// replacing earlier figures, and reports whether they changed
+	SetPaymentFees(ctx context.Context, reference string, fees PaymentFees) (bool, error)
+
+	// MarkPaymentPaid flips a payment to PAID, assigns it the next invoice
+	// number of its month and reports whether this call performed the
+	// transition. Numbers are gap-free: one is only used by a committed
+	// transition.
+	MarkPaymentPaid(ctx context.Context, reference string, paidAt time.Time) (bool, error)
+
+	// ListPayments returns one page of payments, newest first, and the total count
+	ListPayments(ctx context.Context, filter PaymentFilter, limit, offset int) ([]PaymentRecord, int, error)
+
+	// CountPaidPayments returns how many PAID payments the owner has
+	CountPaidPayments(ctx context.Context, filter PaymentFilter) (int, error)
+
+	// PendingPayments returns the owner's UNPAID payments that expire after
+	// expiresAfter, newest first. Payments without a known expiry are skipped.
+	PendingPayments(ctx context.Context, filter PaymentFilter, expiresAfter time.Time) ([]PaymentRecord, error)
+
+	// LatestPaidPayment returns the newest PAID payment whose plan went to
+	// beneficiary, a phone number or group ID, or ErrPaymentNotFound.
+	// Donations are not plans and never match.
+	LatestPaidPayment(ctx context.Context, beneficiary string) (*PaymentRecord, error)
+
+	// RecentDonations returns up to limit PAID donations, latest paid first
+	RecentDonations(ctx context.Context, limit int) ([]PaymentRecord, error)
+
+	// EachPayment calls fn for every payment dated in [from, to), oldest
+	// first, stopping at the first error fn returns. A payment is dated by
+	// when it was paid, or when it was created if it never was. A non-empty
+	// status keeps only payments with that status. Rows are streamed rather
+	// than loaded at once.
+	EachPayment(ctx context.Context, from, to time.Time, status string, fn func(*PaymentRecord) error) error
+}
+
+// PremiumStore persists premium subscriptions
+type PremiumStore interface {
+	// GetPremium returns the premium row for jid/lid or ErrPremiumNotFound
+	GetPremium(ctx context.Context, jid, lid string) (*PremiumRecord, error)
+
+	// UpsertPremium inserts or replaces the premium row for p.JID/p.LID
+	UpsertPremium(ctx context.Context, p PremiumRecord) error
+
+	// ExpiringPremium returns the premium rows expiring after from and no
+	// later than to, soonest first
+	ExpiringPremium(ctx context.Context, from, to time.Time) ([]PremiumRecord, error)
+}
+
+// IdentityStore reads the users, names and groups tables maintained by the bot
+type IdentityStore interface {
+	// UserLID returns the WhatsApp LID registered for a phone number
+	UserLID(ctx context.Context, phoneNumber string) (string, error)
+
+	// PushName returns the display name for a LID
+	PushName(ctx context.Context, lid string) (string, error)
+
+	// GroupName returns the name of a group by ID
+	GroupName(ctx context.Context, groupID string) (string, error)
+}
+
+// PromoStore persists promo codes and their redemptions
+type PromoStore interface {
+	// GetPromoCode looks a code up case-insensitively or returns ErrPromoNotFound
+	GetPromoCode(ctx context.Context, code string) (*PromoCode, error)
+
+	// CountPromoRedemptions returns the redemptions of code overall and by identity
+	CountPromoRedemptions(ctx context.Context, code, identity string) (total, byIdentity int, err error)
+
+	// RedeemPromoCode records a redemption and reports whether it is new.
+	// A payment redeems at most once.
+	RedeemPromoCode(ctx context.Context, r PromoRedemption) (bool, error)
+}
+
+// ReferralStore persists referral codes and rewarded referrals
+type ReferralStore interface {
+	// ReferralCodeFor returns the code owned by phone or ErrReferralNotFound
+	ReferralCodeFor(ctx context.Context, phone string) (string, error)
+
+	// ReferralCodeOwner returns the phone owning code, case-insensitively, or
+	// ErrReferralNotFound
+	ReferralCodeOwner(ctx context.Context, code string) (string, error)
+
+	// CreateReferralCode assigns code to phone and returns phone's code, which
+	// is the existing one if phone already has a code. It returns
+	// ErrReferralCodeTaken if code belongs to another phone.
+	CreateReferralCode(ctx context.Context, phone, code string) (string, error)
+
+	// Referrer returns the phone that referred phone or ErrReferralNotFound
+	Referrer(ctx context.Context, phone string) (string, error)
+
+	// CreateReferral records a rewarded referral and reports whether it is new.
+	// A phone can be referred only once.
+	CreateReferral(ctx context.Context, r Referral) (bool, error)
+
+	// ReferralStats summarises the referrals rewarded to referrerPhone
+	ReferralStats(ctx context.Context, referrerPhone string) (ReferralStats, error)
+}
+
+// ReminderStore remembers which renewal reminders were sent
+type ReminderStore interface {
+	// ClaimRenewalReminder records r and reports whether it is new. Each
+	// expiry gets each reminder at most once.
+	ClaimRenewalReminder(ctx context.Context, r RenewalReminder) (bool, error)
+
+	// ReleaseRenewalReminder forgets a claimed reminder that could not be
+	// delivered, so it is tried again
+	ReleaseRenewalReminder(ctx context.Context, r RenewalReminder) error
+}
+
+// MailStore is the outbox of emails waiting to be sent
+type MailStore interface {
+	// EnqueueEmail adds a pending job and reports whether it is new. A key
+	// is queued at most once.
+	EnqueueEmail(ctx context.Context, job EmailJob) (bool, error)
+
+	// ClaimEmails returns up to limit pending jobs due at now, counting an
+	// attempt on each and pushing their next attempt to leaseUntil, so a job
+	// is not sent twice while it is being worked on
+	ClaimEmails(ctx context.Context, now, leaseUntil time.Time, limit int) ([]EmailJob, error)
+
+	// CompleteEmail marks a job sent
+	CompleteEmail(ctx context.Context, key string, sentAt time.Time) error
+
+	// FailEmail records why a job failed and schedules it again at retryAt,
+	// or gives up on it when retryAt is nil
+	FailEmail(ctx context.Context, key, lastError string, retryAt *time.Time) error
+
+	// GetEmail returns a job by key or ErrEmailNotFound
+	GetEmail(ctx context.Context, key string) (*EmailJob, error)
+}
+
+// IdempotencyStore remembers Idempotency-Key headers of create requests
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims rec.Key for a new request and returns nil,
+	// or returns the record already holding the key. Keys created before
+	// expireBefore, and unfinished ones created before staleBefore, are
+	// discarded first.
+	ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord, expireBefore, staleBefore time.Time) (*IdempotencyRecord, error)
+
+	// CompleteIdempotencyKey stores the response of the request holding key
+	CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error
+
+	// ReleaseIdempotencyKey drops a reservation so the request can be retried
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
+
+// Store groups every repository the backend needs
+type Store interface {
+	PaymentStore
+	PremiumStore
+	IdentityStore
+	IdempotencyStore
+	PromoStore
+	ReferralStore
+	ReminderStore
+	MailStore
+
+	// Ping reports ErrStorageUnavailable while the backing database is unreachable
+	Ping(ctx context.Context) error
+
+	// PendingMigrations names the files in migrations/ that have not been
+	// applied to the database yet
+	PendingMigrations(ctx context.Context) ([]string, error)
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements Store in process memory. It is meant for tests and
+// local development; nothing survives a restart.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	payments map[string]*PaymentRecord
+	premium  map[[2]string]PremiumRecord
+	userLIDs map[string]string
+	names    map[string]string
+	groups   map[string]string
+	idem     map[string]IdempotencyRecord
+	promos   map[string]PromoCode
+	redeemed map[string]PromoRedemption // by payment reference
+	codes    map[string]string          // referral code by phone
+	referred map[string]Referral        // by referred phone
+	reminded map[reminderKey]RenewalReminder
+	invoices map[string]int // last invoice number by period
+	outbox   map[string]EmailJob
+}
+
+// reminderKey identifies one reminder for one premium expiry
+type reminderKey struct {
+	jid, lid   string
+	expired    int64
+	daysBefore int
+}
+
+func keyOfReminder(r RenewalReminder) reminderKey {
+	return reminderKey{r.JID, r.LID, r.Expired.Unix(), r.DaysBefore}
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		payments: make(map[string]*PaymentRecord),
+		premium:  make(map[[2]string]PremiumRecord),
+		userLIDs: make(map[string]string),
+		names:    make(map[string]string),
+		groups:   make(map[string]string),
+		idem:     make(map[string]IdempotencyRecord),
+		promos:   make(map[string]PromoCode),
+		redeemed: make(map[string]PromoRedemption),
+		codes:    make(map[string]string),
+		referred: make(map[string]Referral),
+		reminded: make(map[reminderKey]RenewalReminder),
+		invoices: make(map[string]int),
+		outbox:   make(map[string]EmailJob),
+	}
+}
+
+// SetUser registers a phone number with its LID and display name
+func (s *MemoryStore) SetUser(phoneNumber, lid, pushName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userLIDs[phoneNumber] = lid
+	if pushName != "" {
+		s.names[lid] = pushName
+	}
+}
+
+// SetGroup registers a group with its name
+func (s *MemoryStore) SetGroup(groupID, groupName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[groupID] = groupName
+}
+
+// SetPromoCode creates or replaces a promo code
+func (s *MemoryStore) SetPromoCode(p PromoCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.Code = strings.ToUpper(p.Code)
+	s.promos[p.Code] = p
+}
+
+// Ping always succeeds; memory is always available
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// PendingMigrations always reports none; memory has no schema
+func (s *MemoryStore) PendingMigrations(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+// findPayment matches reference or merchant_ref, like the SQL lookups do.
+// Callers must hold s.mu.
+func (s *MemoryStore) findPayment(reference string) *PaymentRecord {
+	if p, ok := s.payments[reference]; ok {
+		return p
+	}
+	for _, p := range s.payments {
+		if p.MerchantRef == reference {
+			return p
+		}
+	}
+	return nil
+}
+
+// CreatePayment stores a copy of p
+func (s *MemoryStore) CreatePayment(ctx context.Context, p *PaymentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := *p
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now()
+	}
+	record.UpdatedAt = record.CreatedAt
+	if record.Product == "" {
+		record.Product = productPremium
+	}
+	if p.Fees != nil {
+		fees := *p.Fees
+		record.Fees = &fees
+	}
+	s.payments[record.Reference] = &record
+	return nil
+}
+
+// GetPayment returns a copy of the payment with the given reference or merchant reference
+func (s *MemoryStore) GetPayment(ctx context.Context, reference string) (*PaymentRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := s.findPayment(reference)
+	if p == nil {
+		return nil, ErrPaymentNotFound
+	}
+	record := *p
+	return &record, nil
+}
+
+// UpdatePaymentStatus sets a non-PAID status without ever downgrading a PAID payment
+func (s *MemoryStore) UpdatePaymentStatus(ctx context.Context, reference, status string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPayment(reference)
+	if p == nil || p.Status == "PAID" || p.Status == status {
+		return false, nil
+	}
+	p.Status = status
+	p.UpdatedAt = time.Now()
+	return true, nil
+}
+
+// SetPaymentFees records the fees a gateway reported for a payment
+func (s *MemoryStore) SetPaymentFees(ctx context.Context, reference string, fees PaymentFees) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPayment(reference)
+	if p == nil || (p.Fees != nil && *p.Fees == fees) {
+		return false, nil
+	}
+	p.Fees = &fees
+	p.UpdatedAt = time.Now()
+	return true, nil
+}
+
+// MarkPaymentPaid flips a payment to PAID and reports whether this call
+// performed the transition
+func (s *MemoryStore) MarkPaymentPaid(ctx context.Context, reference string, paidAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPayment(reference)
+	if p == nil || p.Status == "PAID" {
+		return false, nil
+	}
+	p.Status = "PAID"
+	p.PaidAt = &paidAt
+	p.UpdatedAt = time.Now()
+
+	period := invoicePeriod(paidAt)
+	s.invoices[period]++
+	p.InvoiceNumber = formatInvoiceNumber(period, s.invoices[period])
+	return true, nil
+}
+
+// ListPayments returns one page of payments for a phone number or group, newest first
+func (s *MemoryStore) ListPayments(ctx context.Context, filter PaymentFilter, limit, offset int) ([]PaymentRecord, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []PaymentRecord
+	for _, p := range s.payments {
+		if !filter.matches(p) {
+			continue
+		}
+		matched = append(matched, *p)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	total := len(matched)
+	if offset >= total {
+		return nil, total, nil
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return matched[offset:end], total, nil
+}
+
+// CountPaidPayments returns how many PAID payments the owner has
+func (s *MemoryStore) CountPaidPayments(ctx context.Context, filter PaymentFilter) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, p := range s.payments {
+		if !filter.matches(p) {
+			continue
+		}
+		if p.Status == "PAID" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// PendingPayments returns the owner's UNPAID payments expiring after expiresAfter
+func (s *MemoryStore) PendingPayments(ctx context.Context, filter PaymentFilter, expiresAfter time.Time) ([]PaymentRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []PaymentRecord
+	for _, p := range s.payments {
+		if !filter.matches(p) {
+			continue
+		}
+		if p.Status != "UNPAID" || p.ExpiredAt == nil || !p.ExpiredAt.After(expiresAfter) {
+			continue
+		}
+		matched = append(matched, *p)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+	return matched, nil
+}
+
+// LatestPaidPayment returns the newest PAID payment whose plan went to beneficiary
+func (s *MemoryStore) LatestPaidPayment(ctx context.Context, beneficiary string) (*PaymentRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest *PaymentRecord
+	for _, p := range s.payments {
+		phone, groupID := p.Beneficiary()
+		if p.Status != "PAID" || p.IsDonation() || (phone != beneficiary && groupID != beneficiary) {
+			continue
+		}
+		if latest == nil || paidTime(p).After(paidTime(latest)) {
+			latest = p
+		}
+	}
+	if latest == nil {
+		return nil, ErrPaymentNotFound
+	}
+	copied := *latest
+	return &copied, nil
+}
+
+// RecentDonations returns up to limit PAID donations, latest paid first
+func (s *MemoryStore) RecentDonations(ctx context.Context, limit int) ([]PaymentRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []PaymentRecord
+	for _, p := range s.payments {
+		if p.Status == "PAID" && p.IsDonation() {
+			matched = append(matched, *p)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return paidTime(&matched[i]).After(paidTime(&matched[j]))
+	})
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+// EachPayment calls fn for the payments dated in [from, to), oldest first
+func (s *MemoryStore) EachPayment(ctx context.Context, from, to time.Time, status string, fn func(*PaymentRecord) error) error {
+	s.mu.RLock()
+	var matched []PaymentRecord
+	for _, p := range s.payments {
+		dated := paidTime(p)
+		if dated.Before(from) || !dated.Before(to) || (status != "" && p.Status != status) {
+			continue
+		}
+		matched = append(matched, *p)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		ti, tj := paidTime(&matched[i]), paidTime(&matched[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return matched[i].Reference < matched[j].Reference
+	})
+	for i := range matched {
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPremium returns the premium row for jid/lid
+func (s *MemoryStore) GetPremium(ctx context.Context, jid, lid string) (*PremiumRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.premium[[2]string{jid, lid}]
+	if !ok {
+		return nil, ErrPremiumNotFound
+	}
+	return &p, nil
+}
+
+// UpsertPremium inserts or replaces the premium row for p.JID/p.LID
+func (s *MemoryStore) UpsertPremium(ctx context.Context, p PremiumRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Match the precision of the RFC3339 text column used by PostgresStore
+	p.Expired = p.Expired.Truncate(time.Second)
+	p.LastSpecialReset = p.LastSpecialReset.Truncate(time.Second)
+	s.premium[[2]string{p.JID, p.LID}] = p
+	return nil
+}
+
+// ExpiringPremium returns the premium rows expiring in (from, to], soonest first
+func (s *MemoryStore) ExpiringPremium(ctx context.Context, from, to time.Time) ([]PremiumRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var expiring []PremiumRecord
+	for _, p := range s.premium {
+		if p.Expired.After(from) && !p.Expired.After(to) {
+			expiring = append(expiring, p)
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].Expired.Before(expiring[j].Expired)
+	})
+	return expiring, nil
+}
+
+// ClaimRenewalReminder records r and reports whether it is new
+func (s *MemoryStore) ClaimRenewalReminder(ctx context.Context, r RenewalReminder) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := keyOfReminder(r)
+	if _, ok := s.reminded[key]; ok {
+		return false, nil
+	}
+	s.reminded[key] = r
+	return true, nil
+}
+
+// ReleaseRenewalReminder forgets a claimed reminder
+func (s *MemoryStore) ReleaseRenewalReminder(ctx context.Context, r RenewalReminder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reminded, keyOfReminder(r))
+	return nil
+}
+
+// EnqueueEmail adds a pending job unless its key is already queued
+func (s *MemoryStore) EnqueueEmail(ctx context.Context, job EmailJob) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.outbox[job.Key]; ok {
+		return false, nil
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+	if job.NextAttempt.IsZero() {
+		job.NextAttempt = job.CreatedAt
+	}
+	job.Status = EmailPending
+	job.Attempts = 0
+	job.SentAt = nil
+	s.outbox[job.Key] = job
+	return true, nil
+}
+
+// ClaimEmails returns the pending jobs due at now, leasing them until leaseUntil
+func (s *MemoryStore) ClaimEmails(ctx context.Context, now, leaseUntil time.Time, limit int) ([]EmailJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []EmailJob
+	for _, job := range s.outbox {
+		if job.Status == EmailPending && !job.NextAttempt.After(now) {
+			due = append(due, job)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].Attempts++
+		due[i].NextAttempt = leaseUntil
+		s.outbox[due[i].Key] = due[i]
+	}
+	return due, nil
+}
+
+// CompleteEmail marks a job sent
+func (s *MemoryStore) CompleteEmail(ctx context.Context, key string, sentAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.outbox[key]
+	if !ok {
+		return ErrEmailNotFound
+	}
+	job.Status = EmailSent
+	job.SentAt = &sentAt
+	job.LastError = ""
+	s.outbox[key] = job
+	return nil
+}
+
+// FailEmail schedules a failed job again, or gives up on it
+func (s *MemoryStore) FailEmail(ctx context.Context, key, lastError string, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.outbox[key]
+	if !ok {
+		return ErrEmailNotFound
+	}
+	job.LastError = lastError
+	if retryAt == nil {
+		job.Status = EmailFailed
+	} else {
+		job.NextAttempt = *retryAt
+	}
+	s.outbox[key] = job
+	return nil
+}
+
+// GetEmail returns a job by key
+func (s *MemoryStore) GetEmail(ctx context.Context, key string) (*EmailJob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.outbox[key]
+	if !ok {
+		return nil, ErrEmailNotFound
+	}
+	return &job, nil
+}
+
+// UserLID returns the LID registered for a phone number
+func (s *MemoryStore) UserLID(ctx context.Context, phoneNumber string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lid, ok := s.userLIDs[phoneNumber]
+	if !ok || lid == "" {
+		return "", ErrIdentityNotFound
+	}
+	return lid, nil
+}
+
+// PushName returns the display name for a LID
+func (s *MemoryStore) PushName(ctx context.Context, lid string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.names[lid]
+	if !ok {
+		return "", ErrIdentityNotFound
+	}
+	return name, nil
+}
+
+// GroupName returns the name of a group by ID
+func (s *MemoryStore) GroupName(ctx context.Context, groupID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.groups[groupID]
+	if !ok {
+		return "", ErrIdentityNotFound
+	}
+	return name, nil
+}
+
+// ReserveIdempotencyKey claims rec.Key or returns the record already holding it
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord, expireBefore, staleBefore time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, existing := range s.idem {
+		if existing.CreatedAt.Before(expireBefore) || (existing.StatusCode == 0 && existing.CreatedAt.Before(staleBefore)) {
+			delete(s.idem, key)
+		}
+	}
+
+	if existing, ok := s.idem[rec.Key]; ok {
+		return &existing, nil
+	}
+	rec.StatusCode, rec.Response = 0, nil
+	s.idem[rec.Key] = rec
+	return nil, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.idem[key]; ok {
+		rec.StatusCode = statusCode
+		rec.Response = append([]byte(nil), response...)
+		s.idem[key] = rec
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey drops an unfinished reservation
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.idem[key]; ok && rec.StatusCode == 0 {
+		delete(s.idem, key)
+	}
+	return nil
+}
+
+// GetPromoCode looks a promo code up case-insensitively
+func (s *MemoryStore) GetPromoCode(ctx context.Context, code string) (*PromoCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.promos[strings.ToUpper(code)]
+	if !ok {
+		return nil, ErrPromoNotFound
+	}
+	return &p, nil
+}
+
+// CountPromoRedemptions returns the redemptions of code overall and by identity
+func (s *MemoryStore) CountPromoRedemptions(ctx context.Context, code, identity string) (int, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total, byIdentity int
+	for _, r := range s.redeemed {
+		if r.Code != strings.ToUpper(code) {
+			continue
+		}
+		total++
+		if r.Identity == identity {
+			byIdentity++
+		}
+	}
+	return total, byIdentity, nil
+}
+
+// RedeemPromoCode records a redemption once per payment
+func (s *MemoryStore) RedeemPromoCode(ctx context.Context, r PromoRedemption) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.redeemed[r.Reference]; ok {
+		return false, nil
+	}
+	r.Code = strings.ToUpper(r.Code)
+	s.redeemed[r.Reference] = r
+	return true, nil
+}
+
+// ReferralCodeFor returns the referral code owned by phone
+func (s *MemoryStore) ReferralCodeFor(ctx context.Context, phone string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	code, ok := s.codes[phone]
+	if !ok {
+		return "", ErrReferralNotFound
+	}
+	return code, nil
+}
+
+// ReferralCodeOwner returns the phone owning a referral code
+func (s *MemoryStore) ReferralCodeOwner(ctx context.Context, code string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for phone, owned := range s.codes {
+		if owned == strings.ToUpper(code) {
+			return phone, nil
+		}
+	}
+	return "", ErrReferralNotFound
+}
+
+// CreateReferralCode assigns code to phone unless phone already has one
+func (s *MemoryStore) CreateReferralCode(ctx context.Context, phone, code string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.codes[phone]; ok {
+		return existing, nil
+	}
+	code = strings.ToUpper(code)
+	for _, owned := range s.codes {
+		if owned == code {
+			return "", ErrReferralCodeTaken
+		}
+	}
+	s.codes[phone] = code
+	return code, nil
+}
+
+// Referrer returns the phone that referred phone
+func (s *MemoryStore) Referrer(ctx context.Context, phone string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.referred[phone]
+	if !ok {
+		return "", ErrReferralNotFound
+	}
+	return r.ReferrerPhone, nil
+}
+
+// CreateReferral records a rewarded referral once per referred phone
+func (s *MemoryStore) CreateReferral(ctx context.Context, r Referral) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.referred[r.ReferredPhone]; ok {
+		return false, nil
+	}
+	r.Code = strings.ToUpper(r.Code)
+	s.referred[r.ReferredPhone] = r
+	return true, nil
+}
+
+// ReferralStats summarises the referrals rewarded to referrerPhone
+func (s *MemoryStore) ReferralStats(ctx context.Context, referrerPhone string) (ReferralStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats ReferralStats
+	for _, r := range s.referred {
+		if r.ReferrerPhone == referrerPhone {
+			stats.Referrals++
+			stats.BonusDays += r.BonusDays
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,1138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore implements Store on top of the shared PostgreSQL database.
+// It can be created before the database is reachable; until SetDB is called
+// every method fails with ErrStorageUnavailable.
+type PostgresStore struct {
+	conn atomic.Pointer[sql.DB]
+}
+
+// NewPostgresStore creates a store backed by db, which may be nil
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	s := &PostgresStore{}
+	if db != nil {
+		s.SetDB(db)
+	}
+	return s
+}
+
+// SetDB installs the connection pool once the database is reachable
+func (s *PostgresStore) SetDB(db *sql.DB) {
+	s.conn.Store(db)
+}
+
+// db returns the connection pool or ErrStorageUnavailable
+func (s *PostgresStore) db() (*tracedDB, error) {
+	db := s.conn.Load()
+	if db == nil {
+		return nil, ErrStorageUnavailable
+	}
+	return &tracedDB{db}, nil
+}
+
+// Ping checks that the database is connected and answering
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+// schemaMigrations lists, for each file in migrations/, a column it adds.
+// Migrations are applied by hand, so a missing column means a pending file.
+var schemaMigrations = []struct {
+	File   string
+	Table  string
+	Column string
+}{
+	{"add_payment_number_and_expired_at.sql", "payment_history", "payment_number"},
+	{"add_payment_number_and_expired_at.sql", "payment_history", "expired_at"},
+	{"add_idempotency_keys.sql", "idempotency_keys", "request_hash"},
+	{"add_promo_codes.sql", "payment_history", "promo_code"},
+	{"add_promo_codes.sql", "promo_codes", "code"},
+	{"add_promo_codes.sql", "promo_redemptions", "reference"},
+	{"add_referrals.sql", "payment_history", "referral_code"},
+	{"add_referrals.sql", "referral_codes", "code"},
+	{"add_referrals.sql", "referrals", "referred_phone"},
+	{"add_gift_purchases.sql", "payment_history", "recipient_phone"},
+	{"add_gift_purchases.sql", "payment_history", "gift_message"},
+	{"add_renewal_reminders.sql", "renewal_reminders", "days_before"},
+	{"add_invoice_numbers.sql", "payment_history", "invoice_number"},
+	{"add_invoice_numbers.sql", "invoice_counters", "last_number"},
+	{"add_customer_email.sql", "payment_history", "customer_email"},
+	{"add_customer_email.sql", "email_outbox", "dedup_key"},
+	{"add_payment_gateway.sql", "payment_history", "gateway"},
+	{"add_payment_fees.sql", "payment_history", "net_amount"},
+	{"add_donations.sql", "payment_history", "product"},
+}
+
+// PendingMigrations names the migrations whose columns are missing
+func (s *PostgresStore) PendingMigrations(ctx context.Context) ([]string, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[[2]string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		columns[[2]string{table, column}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	seen := make(map[string]bool)
+	for _, m := range schemaMigrations {
+		if !columns[[2]string{m.Table, m.Column}] && !seen[m.File] {
+			pending = append(pending, m.File)
+			seen[m.File] = true
+		}
+	}
+	return pending, nil
+}
+
+// Close closes the connection pool, if any
+func (s *PostgresStore) Close() error {
+	if db := s.conn.Swap(nil); db != nil {
+		return db.Close()
+	}
+	return nil
+}
+
+// nullString maps an empty string to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime maps a nil pointer to SQL NULL
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// CreatePayment inserts a new payment_history row
+func (s *PostgresStore) CreatePayment(ctx context.Context, p *PaymentRecord) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	createdAt := p.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	orderItems := []byte(p.OrderItems)
+	if len(orderItems) == 0 {
+		orderItems = nil
+	}
+
+	product := p.Product
+	if product == "" {
+		product = productPremium
+	}
+
+	var feeMerchant, feeCustomer, totalPaid, netAmount sql.NullInt64
+	if f := p.Fees; f != nil {
+		feeMerchant = sql.NullInt64{Int64: int64(f.FeeMerchant), Valid: true}
+		feeCustomer = sql.NullInt64{Int64: int64(f.FeeCustomer), Valid: true}
+		totalPaid = sql.NullInt64{Int64: int64(f.TotalPaid), Valid: true}
+		netAmount = sql.NullInt64{Int64: int64(f.NetAmount), Valid: true}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO payment_history
+		(reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status, order_items, payment_number, expired_at, created_at,
+		 promo_code, discount_amount, referral_code, recipient_phone, recipient_group_id, gift_message, customer_email, gateway,
+		 fee_merchant, fee_customer, total_paid, net_amount, product, donor_name, donor_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27)
+	`,
+		p.Reference,
+		p.MerchantRef,
+		nullString(p.PhoneNumber),
+		nullString(p.GroupID),
+		p.CustomerName,
+		p.Method,
+		p.Amount,
+		p.Status,
+		orderItems,
+		nullString(p.PaymentNumber),
+		nullTime(p.ExpiredAt),
+		createdAt,
+		nullString(p.PromoCode),
+		p.DiscountAmount,
+		nullString(p.ReferralCode),
+		nullString(p.RecipientPhone),
+		nullString(p.RecipientGroupID),
+		nullString(p.GiftMessage),
+		nullString(p.CustomerEmail),
+		nullString(p.Gateway),
+		feeMerchant,
+		feeCustomer,
+		totalPaid,
+		netAmount,
+		product,
+		nullString(p.DonorName),
+		nullString(p.DonorMessage),
+	)
+	return err
+}
+
+const paymentColumns = `reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status,
+	order_items, payment_number, expired_at, created_at, updated_at, paid_at, promo_code, discount_amount,
+	referral_code, recipient_phone, recipient_group_id, gift_message, invoice_number, customer_email, gateway,
+	fee_merchant, fee_customer, total_paid, net_amount, product, donor_name, donor_message`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPayment(row rowScanner) (*PaymentRecord, error) {
+	var p PaymentRecord
+	var phoneNumber, groupID, customerName, paymentNumber, promoCode, referralCode sql.NullString
+	var recipientPhone, recipientGroupID, giftMessage, invoiceNumber, customerEmail, gateway sql.NullString
+	var donorName, donorMessage sql.NullString
+	var orderItems []byte
+	var expiredAt, updatedAt, paidAt sql.NullTime
+	var discountAmount, feeMerchant, feeCustomer, totalPaid, netAmount sql.NullInt64
+
+	err := row.Scan(&p.Reference, &p.MerchantRef, &phoneNumber, &groupID, &customerName, &p.Method,
+		&p.Amount, &p.Status, &orderItems, &paymentNumber, &expiredAt, &p.CreatedAt, &updatedAt, &paidAt,
+		&promoCode, &discountAmount, &referralCode, &recipientPhone, &recipientGroupID, &giftMessage, &invoiceNumber, &customerEmail, &gateway,
+		&feeMerchant, &feeCustomer, &totalPaid, &netAmount, &p.Product, &donorName, &donorMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	p.PhoneNumber = phoneNumber.String
+	p.GroupID = groupID.String
+	p.CustomerName = customerName.String
+	p.PaymentNumber = paymentNumber.String
+	p.PromoCode = promoCode.String
+	p.DiscountAmount = int(discountAmount.Int64)
+	p.ReferralCode = referralCode.String
+	p.RecipientPhone = recipientPhone.String
+	p.RecipientGroupID = recipientGroupID.String
+	p.GiftMessage = giftMessage.String
+	p.InvoiceNumber = invoiceNumber.String
+	p.CustomerEmail = customerEmail.String
+	p.Gateway = gateway.String
+	p.DonorName = donorName.String
+	p.DonorMessage = donorMessage.String
+	p.OrderItems = orderItems
+	p.UpdatedAt = updatedAt.Time
+	if expiredAt.Valid {
+		p.ExpiredAt = &expiredAt.Time
+	}
+	if paidAt.Valid {
+		p.PaidAt = &paidAt.Time
+	}
+	if totalPaid.Valid {
+		p.Fees = &PaymentFees{
+			FeeMerchant: int(feeMerchant.Int64),
+			FeeCustomer: int(feeCustomer.Int64),
+			TotalPaid:   int(totalPaid.Int64),
+			NetAmount:   int(netAmount.Int64),
+		}
+	}
+	return &p, nil
+}
+
+// GetPayment looks a payment up by reference or merchant reference
+func (s *PostgresStore) GetPayment(ctx context.Context, reference string) (*PaymentRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := scanPayment(db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE reference = $1 OR merchant_ref = $1
+	`, reference))
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	return p, err
+}
+
+// UpdatePaymentStatus sets a non-PAID status without ever downgrading a PAID row
+func (s *PostgresStore) UpdatePaymentStatus(ctx context.Context, reference, status string) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE payment_history
+		SET status = $1, updated_at = $2
+		WHERE (reference = $3 OR merchant_ref = $3) AND status <> 'PAID' AND status <> $1
+	`, status, time.Now(), reference)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// SetPaymentFees records the fees a gateway reported for a payment
+func (s *PostgresStore) SetPaymentFees(ctx context.Context, reference string, fees PaymentFees) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE payment_history
+		SET fee_merchant = $1, fee_customer = $2, total_paid = $3, net_amount = $4, updated_at = $5
+		WHERE (reference = $6 OR merchant_ref = $6)
+		AND (fee_merchant, fee_customer, total_paid, net_amount) IS DISTINCT FROM ($1, $2, $3, $4)
+	`, fees.FeeMerchant, fees.FeeCustomer, fees.TotalPaid, fees.NetAmount, time.Now(), reference)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// MarkPaymentPaid flips a payment to PAID and reports whether this call
+// performed the transition
+func (s *PostgresStore) MarkPaymentPaid(ctx context.Context, reference string, paidAt time.Time) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var paidRef string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payment_history
+		SET status = 'PAID', paid_at = $1, updated_at = $2
+		WHERE (reference = $3 OR merchant_ref = $3) AND status <> 'PAID'
+		RETURNING reference
+	`, paidAt, time.Now(), reference).Scan(&paidRef)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// The counter row stays locked until commit, so concurrent payments
+	// take turns and a rolled back transition gives its number back
+	period := invoicePeriod(paidAt)
+	var number int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO invoice_counters (period, last_number) VALUES ($1, 1)
+		ON CONFLICT (period) DO UPDATE SET last_number = invoice_counters.last_number + 1
+		RETURNING last_number
+	`, period).Scan(&number)
+	if err != nil {
+		return false, fmt.Errorf("failed to assign invoice number: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE payment_history SET invoice_number = $1 WHERE reference = $2
+	`, formatInvoiceNumber(period, number), paidRef)
+	if err != nil {
+		return false, fmt.Errorf("failed to assign invoice number: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ownerClause selects the payments of the filter's owner and product as
+// $1 and $2 and returns their arguments
+func ownerClause(filter PaymentFilter) (string, []interface{}) {
+	where := "phone_number = $1"
+	owner := filter.PhoneNumber
+	if filter.GroupID != "" {
+		where = "group_id = $1"
+		owner = filter.GroupID
+	}
+	return where + " AND ($2 = '' OR product = $2)", []interface{}{owner, filter.Product}
+}
+
+// ListPayments returns one page of payments for a phone number or group, newest first
+func (s *PostgresStore) ListPayments(ctx context.Context, filter PaymentFilter, limit, offset int) ([]PaymentRecord, int, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	where, args := ownerClause(filter)
+
+	var totalCount int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM payment_history WHERE "+where, args...).Scan(&totalCount); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE `+where+`
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var payments []PaymentRecord
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, totalCount, rows.Err()
+}
+
+// CountPaidPayments returns how many PAID payments the owner has
+func (s *PostgresStore) CountPaidPayments(ctx context.Context, filter PaymentFilter) (int, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, err
+	}
+
+	where, args := ownerClause(filter)
+
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM payment_history WHERE "+where+" AND status = 'PAID'", args...).Scan(&count)
+	return count, err
+}
+
+// PendingPayments returns the owner's UNPAID payments expiring after expiresAfter
+func (s *PostgresStore) PendingPayments(ctx context.Context, filter PaymentFilter, expiresAfter time.Time) ([]PaymentRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := ownerClause(filter)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE `+where+` AND status = 'UNPAID' AND expired_at > $3
+		ORDER BY created_at DESC
+	`, append(args, expiresAfter)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []PaymentRecord
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+// LatestPaidPayment returns the newest PAID payment whose plan went to beneficiary
+func (s *PostgresStore) LatestPaidPayment(ctx context.Context, beneficiary string) (*PaymentRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := scanPayment(db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE status = 'PAID' AND product <> 'donation' AND (
+			recipient_phone = $1 OR recipient_group_id = $1 OR
+			(recipient_phone IS NULL AND recipient_group_id IS NULL AND (phone_number = $1 OR group_id = $1))
+		)
+		ORDER BY COALESCE(paid_at, created_at) DESC
+		LIMIT 1
+	`, beneficiary))
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	return p, err
+}
+
+// RecentDonations returns up to limit PAID donations, latest paid first
+func (s *PostgresStore) RecentDonations(ctx context.Context, limit int) ([]PaymentRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE product = 'donation' AND status = 'PAID'
+		ORDER BY COALESCE(paid_at, created_at) DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var donations []PaymentRecord
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		donations = append(donations, *p)
+	}
+	return donations, rows.Err()
+}
+
+// EachPayment streams the payments dated in [from, to), oldest first
+func (s *PostgresStore) EachPayment(ctx context.Context, from, to time.Time, status string, fn func(*PaymentRecord) error) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment_history
+		WHERE COALESCE(paid_at, created_at) >= $1 AND COALESCE(paid_at, created_at) < $2
+		AND ($3 = '' OR status = $3)
+		ORDER BY COALESCE(paid_at, created_at), reference
+	`, from, to, status)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const premiumColumns = `jid, lid, special_limit, max_special_limit, expired, last_special_reset`
+
+// scanPremium reads a premium row selected with premiumColumns
+func scanPremium(row rowScanner) (*PremiumRecord, error) {
+	var p PremiumRecord
+	var specialLimit, maxSpecialLimit sql.NullInt64
+	var expired, lastSpecialReset sql.NullString
+	if err := row.Scan(&p.JID, &p.LID, &specialLimit, &maxSpecialLimit, &expired, &lastSpecialReset); err != nil {
+		return nil, err
+	}
+
+	// expired and last_special_reset are RFC3339 text shared with the bot;
+	// an unparsable value is treated as already expired
+	p.SpecialLimit = int(specialLimit.Int64)
+	p.MaxSpecialLimit = int(maxSpecialLimit.Int64)
+	p.Expired, _ = time.Parse(time.RFC3339, expired.String)
+	p.LastSpecialReset, _ = time.Parse(time.RFC3339, lastSpecialReset.String)
+	return &p, nil
+}
+
+// GetPremium returns the premium row for jid/lid
+func (s *PostgresStore) GetPremium(ctx context.Context, jid, lid string) (*PremiumRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := scanPremium(db.QueryRowContext(ctx, `
+		SELECT `+premiumColumns+` FROM premium WHERE jid = $1 AND lid = $2
+	`, jid, lid))
+	if err == sql.ErrNoRows {
+		return nil, ErrPremiumNotFound
+	}
+	return p, err
+}
+
+// ExpiringPremium returns the premium rows expiring in (from, to], soonest
+// first. Rows whose expired text is not a timestamp are skipped.
+func (s *PostgresStore) ExpiringPremium(ctx context.Context, from, to time.Time) ([]PremiumRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+premiumColumns+` FROM (
+			SELECT `+premiumColumns+`,
+				CASE WHEN expired ~ '^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}' THEN expired::timestamptz END AS expires_at
+			FROM premium
+		) p
+		WHERE expires_at > $1 AND expires_at <= $2
+		ORDER BY expires_at
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expiring []PremiumRecord
+	for rows.Next() {
+		p, err := scanPremium(rows)
+		if err != nil {
+			return nil, err
+		}
+		expiring = append(expiring, *p)
+	}
+	return expiring, rows.Err()
+}
+
+// ClaimRenewalReminder records r and reports whether it is new
+func (s *PostgresStore) ClaimRenewalReminder(ctx context.Context, r RenewalReminder) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO renewal_reminders (jid, lid, expired, days_before, sent_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+	`, r.JID, r.LID, r.Expired, r.DaysBefore, r.SentAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReleaseRenewalReminder forgets a claimed reminder
+func (s *PostgresStore) ReleaseRenewalReminder(ctx context.Context, r RenewalReminder) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM renewal_reminders WHERE jid = $1 AND lid = $2 AND expired = $3 AND days_before = $4
+	`, r.JID, r.LID, r.Expired, r.DaysBefore)
+	return err
+}
+
+// EnqueueEmail adds a pending job unless its key is already queued
+func (s *PostgresStore) EnqueueEmail(ctx context.Context, job EmailJob) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	createdAt := job.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	nextAttempt := job.NextAttempt
+	if nextAttempt.IsZero() {
+		nextAttempt = createdAt
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO email_outbox (dedup_key, kind, recipient, payload, status, attempts, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, 0, $6, $7)
+		ON CONFLICT (dedup_key) DO NOTHING
+	`, job.Key, job.Kind, job.To, []byte(job.Payload), EmailPending, nextAttempt, createdAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+const emailColumns = `dedup_key, kind, recipient, payload, status, attempts, next_attempt_at, last_error, created_at, sent_at`
+
+func scanEmail(row rowScanner) (*EmailJob, error) {
+	var job EmailJob
+	var payload []byte
+	var lastError sql.NullString
+	var sentAt sql.NullTime
+
+	err := row.Scan(&job.Key, &job.Kind, &job.To, &payload, &job.Status, &job.Attempts,
+		&job.NextAttempt, &lastError, &job.CreatedAt, &sentAt)
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = payload
+	job.LastError = lastError.String
+	if sentAt.Valid {
+		job.SentAt = &sentAt.Time
+	}
+	return &job, nil
+}
+
+// ClaimEmails leases the pending jobs due at now until leaseUntil. Rows
+// locked by another instance are skipped rather than waited for.
+func (s *PostgresStore) ClaimEmails(ctx context.Context, now, leaseUntil time.Time, limit int) ([]EmailJob, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE email_outbox SET attempts = attempts + 1, next_attempt_at = $2
+		WHERE dedup_key IN (
+			SELECT dedup_key FROM email_outbox
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+emailColumns, now, leaseUntil, EmailPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []EmailJob
+	for rows.Next() {
+		job, err := scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// CompleteEmail marks a job sent
+func (s *PostgresStore) CompleteEmail(ctx context.Context, key string, sentAt time.Time) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE email_outbox SET status = $2, sent_at = $3, last_error = NULL WHERE dedup_key = $1
+	`, key, EmailSent, sentAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrEmailNotFound
+	}
+	return nil
+}
+
+// FailEmail schedules a failed job again, or gives up on it
+func (s *PostgresStore) FailEmail(ctx context.Context, key, lastError string, retryAt *time.Time) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if retryAt == nil {
+		res, err = db.ExecContext(ctx, `
+			UPDATE email_outbox SET status = $2, last_error = $3 WHERE dedup_key = $1
+		`, key, EmailFailed, lastError)
+	} else {
+		res, err = db.ExecContext(ctx, `
+			UPDATE email_outbox SET next_attempt_at = $2, last_error = $3 WHERE dedup_key = $1
+		`, key, *retryAt, lastError)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrEmailNotFound
+	}
+	return nil
+}
+
+// GetEmail returns a job by key
+func (s *PostgresStore) GetEmail(ctx context.Context, key string) (*EmailJob, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := scanEmail(db.QueryRowContext(ctx, `SELECT `+emailColumns+` FROM email_outbox WHERE dedup_key = $1`, key))
+	if err == sql.ErrNoRows {
+		return nil, ErrEmailNotFound
+	}
+	return job, err
+}
+
+// UpsertPremium inserts or replaces the premium row for p.JID/p.LID
+func (s *PostgresStore) UpsertPremium(ctx context.Context, p PremiumRecord) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO premium (jid, lid, special_limit, max_special_limit, expired, last_special_reset)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (jid, lid) DO UPDATE SET
+			special_limit = EXCLUDED.special_limit,
+			max_special_limit = EXCLUDED.max_special_limit,
+			expired = EXCLUDED.expired,
+			last_special_reset = EXCLUDED.last_special_reset
+	`, p.JID, p.LID, p.SpecialLimit, p.MaxSpecialLimit,
+		p.Expired.Format(time.RFC3339), p.LastSpecialReset.Format(time.RFC3339))
+	return err
+}
+
+// UserLID returns the LID registered for a phone number
+func (s *PostgresStore) UserLID(ctx context.Context, phoneNumber string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var lid sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT lid FROM users WHERE phone_number = $1", phoneNumber).Scan(&lid)
+	if err == sql.ErrNoRows || (err == nil && lid.String == "") {
+		return "", ErrIdentityNotFound
+	}
+	return lid.String, err
+}
+
+// PushName returns the display name for a LID
+func (s *PostgresStore) PushName(ctx context.Context, lid string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var pushName string
+	err = db.QueryRowContext(ctx, "SELECT push_name FROM names WHERE lid = $1", lid).Scan(&pushName)
+	if err == sql.ErrNoRows {
+		return "", ErrIdentityNotFound
+	}
+	return pushName, err
+}
+
+// GroupName returns the name of a group by ID
+func (s *PostgresStore) GroupName(ctx context.Context, groupID string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var groupName string
+	err = db.QueryRowContext(ctx, "SELECT group_name FROM groups WHERE id = $1", groupID).Scan(&groupName)
+	if err == sql.ErrNoRows {
+		return "", ErrIdentityNotFound
+	}
+	return groupName, err
+}
+
+// ReserveIdempotencyKey claims rec.Key or returns the record already holding it
+func (s *PostgresStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord, expireBefore, staleBefore time.Time) (*IdempotencyRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE created_at < $1 OR (status_code IS NULL AND created_at < $2)
+	`, expireBefore, staleBefore); err != nil {
+		return nil, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (key, request_hash, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING
+	`, rec.Key, rec.RequestHash, rec.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted > 0 {
+		return nil, err
+	}
+
+	var existing IdempotencyRecord
+	var statusCode sql.NullInt64
+	var response sql.NullString
+	err = db.QueryRowContext(ctx, `
+		SELECT key, request_hash, status_code, response, created_at
+		FROM idempotency_keys
+		WHERE key = $1
+	`, rec.Key).Scan(&existing.Key, &existing.RequestHash, &statusCode, &response, &existing.CreatedAt)
+	if err == sql.ErrNoRows {
+		// Released between the insert and the select; let the caller retry
+		return nil, fmt.Errorf("idempotency key %q was released concurrently", rec.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing.StatusCode = int(statusCode.Int64)
+	if response.Valid {
+		existing.Response = json.RawMessage(response.String)
+	}
+	return &existing, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request holding key
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, response []byte) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE idempotency_keys
+		SET status_code = $1, response = $2
+		WHERE key = $3
+	`, statusCode, string(response), key)
+	return err
+}
+
+// ReleaseIdempotencyKey drops an unfinished reservation
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND status_code IS NULL
+	`, key)
+	return err
+}
+
+// GetPromoCode looks a promo code up case-insensitively
+func (s *PostgresStore) GetPromoCode(ctx context.Context, code string) (*PromoCode, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+
+	var p PromoCode
+	var maxDiscount, maxRedemptions, maxPerIdentity sql.NullInt64
+	var validFrom, validUntil sql.NullTime
+	err = db.QueryRowContext(ctx, `
+		SELECT code, discount_type, discount_value, max_discount, plan_ids, max_redemptions,
+			max_per_identity, valid_from, valid_until, first_purchase_only, active
+		FROM promo_codes
+		WHERE code = $1
+	`, strings.ToUpper(code)).Scan(&p.Code, &p.DiscountType, &p.DiscountValue, &maxDiscount, pq.Array(&p.PlanIDs),
+		&maxRedemptions, &maxPerIdentity, &validFrom, &validUntil, &p.FirstPurchaseOnly, &p.Active)
+	if err == sql.ErrNoRows {
+		return nil, ErrPromoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.MaxDiscount = int(maxDiscount.Int64)
+	p.MaxRedemptions = int(maxRedemptions.Int64)
+	p.MaxPerIdentity = int(maxPerIdentity.Int64)
+	if validFrom.Valid {
+		p.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		p.ValidUntil = &validUntil.Time
+	}
+	return &p, nil
+}
+
+// CountPromoRedemptions returns the redemptions of code overall and by identity
+func (s *PostgresStore) CountPromoRedemptions(ctx context.Context, code, identity string) (int, int, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total, byIdentity int
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE identity = $2)
+		FROM promo_redemptions
+		WHERE code = $1
+	`, strings.ToUpper(code), identity).Scan(&total, &byIdentity)
+	return total, byIdentity, err
+}
+
+// RedeemPromoCode records a redemption once per payment
+func (s *PostgresStore) RedeemPromoCode(ctx context.Context, r PromoRedemption) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO promo_redemptions (code, reference, identity, discount, redeemed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (reference) DO NOTHING
+	`, strings.ToUpper(r.Code), r.Reference, r.Identity, r.Discount, r.RedeemedAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// ReferralCodeFor returns the referral code owned by phone
+func (s *PostgresStore) ReferralCodeFor(ctx context.Context, phone string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var code string
+	err = db.QueryRowContext(ctx, "SELECT code FROM referral_codes WHERE phone_number = $1", phone).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", ErrReferralNotFound
+	}
+	return code, err
+}
+
+// ReferralCodeOwner returns the phone owning a referral code
+func (s *PostgresStore) ReferralCodeOwner(ctx context.Context, code string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var phone string
+	err = db.QueryRowContext(ctx, "SELECT phone_number FROM referral_codes WHERE code = $1", strings.ToUpper(code)).Scan(&phone)
+	if err == sql.ErrNoRows {
+		return "", ErrReferralNotFound
+	}
+	return phone, err
+}
+
+// CreateReferralCode assigns code to phone unless phone already has one
+func (s *PostgresStore) CreateReferralCode(ctx context.Context, phone, code string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO referral_codes (code, phone_number, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, strings.ToUpper(code), phone, time.Now()); err != nil {
+		return "", err
+	}
+
+	existing, err := s.ReferralCodeFor(ctx, phone)
+	if err == ErrReferralNotFound {
+		// The insert lost to another phone holding the same code
+		return "", ErrReferralCodeTaken
+	}
+	return existing, err
+}
+
+// Referrer returns the phone that referred phone
+func (s *PostgresStore) Referrer(ctx context.Context, phone string) (string, error) {
+	db, err := s.db()
+	if err != nil {
+		return "", err
+	}
+
+	var referrer string
+	err = db.QueryRowContext(ctx, "SELECT referrer_phone FROM referrals WHERE referred_phone = $1", phone).Scan(&referrer)
+	if err == sql.ErrNoRows {
+		return "", ErrReferralNotFound
+	}
+	return referrer, err
+}
+
+// CreateReferral records a rewarded referral once per referred phone
+func (s *PostgresStore) CreateReferral(ctx context.Context, r Referral) (bool, error) {
+	db, err := s.db()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO referrals (referred_phone, referrer_phone, code, reference, bonus_days, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (referred_phone) DO NOTHING
+	`, r.ReferredPhone, r.ReferrerPhone, strings.ToUpper(r.Code), r.Reference, r.BonusDays, r.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// ReferralStats summarises the referrals rewarded to referrerPhone
+func (s *PostgresStore) ReferralStats(ctx context.Context, referrerPhone string) (ReferralStats, error) {
+	db, err := s.db()
+	if err != nil {
+		return ReferralStats{}, err
+	}
+
+	var stats ReferralStats
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(bonus_days), 0)
+		FROM referrals
+		WHERE referrer_phone = $1
+	`, referrerPhone).Scan(&stats.Referrals, &stats.BonusDays)
+	return stats, err
+}
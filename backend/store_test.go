@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func orderItems(name string, price int) []interface{} {
+	return []interface{}{
+		map[string]interface{}{"name": name, "price": price, "quantity": 1},
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// assertExpiresIn checks an expiry against now+days, allowing for test runtime
+func assertExpiresIn(t *testing.T, expired time.Time, days int) {
+	t.Helper()
+	want := time.Now().AddDate(0, 0, days)
+	if diff := expired.Sub(want); diff < -time.Minute || diff > time.Minute {
+		t.Fatalf("expected premium to expire around %s, got %s", want.Format(time.RFC3339), expired.Format(time.RFC3339))
+	}
+}
+
+// runStoreConformance checks the behaviour every Store implementation must
+// share. newStore returns an empty store; seedUser registers a bot user and
+// seedPromo creates a promo code.
+func runStoreConformance(t *testing.T, newStore func(t *testing.T) Store, seedUser func(t *testing.T, phone, lid, pushName string), seedPromo func(t *testing.T, p PromoCode)) {
+	t.Run("payment lookup by reference and merchant ref", func(t *testing.T) {
+		s := newStore(t)
+		expiredAt := time.Now().Add(time.Hour).Truncate(time.Second)
+		err := s.CreatePayment(context.Background(), &PaymentRecord{
+			Reference:     "REF-1",
+			MerchantRef:   "MREF-1",
+			PhoneNumber:   "6281234567890",
+			CustomerName:  "Tester",
+			Method:        "QRIS",
+			Amount:        15000,
+			Status:        "UNPAID",
+			OrderItems:    []byte(`[{"name":"User Premium 30 Days"}]`),
+			PaymentNumber: "000201",
+			ExpiredAt:     &expiredAt,
+		})
+		if err != nil {
+			t.Fatalf("CreatePayment failed: %v", err)
+		}
+		err = s.CreatePayment(context.Background(), &PaymentRecord{
+			Reference:      "GIFT-1",
+			MerchantRef:    "GIFT-1",
+			PhoneNumber:    "6281234567890",
+			Method:         "QRIS",
+			Status:         "UNPAID",
+			RecipientPhone: "6289876543210",
+			GiftMessage:    "Selamat ulang tahun!",
+		})
+		if err != nil {
+			t.Fatalf("CreatePayment failed: %v", err)
+		}
+
+		for _, ref := range []string{"REF-1", "MREF-1"} {
+			p, err := s.GetPayment(context.Background(), ref)
+			if err != nil {
+				t.Fatalf("GetPayment(%s) failed: %v", ref, err)
+			}
+			if p.Reference != "REF-1" || p.Amount != 15000 || p.GroupID != "" || p.PaymentNumber != "000201" {
+				t.Fatalf("unexpected payment: %+v", p)
+			}
+			if p.ExpiredAt == nil || !p.ExpiredAt.Equal(expiredAt) {
+				t.Fatalf("expected expired_at %s, got %v", expiredAt, p.ExpiredAt)
+			}
+		}
+
+		gift, err := s.GetPayment(context.Background(), "GIFT-1")
+		if err != nil {
+			t.Fatalf("GetPayment(GIFT-1) failed: %v", err)
+		}
+		if phone, group := gift.Beneficiary(); phone != "6289876543210" || group != "" || gift.GiftMessage != "Selamat ulang tahun!" {
+			t.Fatalf("unexpected gift: %+v", gift)
+		}
+
+		if _, err := s.GetPayment(context.Background(), "missing"); err != ErrPaymentNotFound {
+			t.Fatalf("expected ErrPaymentNotFound, got %v", err)
+		}
+	})
+
+	t.Run("paid transition happens once and is never downgraded", func(t *testing.T) {
+		s := newStore(t)
+		s.CreatePayment(context.Background(), &PaymentRecord{Reference: "REF-2", MerchantRef: "REF-2", PhoneNumber: "1", Method: "QRIS", Amount: 1, Status: "UNPAID"})
+
+		if _, err := s.UpdatePaymentStatus(context.Background(), "REF-2", "EXPIRED"); err != nil {
+			t.Fatalf("UpdatePaymentStatus failed: %v", err)
+		}
+		if p, _ := s.GetPayment(context.Background(), "REF-2"); p.Status != "EXPIRED" {
+			t.Fatalf("expected EXPIRED, got %s", p.Status)
+		}
+
+		updated, err := s.MarkPaymentPaid(context.Background(), "REF-2", time.Now())
+		if err != nil || !updated {
+			t.Fatalf("expected first MarkPaymentPaid to transition, got %v, %v", updated, err)
+		}
+		updated, err = s.MarkPaymentPaid(context.Background(), "REF-2", time.Now())
+		if err != nil || updated {
+			t.Fatalf("expected second MarkPaymentPaid to be a no-op, got %v, %v", updated, err)
+		}
+
+		if changed, _ := s.UpdatePaymentStatus(context.Background(), "REF-2", "FAILED"); changed {
+			t.Fatal("expected UpdatePaymentStatus to leave a PAID payment alone")
+		}
+		p, _ := s.GetPayment(context.Background(), "REF-2")
+		if p.Status != "PAID" || p.PaidAt == nil {
+			t.Fatalf("expected PAID with paid_at, got %+v", p)
+		}
+
+		if updated, _ := s.MarkPaymentPaid(context.Background(), "missing", time.Now()); updated {
+			t.Fatal("expected MarkPaymentPaid on a missing payment to report no transition")
+		}
+	})
+
+	t.Run("list payments pages newest first per owner", func(t *testing.T) {
+		s := newStore(t)
+		base := time.Now().Add(-time.Hour)
+		for i := 0; i < 12; i++ {
+			s.CreatePayment(context.Background(), &PaymentRecord{
+				Reference:   fmt.Sprintf("LIST-%02d", i),
+				MerchantRef: fmt.Sprintf("LIST-%02d", i),
+				PhoneNumber: "6280000000000",
+				Method:      "QRIS",
+				Amount:      i,
+				Status:      "UNPAID",
+				CreatedAt:   base.Add(time.Duration(i) * time.Minute),
+			})
+		}
+		s.CreatePayment(context.Background(), &PaymentRecord{Reference: "GROUP-1", MerchantRef: "GROUP-1", GroupID: "6280000000000", Method: "QRIS", Status: "PAID"})
+
+		page, total, err := s.ListPayments(context.Background(), PaymentFilter{PhoneNumber: "6280000000000"}, 5, 10)
+		if err != nil {
+			t.Fatalf("ListPayments failed: %v", err)
+		}
+		if total != 12 || len(page) != 2 || page[0].Reference != "LIST-01" || page[1].Reference != "LIST-00" {
+			t.Fatalf("unexpected page: total=%d, %d rows", total, len(page))
+		}
+
+		groups, total, _ := s.ListPayments(context.Background(), PaymentFilter{GroupID: "6280000000000"}, 5, 0)
+		if total != 1 || len(groups) != 1 || groups[0].Reference != "GROUP-1" {
+			t.Fatalf("expected only the group payment, got total=%d", total)
+		}
+	})
+
+	t.Run("pending payments are unpaid and unexpired", func(t *testing.T) {
+		s := newStore(t)
+		now := time.Now()
+		for _, p := range []PaymentRecord{
+			{Reference: "PEND-OLD", Status: "UNPAID", ExpiredAt: timePtr(now.Add(2 * time.Hour)), CreatedAt: now.Add(-time.Hour)},
+			{Reference: "PEND-NEW", Status: "UNPAID", ExpiredAt: timePtr(now.Add(time.Hour)), CreatedAt: now},
+			{Reference: "PEND-EXPIRED", Status: "UNPAID", ExpiredAt: timePtr(now.Add(-time.Minute)), CreatedAt: now},
+			{Reference: "PEND-NO-EXPIRY", Status: "UNPAID", CreatedAt: now},
+			{Reference: "PEND-PAID", Status: "PAID", ExpiredAt: timePtr(now.Add(time.Hour)), CreatedAt: now},
+		} {
+			p.MerchantRef, p.PhoneNumber, p.Method = p.Reference, "6281111111111", "QRIS"
+			s.CreatePayment(context.Background(), &p)
+		}
+
+		pending, err := s.PendingPayments(context.Background(), PaymentFilter{PhoneNumber: "6281111111111"}, now)
+		if err != nil {
+			t.Fatalf("PendingPayments failed: %v", err)
+		}
+		if len(pending) != 2 || pending[0].Reference != "PEND-NEW" || pending[1].Reference != "PEND-OLD" {
+			t.Fatalf("expected PEND-NEW and PEND-OLD, got %+v", pending)
+		}
+	})
+
+	t.Run("premium upsert replaces the existing row", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.GetPremium(context.Background(), "jid", "lid"); err != ErrPremiumNotFound {
+			t.Fatalf("expected ErrPremiumNotFound, got %v", err)
+		}
+
+		expired := time.Now().AddDate(0, 0, 7)
+		s.UpsertPremium(context.Background(), PremiumRecord{JID: "jid", LID: "lid", SpecialLimit: 3, MaxSpecialLimit: 5, Expired: expired, LastSpecialReset: time.Now()})
+		s.UpsertPremium(context.Background(), PremiumRecord{JID: "jid", LID: "lid", SpecialLimit: 0, MaxSpecialLimit: 15, Expired: expired.AddDate(0, 0, 30), LastSpecialReset: time.Now()})
+
+		p, err := s.GetPremium(context.Background(), "jid", "lid")
+		if err != nil {
+			t.Fatalf("GetPremium failed: %v", err)
+		}
+		if p.SpecialLimit != 0 || p.MaxSpecialLimit != 15 {
+			t.Fatalf("unexpected limits: %+v", p)
+		}
+		if !p.Expired.Equal(expired.AddDate(0, 0, 30).Truncate(time.Second)) {
+			t.Fatalf("unexpected expiry: %s", p.Expired)
+		}
+	})
+
+	t.Run("expiring premium and renewal reminders", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		for jid, expires := range map[string]time.Duration{
+			"soon":    12 * time.Hour,
+			"later":   60 * time.Hour,
+			"far":     10 * 24 * time.Hour,
+			"expired": -time.Hour,
+		} {
+			s.UpsertPremium(ctx, PremiumRecord{JID: jid, LID: "lid-" + jid, MaxSpecialLimit: 15, Expired: now.Add(expires), LastSpecialReset: now})
+		}
+
+		expiring, err := s.ExpiringPremium(ctx, now, now.AddDate(0, 0, 3))
+		if err != nil {
+			t.Fatalf("ExpiringPremium failed: %v", err)
+		}
+		if len(expiring) != 2 || expiring[0].JID != "soon" || expiring[1].JID != "later" || expiring[0].LID != "lid-soon" {
+			t.Fatalf("expected soon and later, got %+v", expiring)
+		}
+
+		reminder := RenewalReminder{JID: "soon", LID: "lid-soon", Expired: expiring[0].Expired, DaysBefore: 1, SentAt: now}
+		if claimed, err := s.ClaimRenewalReminder(ctx, reminder); err != nil || !claimed {
+			t.Fatalf("expected the first claim to succeed, got %v, %v", claimed, err)
+		}
+		if claimed, _ := s.ClaimRenewalReminder(ctx, reminder); claimed {
+			t.Fatal("expected a reminder to be claimed only once")
+		}
+		renewed := reminder
+		renewed.Expired = reminder.Expired.AddDate(0, 0, 30)
+		if claimed, _ := s.ClaimRenewalReminder(ctx, renewed); !claimed {
+			t.Fatal("expected a new expiry to get its own reminder")
+		}
+		if err := s.ReleaseRenewalReminder(ctx, reminder); err != nil {
+			t.Fatalf("ReleaseRenewalReminder failed: %v", err)
+		}
+		if claimed, _ := s.ClaimRenewalReminder(ctx, reminder); !claimed {
+			t.Fatal("expected a released reminder to be claimable again")
+		}
+	})
+
+	t.Run("latest paid payment by beneficiary", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		paid := func(ref, phone, recipient, plan string, paidAt time.Time) {
+			t.Helper()
+			items, _ := json.Marshal(orderItems(plan, 15000))
+			s.CreatePayment(ctx, &PaymentRecord{Reference: ref, MerchantRef: ref, PhoneNumber: phone, RecipientPhone: recipient, Method: "QRIS", Status: "UNPAID", OrderItems: items})
+			if _, err := s.MarkPaymentPaid(ctx, ref, paidAt); err != nil {
+				t.Fatalf("MarkPaymentPaid failed: %v", err)
+			}
+		}
+		now := time.Now().Truncate(time.Second)
+		paid("LATEST-1", "6281111111111", "", "User Premium 7 Days", now.Add(-48*time.Hour))
+		paid("LATEST-2", "6281111111111", "", "User Premium 30 Days", now.Add(-24*time.Hour))
+		paid("LATEST-3", "6281111111111", "6282222222222", "User Premium 15 Days", now)
+
+		p, err := s.LatestPaidPayment(ctx, "6281111111111")
+		if err != nil || p.Reference != "LATEST-2" {
+			t.Fatalf("expected LATEST-2 for the payer, got %+v, %v", p, err)
+		}
+		if p, err := s.LatestPaidPayment(ctx, "6282222222222"); err != nil || p.Reference != "LATEST-3" {
+			t.Fatalf("expected the gift for its recipient, got %+v, %v", p, err)
+		}
+		if _, err := s.LatestPaidPayment(ctx, "6283333333333"); err != ErrPaymentNotFound {
+			t.Fatalf("expected ErrPaymentNotFound, got %v", err)
+		}
+	})
+
+	t.Run("invoice numbers are sequential per month", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		for _, ref := range []string{"INV-1", "INV-2", "INV-3", "INV-4"} {
+			s.CreatePayment(ctx, &PaymentRecord{Reference: ref, MerchantRef: ref, PhoneNumber: "6281234567890", Method: "QRIS", Status: "UNPAID"})
+		}
+		october := time.Date(2026, 10, 31, 16, 0, 0, 0, time.UTC)  // 23:00 WIB
+		november := time.Date(2026, 10, 31, 17, 0, 0, 0, time.UTC) // 00:00 WIB
+		for _, ref := range []string{"INV-2", "INV-1"} {
+			if _, err := s.MarkPaymentPaid(ctx, ref, october); err != nil {
+				t.Fatalf("MarkPaymentPaid failed: %v", err)
+			}
+		}
+		// Repeated callbacks must not use up a number
+		s.MarkPaymentPaid(ctx, "INV-2", october)
+		s.MarkPaymentPaid(ctx, "INV-4", november)
+
+		for ref, want := range map[string]string{
+			"INV-2": "SHR/2026/10/000001",
+			"INV-1": "SHR/2026/10/000002",
+			"INV-3": "",
+			"INV-4": "SHR/2026/11/000001",
+		} {
+			if p, _ := s.GetPayment(ctx, ref); p.InvoiceNumber != want {
+				t.Errorf("expected %s to have invoice number %q, got %q", ref, want, p.InvoiceNumber)
+			}
+		}
+	})
+
+	t.Run("payment fees are recorded and replaced", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		s.CreatePayment(ctx, &PaymentRecord{Reference: "FEE-1", MerchantRef: "FEE-M1", Method: "QRIS", Amount: 16000, Status: "UNPAID"})
+		s.CreatePayment(ctx, &PaymentRecord{
+			Reference: "FEE-2", MerchantRef: "FEE-2", Method: "QRIS", Amount: 16000, Status: "UNPAID",
+			Fees: newPaymentFees(16112, 0, 112),
+		})
+
+		if p, _ := s.GetPayment(ctx, "FEE-1"); p.Fees != nil {
+			t.Fatalf("expected no fees before the gateway reports them, got %+v", p.Fees)
+		}
+		if p, _ := s.GetPayment(ctx, "FEE-2"); p.Fees == nil || *p.Fees != *newPaymentFees(16112, 0, 112) {
+			t.Fatalf("expected fees given at creation to be stored, got %+v", p.Fees)
+		}
+
+		fees := *newPaymentFees(16000, 750, 0)
+		if changed, err := s.SetPaymentFees(ctx, "FEE-M1", fees); err != nil || !changed {
+			t.Fatalf("expected fees to be recorded by merchant ref, got %v, %v", changed, err)
+		}
+		if changed, _ := s.SetPaymentFees(ctx, "FEE-1", fees); changed {
+			t.Errorf("expected the same fees not to count as a change")
+		}
+		if p, _ := s.GetPayment(ctx, "FEE-1"); p.Fees == nil || *p.Fees != fees || p.Fees.NetAmount != 15250 {
+			t.Errorf("unexpected stored fees %+v", p.Fees)
+		}
+		if changed, err := s.SetPaymentFees(ctx, "FEE-MISSING", fees); err != nil || changed {
+			t.Errorf("expected an unknown payment to be left alone, got %v, %v", changed, err)
+		}
+	})
+
+	t.Run("donations are kept apart from premium payments", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		s.CreatePayment(ctx, &PaymentRecord{Reference: "DON-PREMIUM", MerchantRef: "DON-PREMIUM", PhoneNumber: "6281234567890", Method: "QRIS", Amount: 16000, Status: "UNPAID"})
+		for i, ref := range []string{"DON-1", "DON-2", "DON-3"} {
+			s.CreatePayment(ctx, &PaymentRecord{
+				Reference: ref, MerchantRef: ref, PhoneNumber: "6281234567890", Method: "QRIS", Amount: 5000 * (i + 1),
+				Status: "UNPAID", Product: productDonation, DonorName: "Budi", DonorMessage: "Semangat!",
+			})
+		}
+		s.CreatePayment(ctx, &PaymentRecord{Reference: "DON-UNPAID", MerchantRef: "DON-UNPAID", Method: "QRIS", Amount: 5000, Status: "UNPAID", Product: productDonation})
+		s.MarkPaymentPaid(ctx, "DON-PREMIUM", now.Add(-2*time.Hour))
+		s.MarkPaymentPaid(ctx, "DON-1", now.Add(-time.Hour))
+		s.MarkPaymentPaid(ctx, "DON-2", now)
+		s.MarkPaymentPaid(ctx, "DON-3", now.Add(-30*time.Minute))
+
+		if p, _ := s.GetPayment(ctx, "DON-PREMIUM"); p.Product != productPremium || p.IsDonation() {
+			t.Errorf("expected payments to be premium by default, got %q", p.Product)
+		}
+		if p, _ := s.GetPayment(ctx, "DON-1"); !p.IsDonation() || p.DonorName != "Budi" || p.DonorMessage != "Semangat!" {
+			t.Errorf("unexpected donation %+v", p)
+		}
+
+		owner := PaymentFilter{PhoneNumber: "6281234567890"}
+		if _, total, _ := s.ListPayments(ctx, owner, 10, 0); total != 4 {
+			t.Errorf("expected an empty product to match every payment, got %d", total)
+		}
+		owner.Product = productPremium
+		if payments, total, _ := s.ListPayments(ctx, owner, 10, 0); total != 1 || payments[0].Reference != "DON-PREMIUM" {
+			t.Errorf("expected only the premium payment, got %d", total)
+		}
+		if n, _ := s.CountPaidPayments(ctx, owner); n != 1 {
+			t.Errorf("expected donations not to count as premium purchases, got %d", n)
+		}
+		owner.Product = productDonation
+		if _, total, _ := s.ListPayments(ctx, owner, 10, 0); total != 3 {
+			t.Errorf("expected 3 donations, got %d", total)
+		}
+
+		if p, err := s.LatestPaidPayment(ctx, "6281234567890"); err != nil || p.Reference != "DON-PREMIUM" {
+			t.Errorf("expected donations to be skipped, got %+v, %v", p, err)
+		}
+
+		recent, err := s.RecentDonations(ctx, 2)
+		if err != nil {
+			t.Fatalf("RecentDonations failed: %v", err)
+		}
+		if len(recent) != 2 || recent[0].Reference != "DON-2" || recent[1].Reference != "DON-3" {
+			t.Errorf("expected the 2 latest paid donations, got %+v", recent)
+		}
+	})
+
+	t.Run("payments are streamed by booking date for exports", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		october := time.Date(2026, 10, 1, 0, 0, 0, 0, wib)
+		november := october.AddDate(0, 1, 0)
+		for _, p := range []PaymentRecord{
+			{Reference: "EXP-LATE", CreatedAt: october.Add(-time.Hour), Status: "UNPAID"},    // paid in October
+			{Reference: "EXP-B", CreatedAt: october.Add(2 * time.Hour), Status: "UNPAID"},    // unpaid, created in October
+			{Reference: "EXP-A", CreatedAt: october.Add(2 * time.Hour), Status: "UNPAID"},    // same time, sorts by reference
+			{Reference: "EXP-NOV", CreatedAt: november.Add(-time.Hour), Status: "UNPAID"},    // paid in November
+			{Reference: "EXP-SEPT", CreatedAt: october.Add(-time.Minute), Status: "EXPIRED"}, // before the range
+			{Reference: "EXP-EDGE", CreatedAt: november, Status: "UNPAID"},                   // the end is exclusive
+		} {
+			p.MerchantRef = p.Reference
+			p.Gateway = "pakasir"
+			if err := s.CreatePayment(ctx, &p); err != nil {
+				t.Fatalf("CreatePayment failed: %v", err)
+			}
+		}
+		s.MarkPaymentPaid(ctx, "EXP-LATE", october.Add(time.Hour))
+		s.MarkPaymentPaid(ctx, "EXP-NOV", november.Add(time.Hour))
+
+		collect := func(status string) []string {
+			var refs []string
+			err := s.EachPayment(ctx, october, november, status, func(p *PaymentRecord) error {
+				if p.Gateway != "pakasir" {
+					t.Errorf("expected %s to keep its gateway, got %q", p.Reference, p.Gateway)
+				}
+				refs = append(refs, p.Reference)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("EachPayment failed: %v", err)
+			}
+			return refs
+		}
+		if got, want := strings.Join(collect(""), ","), "EXP-LATE,EXP-A,EXP-B"; got != want {
+			t.Errorf("expected October to hold %s, got %s", want, got)
+		}
+		if got, want := strings.Join(collect("PAID"), ","), "EXP-LATE"; got != want {
+			t.Errorf("expected PAID filter to keep %s, got %s", want, got)
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err := s.EachPayment(ctx, october, november, "", func(p *PaymentRecord) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("expected the callback error to stop the export after one row, got %v after %d", err, calls)
+		}
+	})
+
+	t.Run("email outbox claims, retries and completes", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		enqueue := func(key string, due time.Time) bool {
+			t.Helper()
+			queued, err := s.EnqueueEmail(ctx, EmailJob{Key: key, Kind: emailKindReceipt, To: "budi@example.com",
+				Payload: json.RawMessage(`{"reference":"` + key + `"}`), NextAttempt: due, CreatedAt: now})
+			if err != nil {
+				t.Fatalf("EnqueueEmail(%s) failed: %v", key, err)
+			}
+			return queued
+		}
+		if !enqueue("mail-1", now.Add(-time.Minute)) || !enqueue("mail-2", now) || !enqueue("mail-3", now.Add(time.Hour)) {
+			t.Fatal("expected new jobs to be queued")
+		}
+		if enqueue("mail-1", now) {
+			t.Fatal("expected a queued key to be left alone")
+		}
+
+		jobs, err := s.ClaimEmails(ctx, now, now.Add(5*time.Minute), 10)
+		if err != nil || len(jobs) != 2 {
+			t.Fatalf("expected the two due jobs, got %+v, %v", jobs, err)
+		}
+		for _, job := range jobs {
+			if job.Attempts != 1 || !job.NextAttempt.Equal(now.Add(5*time.Minute)) || job.To != "budi@example.com" {
+				t.Fatalf("expected a leased first attempt, got %+v", job)
+			}
+		}
+		if jobs, _ := s.ClaimEmails(ctx, now, now.Add(5*time.Minute), 10); len(jobs) != 0 {
+			t.Fatalf("expected leased jobs not to be claimed again, got %+v", jobs)
+		}
+
+		if err := s.CompleteEmail(ctx, "mail-1", now); err != nil {
+			t.Fatalf("CompleteEmail failed: %v", err)
+		}
+		if err := s.FailEmail(ctx, "mail-2", "451 try again", timePtr(now.Add(time.Minute))); err != nil {
+			t.Fatalf("FailEmail failed: %v", err)
+		}
+		if err := s.FailEmail(ctx, "mail-3", "550 no such user", nil); err != nil {
+			t.Fatalf("FailEmail failed: %v", err)
+		}
+		if err := s.CompleteEmail(ctx, "missing", now); err != ErrEmailNotFound {
+			t.Fatalf("expected ErrEmailNotFound, got %v", err)
+		}
+
+		jobs, _ = s.ClaimEmails(ctx, now.Add(2*time.Hour), now.Add(3*time.Hour), 10)
+		if len(jobs) != 1 || jobs[0].Key != "mail-2" || jobs[0].Attempts != 2 || jobs[0].LastError != "451 try again" {
+			t.Fatalf("expected only the retried job, got %+v", jobs)
+		}
+		if job, err := s.GetEmail(ctx, "mail-1"); err != nil || job.Status != EmailSent || job.SentAt == nil {
+			t.Fatalf("expected mail-1 sent, got %+v, %v", job, err)
+		}
+		if job, _ := s.GetEmail(ctx, "mail-3"); job.Status != EmailFailed || job.LastError != "550 no such user" {
+			t.Fatalf("expected mail-3 given up on, got %+v", job)
+		}
+	})
+
+	t.Run("idempotency keys are reserved once and expire", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		reserve := func(key string, createdAt time.Time) *IdempotencyRecord {
+			t.Helper()
+			existing, err := s.ReserveIdempotencyKey(ctx, IdempotencyRecord{Key: key, RequestHash: "hash-" + key, CreatedAt: createdAt},
+				now.Add(-24*time.Hour), now.Add(-time.Minute))
+			if err != nil {
+				t.Fatalf("ReserveIdempotencyKey(%s) failed: %v", key, err)
+			}
+			return existing
+		}
+
+		if existing := reserve("KEY-1", now); existing != nil {
+			t.Fatalf("expected a fresh key to be reserved, got %+v", existing)
+		}
+		if existing := reserve("KEY-1", now); existing == nil || existing.StatusCode != 0 || existing.RequestHash != "hash-KEY-1" {
+			t.Fatalf("expected the in-flight reservation, got %+v", existing)
+		}
+
+		if err := s.CompleteIdempotencyKey(ctx, "KEY-1", 200, []byte(`{"success":true}`)); err != nil {
+			t.Fatalf("CompleteIdempotencyKey failed: %v", err)
+		}
+		if err := s.ReleaseIdempotencyKey(ctx, "KEY-1"); err != nil {
+			t.Fatalf("ReleaseIdempotencyKey failed: %v", err)
+		}
+		existing := reserve("KEY-1", now)
+		if existing == nil || existing.StatusCode != 200 || string(existing.Response) != `{"success":true}` {
+			t.Fatalf("expected the completed response to survive release, got %+v", existing)
+		}
+
+		reserve("KEY-2", now)
+		s.ReleaseIdempotencyKey(ctx, "KEY-2")
+		if existing := reserve("KEY-2", now); existing != nil {
+			t.Fatalf("expected a released key to be reservable, got %+v", existing)
+		}
+
+		reserve("KEY-STALE", now.Add(-2*time.Minute))
+		reserve("KEY-OLD", now.Add(-25*time.Hour))
+		s.CompleteIdempotencyKey(ctx, "KEY-OLD", 200, []byte(`{}`))
+		for _, key := range []string{"KEY-STALE", "KEY-OLD"} {
+			if existing := reserve(key, now); existing != nil {
+				t.Fatalf("expected %s to be reclaimed, got %+v", key, existing)
+			}
+		}
+	})
+
+	t.Run("promo codes and redemptions", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+		validUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+		seedPromo(t, PromoCode{Code: "HEMAT20", DiscountType: DiscountPercent, DiscountValue: 20, MaxDiscount: 5000,
+			PlanIDs: []string{"user-1m", "group-1m"}, MaxPerIdentity: 1, ValidUntil: &validUntil, Active: true})
+
+		p, err := s.GetPromoCode(ctx, "hemat20")
+		if err != nil {
+			t.Fatalf("GetPromoCode failed: %v", err)
+		}
+		if p.Code != "HEMAT20" || p.DiscountValue != 20 || p.MaxDiscount != 5000 || len(p.PlanIDs) != 2 ||
+			p.MaxPerIdentity != 1 || p.MaxRedemptions != 0 || p.ValidFrom != nil || !p.ValidUntil.Equal(validUntil) || !p.Active {
+			t.Fatalf("unexpected promo code: %+v", p)
+		}
+		if _, err := s.GetPromoCode(ctx, "missing"); err != ErrPromoNotFound {
+			t.Fatalf("expected ErrPromoNotFound, got %v", err)
+		}
+
+		for _, r := range []PromoRedemption{
+			{Code: "HEMAT20", Reference: "PROMO-1", Identity: "6281111111111", Discount: 4000, RedeemedAt: time.Now()},
+			{Code: "HEMAT20", Reference: "PROMO-2", Identity: "6282222222222", Discount: 4000, RedeemedAt: time.Now()},
+		} {
+			if redeemed, err := s.RedeemPromoCode(ctx, r); err != nil || !redeemed {
+				t.Fatalf("expected %s to redeem, got %v, %v", r.Reference, redeemed, err)
+			}
+		}
+		if redeemed, _ := s.RedeemPromoCode(ctx, PromoRedemption{Code: "HEMAT20", Reference: "PROMO-1", Identity: "6281111111111", RedeemedAt: time.Now()}); redeemed {
+			t.Fatal("expected a payment to redeem only once")
+		}
+
+		total, byIdentity, err := s.CountPromoRedemptions(ctx, "hemat20", "6281111111111")
+		if err != nil || total != 2 || byIdentity != 1 {
+			t.Fatalf("CountPromoRedemptions = %d, %d, %v", total, byIdentity, err)
+		}
+	})
+
+	t.Run("referral codes and referrals", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		if _, err := s.ReferralCodeFor(ctx, "6281111111111"); err != ErrReferralNotFound {
+			t.Fatalf("expected ErrReferralNotFound, got %v", err)
+		}
+		code, err := s.CreateReferralCode(ctx, "6281111111111", "abcd1234")
+		if err != nil || code != "ABCD1234" {
+			t.Fatalf("CreateReferralCode = %q, %v", code, err)
+		}
+		if code, err := s.CreateReferralCode(ctx, "6281111111111", "OTHER123"); err != nil || code != "ABCD1234" {
+			t.Fatalf("expected the existing code back, got %q, %v", code, err)
+		}
+		if _, err := s.CreateReferralCode(ctx, "6282222222222", "ABCD1234"); err != ErrReferralCodeTaken {
+			t.Fatalf("expected ErrReferralCodeTaken, got %v", err)
+		}
+		if owner, err := s.ReferralCodeOwner(ctx, "abcd1234"); err != nil || owner != "6281111111111" {
+			t.Fatalf("ReferralCodeOwner = %q, %v", owner, err)
+		}
+		if code, err := s.ReferralCodeFor(ctx, "6281111111111"); err != nil || code != "ABCD1234" {
+			t.Fatalf("ReferralCodeFor = %q, %v", code, err)
+		}
+
+		if _, err := s.Referrer(ctx, "6283333333333"); err != ErrReferralNotFound {
+			t.Fatalf("expected ErrReferralNotFound, got %v", err)
+		}
+		for _, r := range []Referral{
+			{ReferredPhone: "6283333333333", ReferrerPhone: "6281111111111", Code: "ABCD1234", Reference: "REF-1", BonusDays: 3, CreatedAt: time.Now()},
+			{ReferredPhone: "6284444444444", ReferrerPhone: "6281111111111", Code: "ABCD1234", Reference: "REF-2", BonusDays: 5, CreatedAt: time.Now()},
+		} {
+			if created, err := s.CreateReferral(ctx, r); err != nil || !created {
+				t.Fatalf("expected %s to be referred, got %v, %v", r.ReferredPhone, created, err)
+			}
+		}
+		if created, _ := s.CreateReferral(ctx, Referral{ReferredPhone: "6283333333333", ReferrerPhone: "6281111111111", Code: "ABCD1234", Reference: "REF-3", CreatedAt: time.Now()}); created {
+			t.Fatal("expected a phone number to be referred only once")
+		}
+		if referrer, err := s.Referrer(ctx, "6283333333333"); err != nil || referrer != "6281111111111" {
+			t.Fatalf("Referrer = %q, %v", referrer, err)
+		}
+
+		stats, err := s.ReferralStats(ctx, "6281111111111")
+		if err != nil || stats.Referrals != 2 || stats.BonusDays != 8 {
+			t.Fatalf("ReferralStats = %+v, %v", stats, err)
+		}
+	})
+
+	t.Run("paid payments are counted per owner", func(t *testing.T) {
+		s := newStore(t)
+		for i, status := range []string{"PAID", "PAID", "UNPAID"} {
+			ref := fmt.Sprintf("COUNT-%d", i)
+			s.CreatePayment(context.Background(), &PaymentRecord{Reference: ref, MerchantRef: ref, PhoneNumber: "6283333333333", Method: "QRIS", Status: status})
+		}
+		if n, err := s.CountPaidPayments(context.Background(), PaymentFilter{PhoneNumber: "6283333333333"}); err != nil || n != 2 {
+			t.Fatalf("CountPaidPayments = %d, %v", n, err)
+		}
+		if n, _ := s.CountPaidPayments(context.Background(), PaymentFilter{GroupID: "6283333333333"}); n != 0 {
+			t.Fatalf("expected no group payments, got %d", n)
+		}
+	})
+
+	t.Run("identity lookups", func(t *testing.T) {
+		s := newStore(t)
+		seedUser(t, "6289999999999", "lid-999", "Budi")
+
+		lid, err := s.UserLID(context.Background(), "6289999999999")
+		if err != nil || lid != "lid-999" {
+			t.Fatalf("UserLID = %q, %v", lid, err)
+		}
+		if name, err := s.PushName(context.Background(), lid); err != nil || name != "Budi" {
+			t.Fatalf("PushName = %q, %v", name, err)
+		}
+		if _, err := s.UserLID(context.Background(), "unknown"); err != ErrIdentityNotFound {
+			t.Fatalf("expected ErrIdentityNotFound, got %v", err)
+		}
+		if _, err := s.GroupName(context.Background(), "unknown"); err != ErrIdentityNotFound {
+			t.Fatalf("expected ErrIdentityNotFound, got %v", err)
+		}
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	var memory *MemoryStore
+	runStoreConformance(t, func(t *testing.T) Store {
+		memory = NewMemoryStore()
+		return memory
+	}, func(t *testing.T, phone, lid, pushName string) {
+		memory.SetUser(phone, lid, pushName)
+	}, func(t *testing.T, p PromoCode) {
+		memory.SetPromoCode(p)
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "shiroine-payment-backend"
+
+// tracer creates every span in the backend. Until setupTracing installs a
+// provider it is a no-op.
+var tracer = otel.Tracer(serviceName)
+
+// setupTracing installs the global tracer provider selected by
+// OTEL_TRACES_EXPORTER: "otlp" (OTLP/HTTP, configured by the standard
+// OTEL_EXPORTER_OTLP_* variables), "stdout", or "none" (default). The
+// returned function flushes pending spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")); exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = serviceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tagPaymentReference attaches the payment reference to the current span so
+// a payment can be found by reference in the tracing backend
+func tagPaymentReference(ctx context.Context, reference string) {
+	if reference != "" {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("payment.reference", reference))
+	}
+}
+
+// tracingMiddleware starts a server span per request, continuing any trace
+// propagated by the caller. It must run inside routeMiddleware and
+// requestIDMiddleware.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeFromRequest(r)
+
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", getIP(r)),
+				attribute.String("request.id", requestIDFrom(ctx)),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// sqlStatementPattern picks the operation and table out of a SQL statement
+var sqlStatementPattern = regexp.MustCompile(`(?is)^\s*(\w+)\s+(?:.*?\b(?:FROM|INTO)\s+)?(\w+)`)
+
+// tracedDB wraps the connection pool so every statement gets a client span
+// carrying the parameterised query text (never the arguments)
+type tracedDB struct {
+	*sql.DB
+}
+
+func startDBSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation, table := "QUERY", ""
+	if m := sqlStatementPattern.FindStringSubmatch(query); m != nil {
+		operation, table = strings.ToUpper(m[1]), m[2]
+	}
+
+	return tracer.Start(ctx, strings.TrimSpace(operation+" "+table),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "postgresql"),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.collection.name", table),
+			attribute.String("db.query.text", strings.Join(strings.Fields(query), " ")),
+		))
+}
+
+func (db *tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startDBSpan(ctx, query)
+	result, err := db.DB.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return result, err
+}
+
+func (db *tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startDBSpan(ctx, query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (db *tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startDBSpan(ctx, query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	endSpan(span, row.Err())
+	return row
+}
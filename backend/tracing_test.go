@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs an in-memory tracer provider. The global provider can
+// only be swapped in once, so every test shares one recorder.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	spanRecorder.Reset()
+	return spanRecorder
+}
+
+func spanAttr(span sdktrace.ReadOnlySpan, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestCallbackTraceLinksHandlerGatewayAndActivation(t *testing.T) {
+	recorder := recordSpans(t)
+
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Tester")
+	store = memory
+	g := newTripayTestGateway(t, "T-TRACE-1")
+	paymentGateway = g
+
+	if _, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        15000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 15000),
+	}); err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+	recorder.Reset()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/transaction-status/", transactionStatusHandler)
+	handler := requestIDMiddleware(routeMiddleware(mux, tracingMiddleware(mux)))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/transaction-status/T-TRACE-1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		byName[span.Name()] = span
+	}
+
+	server, ok := byName["GET /api/transaction-status/"]
+	if !ok {
+		t.Fatalf("expected a server span named by route, got %v", byName)
+	}
+	if ref, _ := spanAttr(server, "payment.reference"); ref.AsString() != "T-TRACE-1" {
+		t.Fatalf("expected server span tagged with the payment reference, got %q", ref.AsString())
+	}
+
+	for _, name := range []string{"tripay transaction_status", "completePayment", "activatePremium"} {
+		span, ok := byName[name]
+		if !ok {
+			t.Fatalf("missing span %q, got %v", name, byName)
+		}
+		if span.SpanContext().TraceID() != server.SpanContext().TraceID() {
+			t.Fatalf("span %q is not part of the request trace", name)
+		}
+	}
+}
+
+func TestDBSpanNames(t *testing.T) {
+	recorder := recordSpans(t)
+
+	for query, want := range map[string]string{
+		"SELECT reference, status FROM payment_history WHERE reference = $1": "SELECT payment_history",
+		"\n\t\tUPDATE payment_history\n\t\tSET status = $1":                  "UPDATE payment_history",
+		"INSERT INTO premium (jid, lid) VALUES ($1, $2)":                     "INSERT premium",
+	} {
+		_, span := startDBSpan(context.Background(), query)
+		span.End()
+
+		ended := recorder.Ended()
+		if got := ended[len(ended)-1].Name(); got != want {
+			t.Errorf("span name for %q = %q, want %q", query, got, want)
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -23,7 +24,7 @@ type TripayGateway struct {
 	MerchantCode string
 	Mode         string
 	APIURL       string
-	db           *sql.DB
+	store        Store
 }
 
 // NewTripayGateway creates a new Tripay gateway instance
@@ -53,19 +54,27 @@ func (g *TripayGateway) GetName() string {
 	return "tripay"
 }
 
-// Initialize sets up the gateway with database connection
-func (g *TripayGateway) Initialize(db *sql.DB) {
-	g.db = db
+// Initialize sets up the gateway with its storage
+func (g *TripayGateway) Initialize(store Store) {
+	g.store = store
+}
+
+// HealthCheck reports missing credentials or an unreachable Tripay API
+func (g *TripayGateway) HealthCheck(ctx context.Context) error {
+	if g.APIKey == "" || g.PrivateKey == "" || g.MerchantCode == "" {
+		return fmt.Errorf("tripay credentials are not configured")
+	}
+	return probeGateway(ctx, g.GetName(), g.APIURL)
 }
 
 // GetPaymentChannels fetches available payment channels from Tripay
-func (g *TripayGateway) GetPaymentChannels() (interface{}, error) {
+func (g *TripayGateway) GetPaymentChannels(ctx context.Context) (interface{}, error) {
 	if g.APIKey == "" {
 		return nil, fmt.Errorf("payment gateway not configured")
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest("GET", g.APIURL+"/merchant/payment-channel", nil)
+	client := newGatewayClient("tripay", "payment_channels")
+	req, err := http.NewRequestWithContext(ctx, "GET", g.APIURL+"/merchant/payment-channel", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -121,14 +130,14 @@ func (g *TripayGateway) verifyCallbackSignature(callbackSignature string, payloa
 }
 
 // CreateTransaction creates a new payment transaction with Tripay
-func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interface{}, error) {
+func (g *TripayGateway) CreateTransaction(ctx context.Context, req CreateTransactionRequest) (interface{}, error) {
 	// Validate required fields
 	if req.Method == "" || req.Amount == 0 || req.OrderItems == nil {
 		return nil, fmt.Errorf("missing required fields")
 	}
 
-	// Require either phone or group ID
-	if req.CustomerPhone == "" && req.GroupID == "" {
+	// Require either phone or group ID; donors may stay anonymous
+	if req.CustomerPhone == "" && req.GroupID == "" && req.Product != productDonation {
 		return nil, fmt.Errorf("either phone number or group ID is required")
 	}
 
@@ -154,6 +163,12 @@ func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interfa
 		domain = "shiroine.my.id"
 	}
 
+	// Tripay requires an email; fall back to a no-reply address
+	customerEmail := req.CustomerEmail
+	if customerEmail == "" {
+		customerEmail = fmt.Sprintf("noreply@%s", domain)
+	}
+
 	// Set default return URL
 	returnURL := req.ReturnURL
 	if returnURL == "" {
@@ -166,7 +181,7 @@ func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interfa
 		"merchant_ref":   merchantRef,
 		"amount":         req.Amount,
 		"customer_name":  customerName,
-		"customer_email": fmt.Sprintf("noreply@%s", domain),
+		"customer_email": customerEmail,
 		"customer_phone": req.CustomerPhone,
 		"order_items":    req.OrderItems,
 		"return_url":     returnURL,
@@ -180,8 +195,8 @@ func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interfa
 	}
 
 	// Create transaction with Tripay
-	client := &http.Client{Timeout: 30 * time.Second}
-	httpReq, err := http.NewRequest("POST", g.APIURL+"/transaction/create", strings.NewReader(string(jsonData)))
+	client := newGatewayClient("tripay", "create_transaction")
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", g.APIURL+"/transaction/create", strings.NewReader(string(jsonData)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -208,34 +223,25 @@ func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interfa
 	if success, ok := result["success"].(bool); ok && success {
 		if paymentData, ok := result["data"].(map[string]interface{}); ok {
 			// Save to payment_history table
-			if g.db != nil {
-				orderItemsJSON, _ := json.Marshal(req.OrderItems)
-				var phoneNumber, groupID sql.NullString
-				if req.CustomerPhone != "" {
-					phoneNumber = sql.NullString{String: req.CustomerPhone, Valid: true}
+			reference, _ := paymentData["reference"].(string)
+			tagPaymentReference(ctx, reference)
+			if g.store != nil {
+				record := newPaymentRecord(req, g.GetName(), reference, merchantRef, req.Method, req.Amount)
+				// QRIS carries a QR string, virtual accounts a pay code
+				if qr, ok := paymentData["qr_string"].(string); ok && qr != "" {
+					record.PaymentNumber = qr
+				} else if payCode, ok := paymentData["pay_code"].(string); ok {
+					record.PaymentNumber = payCode
 				}
-				if req.GroupID != "" {
-					groupID = sql.NullString{String: req.GroupID, Valid: true}
+				if expiredTime, ok := paymentData["expired_time"].(float64); ok {
+					expiredAt := time.Unix(int64(expiredTime), 0)
+					record.ExpiredAt = &expiredAt
 				}
-
-				_, err := g.db.Exec(`
-					INSERT INTO payment_history 
-					(reference, merchant_ref, phone_number, group_id, customer_name, method, amount, status, order_items, created_at)
-					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-				`,
-					paymentData["reference"],
-					merchantRef,
-					phoneNumber,
-					groupID,
-					customerName,
-					req.Method,
-					req.Amount,
-					"UNPAID",
-					orderItemsJSON,
-					time.Now(),
-				)
-				if err != nil {
-					log.Printf("Failed to save transaction to database: %v", err)
+				record.Fees = tripayFees(paymentData)
+				if err := g.store.CreatePayment(ctx, record); err != nil {
+					// Tripay cannot cancel a closed payment; left unpaid it expires
+					slog.ErrorContext(ctx, "failed to save transaction, abandoning it", "gateway", "tripay", "reference", reference, "error", err)
+					return nil, fmt.Errorf("%w: %v", ErrPaymentNotRecorded, err)
 				}
 			}
 
@@ -253,18 +259,18 @@ func (g *TripayGateway) CreateTransaction(req CreateTransactionRequest) (interfa
 	if msg, ok := result["message"].(string); ok {
 		message = msg
 	}
-	return nil, fmt.Errorf(message)
+	return nil, errors.New(message)
 }
 
 // GetTransactionStatus retrieves the status of a transaction
-func (g *TripayGateway) GetTransactionStatus(reference string) (interface{}, error) {
+func (g *TripayGateway) GetTransactionStatus(ctx context.Context, reference string) (interface{}, error) {
 	if g.APIKey == "" {
 		return nil, fmt.Errorf("payment gateway not configured")
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newGatewayClient("tripay", "transaction_status")
 	url := fmt.Sprintf("%s/transaction/detail?reference=%s", g.APIURL, reference)
-	httpReq, err := http.NewRequest("GET", url, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -290,15 +296,10 @@ func (g *TripayGateway) GetTransactionStatus(reference string) (interface{}, err
 	if success, ok := result["success"].(bool); ok && success {
 		if data, ok := result["data"].(map[string]interface{}); ok {
 			// Update transaction status in database
-			if g.db != nil && data["status"] != nil {
-				status := data["status"].(string)
-				_, err := g.db.Exec(`
-					UPDATE payment_history 
-					SET status = $1, updated_at = $2
-					WHERE reference = $3
-				`, status, time.Now(), reference)
-				if err != nil {
-					log.Printf("Failed to update transaction status: %v", err)
+			if g.store != nil {
+				recordPaymentFees(ctx, g.store, reference, tripayFees(data))
+				if status, ok := data["status"].(string); ok {
+					g.syncStatus(ctx, reference, status)
 				}
 			}
 
@@ -315,13 +316,45 @@ func (g *TripayGateway) GetTransactionStatus(reference string) (interface{}, err
 	return nil, fmt.Errorf("transaction not found")
 }
 
+// syncStatus stores a status reported by the transaction detail endpoint.
+// A PAID status goes through completePayment so a poll that beats the
+// callback still activates premium exactly once.
+func (g *TripayGateway) syncStatus(ctx context.Context, reference, status string) {
+	if status == "PAID" {
+		if err := completePayment(ctx, g.store, reference, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "tripay", "reference", reference, "error", err)
+		}
+		return
+	}
+
+	if err := setPaymentStatus(ctx, g.store, reference, status); err != nil {
+		slog.ErrorContext(ctx, "failed to update transaction status", "gateway", "tripay", "reference", reference, "error", err)
+	}
+}
+
+// tripayFees reads the fees of a transaction. Create and detail responses
+// call the customer's total amount, callbacks total_amount; either way it
+// already includes fee_customer.
+func tripayFees(data map[string]interface{}) *PaymentFees {
+	totalPaid, ok := jsonInt(data, "total_amount")
+	if !ok {
+		totalPaid, ok = jsonInt(data, "amount")
+	}
+	feeMerchant, okMerchant := jsonInt(data, "fee_merchant")
+	feeCustomer, okCustomer := jsonInt(data, "fee_customer")
+	if !ok || !okMerchant || !okCustomer {
+		return nil
+	}
+	return newPaymentFees(totalPaid, feeMerchant, feeCustomer)
+}
+
 // HandleCallback processes payment callback from Tripay
-func (g *TripayGateway) HandleCallback(payload []byte, headers map[string]string) error {
+func (g *TripayGateway) HandleCallback(ctx context.Context, payload []byte, headers map[string]string) error {
 	callbackSignature := headers["x-callback-signature"]
 
 	// Verify signature
 	if !g.verifyCallbackSignature(callbackSignature, payload) {
-		return fmt.Errorf("invalid signature")
+		return ErrInvalidSignature
 	}
 
 	var callbackPayload map[string]interface{}
@@ -335,42 +368,32 @@ func (g *TripayGateway) HandleCallback(payload []byte, headers map[string]string
 	merchantRef := callbackPayload["merchant_ref"]
 	amount := callbackPayload["amount"]
 
-	log.Printf("Tripay Callback: reference=%v, status=%v, merchant_ref=%v, amount=%v, timestamp=%s",
-		reference, status, merchantRef, amount, time.Now().Format(time.RFC3339))
+	if refStr, ok := reference.(string); ok {
+		tagPaymentReference(ctx, refStr)
+		if g.store != nil {
+			recordPaymentFees(ctx, g.store, refStr, tripayFees(callbackPayload))
+		}
+	}
+
+	slog.InfoContext(ctx, "callback received", "gateway", "tripay",
+		"reference", reference, "status", status, "merchant_ref", merchantRef, "amount", amount)
 
 	if status == "PAID" {
-		log.Printf("Payment successful for reference: %v", reference)
-
-		// Update payment_history table
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, paid_at = $2, updated_at = $3
-				WHERE reference = $4
-			`, status, time.Now(), time.Now(), reference)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
-			}
+		slog.InfoContext(ctx, "payment successful", "gateway", "tripay", "reference", reference)
 
-			// Activate premium
-			if refStr, ok := reference.(string); ok {
-				if err := activatePremium(g.db, refStr); err != nil {
-					log.Printf("Failed to activate premium: %v", err)
-				}
+		// Update payment_history table and activate premium
+		if refStr, ok := reference.(string); ok && g.store != nil {
+			if err := completePayment(ctx, g.store, refStr, time.Now()); err != nil {
+				return err
 			}
 		}
 	} else if status == "EXPIRED" || status == "FAILED" {
-		log.Printf("Payment %v for reference: %v", status, reference)
+		slog.InfoContext(ctx, "payment not completed", "gateway", "tripay", "reference", reference, "status", status)
 
 		// Update payment_history table
-		if g.db != nil {
-			_, err := g.db.Exec(`
-				UPDATE payment_history 
-				SET status = $1, updated_at = $2
-				WHERE reference = $3
-			`, status, time.Now(), reference)
-			if err != nil {
-				log.Printf("Failed to update payment history: %v", err)
+		if refStr, ok := reference.(string); ok && g.store != nil {
+			if err := setPaymentStatus(ctx, g.store, refStr, status.(string)); err != nil {
+				slog.ErrorContext(ctx, "failed to update payment history", "gateway", "tripay", "reference", reference, "error", err)
 			}
 		}
 	}
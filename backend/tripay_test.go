@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTripayTestGateway wires a Tripay gateway to a fake upstream that accepts
+// any create request and hands out the given reference. The transaction
+// detail endpoint always reports the transaction as PAID.
+func newTripayTestGateway(t *testing.T, reference string) *TripayGateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/transaction/create":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data": map[string]interface{}{
+					"reference":    reference,
+					"merchant_ref": body["merchant_ref"],
+					"amount":       body["amount"],
+					"status":       "UNPAID",
+				},
+			})
+		case "/transaction/detail":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data": map[string]interface{}{
+					"reference": r.URL.Query().Get("reference"),
+					"status":    "PAID",
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	g := &TripayGateway{
+		APIKey:       "test-api-key",
+		PrivateKey:   "test-private-key",
+		MerchantCode: "T0001",
+		Mode:         "sandbox",
+		APIURL:       upstream.URL,
+	}
+	g.Initialize(store)
+	return g
+}
+
+func tripayCallback(t *testing.T, g *TripayGateway, reference, status string, amount int) error {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]interface{}{
+		"reference":    reference,
+		"merchant_ref": "PREMIUM-test",
+		"status":       status,
+		"amount":       amount,
+	})
+	mac := hmac.New(sha256.New, []byte(g.PrivateKey))
+	mac.Write(payload)
+	return g.HandleCallback(context.Background(), payload, map[string]string{
+		"x-callback-signature": hex.EncodeToString(mac.Sum(nil)),
+	})
+}
+
+func TestTripayFlowWithMemoryStore(t *testing.T) {
+	memory := NewMemoryStore()
+	memory.SetUser("6281234567890", "lid-123", "Tester")
+	store = memory
+	g := newTripayTestGateway(t, "T-MEM-1")
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:        "QRIS",
+		Amount:        15000,
+		CustomerPhone: "6281234567890",
+		OrderItems:    orderItems("User Premium 30 Days", 15000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tripayCallback(t, g, "T-MEM-1", "PAID", 15000); err != nil {
+			t.Fatalf("HandleCallback #%d failed: %v", i+1, err)
+		}
+	}
+
+	payment, err := memory.GetPayment(context.Background(), "T-MEM-1")
+	if err != nil {
+		t.Fatalf("GetPayment failed: %v", err)
+	}
+	if payment.Status != "PAID" || payment.PaidAt == nil {
+		t.Fatalf("expected PAID with paid_at, got %+v", payment)
+	}
+
+	premium, err := memory.GetPremium(context.Background(), "6281234567890", "lid-123")
+	if err != nil {
+		t.Fatalf("GetPremium failed: %v", err)
+	}
+	assertExpiresIn(t, premium.Expired, 30)
+}
+
+func TestTripayStatusPollBeforeCallbackActivatesOnce(t *testing.T) {
+	memory := NewMemoryStore()
+	store = memory
+	g := newTripayTestGateway(t, "T-MEM-POLL")
+
+	_, err := g.CreateTransaction(context.Background(), CreateTransactionRequest{
+		Method:     "QRIS",
+		Amount:     25000,
+		GroupID:    "120363000000000000@g.us",
+		OrderItems: orderItems("Group Premium 1 Month", 25000),
+	})
+	if err != nil {
+		t.Fatalf("CreateTransaction failed: %v", err)
+	}
+
+	if _, err := g.GetTransactionStatus(context.Background(), "T-MEM-POLL"); err != nil {
+		t.Fatalf("GetTransactionStatus failed: %v", err)
+	}
+	if err := tripayCallback(t, g, "T-MEM-POLL", "PAID", 25000); err != nil {
+		t.Fatalf("HandleCallback failed: %v", err)
+	}
+
+	premium, err := memory.GetPremium(context.Background(), "120363000000000000@g.us", "120363000000000000@g.us")
+	if err != nil {
+		t.Fatalf("GetPremium failed: %v", err)
+	}
+	if premium.MaxSpecialLimit != 50 {
+		t.Fatalf("expected group-1m special limit 50, got %d", premium.MaxSpecialLimit)
+	}
+	assertExpiresIn(t, premium.Expired, 30)
+}
+
+// unrecordingStore is a store that cannot save new payments
+type unrecordingStore struct {
+	*MemoryStore
+}
+
+func (s unrecordingStore) CreatePayment(ctx context.Context, p *PaymentRecord) error {
+	return ErrStorageUnavailable
+}
+
+func TestCreateTransactionRefusedWhenPaymentNotRecorded(t *testing.T) {
+	store = unrecordingStore{NewMemoryStore()}
+	paymentGateway = newTripayTestGateway(t, "T-UNSAVED-1")
+
+	body := `{"method":"BRI_VA","amount":15000,"customerPhone":"6281234567890","orderItems":[{"name":"User Premium 30 Days","price":15000,"quantity":1}]}`
+	rec := postCreateTransaction(t, "", body)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "T-UNSAVED-1") {
+		t.Errorf("expected the unsaved transaction not to be handed out: %s", rec.Body.String())
+	}
+}
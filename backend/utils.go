@@ -1,13 +1,17 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Random string generator
@@ -42,93 +46,93 @@ func parsePlanDetails(planID string) (days int, specialLimit int, isGroup bool)
 	}
 }
 
+// planNameFromOrderItems returns the name of the first order item
+func planNameFromOrderItems(orderItems []map[string]interface{}) string {
+	if len(orderItems) == 0 {
+		return ""
+	}
+	name, _ := orderItems[0]["name"].(string)
+	return name
+}
+
+// planIDFromName maps a plan display name (English or Indonesian) to its plan ID
+func planIDFromName(planName string) string {
+	nameLower := strings.ToLower(planName)
+
+	if strings.Contains(nameLower, "user premium") {
+		// Match specific day counts to avoid ambiguity; "15 day" contains
+		// "5 day", so it is checked first
+		if strings.Contains(nameLower, "15 day") || strings.Contains(nameLower, "15 hari") {
+			return "user-15d"
+		} else if strings.Contains(nameLower, "5 day") || strings.Contains(nameLower, "5 hari") {
+			return "user-5d"
+		} else if strings.Contains(nameLower, "30 day") || strings.Contains(nameLower, "30 hari") || strings.Contains(nameLower, "1 month") || strings.Contains(nameLower, "1 bulan") {
+			return "user-1m"
+		}
+	} else if strings.Contains(nameLower, "group premium") || strings.Contains(nameLower, "grup premium") {
+		if strings.Contains(nameLower, "15 day") || strings.Contains(nameLower, "15 hari") {
+			return "group-15d"
+		} else if strings.Contains(nameLower, "30 day") || strings.Contains(nameLower, "30 hari") || strings.Contains(nameLower, "1 month") || strings.Contains(nameLower, "1 bulan") {
+			return "group-1m"
+		}
+	}
+
+	return ""
+}
+
+// planIDFromOrderItems returns the plan ID of stored order_items JSON, or ""
+func planIDFromOrderItems(orderItemsJSON []byte) string {
+	var orderItems []map[string]interface{}
+	if err := json.Unmarshal(orderItemsJSON, &orderItems); err != nil {
+		return ""
+	}
+	return planIDFromName(planNameFromOrderItems(orderItems))
+}
+
 // activatePremium activates premium for a user/group based on payment reference
-func activatePremium(db *sql.DB, reference string) error {
-	// Get transaction details to activate premium
-	var phoneNumber, groupID sql.NullString
-	var orderItemsJSON []byte
-	err := db.QueryRow(`
-		SELECT phone_number, group_id, order_items 
-		FROM payment_history 
-		WHERE reference = $1 OR merchant_ref = $1
-	`, reference).Scan(&phoneNumber, &groupID, &orderItemsJSON)
+func activatePremium(ctx context.Context, store Store, reference string) (err error) {
+	ctx, span := tracer.Start(ctx, "activatePremium", trace.WithAttributes(attribute.String("payment.reference", reference)))
+	defer func() { endSpan(span, err) }()
 
+	// Get transaction details to activate premium
+	payment, err := store.GetPayment(ctx, reference)
 	if err != nil {
 		return fmt.Errorf("failed to query payment_history for reference %s: %v", reference, err)
 	}
 
-	phoneStr := "nil"
-	if phoneNumber.Valid {
-		phoneStr = phoneNumber.String
-	}
-	groupStr := "nil"
-	if groupID.Valid {
-		groupStr = groupID.String
-	}
-	log.Printf("Retrieved payment details: phoneNumber=%s, groupID=%s, orderItemsSize=%d bytes",
-		phoneStr, groupStr, len(orderItemsJSON))
+	slog.DebugContext(ctx, "retrieved payment details", "reference", reference,
+		"phone", payment.PhoneNumber, "group_id", payment.GroupID, "order_items_bytes", len(payment.OrderItems))
 
 	// Parse order items to get plan details
 	var orderItems []map[string]interface{}
-	unmarshalErr := json.Unmarshal(orderItemsJSON, &orderItems)
+	unmarshalErr := json.Unmarshal(payment.OrderItems, &orderItems)
 	if unmarshalErr != nil {
 		return fmt.Errorf("failed to unmarshal order_items: %v", unmarshalErr)
 	}
 
-	log.Printf("Parsed %d order items", len(orderItems))
-
 	if len(orderItems) == 0 {
 		return fmt.Errorf("no order items found in payment_history for reference %s", reference)
 	}
 
-	planName := ""
-	if name, ok := orderItems[0]["name"].(string); ok {
-		planName = name
-	}
-	log.Printf("Plan name from order_items: %s", planName)
+	planName := planNameFromOrderItems(orderItems)
 
 	// Extract plan ID from name with improved pattern matching
-	planID := ""
-	nameLower := strings.ToLower(planName)
-
-	if strings.Contains(nameLower, "user premium") {
-		// Match specific day counts to avoid ambiguity
-		if strings.Contains(nameLower, "5 day") || strings.Contains(nameLower, "5 hari") {
-			planID = "user-5d"
-		} else if strings.Contains(nameLower, "15 day") || strings.Contains(nameLower, "15 hari") {
-			planID = "user-15d"
-		} else if strings.Contains(nameLower, "30 day") || strings.Contains(nameLower, "30 hari") || strings.Contains(nameLower, "1 month") || strings.Contains(nameLower, "1 bulan") {
-			planID = "user-1m"
-		}
-	} else if strings.Contains(nameLower, "group premium") || strings.Contains(nameLower, "grup premium") {
-		if strings.Contains(nameLower, "15 day") || strings.Contains(nameLower, "15 hari") {
-			planID = "group-15d"
-		} else if strings.Contains(nameLower, "30 day") || strings.Contains(nameLower, "30 hari") || strings.Contains(nameLower, "1 month") || strings.Contains(nameLower, "1 bulan") {
-			planID = "group-1m"
-		}
-	}
-
+	planID := planIDFromName(planName)
 	if planID == "" {
 		return fmt.Errorf("could not determine planID from plan name: %s", planName)
 	}
 
-	log.Printf("Determined planID: %s", planID)
+	slog.DebugContext(ctx, "determined plan", "reference", reference, "plan_name", planName, "plan_id", planID)
 	days, specialLimit, isGroup := parsePlanDetails(planID)
 
+	// Gifts are activated for the recipient rather than the payer
+	phone, groupID := payment.Beneficiary()
 	var jid, lid string
-	if isGroup && groupID.Valid {
-		jid = groupID.String
-		lid = groupID.String // For groups, lid = id
-		log.Printf("Group premium: jid=%s, lid=%s", jid, lid)
-	} else if phoneNumber.Valid {
-		jid = phoneNumber.String
-		// Get lid from users table
-		err = db.QueryRow("SELECT lid FROM users WHERE phone_number = $1", phoneNumber.String).Scan(&lid)
-		if err != nil {
-			log.Printf("Failed to get lid for phone %s: %v", phoneNumber.String, err)
-			lid = phoneNumber.String // Fallback to phone number
-		}
-		log.Printf("User premium: jid=%s, lid=%s", jid, lid)
+	if isGroup && groupID != "" {
+		jid = groupID
+		lid = groupID // For groups, lid = id
+	} else if phone != "" {
+		jid, lid = userPremiumKey(ctx, store, phone)
 	} else {
 		return fmt.Errorf("neither phoneNumber nor groupID is valid")
 	}
@@ -137,49 +141,253 @@ func activatePremium(db *sql.DB, reference string) error {
 		return fmt.Errorf("missing jid or lid - jid=%s, lid=%s", jid, lid)
 	}
 
-	// Check if premium already exists
-	var existingExpired sql.NullString
-	err = db.QueryRow(`
-		SELECT expired FROM premium WHERE jid = $1 AND lid = $2
-	`, jid, lid).Scan(&existingExpired)
+	newExpired, err := stackPremium(ctx, store, jid, lid, days, specialLimit, true)
+	if err != nil {
+		return fmt.Errorf("failed to activate premium: %v", err)
+	}
+
+	slog.InfoContext(ctx, "premium activated", "reference", reference, "jid", jid, "lid", lid,
+		"plan_id", planID, "days", days, "special_limit", specialLimit, "expired", newExpired, "gift", payment.IsGift())
 
+	notifyBot(ctx, premiumActivatedNotification(payment, planID, jid, lid, isGroup, days, newExpired))
+
+	return nil
+}
+
+// userPremiumKey returns the premium jid/lid of a phone number. The lid
+// falls back to the phone number for users the bot has not registered.
+func userPremiumKey(ctx context.Context, store Store, phone string) (jid, lid string) {
+	lid, err := store.UserLID(ctx, phone)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to get lid, falling back to phone number", "phone", phone, "error", err)
+		lid = phone
+	}
+	return phone, lid
+}
+
+// stackPremium adds days to the premium of jid/lid, counting from the
+// current expiry while it is still running and from now otherwise. With
+// resetLimits the special limit restarts at zero under a new maximum of
+// specialLimit; without it an existing row keeps its limits and specialLimit
+// only applies to a new one.
+func stackPremium(ctx context.Context, store Store, jid, lid string, days, specialLimit int, resetLimits bool) (time.Time, error) {
 	var newExpired time.Time
-	if err == sql.ErrNoRows {
+	record := PremiumRecord{
+		JID:              jid,
+		LID:              lid,
+		SpecialLimit:     0,
+		MaxSpecialLimit:  specialLimit,
+		LastSpecialReset: time.Now(),
+	}
+
+	// Check if premium already exists
+	existing, err := store.GetPremium(ctx, jid, lid)
+	if err == ErrPremiumNotFound {
 		// New premium
 		newExpired = time.Now().AddDate(0, 0, days)
-		log.Printf("Creating new premium entry")
-	} else if err == nil && existingExpired.Valid {
+		slog.DebugContext(ctx, "creating new premium entry", "jid", jid)
+	} else if err == nil {
 		// Stack premium
-		currentExpired, _ := time.Parse(time.RFC3339, existingExpired.String)
-		if currentExpired.Before(time.Now()) {
+		if existing.Expired.Before(time.Now()) {
 			newExpired = time.Now().AddDate(0, 0, days)
-			log.Printf("Existing premium expired, creating new from now")
+			slog.DebugContext(ctx, "existing premium expired, creating new from now", "jid", jid)
 		} else {
-			newExpired = currentExpired.AddDate(0, 0, days)
-			log.Printf("Stacking premium on existing expiry: %s", currentExpired.Format(time.RFC3339))
+			newExpired = existing.Expired.AddDate(0, 0, days)
+			slog.DebugContext(ctx, "stacking premium on existing expiry", "jid", jid, "expired", existing.Expired)
+		}
+		if !resetLimits {
+			record.SpecialLimit = existing.SpecialLimit
+			record.MaxSpecialLimit = existing.MaxSpecialLimit
+			record.LastSpecialReset = existing.LastSpecialReset
 		}
 	} else {
 		newExpired = time.Now().AddDate(0, 0, days)
-		log.Printf("Error checking existing premium: %v, creating new", err)
+		slog.WarnContext(ctx, "failed to check existing premium, creating new", "jid", jid, "error", err)
 	}
 
-	// Upsert premium
-	_, err = db.Exec(`
-		INSERT INTO premium (jid, lid, special_limit, max_special_limit, expired, last_special_reset)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (jid, lid) DO UPDATE SET
-			special_limit = 0,
-			max_special_limit = $4,
-			expired = $5,
-			last_special_reset = $6
-	`, jid, lid, 0, specialLimit, newExpired.Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	record.Expired = newExpired
+	if err := store.UpsertPremium(ctx, record); err != nil {
+		return time.Time{}, err
+	}
+	return newExpired, nil
+}
+
+// completePayment marks a payment PAID and activates premium. Gateways retry
+// callbacks and the status endpoints poll, so only the caller that performs
+// the PAID transition activates; everyone else would stack the same purchase
+// twice. An activation failure is logged rather than returned because the
+// payment itself has been recorded.
+func completePayment(ctx context.Context, store Store, reference string, paidAt time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "completePayment", trace.WithAttributes(attribute.String("payment.reference", reference)))
+	defer func() { endSpan(span, err) }()
 
+	updated, err := store.MarkPaymentPaid(ctx, reference, paidAt)
 	if err != nil {
-		return fmt.Errorf("failed to activate premium: %v", err)
+		return fmt.Errorf("failed to update payment history: %w", err)
+	}
+	span.SetAttributes(attribute.Bool("payment.transitioned", updated))
+
+	if !updated {
+		slog.InfoContext(ctx, "payment already marked as PAID, skipping premium activation", "reference", reference)
+		return nil
+	}
+
+	payment, err := lookupPaidPayment(ctx, store, reference)
+	if err != nil {
+		// Without the payment its product is unknown, and activating premium
+		// for a donation would grant a plan nobody bought
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "paid payment could not be read, skipping activation", "reference", reference, "error", err)
+		return nil
+	}
+	observePaymentEvent("paid", payment.OrderItems, payment.Method)
+	if payment.PromoCode != "" {
+		redeemPromo(ctx, store, payment)
+	}
+
+	if payment.IsDonation() {
+		// Donations buy nothing to activate
+		slog.InfoContext(ctx, "donation received", "reference", reference, "amount", payment.Amount)
+	} else {
+		if err := activatePremium(ctx, store, reference); err != nil {
+			premiumActivationFailures.Inc()
+			span.RecordError(err)
+			slog.ErrorContext(ctx, "failed to activate premium", "reference", reference, "error", err)
+		}
+
+		// Bonus days stack on top of the plan just activated
+		if payment.ReferralCode != "" {
+			rewardReferral(ctx, store, payment)
+		}
+	}
+
+	if mailQueue != nil {
+		if err := mailQueue.EnqueueReceipt(ctx, payment); err != nil {
+			slog.ErrorContext(ctx, "failed to queue receipt email", "reference", reference, "error", err)
+		}
+	}
+	return nil
+}
+
+// Retries of the lookup after a payment is marked PAID
+const paidLookupAttempts = 3
+
+var paidLookupDelay = 200 * time.Millisecond // times the attempt number
+
+// lookupPaidPayment reads a payment that was just marked PAID, retrying
+// briefly since the write that marked it succeeded moments ago
+func lookupPaidPayment(ctx context.Context, store Store, reference string) (*PaymentRecord, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var payment *PaymentRecord
+		if payment, err = store.GetPayment(ctx, reference); err == nil {
+			return payment, nil
+		}
+		if attempt == paidLookupAttempts {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(attempt) * paidLookupDelay):
+		}
 	}
+}
 
-	log.Printf("Premium activated for jid=%s, lid=%s, days=%d, specialLimit=%d, expired=%s",
-		jid, lid, days, specialLimit, newExpired.Format(time.RFC3339))
+// setPaymentStatus records a non-PAID status reported by a gateway. A PAID
+// payment is never downgraded.
+func setPaymentStatus(ctx context.Context, store Store, reference, status string) error {
+	changed, err := store.UpdatePaymentStatus(ctx, reference, status)
+	if err != nil {
+		return err
+	}
 
+	if changed && status != "UNPAID" {
+		if payment, err := store.GetPayment(ctx, reference); err == nil {
+			observePaymentEvent(strings.ToLower(status), payment.OrderItems, payment.Method)
+		}
+	}
 	return nil
 }
+
+// recordPaymentFees stores the fees a gateway reported, if it reported
+// any. Fees only feed accounting, so a failure is logged and not returned.
+func recordPaymentFees(ctx context.Context, store Store, reference string, fees *PaymentFees) {
+	if fees == nil {
+		return
+	}
+	changed, err := store.SetPaymentFees(ctx, reference, *fees)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to record payment fees", "reference", reference, "error", err)
+	} else if changed {
+		slog.InfoContext(ctx, "payment fees recorded", "reference", reference,
+			"fee_merchant", fees.FeeMerchant, "fee_customer", fees.FeeCustomer, "total_paid", fees.TotalPaid, "net_amount", fees.NetAmount)
+	}
+}
+
+// addPaymentFees adds the recorded fees of a payment to a gateway's status
+// response, in the same fields for every gateway
+func addPaymentFees(ctx context.Context, reference string, data interface{}) {
+	fields, ok := data.(map[string]interface{})
+	if !ok || store == nil {
+		return
+	}
+	payment, err := store.GetPayment(ctx, reference)
+	if err != nil || payment.Fees == nil {
+		return
+	}
+	fields["fee_merchant"] = payment.Fees.FeeMerchant
+	fields["fee_customer"] = payment.Fees.FeeCustomer
+	fields["total_paid"] = payment.Fees.TotalPaid
+	fields["net_amount"] = payment.Fees.NetAmount
+}
+
+// jsonInt reads a whole number from a decoded JSON object. Gateways send
+// amounts as numbers, some as numeric strings.
+func jsonInt(data map[string]interface{}, key string) (int, bool) {
+	switch v := data[key].(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// newPaymentRecord builds an UNPAID payment_history record for a request
+// created through gateway
+func newPaymentRecord(req CreateTransactionRequest, gateway, reference, merchantRef, method string, amount int) *PaymentRecord {
+	orderItemsJSON, _ := json.Marshal(req.OrderItems)
+
+	customerName := req.CustomerName
+	if customerName == "" {
+		customerName = fmt.Sprintf("Customer-%s", req.CustomerPhone)
+	}
+
+	return &PaymentRecord{
+		Reference:        reference,
+		MerchantRef:      merchantRef,
+		Gateway:          gateway,
+		PhoneNumber:      req.CustomerPhone,
+		GroupID:          req.GroupID,
+		CustomerName:     customerName,
+		Method:           method,
+		Amount:           amount,
+		Status:           "UNPAID",
+		OrderItems:       orderItemsJSON,
+		CreatedAt:        time.Now(),
+		PromoCode:        req.PromoCode,
+		DiscountAmount:   req.DiscountAmount,
+		ReferralCode:     req.ReferralCode,
+		RecipientPhone:   req.RecipientPhone,
+		RecipientGroupID: req.RecipientGroupID,
+		GiftMessage:      req.GiftMessage,
+		CustomerEmail:    req.CustomerEmail,
+		Product:          req.Product,
+		DonorName:        req.DonorName,
+		DonorMessage:     req.DonorMessage,
+	}
+}
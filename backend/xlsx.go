@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxEpoch is day zero of spreadsheet date serials
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// Cell styles, indexes into cellXfs of xlsxStyles
+const (
+	xlsxStyleDefault = 0
+	xlsxStyleHeader  = 1
+	xlsxStyleTime    = 2
+	xlsxStyleAmount  = 3
+)
+
+// XLSXCell is one spreadsheet cell: a string, a number or a time. The zero
+// value is an empty cell.
+type XLSXCell struct {
+	kind   byte // 's', 'n', 't' or 0 for empty
+	text   string
+	number float64
+	time   time.Time
+}
+
+// XLSXString returns a text cell
+func XLSXString(s string) XLSXCell { return XLSXCell{kind: 's', text: s} }
+
+// XLSXAmount returns a rupiah amount cell
+func XLSXAmount(n int) XLSXCell { return XLSXCell{kind: 'n', number: float64(n)} }
+
+// XLSXTime returns a date and time cell, shown in t's location
+func XLSXTime(t time.Time) XLSXCell { return XLSXCell{kind: 't', time: t} }
+
+// XLSXWriter streams a single-sheet workbook. Rows are compressed and
+// written as they come, so the sheet never has to fit in memory.
+type XLSXWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+// NewXLSXWriter starts a workbook with one sheet named sheetName
+func NewXLSXWriter(w io.Writer, sheetName string) (*XLSXWriter, error) {
+	zw := zip.NewWriter(w)
+	var name strings.Builder
+	xml.EscapeText(&name, []byte(sheetName))
+
+	parts := []struct{ path, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, name.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		f, err := zw.Create(part.path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &XLSXWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	x.sheet.WriteString(xml.Header)
+	x.sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, nil
+}
+
+// WriteHeader writes a row of bold column titles
+func (x *XLSXWriter) WriteHeader(titles []string) error {
+	cells := make([]XLSXCell, len(titles))
+	for i, title := range titles {
+		cells[i] = XLSXString(title)
+	}
+	return x.writeRow(cells, xlsxStyleHeader)
+}
+
+// WriteRow appends a row of cells
+func (x *XLSXWriter) WriteRow(cells []XLSXCell) error {
+	return x.writeRow(cells, xlsxStyleDefault)
+}
+
+func (x *XLSXWriter) writeRow(cells []XLSXCell, style int) error {
+	x.rows++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(x.rows)
+		cellStyle := style
+		switch cell.kind {
+		case 's':
+			fmt.Fprintf(x.sheet, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, cellStyle)
+			xml.EscapeText(x.sheet, []byte(cell.text))
+			x.sheet.WriteString(`</t></is></c>`)
+		case 'n':
+			if cellStyle == xlsxStyleDefault {
+				cellStyle = xlsxStyleAmount
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" s="%d"><v>%s</v></c>`, ref, cellStyle, strconv.FormatFloat(cell.number, 'f', -1, 64))
+		case 't':
+			if cellStyle == xlsxStyleDefault {
+				cellStyle = xlsxStyleTime
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" s="%d"><v>%s</v></c>`, ref, cellStyle, strconv.FormatFloat(xlsxSerial(cell.time), 'f', -1, 64))
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+// Close finishes the sheet and the workbook. It does not close the
+// underlying writer.
+func (x *XLSXWriter) Close() error {
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// xlsxSerial converts t, as read on a wall clock in its location, to a
+// spreadsheet date serial
+func xlsxSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	return float64(wall.Sub(xlsxEpoch)) / float64(24*time.Hour)
+}
+
+// xlsxColumn returns the letters of the zero-based column i: A, B, ... AA
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+const xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+</Types>`
+
+const xlsxRootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxWorkbookRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`
+
+// xlsxStyles defines the default, header (bold), date-time and amount
+// (thousands separator) cell styles
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="4">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`
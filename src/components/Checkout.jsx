@@ -1,5 +1,5 @@
-import React, { useState, useEffect } from 'react';
-import { useLocation, useNavigate } from 'react-router-dom';
+import React, { useState, useEffect, useRef } from 'react';
+import { useLocation, useNavigate, useSearchParams } from 'react-router-dom';
 import { MessageCircle, ArrowLeft, Check, Loader2, Globe } from 'lucide-react';
 import { translations } from '../translations';
 import { PAYMENT_API_CONFIG, CONTACT_INFO } from '../config';
@@ -12,16 +12,34 @@ import { toast } from 'sonner';
 import axios from 'axios';
 import Sidebar from './Sidebar';
 
+// Plans a renewal link (/checkout?plan=...) can open, mirroring the pricing page
+const RENEWAL_PLANS = {
+  'user-5d': { duration: 'days5', price: 'Rp 7.000', group: false },
+  'user-15d': { duration: 'days15', price: 'Rp 15.000', group: false },
+  'user-1m': { duration: 'month1', price: 'Rp 20.000', group: false },
+  'group-15d': { duration: 'days15', price: 'Rp 30.000', group: true },
+  'group-1m': { duration: 'month1', price: 'Rp 50.000', group: true },
+};
+
 const Checkout = () => {
+  const [searchParams] = useSearchParams();
   const [language, setLanguage] = useState('id');
   const [selectedPaymentMethod, setSelectedPaymentMethod] = useState('');
   const [paymentChannels, setPaymentChannels] = useState([]);
   const [loading, setLoading] = useState(true);
   const [processing, setProcessing] = useState(false);
-  const [whatsappNumber, setWhatsappNumber] = useState('');
+  const [whatsappNumber, setWhatsappNumber] = useState(
+    () => searchParams.get('phone') || searchParams.get('group') || ''
+  );
   const [verifying, setVerifying] = useState(false);
   const [verified, setVerified] = useState(false);
   const [verificationResult, setVerificationResult] = useState(null);
+  const [promoCode, setPromoCode] = useState('');
+  const [customerEmail, setCustomerEmail] = useState('');
+  const [promoQuote, setPromoQuote] = useState(null);
+  const [applyingPromo, setApplyingPromo] = useState(false);
+  // Idempotency-Key of the last checkout attempt; retries of the same order reuse it
+  const idempotency = useRef({ key: '', payload: '' });
   
   const location = useLocation();
   const navigate = useNavigate();
@@ -30,13 +48,22 @@ const Checkout = () => {
   // Get plan details from navigation state with proper defaults
   const planDetails = React.useMemo(() => {
     const state = location.state || {};
+    const renewal = RENEWAL_PLANS[searchParams.get('plan')];
+    if (!state.id && renewal) {
+      return {
+        id: searchParams.get('plan'),
+        duration: t[renewal.duration],
+        price: renewal.price,
+        type: renewal.group ? t.groupPremium : t.userPremium
+      };
+    }
     return {
       id: state.id || 'user-5d',
       duration: state.duration || '5 Days',
       price: state.price || 'Rp 7.000',
       type: state.type || 'User Premium'
     };
-  }, [location.state]);
+  }, [location.state, searchParams, t]);
 
   const communityLink = React.useMemo(() => {
     const hostname = window.location.hostname;
@@ -58,7 +85,11 @@ const Checkout = () => {
     return parseInt(priceStr.replace(/[^0-9]/g, ''), 10);
   };
 
-  // Fetch available payment channels from backend (which proxies to Tripay)
+  // What the plan costs before channel fees, after any promo discount
+  const orderAmount = promoQuote ? promoQuote.finalAmount : getNumericPrice(planDetails.price);
+
+  // Fetch available payment channels from backend (which proxies to Tripay),
+  // priced for this order so each channel shows its total including fees
   useEffect(() => {
     const fetchPaymentChannels = async () => {
       try {
@@ -67,6 +98,7 @@ const Checkout = () => {
         const response = await axios.get(
           `${PAYMENT_API_CONFIG.baseUrl}${PAYMENT_API_CONFIG.endpoints.paymentChannels}`,
           {
+            params: { amount: orderAmount },
             withCredentials: true, // Include cookies
           }
         );
@@ -87,7 +119,7 @@ const Checkout = () => {
     };
 
     fetchPaymentChannels();
-  }, [language]);
+  }, [language, orderAmount]);
 
   // Verify user/group
   const handleVerify = async () => {
@@ -133,6 +165,44 @@ const Checkout = () => {
     }
   };
 
+  // Check a promo code against the selected plan and the verified number/group
+  const handleApplyPromo = async () => {
+    if (!verified) {
+      toast.error(language === 'id' ? 'Harap verifikasi nomor/ID terlebih dahulu' : 'Please verify your number/ID first');
+      return;
+    }
+
+    try {
+      setApplyingPromo(true);
+      const isGroup = planDetails.type.toLowerCase().includes('group') || planDetails.id.startsWith('group');
+
+      const response = await axios.post(
+        `${PAYMENT_API_CONFIG.baseUrl}${PAYMENT_API_CONFIG.endpoints.validatePromo}`,
+        {
+          code: promoCode.trim(),
+          planId: planDetails.id,
+          customerPhone: isGroup ? '' : whatsappNumber,
+          groupId: isGroup ? whatsappNumber : '',
+        },
+        {
+          headers: {
+            'Content-Type': 'application/json',
+          },
+          withCredentials: true,
+        }
+      );
+
+      setPromoQuote(response.data.data);
+      toast.success(language === 'id' ? 'Kode promo diterapkan!' : 'Promo code applied!');
+    } catch (error) {
+      setPromoQuote(null);
+      toast.error(error.response?.data?.message ||
+        (language === 'id' ? 'Kode promo tidak valid' : 'Invalid promo code'));
+    } finally {
+      setApplyingPromo(false);
+    }
+  };
+
   // Create transaction via backend API
   const handleProceedPayment = async () => {
     // Validate inputs
@@ -151,10 +221,15 @@ const Checkout = () => {
       return;
     }
 
+    if (customerEmail.trim() && !/^[^\s@]+@[^\s@]+\.[^\s@]+$/.test(customerEmail.trim())) {
+      toast.error(language === 'id' ? 'Alamat email tidak valid' : 'Invalid email address');
+      return;
+    }
+
     try {
       setProcessing(true);
 
-      const amount = getNumericPrice(planDetails.price);
+      const amount = orderAmount;
       const isGroup = planDetails.type.toLowerCase().includes('group') || planDetails.id.startsWith('group');
       
       // Prepare transaction data for backend
@@ -172,8 +247,18 @@ const Checkout = () => {
           }
         ],
         returnUrl: `${window.location.origin}/payment-verification`,
+        planId: planDetails.id,
+        promoCode: promoQuote ? promoQuote.code : '',
+        customerEmail: customerEmail.trim(),
       };
 
+      // Reuse the key while the order is unchanged so double-clicks and
+      // network retries return the same transaction
+      const payload = JSON.stringify(transactionData);
+      if (idempotency.current.payload !== payload) {
+        idempotency.current = { key: crypto.randomUUID(), payload };
+      }
+
       // Create transaction via backend
       const response = await axios.post(
         `${PAYMENT_API_CONFIG.baseUrl}${PAYMENT_API_CONFIG.endpoints.createTransaction}`,
@@ -181,6 +266,7 @@ const Checkout = () => {
         {
           headers: {
             'Content-Type': 'application/json',
+            'Idempotency-Key': idempotency.current.key,
           },
           withCredentials: true, // Include cookies for payment history
         }
@@ -295,10 +381,18 @@ const Checkout = () => {
                     <span className="text-gray-300">{t.planDuration}:</span>
                     <span className="font-medium text-white">{planDetails.duration || '-'}</span>
                   </div>
+                  {promoQuote && (
+                    <div className="flex justify-between">
+                      <span className="text-gray-300">{language === 'id' ? 'Diskon' : 'Discount'} ({promoQuote.code}):</span>
+                      <span className="font-medium text-green-400">-Rp {promoQuote.discount.toLocaleString('id-ID')}</span>
+                    </div>
+                  )}
                   <div className="border-t border-gray-700 pt-3 mt-3">
                     <div className="flex justify-between text-lg font-bold">
                       <span className="text-white">{t.total}:</span>
-                      <span className="text-green-400">{planDetails.price || 'Rp 0'}</span>
+                      <span className="text-green-400">
+                        {promoQuote ? `Rp ${promoQuote.finalAmount.toLocaleString('id-ID')}` : (planDetails.price || 'Rp 0')}
+                      </span>
                     </div>
                   </div>
                 </div>
@@ -347,6 +441,7 @@ const Checkout = () => {
                         setWhatsappNumber(e.target.value);
                         setVerified(false);
                         setVerificationResult(null);
+                        setPromoQuote(null);
                       }}
                       className="flex-1 text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
                       disabled={verifying}
@@ -385,6 +480,61 @@ const Checkout = () => {
                   </p>
                 </div>
 
+                {/* Email for the receipt */}
+                <div className="mb-6">
+                  <Label htmlFor="email" className="mb-2 block text-white font-semibold">
+                    {language === 'id' ? 'Email (opsional)' : 'Email (optional)'}
+                  </Label>
+                  <Input
+                    id="email"
+                    type="email"
+                    autoComplete="email"
+                    placeholder="nama@email.com"
+                    value={customerEmail}
+                    onChange={(e) => setCustomerEmail(e.target.value)}
+                    className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+                  />
+                  <p className="text-xs text-gray-300 mt-2">
+                    {language === 'id'
+                      ? 'Kuitansi dan pengingat masa aktif premium akan dikirim ke email ini'
+                      : 'Your receipt and premium expiry reminders will be sent to this email'}
+                  </p>
+                </div>
+
+                {/* Promo Code */}
+                <div className="mb-6">
+                  <Label htmlFor="promo" className="mb-2 block text-white font-semibold">
+                    {language === 'id' ? 'Kode Promo' : 'Promo Code'}
+                  </Label>
+                  <div className="flex gap-2">
+                    <Input
+                      id="promo"
+                      type="text"
+                      placeholder={language === 'id' ? 'Masukkan kode promo (opsional)' : 'Enter promo code (optional)'}
+                      value={promoCode}
+                      onChange={(e) => {
+                        setPromoCode(e.target.value.toUpperCase());
+                        setPromoQuote(null);
+                      }}
+                      className="flex-1 text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+                      disabled={applyingPromo}
+                    />
+                    <Button
+                      onClick={handleApplyPromo}
+                      disabled={applyingPromo || !promoCode.trim()}
+                      variant="outline"
+                      className="border-gray-700 text-white hover:bg-gray-800 hover:text-white"
+                      style={{ minWidth: '100px' }}
+                    >
+                      {applyingPromo ? (
+                        <Loader2 size={18} className="animate-spin" />
+                      ) : (
+                        language === 'id' ? 'Terapkan' : 'Apply'
+                      )}
+                    </Button>
+                  </div>
+                </div>
+
                 {loading ? (
                   <div className="flex items-center justify-center py-8 text-white">
                     <Loader2 className="animate-spin mr-2" size={24} />
@@ -436,7 +586,11 @@ const Checkout = () => {
                                       {channel.name || 'Payment Method'}
                                     </Label>
                                   </div>
-                                  {channel.total_fee && channel.total_fee.flat && (
+                                  {channel.total_amount ? (
+                                    <span className="text-sm text-gray-200">
+                                      {language === 'id' ? 'Total termasuk biaya' : 'Total incl. fee'}: Rp {channel.total_amount.toLocaleString('id-ID')}
+                                    </span>
+                                  ) : channel.total_fee && channel.total_fee.flat && (
                                     <span className="text-sm text-gray-200">
                                       +Rp {channel.total_fee.flat.toLocaleString('id-ID')}
                                     </span>
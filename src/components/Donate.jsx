@@ -1,10 +1,15 @@
-import React, { useState } from 'react';
-import { MessageCircle, Heart, Copy, Check, Globe } from 'lucide-react';
+import React, { useState, useEffect, useRef } from 'react';
+import { useNavigate } from 'react-router-dom';
+import { MessageCircle, Heart, Copy, Check, Globe, Loader2 } from 'lucide-react';
 import { translations } from '../translations';
+import { PAYMENT_API_CONFIG } from '../config';
 import { QRCodeSVG } from 'qrcode.react';
 import { Button } from './ui/button';
 import { Card } from './ui/card';
+import { Input } from './ui/input';
+import { Label } from './ui/label';
 import { useToast } from '../hooks/use-toast';
+import axios from 'axios';
 import Footer from './Footer';
 import Sidebar from './Sidebar';
 
@@ -13,6 +18,27 @@ const Donate = () => {
   const [language, setLanguage] = useState('id');
   const [logoErrors, setLogoErrors] = useState({});
   const { toast } = useToast();
+  const navigate = useNavigate();
+  const [donationAmount, setDonationAmount] = useState('');
+  const [donorName, setDonorName] = useState('');
+  const [donorMessage, setDonorMessage] = useState('');
+  const [donorPhone, setDonorPhone] = useState('');
+  const [donorEmail, setDonorEmail] = useState('');
+  const [processing, setProcessing] = useState(false);
+  const [supporters, setSupporters] = useState([]);
+  // Idempotency-Key of the last donation attempt; retries of the same donation reuse it
+  const idempotency = useRef({ key: '', payload: '' });
+
+  useEffect(() => {
+    axios
+      .get(`${PAYMENT_API_CONFIG.baseUrl}${PAYMENT_API_CONFIG.endpoints.recentDonations}?limit=10`)
+      .then((response) => {
+        if (response.data.success) {
+          setSupporters(response.data.data || []);
+        }
+      })
+      .catch((error) => console.error('Error fetching recent donations:', error));
+  }, []);
 
   const communityLink = React.useMemo(() => {
     const hostname = window.location.hostname;
@@ -58,6 +84,74 @@ const Donate = () => {
     }
   ];
 
+  const formatRupiah = (amount) => `Rp ${Number(amount).toLocaleString('id-ID')}`;
+
+  // Create a QRIS donation via backend API and open its payment page
+  const handleDonate = async () => {
+    const amount = parseInt(donationAmount, 10);
+    if (!amount || amount < 1000) {
+      toast({
+        title: language === 'id' ? 'Nominal tidak valid' : 'Invalid amount',
+        description: language === 'id' ? 'Donasi minimal Rp 1.000' : 'The minimum donation is Rp 1.000',
+        variant: 'destructive',
+      });
+      return;
+    }
+
+    try {
+      setProcessing(true);
+
+      const donationData = {
+        method: 'QRIS',
+        amount: amount,
+        product: 'donation',
+        donorName: donorName.trim(),
+        donorMessage: donorMessage.trim(),
+        customerPhone: donorPhone.trim(),
+        customerEmail: donorEmail.trim(),
+        returnUrl: `${window.location.origin}/payment-verification`,
+      };
+
+      const payload = JSON.stringify(donationData);
+      if (idempotency.current.payload !== payload) {
+        idempotency.current = { key: crypto.randomUUID(), payload };
+      }
+
+      const response = await axios.post(
+        `${PAYMENT_API_CONFIG.baseUrl}${PAYMENT_API_CONFIG.endpoints.createTransaction}`,
+        donationData,
+        {
+          headers: {
+            'Content-Type': 'application/json',
+            'Idempotency-Key': idempotency.current.key,
+          },
+          withCredentials: true,
+        }
+      );
+
+      const paymentData = response.data.data || {};
+      const invoiceId = paymentData.merchant_order_id || paymentData.reference;
+      if (response.data.success && invoiceId) {
+        navigate(`/pay/${invoiceId}`);
+      } else {
+        toast({
+          title: language === 'id' ? 'Gagal membuat donasi' : 'Failed to create donation',
+          description: response.data.message,
+          variant: 'destructive',
+        });
+      }
+    } catch (error) {
+      console.error('Error creating donation:', error);
+      toast({
+        title: language === 'id' ? 'Gagal membuat donasi' : 'Failed to create donation',
+        description: error.response?.data?.message,
+        variant: 'destructive',
+      });
+    } finally {
+      setProcessing(false);
+    }
+  };
+
   const copyToClipboard = (text, type, id) => {
     navigator.clipboard.writeText(text);
     if (type === 'donation') {
@@ -116,6 +210,91 @@ const Donate = () => {
               {t.donationDescription}
             </p>
           </div>
+
+          {/* Donation form, paid through the payment gateway */}
+          <Card className="donation-card" style={{ maxWidth: '560px', margin: '0 auto 32px', textAlign: 'left' }}>
+            <div className="mb-4">
+              <Label htmlFor="donation-amount" className="mb-2 block text-white font-semibold">
+                {language === 'id' ? 'Nominal donasi (Rp)' : 'Donation amount (Rp)'} <span className="text-red-500">*</span>
+              </Label>
+              <Input
+                id="donation-amount"
+                type="number"
+                min="1000"
+                placeholder="10000"
+                value={donationAmount}
+                onChange={(e) => setDonationAmount(e.target.value)}
+                className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+              />
+            </div>
+            <div className="mb-4">
+              <Label htmlFor="donor-name" className="mb-2 block text-white font-semibold">
+                {language === 'id' ? 'Nama (opsional, kosongkan untuk anonim)' : 'Name (optional, leave empty to stay anonymous)'}
+              </Label>
+              <Input
+                id="donor-name"
+                type="text"
+                maxLength={50}
+                value={donorName}
+                onChange={(e) => setDonorName(e.target.value)}
+                className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+              />
+            </div>
+            <div className="mb-4">
+              <Label htmlFor="donor-message" className="mb-2 block text-white font-semibold">
+                {language === 'id' ? 'Pesan (opsional)' : 'Message (optional)'}
+              </Label>
+              <Input
+                id="donor-message"
+                type="text"
+                maxLength={280}
+                value={donorMessage}
+                onChange={(e) => setDonorMessage(e.target.value)}
+                className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+              />
+            </div>
+            <div className="mb-4">
+              <Label htmlFor="donor-phone" className="mb-2 block text-white font-semibold">
+                {language === 'id' ? 'Nomor WhatsApp (opsional, untuk riwayat donasi)' : 'WhatsApp number (optional, for your donation history)'}
+              </Label>
+              <Input
+                id="donor-phone"
+                type="text"
+                placeholder={t.whatsappNumberPlaceholder}
+                value={donorPhone}
+                onChange={(e) => setDonorPhone(e.target.value)}
+                className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+              />
+            </div>
+            <div className="mb-6">
+              <Label htmlFor="donor-email" className="mb-2 block text-white font-semibold">
+                {language === 'id' ? 'Email (opsional, untuk kuitansi)' : 'Email (optional, for the receipt)'}
+              </Label>
+              <Input
+                id="donor-email"
+                type="email"
+                autoComplete="email"
+                placeholder="nama@email.com"
+                value={donorEmail}
+                onChange={(e) => setDonorEmail(e.target.value)}
+                className="text-white bg-gray-800/50 border-gray-700 placeholder:text-gray-400"
+              />
+            </div>
+            <Button className="btn-primary w-full" onClick={handleDonate} disabled={processing}>
+              {processing ? (
+                <>
+                  <Loader2 size={18} className="animate-spin mr-2" />
+                  {language === 'id' ? 'Memproses...' : 'Processing...'}
+                </>
+              ) : (
+                <>
+                  <Heart size={18} />
+                  {language === 'id' ? 'Donasi via QRIS' : 'Donate via QRIS'}
+                </>
+              )}
+            </Button>
+          </Card>
+
           <div className="donation-grid">
             {donationMethods.map((method) => (
               <Card key={method.id} className="donation-card">
@@ -172,6 +351,28 @@ const Donate = () => {
               </Card>
             ))}
           </div>
+
+          {/* Recent supporters */}
+          {supporters.length > 0 && (
+            <div style={{ maxWidth: '560px', margin: '48px auto 0' }}>
+              <h3 className="section-title" style={{ fontSize: '1.5rem' }}>
+                {language === 'id' ? 'Pendukung Terbaru' : 'Recent Supporters'}
+              </h3>
+              {supporters.map((supporter, index) => (
+                <Card key={`${supporter.paidAt}-${index}`} className="donation-card" style={{ marginTop: '12px', textAlign: 'left' }}>
+                  <p className="text-white font-semibold">
+                    {supporter.name} · {formatRupiah(supporter.amount)}
+                  </p>
+                  {supporter.message && (
+                    <p className="text-sm text-gray-300 mt-1">{supporter.message}</p>
+                  )}
+                  <p className="text-xs text-gray-400 mt-1">
+                    {new Date(supporter.paidAt).toLocaleString(language === 'id' ? 'id-ID' : 'en-US')}
+                  </p>
+                </Card>
+              ))}
+            </div>
+          )}
         </div>
       </section>
 
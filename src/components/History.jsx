@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from 'react';
-import { MessageCircle, Globe, Clock, CheckCircle, XCircle, AlertCircle, ExternalLink, Loader2, ChevronLeft, ChevronRight } from 'lucide-react';
+import { MessageCircle, Globe, Clock, CheckCircle, XCircle, AlertCircle, ExternalLink, Loader2, ChevronLeft, ChevronRight, FileText } from 'lucide-react';
 import { useNavigate } from 'react-router-dom';
 import { Button } from './ui/button';
 import { Input } from './ui/input';
@@ -345,6 +345,12 @@ const History = () => {
                                 gap: '8px'
                               }}>
                                 <span>Ref: {transaction.merchantRef || transaction.reference}</span>
+                                {transaction.invoiceNumber && (
+                                  <>
+                                    <span>•</span>
+                                    <span>{language === 'id' ? 'No. Invoice' : 'Invoice'}: {transaction.invoiceNumber}</span>
+                                  </>
+                                )}
                                 {transaction.method && (
                                   <>
                                     <span>•</span>
@@ -407,6 +413,19 @@ const History = () => {
                           </Button>
                         </div>
                       )}
+
+                      {transaction.status === 'PAID' && transaction.receiptUrl && (
+                        <div className="mt-4 pt-4" style={{ borderTop: '1px solid var(--border-subtle)' }}>
+                          <Button
+                            onClick={() => window.open(`${PAYMENT_API_CONFIG.baseUrl}${transaction.receiptUrl}`, '_blank', 'noopener')}
+                            variant="outline"
+                            style={{ width: '100%' }}
+                          >
+                            <FileText size={16} />
+                            {language === 'id' ? 'Unduh Kuitansi' : 'Download Receipt'}
+                          </Button>
+                        </div>
+                      )}
                     </div>
                   );
                 })}
@@ -405,6 +405,13 @@ const PaymentPage = () => {
                           </div>
                         </div>
 
+                        {paymentData.qris_merchant_name && (
+                          <p className="text-sm text-gray-400 mb-4">
+                            {language === 'id' ? 'Pastikan nama merchant: ' : 'Check the merchant name: '}
+                            <span className="font-semibold text-white">{paymentData.qris_merchant_name}</span>
+                          </p>
+                        )}
+
                         {timeRemaining && (
                           <div className="mb-4">
                             <p className="text-sm text-gray-400 mb-1">
@@ -33,7 +33,10 @@ export const PAYMENT_API_CONFIG = {
     createTransaction: '/api/create-transaction',
     transactionStatus: '/api/transaction-status',
     paymentHistory: '/api/payment-history',
+    validatePromo: '/api/promo/validate',
     cart: '/api/cart',
+    donationHistory: '/api/donation-history',
+    recentDonations: '/api/donations/recent',
     callback: '/callback',
   }
 };